@@ -16,6 +16,7 @@ extends Node2D
 @onready var line_formation_button = $UI/LineFormationButton
 @onready var spread_formation_button = $UI/SpreadFormationButton
 @onready var event_log = $UI/EventLog
+@onready var chat_input = $UI/ChatInput
 
 # Tile system (from server via handshake)
 var tile_size: int
@@ -35,7 +36,7 @@ var local_client_id: int = -1
 var local_money: float = 0.0
 var players_data: Dictionary = {}
 var selected_units: Array[int] = []  # Entity IDs of selected units
-var selected_target_id: int = -1  # Target for attacks (buildings)
+var selected_target_id: int = -1  # Target for attacks (enemy units or buildings)
 var selected_building: Node2D = null
 var event_messages: Array = []
 
@@ -44,6 +45,7 @@ var is_dragging: bool = false
 var drag_start_pos: Vector2 = Vector2.ZERO
 var drag_current_pos: Vector2 = Vector2.ZERO
 const DRAG_THRESHOLD: float = 5.0  # Minimum pixels to count as drag vs click
+const RESOURCE_NODE_TYPE = "resource_node"  # Entity type of the map's neutral resource nodes
 
 # Formation system
 var current_formation: String = "box"  # Options: "box", "line", "spread"
@@ -60,6 +62,12 @@ func _ready():
 	network_manager.connected_to_server.connect(_on_connected_to_server)
 	network_manager.snapshot_received.connect(_on_snapshot_received)
 	network_manager.disconnected_from_server.connect(_on_disconnected_from_server)
+	network_manager.connection_rejected.connect(_on_connection_rejected)
+	network_manager.command_failed.connect(_on_command_failed)
+	network_manager.lobby_updated.connect(_on_lobby_updated)
+	network_manager.chat_received.connect(_on_chat_received)
+	network_manager.event_received.connect(_on_event_received)
+	network_manager.server_shutdown.connect(_on_server_shutdown)
 
 	# Connect UI signals
 	build_button.pressed.connect(_on_build_button_pressed)
@@ -67,6 +75,7 @@ func _ready():
 	box_formation_button.pressed.connect(func(): set_formation("box"))
 	line_formation_button.pressed.connect(func(): set_formation("line"))
 	spread_formation_button.pressed.connect(func(): set_formation("spread"))
+	chat_input.text_submitted.connect(_on_chat_submitted)
 
 	# Initialize formation display (box is default)
 	box_formation_button.text = "► Box (1)"
@@ -272,6 +281,7 @@ func _on_snapshot_received(snapshot: Dictionary):
 		var max_health = int(entity_data.get("maxHealth", 100))
 		var footprint_width = int(entity_data.get("footprintWidth", 0))
 		var footprint_height = int(entity_data.get("footprintHeight", 0))
+		var remembered = entity_data.get("remembered", false)
 
 		current_entity_ids[entity_id] = true
 
@@ -282,7 +292,7 @@ func _on_snapshot_received(snapshot: Dictionary):
 		# Convert to isometric screen position
 		var screen_pos = tile_to_iso(interp_tile_x, interp_tile_y)
 
-		if entity_type == "player" or entity_type == "worker":
+		if network_manager.entity_type(entity_type).get("kind", "") == "unit":
 			if entity_id in entities:
 				# Update existing unit
 				var unit = entities[entity_id]
@@ -302,18 +312,23 @@ func _on_snapshot_received(snapshot: Dictionary):
 				entities[entity_id] = unit
 				print("Spawned %s entity %d at tile (%d, %d)" % [entity_type, entity_id, tile_x, tile_y])
 
-		elif entity_type == "generator":
+		elif footprint_width > 0:
 			if entity_id in entities:
 				# Update existing building
 				var building = entities[entity_id]
 				update_building_health(building, health, max_health)
+				update_building_status(building, entity_data)
+				# Fade buildings only known from memory (fog of war)
+				building.modulate.a = 0.5 if remembered else 1.0
 			else:
 				# Create new building at tile corner in isometric space
 				var building_pos = tile_to_iso(float(tile_x), float(tile_y))
-				var building = create_building(entity_id, owner_id, building_pos, footprint_width, footprint_height, health, max_health)
+				var building = create_building(entity_id, entity_type, owner_id, building_pos, footprint_width, footprint_height, health, max_health)
+				update_building_status(building, entity_data)
+				building.modulate.a = 0.5 if remembered else 1.0
 				entities_container.add_child(building)
 				entities[entity_id] = building
-				print("Spawned generator %d at tile (%d, %d)" % [entity_id, tile_x, tile_y])
+				print("Spawned %s %d at tile (%d, %d)" % [entity_type, entity_id, tile_x, tile_y])
 
 	# Remove entities that are no longer in the snapshot
 	for entity_id in entities.keys():
@@ -346,12 +361,51 @@ func _on_disconnected_from_server():
 		entity.queue_free()
 	entities.clear()
 
+func _on_server_shutdown(message: String):
+	_on_disconnected_from_server()
+	connection_label.text = "Server shut down"
+	log_event("Server shut down: %s" % message)
+
+func _on_connection_rejected(reason: String, message: String):
+	connection_label.text = "Rejected: %s" % reason
+	log_event("Server rejected connection: %s" % message)
+
+func _on_command_failed(sequence: int, command_type: String, reason: String, message: String):
+	log_event("Can't %s: %s" % [command_type, message])
+
+func _on_lobby_updated(lobby: Dictionary):
+	var phase = lobby.get("phase", "")
+	var me = network_manager.local_lobby_player()
+	match phase:
+		"lobby":
+			var ready_count = 0
+			for player in lobby.get("players", []):
+				if player.get("ready", false):
+					ready_count += 1
+			var hint = "R: ready, T: switch team"
+			if network_manager.is_host():
+				hint += ", Enter: start"
+			connection_label.text = "Lobby (team %d, %s) %d/%d ready - %s" % [
+				int(me.get("team", 0)), "ready" if me.get("ready", false) else "not ready",
+				ready_count, lobby.get("players", []).size(), hint]
+		"countdown":
+			var ticks_left = int(lobby.get("startTick", 0)) - network_manager.estimated_server_tick()
+			connection_label.text = "Match starting in %.0fs" % max(0.0, ticks_left / float(network_manager.tick_rate))
+		"running":
+			if me.get("spectator", false):
+				var watching = "everyone" if network_manager.follow_player_id == 0 else "player %d" % network_manager.follow_player_id
+				connection_label.text = "Spectating %s (F: switch view)" % watching
+			else:
+				connection_label.text = "Connected (ID: %d)" % local_client_id
+
 func _process(delta):
 	# Update FPS
 	fps_label.text = "FPS: %d" % Engine.get_frames_per_second()
 
-	# WASD/Arrow key camera panning
+	# WASD/Arrow key camera panning (not while typing chat)
 	var pan_direction = Vector2.ZERO
+	if chat_input.has_focus():
+		return
 
 	if Input.is_key_pressed(KEY_W) or Input.is_key_pressed(KEY_UP):
 		pan_direction.y -= 1
@@ -366,6 +420,12 @@ func _process(delta):
 		pan_camera(pan_direction.normalized() * camera_pan_speed * delta)
 
 func _input(event):
+	# Keys go to the chat box while typing
+	if chat_input.has_focus():
+		if event is InputEventKey and event.pressed and event.keycode == KEY_ESCAPE:
+			chat_input.release_focus()
+		return
+
 	# Handle scroll/zoom in _input (before _unhandled_input)
 	if event is InputEventMouseButton:
 		if event.button_index == MOUSE_BUTTON_WHEEL_UP:
@@ -381,6 +441,44 @@ func _input(event):
 	if event is InputEventKey and event.pressed and not event.echo and event.keycode == KEY_Q:
 		_on_attack_button_pressed()
 
+	# Production hotkeys: O builds an office, E trains a worker at the selected building, X cancels
+	# the last one (or the construction of a building still going up)
+	if event is InputEventKey and event.pressed and not event.echo:
+		match event.keycode:
+			KEY_O:
+				_on_build_button_pressed("office")
+			KEY_E:
+				train_at_selected_building("worker")
+			KEY_X:
+				cancel_at_selected_building()
+
+	# Y opens the chat box
+	if event is InputEventKey and event.pressed and not event.echo and event.keycode == KEY_Y:
+		chat_input.grab_focus()
+		get_viewport().set_input_as_handled()
+		return
+
+	# Spectator hotkey: cycle between watching everyone and each player's view
+	if event is InputEventKey and event.pressed and not event.echo and event.keycode == KEY_F and network_manager.is_spectator():
+		var ids = [0]
+		for player in network_manager.lobby_state.get("players", []):
+			if not player.get("spectator", false):
+				ids.append(int(player.get("id", 0)))
+		var next = (ids.find(network_manager.follow_player_id) + 1) % ids.size()
+		network_manager.follow(ids[next])
+
+	# Lobby hotkeys: ready up, switch team, host starts the match
+	if event is InputEventKey and event.pressed and not event.echo and network_manager.lobby_state.get("phase", "") == "lobby":
+		var me = network_manager.local_lobby_player()
+		match event.keycode:
+			KEY_R:
+				network_manager.set_ready(not me.get("ready", false))
+			KEY_T:
+				network_manager.set_team((int(me.get("team", 0)) + 1) % 2)
+			KEY_ENTER:
+				if network_manager.is_host():
+					network_manager.start_match()
+
 	# Handle formation hotkeys
 	if event is InputEventKey and event.pressed and not event.echo:
 		match event.keycode:
@@ -476,6 +574,11 @@ func _unhandled_input(event):
 						update_selection_visual()
 						log_event("Selected unit %d" % clicked_entity_id)
 						print("Selected unit: ", clicked_entity_id)
+					elif entity:
+						# Enemy unit - remember it as the attack target
+						selected_target_id = clicked_entity_id
+						selection_label.text = "Selected: Enemy Unit #%d" % clicked_entity_id
+						log_event("Selected enemy unit #%d - press Q to attack!" % clicked_entity_id)
 					else:
 						print("Not our unit or invalid entity")
 				else:
@@ -499,12 +602,36 @@ func _unhandled_input(event):
 
 	# Right click to move selected units
 	elif event is InputEventMouseButton and event.pressed and event.button_index == MOUSE_BUTTON_RIGHT:
+		# With only an own building selected, right-click sets where its trained units go
+		if selected_units.is_empty() and own_selected_building() != -1:
+			var rally_tile = iso_to_tile(get_local_mouse_position())
+			network_manager.send_input([{
+				"type": "rally",
+				"data": {"buildingId": own_selected_building(), "tileX": rally_tile.x, "tileY": rally_tile.y}
+			}])
+			log_event("Rally point set to tile (%d, %d)" % [rally_tile.x, rally_tile.y])
+			return
+
 		if selected_units.is_empty():
 			log_event("No units selected")
 			return
 
-		# Convert isometric click to tile coordinates
+		# Right-clicking a resource node gathers from it, and an enemy attacks it, instead of moving there
 		var click_pos = get_local_mouse_position()
+		var clicked_entity_id = get_entity_at_position(click_pos)
+		if clicked_entity_id != -1 and entities[clicked_entity_id].get_meta("entity_type", "") == RESOURCE_NODE_TYPE:
+			network_manager.send_input([{
+				"type": "gather",
+				"data": {"unitIds": selected_units, "nodeId": clicked_entity_id}
+			}])
+			log_event("Sending %d units to gather from node #%d" % [selected_units.size(), clicked_entity_id])
+			return
+		if clicked_entity_id != -1 and entities[clicked_entity_id].get_meta("owner_id", -1) != local_client_id:
+			selected_target_id = clicked_entity_id
+			_on_attack_button_pressed()
+			return
+
+		# Convert isometric click to tile coordinates
 		var tile_coords = iso_to_tile(click_pos)
 
 		print("Move command: units ", selected_units, " -> tile: ", tile_coords)
@@ -644,11 +771,15 @@ func update_player_list():
 		var player_id = int(player_data.get("id", -1))  # JSON→int conversion
 		var player_name = player_data.get("name", "Unknown")
 		var money = player_data.get("money", 0.0)
+		var rtt = int(player_data.get("rtt", 0))
+		var ping_text = " (%d ms)" % rtt if rtt > 0 else ""
 
 		if player_id == local_client_id:
-			text += "• You: $%.0f\n" % money
+			text += "• You: $%.0f%s\n" % [money, ping_text]
+		elif player_data.get("moneyHidden", false):
+			text += "• %s: $?%s\n" % [player_name, ping_text]
 		else:
-			text += "• %s: $%.0f\n" % [player_name, money]
+			text += "• %s: $%.0f%s\n" % [player_name, money, ping_text]
 	player_list_label.text = text
 
 func update_building_health(building: Node2D, health: int, max_health: int):
@@ -658,11 +789,29 @@ func update_building_health(building: Node2D, health: int, max_health: int):
 		var health_bar = building.get_meta("health_bar")
 		health_bar.value = (float(health) / float(max_health)) * 100.0
 
-func create_building(entity_id: int, owner_id: int, pos: Vector2, footprint_w: int, footprint_h: int, health: int, max_health: int) -> Node2D:
+# Shows construction progress, e.g. "Generator (building 40%)", what an own building is
+# training, e.g. "Office (2) 40%", or what a resource node has left, e.g. "Gold 1350"
+func update_building_status(building: Node2D, entity_data: Dictionary):
+	var under_construction = entity_data.get("underConstruction", false)
+	building.set_meta("under_construction", under_construction)
+	if not building.has_meta("label"):
+		return
+	var text = building.get_meta("entity_type", "building").capitalize()
+	var queue = entity_data.get("trainingQueue", [])
+	if building.get_meta("entity_type", "") == RESOURCE_NODE_TYPE:
+		text = "%s %d" % [str(entity_data.get("resourceType", "resources")).capitalize(), int(entity_data.get("resources", 0))]
+	elif under_construction:
+		text += " (building %d%%)" % int(float(entity_data.get("buildProgress", 0.0)) * 100)
+	elif not queue.is_empty():
+		text += " (%d) %d%%" % [queue.size(), int(float(entity_data.get("trainProgress", 0.0)) * 100)]
+	building.get_meta("label").text = text
+
+func create_building(entity_id: int, entity_type: String, owner_id: int, pos: Vector2, footprint_w: int, footprint_h: int, health: int, max_health: int) -> Node2D:
 	var building = Node2D.new()
 	building.position = pos
 	building.set_meta("entity_id", entity_id)
 	building.set_meta("owner_id", owner_id)
+	building.set_meta("entity_type", entity_type)
 	building.set_meta("health", health)
 	building.set_meta("max_health", max_health)
 
@@ -674,6 +823,8 @@ func create_building(entity_id: int, owner_id: int, pos: Vector2, footprint_w: i
 	# Use Polygon2D to draw isometric box
 	var iso_box = Polygon2D.new()
 	var base_color = Color(1, 0.8, 0, 1) if owner_id == local_client_id else Color(0.8, 0.4, 0, 1)
+	if entity_type == RESOURCE_NODE_TYPE:
+		base_color = Color(0.3, 0.7, 0.9, 1)
 
 	# Draw as isometric box (top face + two visible sides)
 	# Top face (diamond shape)
@@ -711,21 +862,23 @@ func create_building(entity_id: int, owner_id: int, pos: Vector2, footprint_w: i
 	left_face.color = base_color.darkened(0.4)
 	building.add_child(left_face)
 
-	# Health bar (above the building)
-	var health_bar = ProgressBar.new()
-	health_bar.position = Vector2(0, -15)
-	health_bar.size = Vector2(visual_width, 8)
-	health_bar.max_value = 100
-	health_bar.value = (float(health) / float(max_health)) * 100.0
-	health_bar.show_percentage = false
-	building.add_child(health_bar)
-	building.set_meta("health_bar", health_bar)
+	# Health bar (above the building; resource nodes have no health)
+	if max_health > 0:
+		var health_bar = ProgressBar.new()
+		health_bar.position = Vector2(0, -15)
+		health_bar.size = Vector2(visual_width, 8)
+		health_bar.max_value = 100
+		health_bar.value = (float(health) / float(max_health)) * 100.0
+		health_bar.show_percentage = false
+		building.add_child(health_bar)
+		building.set_meta("health_bar", health_bar)
 
 	# Label (below the building)
 	var label = Label.new()
-	label.text = "Generator"
+	label.text = entity_type.capitalize()
 	label.position = Vector2(0, visual_height + building_height + 2)
 	building.add_child(label)
+	building.set_meta("label", label)
 
 	# Make clickable (click area covers the whole building including height)
 	var input_area = Area2D.new()
@@ -772,15 +925,80 @@ func _on_building_clicked(viewport, event, shape_idx, entity_id):
 				highlight.visible = true
 
 			var owner_id = selected_building.get_meta("owner_id") if selected_building.has_meta("owner_id") else -1
-			if owner_id == local_client_id:
-				selection_label.text = "Selected: Your Generator #%d" % entity_id
-				log_event("Selected your generator #%d" % entity_id)
+			var type_name = selected_building.get_meta("entity_type", "building")
+			if type_name == RESOURCE_NODE_TYPE:
+				selection_label.text = "Selected: Resource Node #%d" % entity_id
+				log_event("Selected resource node #%d - right-click it with workers selected to gather" % entity_id)
+			elif owner_id == local_client_id:
+				selection_label.text = "Selected: Your %s #%d" % [type_name.capitalize(), entity_id]
+				if network_manager.entity_type(type_name).get("trains", []).is_empty():
+					log_event("Selected your %s #%d" % [type_name, entity_id])
+				else:
+					log_event("Selected your %s #%d - press E to train, right-click to set a rally point" % [type_name, entity_id])
 			else:
-				selection_label.text = "Selected: Enemy Generator #%d" % entity_id
-				log_event("Selected enemy generator #%d - press Q to attack!" % entity_id)
+				selection_label.text = "Selected: Enemy %s #%d" % [type_name.capitalize(), entity_id]
+				log_event("Selected enemy %s #%d - press Q to attack!" % [type_name, entity_id])
 
 # Removed - infer events from snapshot changes instead
 
+func _on_chat_submitted(text: String):
+	chat_input.clear()
+	chat_input.release_focus()
+	text = text.strip_edges()
+	if text.is_empty():
+		return
+	if text.begins_with("/t "):
+		network_manager.send_chat("team", text.substr(3))
+	elif text.begins_with("/w "):
+		var parts = text.substr(3).split(" ", false, 1)
+		if parts.size() == 2 and parts[0].is_valid_int():
+			network_manager.send_chat("whisper", parts[1], int(parts[0]))
+		else:
+			log_event("Usage: /w <player id> <message>")
+	else:
+		network_manager.send_chat("all", text)
+
+func _on_chat_received(entry: Dictionary):
+	var text = entry.get("text", "")
+	match entry.get("scope", ""):
+		"system":
+			log_event("* %s" % text)
+		"team":
+			log_event("[team] %s: %s" % [entry.get("fromName", "?"), text])
+		"whisper":
+			if int(entry.get("fromId", 0)) == local_client_id:
+				log_event("[to %d] %s" % [int(entry.get("toId", 0)), text])
+			else:
+				log_event("[whisper] %s: %s" % [entry.get("fromName", "?"), text])
+		_:
+			log_event("%s: %s" % [entry.get("fromName", "?"), text])
+
+func _on_event_received(event: Dictionary):
+	var entity_id = int(event.get("entityId", 0))
+	var player_id = int(event.get("playerId", 0))
+	match event.get("type", ""):
+		"damage_dealt":
+			# Flash the hit entity red
+			if entities.has(entity_id):
+				var entity = entities[entity_id]
+				var tween = create_tween()
+				tween.tween_property(entity, "modulate", Color(1, 0.3, 0.3, entity.modulate.a), 0.05)
+				tween.tween_property(entity, "modulate", Color(1, 1, 1, entity.modulate.a), 0.2)
+		"entity_destroyed":
+			var who = "You" if player_id == local_client_id else "Player %d" % player_id
+			log_event("%s destroyed %s #%d" % [who, event.get("entityType", "entity"), entity_id])
+		"building_completed":
+			if player_id == local_client_id:
+				log_event("Your %s #%d is complete" % [event.get("entityType", "building"), entity_id])
+		"construction_cancelled":
+			if player_id == local_client_id:
+				log_event("Cancelled your %s #%d" % [event.get("entityType", "building"), entity_id])
+		"unit_trained":
+			log_event("Your %s #%d is ready" % [event.get("entityType", "unit"), entity_id])
+		"resource_depleted":
+			log_event("Resource node #%d ran out" % entity_id)
+		# player_joined is announced by chat; income_received shows in the money label
+
 func log_event(message: String):
 	event_messages.append(message)
 	if event_messages.size() > 10:
@@ -794,7 +1012,7 @@ func log_event(message: String):
 	# Auto-scroll to bottom
 	event_log.scroll_to_line(event_log.get_line_count() - 1)
 
-func _on_build_button_pressed():
+func _on_build_button_pressed(building_type: String = "generator"):
 	if not network_manager.is_connected or tile_size == 0 or selected_units.is_empty():
 		log_event("No units selected to build!")
 		return
@@ -812,14 +1030,15 @@ func _on_build_button_pressed():
 	var build_tile_y = unit_tile.y
 
 	# Client-side validation
-	if not can_build_at_tile(build_tile_x, build_tile_y):
+	if not can_build_at_tile(building_type, build_tile_x, build_tile_y):
 		return
 
-	# Send build command
+	# Send build command; the selected workers walk over and construct it
 	var commands = [{
 		"type": "build",
 		"data": {
-			"buildingType": "generator",
+			"unitIds": selected_units,
+			"buildingType": building_type,
 			"tileX": build_tile_x,
 			"tileY": build_tile_y
 		}
@@ -827,14 +1046,15 @@ func _on_build_button_pressed():
 	network_manager.send_input(commands)
 
 	# Client-side prediction: assume success (will be corrected by snapshot if wrong)
-	log_event("Building generator at tile (%d, %d)..." % [build_tile_x, build_tile_y])
+	log_event("Building %s at tile (%d, %d)..." % [building_type, build_tile_x, build_tile_y])
 
-func can_build_at_tile(tile_x: int, tile_y: int) -> bool:
-	var building_footprint_w = 2  # Generators are 2x2
-	var building_footprint_h = 2
+func can_build_at_tile(building_type: String, tile_x: int, tile_y: int) -> bool:
+	var definition = network_manager.entity_type(building_type)
+	var building_footprint_w = int(definition.get("footprintWidth", 2))
+	var building_footprint_h = int(definition.get("footprintHeight", 2))
 
 	# Check money
-	if local_money < 50:
+	if local_money < int(definition.get("cost", 0)):
 		log_event("Not enough money to build!")
 		return false
 
@@ -849,6 +1069,44 @@ func can_build_at_tile(tile_x: int, tile_y: int) -> bool:
 
 	return true
 
+# Returns the id of the selected building if it is ours, or -1
+func own_selected_building() -> int:
+	if selected_building == null or not is_instance_valid(selected_building):
+		return -1
+	if selected_building.get_meta("owner_id", -1) != local_client_id:
+		return -1
+	return int(selected_building.get_meta("entity_id", -1))
+
+func train_at_selected_building(unit_type: String):
+	var building_id = own_selected_building()
+	if building_id == -1:
+		log_event("Select one of your buildings to train units!")
+		return
+	var trains = network_manager.entity_type(selected_building.get_meta("entity_type", "")).get("trains", [])
+	if not (unit_type in trains):
+		log_event("This building can't train a %s" % unit_type)
+		return
+	if local_money < int(network_manager.entity_type(unit_type).get("cost", 0)):
+		log_event("Not enough money to train a %s!" % unit_type)
+		return
+
+	network_manager.send_input([{
+		"type": "train",
+		"data": {"buildingId": building_id, "unitType": unit_type}
+	}])
+	log_event("Training %s at building #%d..." % [unit_type, building_id])
+
+func cancel_at_selected_building():
+	var building_id = own_selected_building()
+	if building_id == -1:
+		return
+	if selected_building.get_meta("under_construction", false):
+		network_manager.send_input([{"type": "cancel_build", "data": {"buildingId": building_id}}])
+		log_event("Cancelled construction of building #%d" % building_id)
+		return
+	network_manager.send_input([{"type": "cancel_train", "data": {"buildingId": building_id}}])
+	log_event("Cancelled the last unit queued at building #%d" % building_id)
+
 func _on_attack_button_pressed():
 	if not network_manager.is_connected or selected_target_id == -1:
 		log_event("No target selected!")
@@ -863,14 +1121,20 @@ func _on_attack_button_pressed():
 	var target_owner = target.get_meta("owner_id") if target.has_meta("owner_id") else -1
 
 	if target_owner == local_client_id:
-		log_event("Can't attack your own buildings!")
+		log_event("Can't attack your own units or buildings!")
+		return
+
+	if selected_units.is_empty():
+		log_event("Select units to attack with!")
 		return
 
+	# Units walk into range and keep hitting until the target is destroyed
 	var commands = [{
 		"type": "attack",
 		"data": {
+			"unitIds": selected_units,
 			"targetId": selected_target_id
 		}
 	}]
 	network_manager.send_input(commands)
-	log_event("Attacking entity %d..." % selected_target_id)
+	log_event("Attacking entity %d with %d units..." % [selected_target_id, selected_units.size()])
@@ -3,19 +3,54 @@ extends Node
 signal connected_to_server(client_id: int, tick_rate: int, tile_size: int, arena_tiles_width: int, arena_tiles_height: int, terrain_data: Dictionary)
 signal snapshot_received(snapshot: Dictionary)
 signal disconnected_from_server()
+signal connection_rejected(reason: String, message: String)
+signal inputs_acknowledged(sequence: int, tick: int)
+signal command_failed(sequence: int, command_type: String, reason: String, message: String)
+signal lobby_updated(lobby: Dictionary)
+signal chat_received(entry: Dictionary)
+signal event_received(event: Dictionary)
+signal server_shutdown(message: String)
 
 var udp_socket: PacketPeerUDP
 var server_address: String = "127.0.0.1"
 var server_port: int = 8080
 var is_connected: bool = false
 var client_id: int = -1
+var session_token: String = ""  # Issued in welcome, required on input/ping/ack
+var room_id: String = ""  # Room to join (empty = server's default room), set from welcome
+var role: String = "player"  # "player" or "spectator"; the server may make late joiners spectators
+var follow_player_id: int = 0  # Spectators: player whose view to watch (0 = everything)
+var spectator_delay_ms: int = 0  # How far spectator snapshots lag behind the match
+const PROTOCOL_VERSION = "1.2"
+const CAPABILITIES = ["delta_snapshots", "reliable_events"]  # Optional features this client supports
+var server_capabilities: Array = []  # Features the server enabled for us
 var tick_rate: int = 20
+var starting_money: int = 100  # Server-configured economy, from the welcome
+var entity_types: Dictionary = {}  # Unit and building stats by type (cost, footprint, ...), from the welcome
 var current_tick: int = 0
 var sequence: int = 0
 var heartbeat_interval: float = 2.0  # seconds
 var heartbeat_timer: float = 0.0
 var input_redundancy: int = 3  # Send last N commands
-var command_history: Array = []  # Store recent commands for redundancy
+var command_history: Array = []  # Unacknowledged commands, resent for redundancy
+var last_acked_sequence: int = 0  # Highest input sequence the server has applied
+var snapshot_states: Dictionary = {}  # tick -> {entities: {id: entity}, players: {id: player}} (delta baselines)
+const SNAPSHOT_HISTORY_SIZE = 32  # Must match server's SnapshotHistorySize
+var pending_fragments: Dictionary = {}  # fragment id -> {parts: Array, received: int, first_seen: float}
+const FRAGMENT_TIMEOUT = 2.0  # seconds, must match server's FragmentTimeout
+var rtt_ms: float = 0.0  # Smoothed round-trip time measured from pongs
+var jitter_ms: float = 0.0  # Smoothed RTT deviation
+var last_pong_server_time: int = 0  # Echoed back in the next ping so the server can measure RTT
+var last_pong_received_at: int = 0  # Local msec the last pong arrived
+var last_pong_server_tick: int = 0  # Server tick when it handled our last ping
+var tick_interval_ms: int = 50
+var lobby_state: Dictionary = {}  # Latest lobby_state: phase, hostId, players, spawnSlots
+var chat_sequence: int = 0  # Last chat sequence we sent
+var pending_chats: Array = []  # Chat the server hasn't acknowledged yet, resent until it does
+var chat_resend_timer: float = 0.0
+var last_chat_received: int = 0  # Highest server chat sequence handled (acked back)
+var last_event_seq: int = 0  # Highest reliable event handled (acked back with snapshots)
+const CHAT_RESEND_INTERVAL = 0.5  # seconds
 
 # Tile configuration (from server)
 var tile_size: int
@@ -27,6 +62,11 @@ func _ready():
 	udp_socket.bind(0)  # Bind to any available port
 	set_process(true)
 
+func _notification(what):
+	# Tell the server we're leaving so our slot frees immediately
+	if what == NOTIFICATION_WM_CLOSE_REQUEST and is_connected:
+		send_goodbye()
+
 func connect_to_server(player_name: String):
 	print("Connecting to server at %s:%d" % [server_address, server_port])
 	udp_socket.connect_to_host(server_address, server_port)
@@ -35,8 +75,13 @@ func connect_to_server(player_name: String):
 	var hello_msg = {
 		"type": "hello",
 		"data": {
-			"clientVersion": "1.0",
-			"playerName": player_name
+			"clientVersion": PROTOCOL_VERSION,
+			"playerName": player_name,
+			"roomId": room_id,
+			"role": role,
+			"follow": follow_player_id,
+			"sessionToken": session_token,  # Non-empty when resuming a previous session
+			"capabilities": CAPABILITIES
 		}
 	}
 	send_message(hello_msg)
@@ -55,22 +100,23 @@ func send_input(commands: Array):
 	# Create command frame
 	var command_frame = {
 		"sequence": sequence,
-		"tick": current_tick,
+		"tick": estimated_server_tick(),
 		"commands": commands
 	}
 
 	# Add to history
 	command_history.append(command_frame)
 
-	# Keep only last N commands for redundancy
+	# Keep only last N unacknowledged commands for redundancy
 	if command_history.size() > input_redundancy:
 		command_history.pop_front()
 
-	# Send last N command frames (redundancy for packet loss)
+	# Send unacknowledged command frames (redundancy for packet loss)
 	var input_msg = {
 		"type": "input",
 		"data": {
 			"clientId": client_id,
+			"sessionToken": session_token,
 			"commands": command_history  # Send all recent frames
 		}
 	}
@@ -82,10 +128,45 @@ func send_ping():
 
 	var ping_msg = {
 		"type": "ping",
-		"data": {}
+		"data": {
+			"clientId": client_id,
+			"sessionToken": session_token,
+			"clientTime": Time.get_ticks_msec()
+		}
 	}
+	# Echo the last pong so the server can measure RTT on its side
+	if last_pong_received_at > 0:
+		ping_msg["data"]["echoServerTime"] = last_pong_server_time
+		ping_msg["data"]["echoDelay"] = Time.get_ticks_msec() - last_pong_received_at
 	send_message(ping_msg)
 
+func handle_pong(data: Dictionary):
+	var now = Time.get_ticks_msec()
+	var sample = float(now - int(data.get("clientTime", now)))
+	if sample < 0:
+		return
+
+	# Same smoothing as the server (SRTT/RTTVAR)
+	if rtt_ms == 0.0:
+		rtt_ms = sample
+		jitter_ms = sample / 2.0
+	else:
+		jitter_ms += 0.25 * (abs(sample - rtt_ms) - jitter_ms)
+		rtt_ms += 0.125 * (sample - rtt_ms)
+
+	last_pong_server_time = int(data.get("serverTime", 0))
+	last_pong_server_tick = int(data.get("serverTick", 0))
+	tick_interval_ms = max(int(data.get("tickInterval", 1000 / tick_rate)), 1)
+	last_pong_received_at = now
+
+# Best guess of the tick the server is on now, from the last pong plus elapsed time
+# and half the round trip (falls back to the latest snapshot tick before any pong)
+func estimated_server_tick() -> int:
+	if last_pong_received_at == 0:
+		return current_tick
+	var elapsed = Time.get_ticks_msec() - last_pong_received_at + rtt_ms / 2.0
+	return last_pong_server_tick + int(elapsed / tick_interval_ms)
+
 func _process(delta):
 	# Handle heartbeat
 	if is_connected:
@@ -94,6 +175,13 @@ func _process(delta):
 			heartbeat_timer = 0.0
 			send_ping()
 
+		# Resend chat the server hasn't acknowledged
+		chat_resend_timer += delta
+		if chat_resend_timer >= CHAT_RESEND_INTERVAL and not pending_chats.is_empty():
+			chat_resend_timer = 0.0
+			for chat in pending_chats:
+				send_message({"type": "chat", "data": chat})
+
 	# Check for incoming packets
 	while udp_socket.get_available_packet_count() > 0:
 		var packet = udp_socket.get_packet()
@@ -105,18 +193,77 @@ func _process(delta):
 			var message = json.data
 			handle_message(message)
 
+	expire_fragments()
+
 func handle_message(message: Dictionary):
 	match message.get("type", ""):
+		"fragment":
+			handle_fragment(message.get("data", {}))
 		"welcome":
 			handle_welcome(message.get("data", {}))
 		"snapshot":
 			handle_snapshot(message.get("data", {}))
 		"pong":
-			pass  # Handle ping/pong if needed
+			handle_pong(message.get("data", {}))
+		"reject":
+			handle_reject(message.get("data", {}))
+		"shutdown":
+			handle_shutdown(message.get("data", {}))
+		"command_error":
+			handle_command_error(message.get("data", {}))
+		"lobby_state":
+			handle_lobby_state(message.get("data", {}))
+		"chat_messages":
+			handle_chat_messages(message.get("data", {}))
+		"chat_ack":
+			handle_chat_ack(message.get("data", {}))
+
+func handle_fragment(data: Dictionary):
+	var fragment_id = int(data.get("id", 0))
+	var index = int(data.get("index", 0))
+	var count = int(data.get("count", 0))
+	if count <= 0 or index < 0 or index >= count:
+		return
+
+	if not pending_fragments.has(fragment_id):
+		var parts = []
+		parts.resize(count)
+		pending_fragments[fragment_id] = {"parts": parts, "received": 0, "first_seen": Time.get_ticks_msec() / 1000.0}
+	var pending = pending_fragments[fragment_id]
+	if pending["parts"].size() != count or pending["parts"][index] != null:
+		return  # Mismatched count or duplicate
+
+	pending["parts"][index] = Marshalls.base64_to_raw(data.get("payload", ""))
+	pending["received"] += 1
+	if pending["received"] < count:
+		return
+
+	# All fragments arrived: join them and handle the original message
+	pending_fragments.erase(fragment_id)
+	var buffer = PackedByteArray()
+	for part in pending["parts"]:
+		buffer.append_array(part)
+	var json = JSON.new()
+	if json.parse(buffer.get_string_from_utf8()) == OK and json.data.get("type", "") != "fragment":
+		handle_message(json.data)
+
+func expire_fragments():
+	var now = Time.get_ticks_msec() / 1000.0
+	for fragment_id in pending_fragments.keys():
+		if now - pending_fragments[fragment_id]["first_seen"] > FRAGMENT_TIMEOUT:
+			pending_fragments.erase(fragment_id)
 
 func handle_welcome(data: Dictionary):
 	client_id = int(data.get("clientId", -1))  # JSON→int conversion
+	var previous_token = session_token
+	session_token = data.get("sessionToken", "")
+	room_id = data.get("roomId", room_id)
+	role = data.get("role", role)
+	spectator_delay_ms = int(data.get("spectatorDelay", 0))
+	server_capabilities = data.get("capabilities", [])
 	tick_rate = int(data.get("tickRate", 20))
+	starting_money = int(data.get("startingMoney", starting_money))
+	entity_types = data.get("entityTypes", {})
 	var heartbeat_ms = int(data.get("heartbeatInterval", 2000))
 	heartbeat_interval = heartbeat_ms / 1000.0  # Convert to seconds
 	input_redundancy = int(data.get("inputRedundancy", 3))  # Server can configure redundancy
@@ -127,17 +274,225 @@ func handle_welcome(data: Dictionary):
 	is_connected = true
 	heartbeat_timer = 0.0  # Reset timer
 	command_history.clear()  # Clear history on new connection
+	sequence = 0  # Server restarts sequence tracking on (re)connect
+	last_acked_sequence = 0
+	snapshot_states.clear()
+	pending_fragments.clear()
+	current_tick = 0
+	last_pong_received_at = 0
+	rtt_ms = 0.0
+	jitter_ms = 0.0
+	# Server restarts our chat numbering on (re)connect; a new session also restarts its own
+	for i in range(pending_chats.size()):
+		pending_chats[i]["clientId"] = client_id
+		pending_chats[i]["sessionToken"] = session_token
+		pending_chats[i]["seq"] = i + 1
+	chat_sequence = pending_chats.size()
+	if session_token != previous_token:
+		last_chat_received = 0
+		last_event_seq = 0
 	print("Connected! Client ID: %d, Tick Rate: %d, Heartbeat: %.1fs, Redundancy: %d" % [client_id, tick_rate, heartbeat_interval, input_redundancy])
+	print("Economy: start $%d, %d entity types" % [starting_money, entity_types.size()])
 	print("Tile config: Size=%d, Arena=%dx%d tiles" % [tile_size, arena_tiles_width, arena_tiles_height])
 	print("Terrain: %d tiles, default=%s" % [terrain_data.get("tiles", []).size(), terrain_data.get("defaultType", "unknown")])
 	connected_to_server.emit(client_id, tick_rate, tile_size, arena_tiles_width, arena_tiles_height, terrain_data)
+	send_ping()  # Measure RTT right away instead of waiting a heartbeat
 
 func handle_snapshot(data: Dictionary):
-	current_tick = data.get("tick", 0)
-	snapshot_received.emit(data)
+	# Reliable events repeat until acked, so even stale snapshots may carry new ones
+	for event in data.get("events", []):
+		var seq = int(event.get("seq", 0))
+		if seq > last_event_seq:
+			last_event_seq = seq
+			event_received.emit(event)
+
+	var tick = int(data.get("tick", 0))
+	if tick <= current_tick:
+		return  # Out of order or duplicate
+
+	# Rebuild full state: start from the baseline for deltas, from scratch for full snapshots
+	var baseline_tick = int(data.get("baselineTick", 0))
+	var entities: Dictionary = {}
+	var players: Dictionary = {}
+	if baseline_tick != 0:
+		if not snapshot_states.has(baseline_tick):
+			return  # Baseline already discarded, wait for the server to fall back to a full snapshot
+		var baseline = snapshot_states[baseline_tick]
+		entities = baseline["entities"].duplicate()
+		players = baseline["players"].duplicate()
+
+	for entity in data.get("entities", []):
+		entities[int(entity.get("id", 0))] = entity
+	for entity_id in data.get("removedEntities", []):
+		entities.erase(int(entity_id))
+
+	var snapshot_players = data.get("players", {})
+	for player_id in snapshot_players:
+		players[player_id] = snapshot_players[player_id]
+	for player_id in data.get("removedPlayers", []):
+		players.erase(player_id)
+
+	# Keep recent states as baselines for future deltas
+	snapshot_states[tick] = {"entities": entities, "players": players}
+	for old_tick in snapshot_states.keys():
+		if old_tick <= tick - SNAPSHOT_HISTORY_SIZE:
+			snapshot_states.erase(old_tick)
+
+	current_tick = tick
+	if "delta_snapshots" in server_capabilities or "reliable_events" in server_capabilities:
+		send_ack(tick)
+
+	acknowledge_inputs(int(data.get("lastProcessedSeq", 0)), int(data.get("lastProcessedTick", 0)))
+
+	snapshot_received.emit({
+		"tick": tick,
+		"entities": entities.values(),
+		"players": players
+	})
+
+func acknowledge_inputs(acked_sequence: int, applied_tick: int):
+	if acked_sequence <= last_acked_sequence:
+		return
+	last_acked_sequence = acked_sequence
+
+	# Server has these frames, stop resending them
+	while not command_history.is_empty() and int(command_history[0]["sequence"]) <= acked_sequence:
+		command_history.pop_front()
+
+	inputs_acknowledged.emit(acked_sequence, applied_tick)
+
+func send_ack(tick: int):
+	var ack_msg = {
+		"type": "ack",
+		"data": {
+			"clientId": client_id,
+			"sessionToken": session_token,
+			"tick": tick,
+			"eventSeq": last_event_seq
+		}
+	}
+	send_message(ack_msg)
+
+func handle_reject(data: Dictionary):
+	var reason = data.get("reason", "unknown")
+	var reject_message = data.get("message", "")
+	print("Connection rejected: %s (%s)" % [reason, reject_message])
+	is_connected = false
+	if reason == "invalid_session":
+		session_token = ""  # Session is gone for good, next hello starts fresh
+	elif reason == "room_not_found":
+		room_id = ""  # Room closed, next hello joins the default room
+	connection_rejected.emit(reason, reject_message)
+
+func handle_shutdown(data: Dictionary):
+	if not is_connected:
+		return  # The notice is sent more than once
+	var shutdown_message = data.get("message", "")
+	print("Server shutting down: %s" % shutdown_message)
+	is_connected = false  # Keep the session token: a server restored from a save can resume it
+	server_shutdown.emit(shutdown_message)
+
+func handle_command_error(data: Dictionary):
+	var seq = int(data.get("sequence", 0))
+	var command_type = data.get("commandType", "")
+	var reason = data.get("reason", "unknown")
+	var error_message = data.get("message", "")
+	print("Command %s (seq %d) rejected: %s (%s)" % [command_type, seq, reason, error_message])
+	command_failed.emit(seq, command_type, reason, error_message)
+
+func handle_lobby_state(data: Dictionary):
+	var previous_phase = lobby_state.get("phase", "")
+	lobby_state = data
+	if data.get("phase", "") != previous_phase:
+		print("Match phase: %s" % data.get("phase", ""))
+	lobby_updated.emit(data)
+
+func is_host() -> bool:
+	return int(lobby_state.get("hostId", 0)) == client_id
+
+func local_lobby_player() -> Dictionary:
+	for player in lobby_state.get("players", []):
+		if int(player.get("id", 0)) == client_id:
+			return player
+	return {}
+
+func send_lobby_message(type: String, fields: Dictionary):
+	var data = {
+		"clientId": client_id,
+		"sessionToken": session_token
+	}
+	data.merge(fields)
+	send_message({"type": type, "data": data})
+
+func set_team(team: int, spawn_slot: int = 0):
+	send_lobby_message("set_team", {"team": team, "spawnSlot": spawn_slot})
+
+func set_ready(ready: bool):
+	send_lobby_message("set_ready", {"ready": ready})
+
+func start_match():
+	send_lobby_message("start_match", {})
+
+# scope is "all", "team" or "whisper" (to = recipient's client id)
+func send_chat(scope: String, text: String, to: int = 0):
+	if not is_connected:
+		return
+	chat_sequence += 1
+	var chat = {
+		"clientId": client_id,
+		"sessionToken": session_token,
+		"seq": chat_sequence,
+		"scope": scope,
+		"to": to,
+		"text": text
+	}
+	pending_chats.append(chat)
+	send_message({"type": "chat", "data": chat})
+
+func handle_chat_ack(data: Dictionary):
+	var acked = int(data.get("seq", 0))
+	while not pending_chats.is_empty() and int(pending_chats[0]["seq"]) <= acked:
+		pending_chats.pop_front()
+
+func handle_chat_messages(data: Dictionary):
+	# The server resends everything we haven't acked, oldest first; skip what we've shown
+	for entry in data.get("messages", []):
+		var seq = int(entry.get("seq", 0))
+		if seq > last_chat_received:
+			last_chat_received = seq
+			chat_received.emit(entry)
+	send_message({
+		"type": "chat_ack",
+		"data": {"clientId": client_id, "sessionToken": session_token, "seq": last_chat_received}
+	})
+
+func is_spectator() -> bool:
+	return role == "spectator"
+
+# Spectators only: watch through one player's fog of war (0 = see everything)
+func follow(player_id: int):
+	follow_player_id = player_id
+	send_lobby_message("follow", {"playerId": player_id})
+
+func send_goodbye():
+	var goodbye_msg = {
+		"type": "goodbye",
+		"data": {
+			"clientId": client_id,
+			"sessionToken": session_token
+		}
+	}
+	send_message(goodbye_msg)
 
 func disconnect_from_server():
+	if is_connected:
+		send_goodbye()
+		session_token = ""  # Left on purpose, nothing to resume
 	is_connected = false
 	client_id = -1
 	udp_socket.close()
-	disconnected_from_server.emit()
\ No newline at end of file
+	disconnected_from_server.emit()
+
+# Stats the server defined for an entity type (empty if unknown)
+func entity_type(type_name: String) -> Dictionary:
+	return entity_types.get(type_name, {})
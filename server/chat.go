@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Chat scopes
+const (
+	ChatAll     = "all"     // Everyone in the room
+	ChatTeam    = "team"    // Sender's team (spectators: other spectators)
+	ChatWhisper = "whisper" // One player
+	ChatSystem  = "system"  // Server announcements (joins, leaves, eliminations)
+)
+
+// ChatMessage is something a client says. Clients number their chat messages from 1 and
+// resend them until a chat_ack covers their sequence.
+type ChatMessage struct {
+	ClientId     uint32 `json:"clientId"`
+	SessionToken string `json:"sessionToken"`
+	Seq          uint32 `json:"seq"`          // Per-client chat sequence (separate from input sequences)
+	Scope        string `json:"scope"`        // all, team or whisper
+	To           uint32 `json:"to,omitempty"` // Whisper recipient's client id
+	Text         string `json:"text"`
+}
+
+// ChatEntry is one line of chat as delivered to a recipient
+type ChatEntry struct {
+	Seq      uint32 `json:"seq"`  // Per-recipient delivery sequence
+	Tick     uint64 `json:"tick"` // Server tick it was said on
+	Scope    string `json:"scope"`
+	FromId   uint32 `json:"fromId,omitempty"` // 0 for system messages
+	FromName string `json:"fromName,omitempty"`
+	ToId     uint32 `json:"toId,omitempty"` // Whisper recipient
+	Text     string `json:"text"`
+}
+
+// ChatMessagesMessage carries every chat entry the recipient hasn't acknowledged yet, oldest first
+type ChatMessagesMessage struct {
+	Messages []ChatEntry `json:"messages"`
+}
+
+// ChatAckMessage acknowledges chat up to and including Seq. Clients send it for entries
+// they received; the server sends it (without a session) for chat it accepted.
+type ChatAckMessage struct {
+	ClientId     uint32 `json:"clientId,omitempty"`
+	SessionToken string `json:"sessionToken,omitempty"`
+	Seq          uint32 `json:"seq"`
+}
+
+// chatOutbox holds chat waiting for one client's acknowledgement
+type chatOutbox struct {
+	entries  []ChatEntry
+	nextSeq  uint32
+	lastSent time.Time
+	unsent   bool // Entries were added since the last send
+}
+
+// add numbers entry and queues it, dropping the oldest once MaxChatBacklog is reached
+func (o *chatOutbox) add(entry ChatEntry) {
+	o.nextSeq++
+	entry.Seq = o.nextSeq
+	o.entries = append(o.entries, entry)
+	if len(o.entries) > MaxChatBacklog {
+		o.entries = o.entries[len(o.entries)-MaxChatBacklog:]
+	}
+	o.unsent = true
+}
+
+// ack forgets every entry up to and including seq
+func (o *chatOutbox) ack(seq uint32) {
+	kept := 0
+	for kept < len(o.entries) && o.entries[kept].Seq <= seq {
+		kept++
+	}
+	o.entries = o.entries[kept:]
+}
+
+// due reports whether the outbox has entries that are new or waited ChatResendInterval for an ack
+func (o *chatOutbox) due(now time.Time) bool {
+	return len(o.entries) > 0 && (o.unsent || now.Sub(o.lastSent) >= ChatResendInterval)
+}
+
+// handleChat relays a client's chat message and acknowledges it. Messages must arrive in
+// sequence; resends and anything after a gap are only acknowledged up to what was accepted.
+func (s *GameServer) handleChat(chat ChatMessage, clientAddr net.Addr) {
+	now := time.Now()
+
+	s.mu.Lock()
+	client := s.authenticate(chat.ClientId, chat.SessionToken, clientAddr)
+	var err error
+	var codec Codec
+	var acked uint32
+	if client != nil {
+		client.LastSeen = now
+		codec = codecFor(client)
+		if chat.Seq == client.LastChatSeq+1 {
+			client.LastChatSeq = chat.Seq
+			if client.ChatBucket.allow(now, ChatRate, ChatBurst) {
+				err = s.relayChat(client, chat)
+			} else {
+				atomic.AddUint64(&s.flood.DroppedChats, 1)
+				err = newCommandError(ErrRateLimited, "sending chat too fast")
+			}
+		}
+		acked = client.LastChatSeq
+	}
+	s.mu.Unlock()
+
+	if client == nil {
+		return
+	}
+	if err != nil {
+		s.sendPayload(codec, MsgCommandError, newCommandErrorMessage(0, string(MsgChat), err), clientAddr)
+	}
+	s.sendPayload(codec, MsgChatAck, ChatAckMessage{Seq: acked}, clientAddr)
+}
+
+func (s *GameServer) handleChatAck(ack ChatAckMessage, clientAddr net.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	client := s.authenticate(ack.ClientId, ack.SessionToken, clientAddr)
+	if client == nil {
+		return
+	}
+	client.LastSeen = time.Now()
+	client.Chat.ack(ack.Seq)
+}
+
+// relayChat validates chat from sender and queues it for everyone in its scope.
+// Must be called with s.mu held.
+func (s *GameServer) relayChat(sender *Client, chat ChatMessage) error {
+	text, err := cleanChatText(chat.Text)
+	if err != nil {
+		return err
+	}
+
+	entry := ChatEntry{
+		Tick:     s.tick,
+		Scope:    chat.Scope,
+		FromId:   sender.Id,
+		FromName: sender.Name,
+		Text:     text,
+	}
+
+	switch chat.Scope {
+	case ChatAll, ChatTeam:
+		for _, recipient := range s.clients {
+			if !s.canHear(sender, recipient) {
+				continue
+			}
+			if chat.Scope == ChatTeam && (recipient.Spectator != sender.Spectator ||
+				(!sender.Spectator && recipient.Team != sender.Team)) {
+				continue
+			}
+			recipient.Chat.add(entry)
+		}
+
+	case ChatWhisper:
+		recipient, exists := s.clients[chat.To]
+		if !exists || recipient.Id == sender.Id {
+			return newCommandError(ErrInvalidTarget, "no player %d to whisper to", chat.To)
+		}
+		if !s.canHear(sender, recipient) {
+			return newCommandError(ErrInvalidTarget, "players can't hear spectators during the match")
+		}
+		entry.ToId = recipient.Id
+		recipient.Chat.add(entry)
+		sender.Chat.add(entry) // Echo so the sender's log shows what was whispered
+
+	default:
+		return newCommandError(ErrInvalidData, "unknown chat scope %q", chat.Scope)
+	}
+	return nil
+}
+
+// canHear reports whether recipient may receive sender's chat. Once the match has started
+// spectators only reach other spectators, so they can't pass on what players can't see.
+// Must be called with s.mu held.
+func (s *GameServer) canHear(sender, recipient *Client) bool {
+	return s.phase == PhaseLobby || !sender.Spectator || recipient.Spectator
+}
+
+// cleanChatText trims text, strips control characters and enforces MaxChatLength
+func cleanChatText(text string) (string, error) {
+	if !utf8.ValidString(text) {
+		return "", newCommandError(ErrInvalidData, "chat must be valid UTF-8")
+	}
+	text = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, text))
+	if text == "" {
+		return "", newCommandError(ErrInvalidData, "empty chat message")
+	}
+	if length := utf8.RuneCountInString(text); length > MaxChatLength {
+		return "", newCommandError(ErrMessageTooLong, "chat is %d characters (max %d)", length, MaxChatLength)
+	}
+	return text, nil
+}
+
+// systemMessage announces text to everyone in the room. Must be called with s.mu held.
+func (s *GameServer) systemMessage(format string, args ...interface{}) {
+	entry := ChatEntry{
+		Tick:  s.tick,
+		Scope: ChatSystem,
+		Text:  fmt.Sprintf(format, args...),
+	}
+	for _, client := range s.clients {
+		client.Chat.add(entry)
+	}
+}
+
+// checkEliminations announces players who have lost every unit and building.
+// Must be called with s.mu held.
+func (s *GameServer) checkEliminations() {
+	if s.phase != PhaseRunning {
+		return
+	}
+
+	owned := make(map[uint32]int, len(s.clients))
+	for _, entity := range s.entities {
+		owned[entity.OwnerId]++
+	}
+	for _, client := range s.clients {
+		if client.Spectator || client.Eliminated || owned[client.Id] > 0 {
+			continue
+		}
+		client.Eliminated = true
+		log.Printf("Client %d (%s) was eliminated", client.Id, client.Name)
+		s.systemMessage("%s was eliminated", client.Name)
+	}
+}
+
+// chatMessages queues chat_messages for every connected client with chat that is new or
+// overdue for an acknowledgement. Must be called with s.mu held.
+func (s *GameServer) chatMessages(outgoing []outgoingMessage, now time.Time) []outgoingMessage {
+	for _, client := range s.clients {
+		if client.Disconnected || !client.Chat.due(now) {
+			continue
+		}
+		outgoing = append(outgoing, outgoingMessage{
+			addr:    client.Addr,
+			codec:   codecFor(client),
+			msgType: MsgChatMessages,
+			payload: ChatMessagesMessage{Messages: append([]ChatEntry(nil), client.Chat.entries...)},
+		})
+		client.Chat.lastSent = now
+		client.Chat.unsent = false
+	}
+	return outgoing
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newChatTestServer creates a running match with two players on team 0, one on team 1
+// and a spectator, with the join announcements already acknowledged
+func newChatTestServer() (*GameServer, map[string]*Client) {
+	server := newSessionTestServer()
+	clients := make(map[string]*Client)
+	for i, name := range []string{"Ann", "Ben", "Cat", "Spec"} {
+		client := &Client{Id: uint32(i + 1), Name: name, Team: []int{0, 0, 1, -1}[i], SessionToken: name,
+			Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i+1)), Port: 1000}, LastSeen: time.Now()}
+		client.Spectator = name == "Spec"
+		server.clients[client.Id] = client
+		clients[name] = client
+	}
+	server.phase = PhaseRunning
+	return server, clients
+}
+
+func chatTexts(client *Client) []string {
+	texts := make([]string, 0, len(client.Chat.entries))
+	for _, entry := range client.Chat.entries {
+		texts = append(texts, entry.Text)
+	}
+	return texts
+}
+
+// TestChatScopes verifies all, team and whisper chat reach the right recipients
+func TestChatScopes(t *testing.T) {
+	server, clients := newChatTestServer()
+
+	server.relayChat(clients["Ann"], ChatMessage{Scope: ChatAll, Text: "hello all"})
+	server.relayChat(clients["Ann"], ChatMessage{Scope: ChatTeam, Text: "hello team"})
+	server.relayChat(clients["Ann"], ChatMessage{Scope: ChatWhisper, To: clients["Cat"].Id, Text: "psst"})
+	server.relayChat(clients["Spec"], ChatMessage{Scope: ChatAll, Text: "nice game"})
+
+	expected := map[string]string{
+		"Ann":  "hello all|hello team|psst",
+		"Ben":  "hello all|hello team",
+		"Cat":  "hello all|psst",
+		"Spec": "hello all|nice game",
+	}
+	for name, want := range expected {
+		if got := strings.Join(chatTexts(clients[name]), "|"); got != want {
+			t.Errorf("%s: expected %q, got %q", name, want, got)
+		}
+	}
+	if entry := clients["Cat"].Chat.entries[1]; entry.FromId != clients["Ann"].Id || entry.ToId != clients["Cat"].Id {
+		t.Errorf("Expected whisper from Ann to Cat, got %+v", entry)
+	}
+}
+
+// TestChatValidation verifies length limits, cleanup and bad scopes or targets
+func TestChatValidation(t *testing.T) {
+	server, clients := newChatTestServer()
+	ann := clients["Ann"]
+
+	expectCommandError(t, server.relayChat(ann, ChatMessage{Scope: ChatAll, Text: strings.Repeat("a", MaxChatLength+1)}), ErrMessageTooLong)
+	expectCommandError(t, server.relayChat(ann, ChatMessage{Scope: ChatAll, Text: " \n\t "}), ErrInvalidData)
+	expectCommandError(t, server.relayChat(ann, ChatMessage{Scope: "shout", Text: "hi"}), ErrInvalidData)
+	expectCommandError(t, server.relayChat(ann, ChatMessage{Scope: ChatWhisper, To: ann.Id, Text: "hi"}), ErrInvalidTarget)
+	expectCommandError(t, server.relayChat(clients["Spec"], ChatMessage{Scope: ChatWhisper, To: ann.Id, Text: "they're behind you"}), ErrInvalidTarget)
+
+	if err := server.relayChat(ann, ChatMessage{Scope: ChatAll, Text: "  gg\x07 wp  "}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if texts := chatTexts(clients["Ben"]); len(texts) != 1 || texts[0] != "gg wp" {
+		t.Errorf("Expected cleaned message only, got %q", texts)
+	}
+}
+
+// TestChatSequencedAndRateLimited verifies resends aren't relayed twice, gaps wait for the
+// missing message and floods are dropped
+func TestChatSequencedAndRateLimited(t *testing.T) {
+	server, clients := newChatTestServer()
+	ann, ben := clients["Ann"], clients["Ben"]
+
+	say := func(seq uint32, text string) {
+		server.handleChat(ChatMessage{ClientId: ann.Id, SessionToken: ann.SessionToken, Seq: seq, Scope: ChatAll, Text: text}, ann.Addr)
+	}
+	say(1, "one")
+	say(1, "one")
+	say(3, "three")
+	say(2, "two")
+
+	if got := strings.Join(chatTexts(ben), "|"); got != "one|two" || ann.LastChatSeq != 2 {
+		t.Fatalf("Expected one|two accepted up to seq 2, got %q up to %d", got, ann.LastChatSeq)
+	}
+
+	for seq := uint32(3); seq < 3+ChatBurst; seq++ {
+		say(seq, "spam")
+	}
+	if len(ben.Chat.entries) != ChatBurst || server.flood.snapshot().DroppedChats == 0 {
+		t.Errorf("Expected chat past the burst dropped, Ben has %d entries", len(ben.Chat.entries))
+	}
+}
+
+// TestChatResentUntilAcknowledged verifies pending chat is sent promptly, resent after
+// ChatResendInterval and dropped once acknowledged
+func TestChatResentUntilAcknowledged(t *testing.T) {
+	server, clients := newChatTestServer()
+	ben := clients["Ben"]
+	server.relayChat(clients["Ann"], ChatMessage{Scope: ChatTeam, Text: "first"})
+	server.relayChat(clients["Ann"], ChatMessage{Scope: ChatTeam, Text: "second"})
+
+	countFor := func(outgoing []outgoingMessage, client *Client) int {
+		count := 0
+		for _, out := range outgoing {
+			if out.addr == client.Addr && out.msgType == MsgChatMessages {
+				count = len(out.payload.(ChatMessagesMessage).Messages)
+			}
+		}
+		return count
+	}
+
+	now := time.Now()
+	if n := countFor(server.chatMessages(nil, now), ben); n != 2 {
+		t.Fatalf("Expected both messages sent immediately, got %d", n)
+	}
+	if n := countFor(server.chatMessages(nil, now.Add(ChatResendInterval/2)), ben); n != 0 {
+		t.Errorf("Expected no resend before ChatResendInterval, got %d", n)
+	}
+
+	server.handleChatAck(ChatAckMessage{ClientId: ben.Id, SessionToken: ben.SessionToken, Seq: 1}, ben.Addr)
+	if n := countFor(server.chatMessages(nil, now.Add(ChatResendInterval)), ben); n != 1 {
+		t.Errorf("Expected only the unacknowledged message resent, got %d", n)
+	}
+
+	server.handleChatAck(ChatAckMessage{ClientId: ben.Id, SessionToken: ben.SessionToken, Seq: 2}, ben.Addr)
+	if n := countFor(server.chatMessages(nil, now.Add(2*ChatResendInterval)), ben); n != 0 {
+		t.Errorf("Expected nothing left to resend, got %d", n)
+	}
+
+	for i := 0; i < MaxChatBacklog+10; i++ {
+		ben.Chat.add(ChatEntry{Text: "backlog"})
+	}
+	if len(ben.Chat.entries) != MaxChatBacklog {
+		t.Errorf("Expected backlog capped at %d, got %d", MaxChatBacklog, len(ben.Chat.entries))
+	}
+}
+
+// TestSystemMessages verifies joins, leaves and eliminations are announced
+func TestSystemMessages(t *testing.T) {
+	server, host, guest := newLobbyTestServer()
+	if texts := chatTexts(host); len(texts) != 2 || texts[0] != "Host joined" || texts[1] != "Guest joined" {
+		t.Errorf("Expected join announcements, got %q", texts)
+	}
+
+	server.beginMatch()
+	for _, id := range guest.OwnedUnits {
+		delete(server.entities, id)
+	}
+	server.checkEliminations()
+	server.checkEliminations()
+
+	server.handleGoodbye(GoodbyeMessage{ClientId: guest.Id, SessionToken: guest.SessionToken}, guest.Addr)
+
+	texts := chatTexts(host)
+	if got := strings.Join(texts[2:], "|"); got != "Guest was eliminated|Guest left" {
+		t.Errorf("Expected elimination announced once, then leave, got %q", got)
+	}
+	if host.Chat.entries[2].Scope != ChatSystem || host.Chat.entries[2].FromId != 0 {
+		t.Errorf("Expected a system message, got %+v", host.Chat.entries[2])
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import "time"
+
+// RTT smoothing weights (as in TCP's SRTT/RTTVAR estimator)
+const (
+	rttGain    = 0.125 // Weight of each new sample in the smoothed RTT
+	jitterGain = 0.25  // Weight of each new deviation in the smoothed jitter
+)
+
+// MaxInputTickSkew bounds how far a command frame's tick may be from the server tick.
+// Frames claiming an earlier or later tick are clamped so clients can't jump the
+// processing order by guessing. Two seconds of ticks; kept in step with TickRate by Config.apply.
+var MaxInputTickSkew = uint64(2 * TickRate)
+
+// serverTimeMillis returns the server clock in milliseconds, the unit used on the wire
+func serverTimeMillis(now time.Time) int64 {
+	return now.UnixMilli()
+}
+
+// updateRtt folds a round-trip sample into the client's smoothed RTT and jitter.
+// Must be called with the owning GameServer's mu held.
+func (c *Client) updateRtt(sample time.Duration) {
+	if c.Rtt == 0 {
+		c.Rtt = sample
+		c.RttJitter = sample / 2
+		return
+	}
+
+	deviation := sample - c.Rtt
+	if deviation < 0 {
+		deviation = -deviation
+	}
+	c.RttJitter += time.Duration(jitterGain * float64(deviation-c.RttJitter))
+	c.Rtt += time.Duration(rttGain * float64(sample-c.Rtt))
+}
+
+// rttSample returns the round trip implied by a ping echoing our last pong, or false if
+// the ping carries no usable echo
+func rttSample(ping PingMessage, now time.Time) (time.Duration, bool) {
+	if ping.EchoServerTime <= 0 || ping.EchoDelay < 0 {
+		return 0, false
+	}
+
+	elapsed := serverTimeMillis(now) - ping.EchoServerTime - ping.EchoDelay
+	if elapsed < 0 || elapsed > ClientTimeout.Milliseconds() {
+		return 0, false
+	}
+	return time.Duration(elapsed) * time.Millisecond, true
+}
+
+// newPongMessage answers a ping with the timing data clients need to estimate RTT and
+// the current server tick. Must be called with s.mu held.
+func (s *GameServer) newPongMessage(ping PingMessage, client *Client, now time.Time) PongMessage {
+	return PongMessage{
+		ClientTime:   ping.ClientTime,
+		ServerTime:   serverTimeMillis(now),
+		ServerTick:   s.tick,
+		TickInterval: int64(1000 / TickRate),
+		Rtt:          durationMillis(client.Rtt),
+		Jitter:       durationMillis(client.RttJitter),
+	}
+}
+
+// clampInputTick keeps a command frame's tick within MaxInputTickSkew of the server tick.
+// Must be called with s.mu held.
+func (s *GameServer) clampInputTick(tick uint64) uint64 {
+	var earliest uint64
+	if s.tick > MaxInputTickSkew {
+		earliest = s.tick - MaxInputTickSkew
+	}
+	latest := s.tick + MaxInputTickSkew
+
+	if tick < earliest {
+		return earliest
+	}
+	if tick > latest {
+		return latest
+	}
+	return tick
+}
+
+// durationTicks converts a duration to ticks at the current tick rate, rounding up so
+// nothing happens sooner than it should (and never in zero ticks)
+func durationTicks(d time.Duration) uint64 {
+	ticks := (d*time.Duration(TickRate) + time.Second - 1) / time.Second
+	return max(uint64(ticks), 1)
+}
+
+// durationMillis converts a duration to whole milliseconds for the wire
+func durationMillis(d time.Duration) uint32 {
+	return uint32(d.Milliseconds())
+}
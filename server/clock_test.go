@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestUpdateRttSmoothsSamples verifies the first sample seeds RTT and later ones are smoothed
+func TestUpdateRttSmoothsSamples(t *testing.T) {
+	client := &Client{}
+
+	client.updateRtt(100 * time.Millisecond)
+	if client.Rtt != 100*time.Millisecond || client.RttJitter != 50*time.Millisecond {
+		t.Fatalf("Expected seed RTT 100ms jitter 50ms, got %v %v", client.Rtt, client.RttJitter)
+	}
+
+	client.updateRtt(180 * time.Millisecond)
+	if client.Rtt != 110*time.Millisecond {
+		t.Errorf("Expected smoothed RTT 110ms, got %v", client.Rtt)
+	}
+	if client.RttJitter != 57500*time.Microsecond {
+		t.Errorf("Expected smoothed jitter 57.5ms, got %v", client.RttJitter)
+	}
+}
+
+// TestRttSampleRejectsBadEchoes verifies pings without a plausible echo are ignored
+func TestRttSampleRejectsBadEchoes(t *testing.T) {
+	now := time.Now()
+	serverTime := serverTimeMillis(now)
+
+	tests := []struct {
+		name string
+		ping PingMessage
+		ok   bool
+		rtt  time.Duration
+	}{
+		{"no echo", PingMessage{}, false, 0},
+		{"valid", PingMessage{EchoServerTime: serverTime - 1080, EchoDelay: 1000}, true, 80 * time.Millisecond},
+		{"negative delay", PingMessage{EchoServerTime: serverTime - 80, EchoDelay: -5}, false, 0},
+		{"delay exceeds elapsed", PingMessage{EchoServerTime: serverTime - 80, EchoDelay: 500}, false, 0},
+		{"stale echo", PingMessage{EchoServerTime: serverTime - 60000}, false, 0},
+	}
+
+	for _, tt := range tests {
+		rtt, ok := rttSample(tt.ping, now)
+		if ok != tt.ok || rtt != tt.rtt {
+			t.Errorf("%s: expected (%v, %v), got (%v, %v)", tt.name, tt.rtt, tt.ok, rtt, ok)
+		}
+	}
+}
+
+// TestPingUpdatesClientRtt verifies echoed pongs feed the client's RTT estimate
+func TestPingUpdatesClientRtt(t *testing.T) {
+	server := newSessionTestServer()
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	client := &Client{Id: 1, Name: "Pinger", SessionToken: "secret", Addr: addr}
+	server.clients[1] = client
+
+	server.handlePing(PingMessage{
+		ClientId:       1,
+		SessionToken:   "secret",
+		EchoServerTime: serverTimeMillis(time.Now()) - 1060,
+		EchoDelay:      1000,
+	}, addr)
+
+	if client.Rtt < 60*time.Millisecond || client.Rtt > 100*time.Millisecond {
+		t.Errorf("Expected RTT near 60ms, got %v", client.Rtt)
+	}
+}
+
+// TestPongCarriesClockData verifies pongs echo client time and report server tick and RTT
+func TestPongCarriesClockData(t *testing.T) {
+	server := NewGameServer()
+	server.tick = 500
+	client := &Client{Rtt: 42 * time.Millisecond, RttJitter: 7 * time.Millisecond}
+	now := time.Now()
+
+	pong := server.newPongMessage(PingMessage{ClientTime: 123456}, client, now)
+
+	if pong.ClientTime != 123456 || pong.ServerTick != 500 || pong.ServerTime != serverTimeMillis(now) {
+		t.Errorf("Unexpected pong timing %+v", pong)
+	}
+	if pong.TickInterval != int64(1000/TickRate) || pong.Rtt != 42 || pong.Jitter != 7 {
+		t.Errorf("Unexpected pong estimates %+v", pong)
+	}
+}
+
+// TestClampInputTick verifies frame ticks are kept near the server tick
+func TestClampInputTick(t *testing.T) {
+	server := NewGameServer()
+
+	server.tick = 10
+	if got := server.clampInputTick(0); got != 0 {
+		t.Errorf("Expected tick 0 allowed early in the match, got %d", got)
+	}
+
+	server.tick = 1000
+	if got := server.clampInputTick(0); got != 1000-MaxInputTickSkew {
+		t.Errorf("Expected stale tick clamped to %d, got %d", 1000-MaxInputTickSkew, got)
+	}
+	if got := server.clampInputTick(5000); got != 1000+MaxInputTickSkew {
+		t.Errorf("Expected future tick clamped to %d, got %d", 1000+MaxInputTickSkew, got)
+	}
+	if got := server.clampInputTick(1003); got != 1003 {
+		t.Errorf("Expected tick 1003 unchanged, got %d", got)
+	}
+}
+
+// TestBinaryPingPongRoundTrip verifies clock fields survive the binary codec
+func TestBinaryPingPongRoundTrip(t *testing.T) {
+	ping := PingMessage{ClientId: 3, SessionToken: "secret", ClientTime: 987654321, EchoServerTime: 1700000000000, EchoDelay: 950}
+	data, err := binaryCodec{}.Encode(MsgPing, ping)
+	if err != nil {
+		t.Fatalf("Encode ping failed: %v", err)
+	}
+	msg, err := decodeDatagram(data)
+	if err != nil {
+		t.Fatalf("Decode ping failed: %v", err)
+	}
+	var decodedPing PingMessage
+	if err := json.Unmarshal(msg.Data, &decodedPing); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if decodedPing != ping {
+		t.Errorf("Expected %+v, got %+v", ping, decodedPing)
+	}
+
+	pong := PongMessage{ClientTime: 987654321, ServerTime: 1700000001000, ServerTick: 4242, TickInterval: 50, Rtt: 64, Jitter: 9}
+	data, err = binaryCodec{}.Encode(MsgPong, pong)
+	if err != nil {
+		t.Fatalf("Encode pong failed: %v", err)
+	}
+	msg, err = decodeDatagram(data)
+	if err != nil {
+		t.Fatalf("Decode pong failed: %v", err)
+	}
+	var decodedPong PongMessage
+	if err := json.Unmarshal(msg.Data, &decodedPong); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if decodedPong != pong {
+		t.Errorf("Expected %+v, got %+v", pong, decodedPong)
+	}
+}
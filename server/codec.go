@@ -0,0 +1,673 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Codec turns messages into datagrams and back. Every client speaks JSON until its hello
+// negotiates something else; incoming datagrams are decoded by whichever codec their
+// first byte identifies, so JSON debugging tools keep working against any server.
+type Codec interface {
+	Name() string
+	Encode(msgType MessageType, payload interface{}) ([]byte, error)
+	Decode(data []byte) (Message, error)
+}
+
+// BinaryCodecVersion is the first byte of every binary-encoded datagram. JSON datagrams
+// always start with '{' (or whitespace), so the two can't be confused.
+const BinaryCodecVersion byte = 0xB1
+
+// decodeDatagram decodes data with the codec its first byte identifies
+func decodeDatagram(data []byte) (Message, error) {
+	if len(data) > 0 && data[0] == BinaryCodecVersion {
+		return binaryCodec{}.Decode(data)
+	}
+	return jsonCodec{}.Decode(data)
+}
+
+// codecFor returns the codec a client negotiated, defaulting to JSON
+func codecFor(client *Client) Codec {
+	if client.Codec == nil {
+		return jsonCodec{}
+	}
+	return client.Codec
+}
+
+// jsonCodec is the original human-readable encoding: {"type": ..., "data": {...}}
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Encode(msgType MessageType, payload interface{}) ([]byte, error) {
+	data, ok := payload.(json.RawMessage)
+	if !ok {
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(Message{Type: msgType, Data: data})
+}
+
+func (jsonCodec) Decode(data []byte) (Message, error) {
+	var msg Message
+	err := json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+// Binary message type ids. Types without a dedicated layout use binaryTypeGeneric,
+// which carries the type name and a JSON body.
+const (
+	binaryTypeGeneric  byte = 0
+	binaryTypeInput    byte = 1
+	binaryTypeSnapshot byte = 2
+	binaryTypePing     byte = 3
+	binaryTypeAck      byte = 4
+	binaryTypeFragment byte = 5
+	binaryTypeGoodbye  byte = 6
+	binaryTypePong     byte = 7
+)
+
+// Entity field flags (optional fields are only present when their bit is set). They are
+// written as a uvarint, so entities using only the first seven fit in one byte.
+const (
+	entityHasTarget    uint64 = 1 << 0 // Target tile differs from current tile
+	entityHasProgress  uint64 = 1 << 1 // MoveProgress is non-zero
+	entityDamaged      uint64 = 1 << 2 // Health differs from MaxHealth
+	entityHasFootprint uint64 = 1 << 3 // Building footprint present
+	entityRemembered   uint64 = 1 << 4 // Last-known state of an enemy building out of sight
+	entityTraining     uint64 = 1 << 5 // Training queue present
+	entityHasRally     uint64 = 1 << 6 // Rally point set
+	entityConstructing uint64 = 1 << 7 // Site still under construction
+	entityHasResources uint64 = 1 << 8 // Resources left in a node, or carried by a worker
+)
+
+// Player field flags
+const (
+	playerDisconnected byte = 1 << 0
+	playerMoneyHidden  byte = 1 << 1 // Money omitted from the encoding
+)
+
+// binaryCodec is a compact encoding: varints for ids and counts, zigzag varints for tile
+// coordinates, move progress quantized to one byte and flag bits for optional fields.
+//
+// Layout: [BinaryCodecVersion][type id][payload]
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string { return "binary" }
+
+func (binaryCodec) Encode(msgType MessageType, payload interface{}) ([]byte, error) {
+	buf := []byte{BinaryCodecVersion}
+
+	switch p := payload.(type) {
+	case SnapshotMessage:
+		if msgType == MsgSnapshot {
+			buf = append(buf, binaryTypeSnapshot)
+			return appendSnapshot(buf, &p), nil
+		}
+	case InputMessage:
+		if msgType == MsgInput {
+			buf = append(buf, binaryTypeInput)
+			return appendInput(buf, &p), nil
+		}
+	case PingMessage:
+		if msgType == MsgPing {
+			buf = append(buf, binaryTypePing)
+			buf = appendSession(buf, p.ClientId, p.SessionToken)
+			buf = binary.AppendVarint(buf, p.ClientTime)
+			buf = binary.AppendVarint(buf, p.EchoServerTime)
+			return binary.AppendVarint(buf, p.EchoDelay), nil
+		}
+	case PongMessage:
+		if msgType == MsgPong {
+			buf = append(buf, binaryTypePong)
+			buf = binary.AppendVarint(buf, p.ClientTime)
+			buf = binary.AppendVarint(buf, p.ServerTime)
+			buf = binary.AppendUvarint(buf, p.ServerTick)
+			buf = binary.AppendUvarint(buf, uint64(p.TickInterval))
+			buf = binary.AppendUvarint(buf, uint64(p.Rtt))
+			return binary.AppendUvarint(buf, uint64(p.Jitter)), nil
+		}
+	case GoodbyeMessage:
+		if msgType == MsgGoodbye {
+			buf = append(buf, binaryTypeGoodbye)
+			return appendSession(buf, p.ClientId, p.SessionToken), nil
+		}
+	case AckMessage:
+		if msgType == MsgAck {
+			buf = append(buf, binaryTypeAck)
+			buf = appendSession(buf, p.ClientId, p.SessionToken)
+			buf = binary.AppendUvarint(buf, p.Tick)
+			return binary.AppendUvarint(buf, uint64(p.EventSeq)), nil
+		}
+	case FragmentMessage:
+		if msgType == MsgFragment {
+			buf = append(buf, binaryTypeFragment)
+			buf = binary.AppendUvarint(buf, uint64(p.Id))
+			buf = binary.AppendUvarint(buf, uint64(p.Index))
+			buf = binary.AppendUvarint(buf, uint64(p.Count))
+			return appendBytes(buf, p.Payload), nil
+		}
+	}
+
+	// Everything else: type name plus JSON body
+	body, ok := payload.(json.RawMessage)
+	if !ok {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	buf = append(buf, binaryTypeGeneric)
+	buf = appendString(buf, string(msgType))
+	return append(buf, body...), nil
+}
+
+// Decode returns the message with its body re-encoded as JSON, so handlers don't need
+// to know which codec a datagram arrived in
+func (binaryCodec) Decode(data []byte) (Message, error) {
+	if len(data) < 2 || data[0] != BinaryCodecVersion {
+		return Message{}, fmt.Errorf("not a binary v%x datagram", BinaryCodecVersion)
+	}
+
+	r := &binaryReader{data: data[2:]}
+	var msgType MessageType
+	var payload interface{}
+
+	switch data[1] {
+	case binaryTypeGeneric:
+		msgType = MessageType(r.string())
+		if r.err != nil {
+			return Message{}, r.err
+		}
+		return Message{Type: msgType, Data: json.RawMessage(r.data)}, nil
+	case binaryTypeSnapshot:
+		msgType, payload = MsgSnapshot, readSnapshot(r)
+	case binaryTypeInput:
+		msgType, payload = MsgInput, readInput(r)
+	case binaryTypePing:
+		ping := PingMessage{}
+		ping.ClientId, ping.SessionToken = readSession(r)
+		ping.ClientTime = r.varint()
+		ping.EchoServerTime = r.varint()
+		ping.EchoDelay = r.varint()
+		msgType, payload = MsgPing, ping
+	case binaryTypePong:
+		msgType, payload = MsgPong, PongMessage{
+			ClientTime:   r.varint(),
+			ServerTime:   r.varint(),
+			ServerTick:   r.uvarint(),
+			TickInterval: int64(r.uvarint()),
+			Rtt:          uint32(r.uvarint()),
+			Jitter:       uint32(r.uvarint()),
+		}
+	case binaryTypeGoodbye:
+		goodbye := GoodbyeMessage{}
+		goodbye.ClientId, goodbye.SessionToken = readSession(r)
+		msgType, payload = MsgGoodbye, goodbye
+	case binaryTypeAck:
+		ack := AckMessage{}
+		ack.ClientId, ack.SessionToken = readSession(r)
+		ack.Tick = r.uvarint()
+		if len(r.data) > 0 { // 1.1 clients don't send an event sequence
+			ack.EventSeq = uint32(r.uvarint())
+		}
+		msgType, payload = MsgAck, ack
+	case binaryTypeFragment:
+		fragment := FragmentMessage{
+			Id:    uint32(r.uvarint()),
+			Index: int(r.uvarint()),
+			Count: int(r.uvarint()),
+		}
+		fragment.Payload = r.bytes()
+		msgType, payload = MsgFragment, fragment
+	default:
+		return Message{}, fmt.Errorf("unknown binary message type %d", data[1])
+	}
+
+	if r.err != nil {
+		return Message{}, fmt.Errorf("decoding binary %s: %w", msgType, r.err)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: msgType, Data: body}, nil
+}
+
+func appendSnapshot(buf []byte, snapshot *SnapshotMessage) []byte {
+	buf = binary.AppendUvarint(buf, snapshot.Tick)
+	buf = binary.AppendUvarint(buf, snapshot.BaselineTick)
+	buf = binary.AppendUvarint(buf, uint64(snapshot.LastProcessedSeq))
+	buf = binary.AppendUvarint(buf, snapshot.LastProcessedTick)
+
+	buf = binary.AppendUvarint(buf, uint64(len(snapshot.Entities)))
+	for i := range snapshot.Entities {
+		buf = appendEntity(buf, &snapshot.Entities[i])
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(snapshot.RemovedEntities)))
+	for _, id := range snapshot.RemovedEntities {
+		buf = binary.AppendUvarint(buf, uint64(id))
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(snapshot.Players)))
+	for id, player := range snapshot.Players {
+		buf = appendString(buf, id)
+		buf = appendPlayer(buf, &player)
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(snapshot.RemovedPlayers)))
+	for _, id := range snapshot.RemovedPlayers {
+		buf = appendString(buf, id)
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(snapshot.Events)))
+	for i := range snapshot.Events {
+		buf = appendEvent(buf, &snapshot.Events[i])
+	}
+
+	return buf
+}
+
+func readSnapshot(r *binaryReader) SnapshotMessage {
+	snapshot := SnapshotMessage{
+		Tick:              r.uvarint(),
+		BaselineTick:      r.uvarint(),
+		LastProcessedSeq:  uint32(r.uvarint()),
+		LastProcessedTick: r.uvarint(),
+	}
+
+	count := r.count()
+	snapshot.Entities = make([]Entity, 0, count)
+	for i := 0; i < count && r.err == nil; i++ {
+		snapshot.Entities = append(snapshot.Entities, readEntity(r))
+	}
+
+	if count = r.count(); count > 0 {
+		snapshot.RemovedEntities = make([]uint32, 0, count)
+		for i := 0; i < count && r.err == nil; i++ {
+			snapshot.RemovedEntities = append(snapshot.RemovedEntities, uint32(r.uvarint()))
+		}
+	}
+
+	count = r.count()
+	snapshot.Players = make(map[string]Player, count)
+	for i := 0; i < count && r.err == nil; i++ {
+		id := r.string()
+		snapshot.Players[id] = readPlayer(r)
+	}
+
+	if count = r.count(); count > 0 {
+		snapshot.RemovedPlayers = make([]string, 0, count)
+		for i := 0; i < count && r.err == nil; i++ {
+			snapshot.RemovedPlayers = append(snapshot.RemovedPlayers, r.string())
+		}
+	}
+
+	if count = r.count(); count > 0 {
+		snapshot.Events = make([]GameEvent, 0, count)
+		for i := 0; i < count && r.err == nil; i++ {
+			snapshot.Events = append(snapshot.Events, readEvent(r))
+		}
+	}
+
+	return snapshot
+}
+
+func appendEvent(buf []byte, event *GameEvent) []byte {
+	buf = binary.AppendUvarint(buf, uint64(event.Seq))
+	buf = binary.AppendUvarint(buf, event.Tick)
+	buf = appendString(buf, event.Type)
+	buf = binary.AppendUvarint(buf, uint64(event.EntityId))
+	buf = appendString(buf, event.EntityType)
+	buf = binary.AppendUvarint(buf, uint64(event.PlayerId))
+	buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(event.Amount))
+	buf = binary.AppendVarint(buf, int64(event.X))
+	buf = binary.AppendVarint(buf, int64(event.Y))
+	return appendString(buf, event.Name)
+}
+
+func readEvent(r *binaryReader) GameEvent {
+	return GameEvent{
+		Seq:        uint32(r.uvarint()),
+		Tick:       r.uvarint(),
+		Type:       r.string(),
+		EntityId:   uint32(r.uvarint()),
+		EntityType: r.string(),
+		PlayerId:   uint32(r.uvarint()),
+		Amount:     math.Float32frombits(r.uint32()),
+		X:          int(r.varint()),
+		Y:          int(r.varint()),
+		Name:       r.string(),
+	}
+}
+
+func appendEntity(buf []byte, entity *Entity) []byte {
+	var flags uint64
+	if entity.TargetTileX != entity.TileX || entity.TargetTileY != entity.TileY {
+		flags |= entityHasTarget
+	}
+	if entity.MoveProgress != 0 {
+		flags |= entityHasProgress
+	}
+	if entity.Health != entity.MaxHealth {
+		flags |= entityDamaged
+	}
+	if entity.FootprintWidth != 0 || entity.FootprintHeight != 0 {
+		flags |= entityHasFootprint
+	}
+	if entity.Remembered {
+		flags |= entityRemembered
+	}
+	if len(entity.TrainingQueue) > 0 {
+		flags |= entityTraining
+	}
+	if entity.HasRally {
+		flags |= entityHasRally
+	}
+	if entity.UnderConstruction {
+		flags |= entityConstructing
+	}
+	if entity.ResourceType != "" || entity.Resources != 0 {
+		flags |= entityHasResources
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(entity.Id))
+	buf = binary.AppendUvarint(buf, uint64(entity.OwnerId))
+	buf = appendString(buf, entity.Type)
+	buf = binary.AppendUvarint(buf, flags)
+	buf = binary.AppendVarint(buf, int64(entity.TileX))
+	buf = binary.AppendVarint(buf, int64(entity.TileY))
+	buf = binary.AppendVarint(buf, int64(entity.MaxHealth))
+
+	if flags&entityHasTarget != 0 {
+		// Targets are adjacent waypoints, so deltas from the current tile stay tiny
+		buf = binary.AppendVarint(buf, int64(entity.TargetTileX-entity.TileX))
+		buf = binary.AppendVarint(buf, int64(entity.TargetTileY-entity.TileY))
+	}
+	if flags&entityHasProgress != 0 {
+		buf = append(buf, quantizeProgress(entity.MoveProgress))
+	}
+	if flags&entityDamaged != 0 {
+		buf = binary.AppendVarint(buf, int64(entity.Health))
+	}
+	if flags&entityHasFootprint != 0 {
+		buf = binary.AppendUvarint(buf, uint64(entity.FootprintWidth))
+		buf = binary.AppendUvarint(buf, uint64(entity.FootprintHeight))
+	}
+	if flags&entityTraining != 0 {
+		buf = binary.AppendUvarint(buf, uint64(len(entity.TrainingQueue)))
+		for _, unitType := range entity.TrainingQueue {
+			buf = appendString(buf, unitType)
+		}
+		buf = append(buf, quantizeProgress(entity.TrainProgress))
+	}
+	if flags&entityHasRally != 0 {
+		buf = binary.AppendVarint(buf, int64(entity.RallyTileX))
+		buf = binary.AppendVarint(buf, int64(entity.RallyTileY))
+	}
+	if flags&entityConstructing != 0 {
+		buf = append(buf, quantizeProgress(entity.BuildProgress))
+	}
+	if flags&entityHasResources != 0 {
+		buf = appendString(buf, entity.ResourceType)
+		buf = binary.AppendUvarint(buf, uint64(entity.Resources))
+	}
+
+	return buf
+}
+
+func readEntity(r *binaryReader) Entity {
+	entity := Entity{
+		Id:      uint32(r.uvarint()),
+		OwnerId: uint32(r.uvarint()),
+		Type:    r.string(),
+	}
+	flags := r.uvarint()
+	entity.TileX = int(r.varint())
+	entity.TileY = int(r.varint())
+	entity.MaxHealth = int32(r.varint())
+
+	entity.TargetTileX = entity.TileX
+	entity.TargetTileY = entity.TileY
+	if flags&entityHasTarget != 0 {
+		entity.TargetTileX += int(r.varint())
+		entity.TargetTileY += int(r.varint())
+	}
+	if flags&entityHasProgress != 0 {
+		entity.MoveProgress = float32(r.byte()) / 255
+	}
+	entity.Health = entity.MaxHealth
+	if flags&entityDamaged != 0 {
+		entity.Health = int32(r.varint())
+	}
+	if flags&entityHasFootprint != 0 {
+		entity.FootprintWidth = int(r.uvarint())
+		entity.FootprintHeight = int(r.uvarint())
+	}
+	entity.Remembered = flags&entityRemembered != 0
+	if flags&entityTraining != 0 {
+		entity.TrainingQueue = make([]string, r.count())
+		for i := range entity.TrainingQueue {
+			entity.TrainingQueue[i] = r.string()
+		}
+		entity.TrainProgress = float32(r.byte()) / 255
+	}
+	if flags&entityHasRally != 0 {
+		entity.HasRally = true
+		entity.RallyTileX = int(r.varint())
+		entity.RallyTileY = int(r.varint())
+	}
+	if flags&entityConstructing != 0 {
+		entity.UnderConstruction = true
+		entity.BuildProgress = float32(r.byte()) / 255
+	}
+	if flags&entityHasResources != 0 {
+		entity.ResourceType = r.string()
+		entity.Resources = int32(r.uvarint())
+	}
+
+	return entity
+}
+
+func appendPlayer(buf []byte, player *Player) []byte {
+	var flags byte
+	if player.Disconnected {
+		flags |= playerDisconnected
+	}
+	if player.MoneyHidden {
+		flags |= playerMoneyHidden
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(player.Id))
+	buf = appendString(buf, player.Name)
+	buf = append(buf, flags)
+	if !player.MoneyHidden {
+		buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(player.Money))
+	}
+	buf = binary.AppendUvarint(buf, uint64(player.Rtt))
+	return binary.AppendUvarint(buf, uint64(player.Jitter))
+}
+
+func readPlayer(r *binaryReader) Player {
+	player := Player{
+		Id:   uint32(r.uvarint()),
+		Name: r.string(),
+	}
+	flags := r.byte()
+	player.Disconnected = flags&playerDisconnected != 0
+	player.MoneyHidden = flags&playerMoneyHidden != 0
+	if !player.MoneyHidden {
+		player.Money = math.Float32frombits(r.uint32())
+	}
+	player.Rtt = uint32(r.uvarint())
+	player.Jitter = uint32(r.uvarint())
+	return player
+}
+
+func appendInput(buf []byte, input *InputMessage) []byte {
+	buf = appendSession(buf, input.ClientId, input.SessionToken)
+	buf = binary.AppendUvarint(buf, uint64(len(input.Commands)))
+	for _, frame := range input.Commands {
+		buf = binary.AppendUvarint(buf, uint64(frame.Sequence))
+		buf = binary.AppendUvarint(buf, frame.Tick)
+		buf = binary.AppendUvarint(buf, uint64(len(frame.Commands)))
+		for _, cmd := range frame.Commands {
+			// Command bodies vary by type and are tiny; keep them as JSON
+			data, _ := json.Marshal(cmd.Data)
+			buf = appendString(buf, cmd.Type)
+			buf = appendBytes(buf, data)
+		}
+	}
+	return buf
+}
+
+func readInput(r *binaryReader) InputMessage {
+	input := InputMessage{}
+	input.ClientId, input.SessionToken = readSession(r)
+
+	frameCount := r.count()
+	input.Commands = make([]CommandFrame, 0, frameCount)
+	for i := 0; i < frameCount && r.err == nil; i++ {
+		frame := CommandFrame{
+			Sequence: uint32(r.uvarint()),
+			Tick:     r.uvarint(),
+		}
+		cmdCount := r.count()
+		frame.Commands = make([]Command, 0, cmdCount)
+		for j := 0; j < cmdCount && r.err == nil; j++ {
+			cmd := Command{Type: r.string()}
+			cmd.Data = json.RawMessage(r.bytes())
+			frame.Commands = append(frame.Commands, cmd)
+		}
+		input.Commands = append(input.Commands, frame)
+	}
+	return input
+}
+
+func appendSession(buf []byte, clientId uint32, token string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(clientId))
+	return appendString(buf, token)
+}
+
+func readSession(r *binaryReader) (uint32, string) {
+	return uint32(r.uvarint()), r.string()
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// quantizeProgress maps 0.0-1.0 onto 0-255
+func quantizeProgress(progress float32) byte {
+	if progress <= 0 {
+		return 0
+	}
+	if progress >= 1 {
+		return 255
+	}
+	return byte(math.Round(float64(progress) * 255))
+}
+
+var errShortBuffer = errors.New("unexpected end of binary message")
+
+// binaryReader reads values in order, remembering the first error so callers can check once
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	r.data = nil
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.fail(errShortBuffer)
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.fail(errShortBuffer)
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// count reads a length prefix, rejecting values that can't fit in the remaining data
+func (r *binaryReader) count() int {
+	n := r.uvarint()
+	if n > uint64(len(r.data)) {
+		r.fail(errShortBuffer)
+		return 0
+	}
+	return int(n)
+}
+
+func (r *binaryReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) < 1 {
+		r.fail(errShortBuffer)
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *binaryReader) uint32() uint32 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) < 4 {
+		r.fail(errShortBuffer)
+		return 0
+	}
+	v := binary.LittleEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v
+}
+
+func (r *binaryReader) bytes() []byte {
+	n := r.count()
+	if r.err != nil {
+		return nil
+	}
+	b := append([]byte(nil), r.data[:n]...)
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *binaryReader) string() string {
+	return string(r.bytes())
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func sampleSnapshot() SnapshotMessage {
+	snapshot := SnapshotMessage{
+		Tick:              1234,
+		BaselineTick:      1200,
+		LastProcessedSeq:  41,
+		LastProcessedTick: 1230,
+		RemovedEntities:   []uint32{7, 8},
+		Players: map[string]Player{
+			"1": {Id: 1, Name: "Alice", Money: 123.5, Rtt: 48, Jitter: 6},
+			"2": {Id: 2, Name: "Bob", Money: 0, Disconnected: true},
+		},
+		RemovedPlayers: []string{"3"},
+		Events: []GameEvent{
+			{Seq: 5, Tick: 1233, Type: EventDamageDealt, EntityId: 99, EntityType: "generator", PlayerId: 2, Amount: 25, X: 3, Y: 4},
+			{Seq: 6, Tick: 1234, Type: EventPlayerJoined, PlayerId: 4, X: 0, Y: 0, Name: "Dana"},
+		},
+	}
+	for i := uint32(1); i <= 30; i++ {
+		snapshot.Entities = append(snapshot.Entities, Entity{
+			Id:           i + 10,
+			OwnerId:      i%2 + 1,
+			Type:         "worker",
+			TileX:        int(i),
+			TileY:        int(i * 2 % 18),
+			TargetTileX:  int(i) + 1,
+			TargetTileY:  int(i * 2 % 18),
+			MoveProgress: 0.4,
+			Health:       100,
+			MaxHealth:    100,
+		})
+	}
+	snapshot.Entities = append(snapshot.Entities, Entity{
+		Id: 99, OwnerId: 1, Type: "generator", TileX: 3, TileY: 4, TargetTileX: 3, TargetTileY: 4,
+		Health: 75, MaxHealth: 100, FootprintWidth: 2, FootprintHeight: 2,
+	})
+	snapshot.Entities = append(snapshot.Entities, Entity{
+		Id: 100, OwnerId: 1, Type: "office", TileX: 8, TileY: 4, TargetTileX: 8, TargetTileY: 4,
+		Health: 200, MaxHealth: 200, FootprintWidth: 3, FootprintHeight: 2,
+		TrainingQueue: []string{"worker", "worker"}, TrainProgress: 0.3, HasRally: true, RallyTileX: 12, RallyTileY: 9,
+	})
+	snapshot.Entities = append(snapshot.Entities, Entity{
+		Id: 101, OwnerId: 2, Type: "generator", TileX: 20, TileY: 10, TargetTileX: 20, TargetTileY: 10,
+		Health: 100, MaxHealth: 100, FootprintWidth: 2, FootprintHeight: 2, UnderConstruction: true, BuildProgress: 0.65,
+	})
+	snapshot.Entities = append(snapshot.Entities, Entity{
+		Id: 102, Type: ResourceNodeType, TileX: 15, TileY: 6, TargetTileX: 15, TargetTileY: 6,
+		FootprintWidth: 2, FootprintHeight: 2, ResourceType: "gold", Resources: 1350,
+	})
+	return snapshot
+}
+
+// TestBinarySnapshotRoundTrip verifies snapshots survive the binary codec
+func TestBinarySnapshotRoundTrip(t *testing.T) {
+	original := sampleSnapshot()
+
+	data, err := binaryCodec{}.Encode(MsgSnapshot, original)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	msg, err := decodeDatagram(data)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if msg.Type != MsgSnapshot {
+		t.Fatalf("Expected snapshot, got %q", msg.Type)
+	}
+
+	var decoded SnapshotMessage
+	if err := json.Unmarshal(msg.Data, &decoded); err != nil {
+		t.Fatalf("Decoded body is not a snapshot: %v", err)
+	}
+
+	if decoded.Tick != original.Tick || decoded.BaselineTick != original.BaselineTick {
+		t.Errorf("Ticks differ: got %d/%d", decoded.Tick, decoded.BaselineTick)
+	}
+	if decoded.LastProcessedSeq != 41 || decoded.LastProcessedTick != 1230 {
+		t.Errorf("Input ack differs: got seq %d tick %d", decoded.LastProcessedSeq, decoded.LastProcessedTick)
+	}
+	if len(decoded.Entities) != len(original.Entities) {
+		t.Fatalf("Expected %d entities, got %d", len(original.Entities), len(decoded.Entities))
+	}
+	for i, want := range original.Entities {
+		got := decoded.Entities[i]
+		// Progress is quantized to 1/255
+		if math.Abs(float64(got.MoveProgress-want.MoveProgress)) > 1.0/255 {
+			t.Errorf("Entity %d progress %f, want %f", want.Id, got.MoveProgress, want.MoveProgress)
+		}
+		if math.Abs(float64(got.TrainProgress-want.TrainProgress)) > 1.0/255 {
+			t.Errorf("Entity %d training progress %f, want %f", want.Id, got.TrainProgress, want.TrainProgress)
+		}
+		if math.Abs(float64(got.BuildProgress-want.BuildProgress)) > 1.0/255 {
+			t.Errorf("Entity %d build progress %f, want %f", want.Id, got.BuildProgress, want.BuildProgress)
+		}
+		got.MoveProgress = want.MoveProgress
+		got.TrainProgress = want.TrainProgress
+		got.BuildProgress = want.BuildProgress
+		if !sameEntityState(got, want) {
+			t.Errorf("Entity mismatch:\n got  %+v\n want %+v", got, want)
+		}
+	}
+	if len(decoded.RemovedEntities) != 2 || decoded.RemovedEntities[1] != 8 {
+		t.Errorf("Removed entities mismatch: %v", decoded.RemovedEntities)
+	}
+	if decoded.Players["1"] != original.Players["1"] || decoded.Players["2"] != original.Players["2"] {
+		t.Errorf("Players mismatch: %v", decoded.Players)
+	}
+	if len(decoded.RemovedPlayers) != 1 || decoded.RemovedPlayers[0] != "3" {
+		t.Errorf("Removed players mismatch: %v", decoded.RemovedPlayers)
+	}
+	if len(decoded.Events) != 2 || decoded.Events[0] != original.Events[0] || decoded.Events[1] != original.Events[1] {
+		t.Errorf("Events mismatch: %+v", decoded.Events)
+	}
+}
+
+// TestBinarySnapshotIsCompact verifies the binary codec is much smaller than JSON
+func TestBinarySnapshotIsCompact(t *testing.T) {
+	snapshot := sampleSnapshot()
+
+	jsonData, _ := jsonCodec{}.Encode(MsgSnapshot, snapshot)
+	binaryData, _ := binaryCodec{}.Encode(MsgSnapshot, snapshot)
+
+	t.Logf("Snapshot size: JSON %d bytes, binary %d bytes", len(jsonData), len(binaryData))
+	if len(binaryData)*5 > len(jsonData) {
+		t.Errorf("Expected binary to be at least 5x smaller than JSON (%d vs %d bytes)", len(binaryData), len(jsonData))
+	}
+}
+
+// TestBinaryInputRoundTrip verifies client inputs decode into the same JSON handlers use
+func TestBinaryInputRoundTrip(t *testing.T) {
+	input := InputMessage{
+		ClientId:     3,
+		SessionToken: "abc123",
+		Commands: []CommandFrame{{
+			Sequence: 9,
+			Tick:     500,
+			Commands: []Command{{Type: "move", Data: map[string]interface{}{
+				"unitIds": []interface{}{float64(4), float64(5)}, "targetTileX": float64(10), "targetTileY": float64(2),
+			}}},
+		}},
+	}
+
+	data, err := binaryCodec{}.Encode(MsgInput, input)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	msg, err := decodeDatagram(data)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	var decoded InputMessage
+	if err := json.Unmarshal(msg.Data, &decoded); err != nil {
+		t.Fatalf("Decoded body is not an input: %v", err)
+	}
+	if decoded.ClientId != 3 || decoded.SessionToken != "abc123" || len(decoded.Commands) != 1 {
+		t.Fatalf("Input header mismatch: %+v", decoded)
+	}
+	frame := decoded.Commands[0]
+	if frame.Sequence != 9 || frame.Tick != 500 || len(frame.Commands) != 1 || frame.Commands[0].Type != "move" {
+		t.Fatalf("Frame mismatch: %+v", frame)
+	}
+	moveData, ok := frame.Commands[0].Data.(map[string]interface{})
+	if !ok || moveData["targetTileX"] != float64(10) {
+		t.Errorf("Command data mismatch: %v", frame.Commands[0].Data)
+	}
+}
+
+// TestBinaryGenericFallback verifies message types without a binary layout still round-trip
+func TestBinaryGenericFallback(t *testing.T) {
+	reject := RejectMessage{Reason: RejectServerFull, Message: "full"}
+
+	data, err := binaryCodec{}.Encode(MsgReject, reject)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	msg, err := decodeDatagram(data)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	var decoded RejectMessage
+	json.Unmarshal(msg.Data, &decoded)
+	if msg.Type != MsgReject || decoded != reject {
+		t.Errorf("Expected %+v, got %q %+v", reject, msg.Type, decoded)
+	}
+}
+
+// TestBinaryDecodeTruncated verifies truncated datagrams error instead of panicking
+func TestBinaryDecodeTruncated(t *testing.T) {
+	data, _ := binaryCodec{}.Encode(MsgSnapshot, sampleSnapshot())
+
+	for _, n := range []int{2, 5, len(data) / 2, len(data) - 1} {
+		if _, err := decodeDatagram(data[:n]); err == nil {
+			t.Errorf("Expected error decoding %d of %d bytes", n, len(data))
+		}
+	}
+}
+
+// TestBinaryFragmentsRawPayload verifies binary fragments reassemble without base64
+func TestBinaryFragmentsRawPayload(t *testing.T) {
+	server := NewGameServer()
+	server.maxDatagramSize = 200
+
+	data, _ := binaryCodec{}.Encode(MsgSnapshot, sampleSnapshot())
+	datagrams, err := server.fragmentMessage(binaryCodec{}, data)
+	if err != nil {
+		t.Fatalf("Fragmenting failed: %v", err)
+	}
+	if len(datagrams) < 2 {
+		t.Fatalf("Expected fragments, got %d datagram(s)", len(datagrams))
+	}
+
+	assembler := newFragmentAssembler()
+	var result Message
+	var complete bool
+	for _, datagram := range datagrams {
+		if len(datagram) > server.maxDatagramSize {
+			t.Errorf("Fragment of %d bytes exceeds limit", len(datagram))
+		}
+		msg, err := decodeDatagram(datagram)
+		if err != nil {
+			t.Fatalf("Fragment decode failed: %v", err)
+		}
+		result, complete = assembler.reassemble(msg, nil)
+	}
+	if !complete || result.Type != MsgSnapshot {
+		t.Errorf("Expected reassembled snapshot, got complete=%v type=%q", complete, result.Type)
+	}
+}
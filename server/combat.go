@@ -0,0 +1,287 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// AttackStats describes how an entity type fights
+type AttackStats struct {
+	Damage   int32    `json:"damage"`   // Health removed per hit
+	Range    int      `json:"range"`    // Tiles between attacker and target (1 = adjacent, diagonals included)
+	Cooldown duration `json:"cooldown"` // Time between hits
+}
+
+// isAttackable reports whether an entity can be targeted by attacks (units and buildings,
+// but not resource nodes)
+func isAttackable(entity *Entity) bool {
+	return isUnit(entity) || (isBuilding(entity) && !isResourceNode(entity))
+}
+
+// tileDistance returns how many tiles (x, y) is from the nearest tile entity occupies,
+// counting diagonal steps as one
+func tileDistance(x, y int, entity *Entity) int {
+	right := entity.TileX + max(entity.FootprintWidth, 1) - 1
+	bottom := entity.TileY + max(entity.FootprintHeight, 1) - 1
+	dx := max(entity.TileX-x, 0, x-right)
+	dy := max(entity.TileY-y, 0, y-bottom)
+	return max(dx, dy)
+}
+
+func (s *GameServer) handleAttackCommand(cmd Command, client *Client) error {
+	attackData, ok := cmd.Data.(map[string]interface{})
+	if !ok {
+		return newCommandError(ErrInvalidData, "attack data must be an object")
+	}
+
+	targetIdFloat, ok := attackData["targetId"].(float64)
+	if !ok {
+		return newCommandError(ErrInvalidData, "attack requires targetId")
+	}
+	targetId := uint32(targetIdFloat)
+
+	// Find target entity
+	target, exists := s.entities[targetId]
+	if !exists {
+		return newCommandError(ErrInvalidTarget, "entity %d does not exist", targetId)
+	}
+
+	// Can't attack own or allied entities
+	if target.OwnerId == client.Id {
+		return newCommandError(ErrInvalidTarget, "cannot attack own entity %d", targetId)
+	}
+	if s.ownerTeam(target.OwnerId) == client.Team {
+		return newCommandError(ErrInvalidTarget, "cannot attack allied entity %d", targetId)
+	}
+	if !isAttackable(target) {
+		return newCommandError(ErrInvalidTarget, "entity %d (%s) cannot be attacked", targetId, target.Type)
+	}
+
+	// Ids of entities the team has never seen aren't known to honest clients
+	_, remembered := s.lastKnown[client.Team][targetId]
+	if !remembered && !s.teamVision(client.Team).seesEntity(target) {
+		return newCommandError(ErrInvalidTarget, "entity %d is not in sight", targetId)
+	}
+
+	unitIdsInterface, ok := attackData["unitIds"].([]interface{})
+	if !ok || len(unitIdsInterface) == 0 {
+		return newCommandError(ErrInvalidData, "attack requires unitIds")
+	}
+
+	// Send every selected unit that can fight after the target
+	armed, ordered := 0, 0
+	for _, unitIdInterface := range unitIdsInterface {
+		unitIdFloat, ok := unitIdInterface.(float64)
+		if !ok {
+			continue
+		}
+		unit, exists := s.entities[uint32(unitIdFloat)]
+		if !exists || unit.OwnerId != client.Id {
+			continue
+		}
+		if def := definitionOf(unit); def == nil || def.Attack == nil {
+			continue
+		}
+		armed++
+		if s.approachTarget(unit, target) {
+			s.leaveFormation(unit.Id)
+			unit.AttackTargetId = target.Id
+			unit.ConstructTargetId = 0
+			unit.GatherNodeId = 0
+			ordered++
+		}
+	}
+
+	if armed == 0 {
+		return newCommandError(ErrNotOwner, "none of the selected units can attack for this player")
+	}
+	if ordered == 0 {
+		return newCommandError(ErrNoPath, "no path into range of entity %d", targetId)
+	}
+	log.Printf("Client %d sent %d units to attack entity %d", client.Id, ordered, targetId)
+	return nil
+}
+
+// approachTarget paths unit to the nearest free tile within attack range of target, or
+// stops it if it is already in range. Returns false, leaving the unit as it was, if no
+// such tile can be reached. Must be called with s.mu held.
+func (s *GameServer) approachTarget(unit, target *Entity) bool {
+	return s.approachWithin(unit, target, definitionOf(unit).Attack.Range)
+}
+
+// approachWithin paths unit to the nearest free tile within reach tiles of target, or
+// stops it if it is already that close. Returns false, leaving the unit as it was, if
+// no such tile can be reached. Must be called with s.mu held.
+func (s *GameServer) approachWithin(unit, target *Entity, reach int) bool {
+	if tileDistance(unit.TileX, unit.TileY, target) <= reach {
+		stopUnit(unit)
+		return true
+	}
+
+	goal, found := s.nearestFreeTile(target, reach, unit.TileX, unit.TileY, unit.Id)
+	if !found {
+		return false
+	}
+	path := s.findPath(unit.TileX, unit.TileY, goal.X, goal.Y, unit.Id)
+	if len(path) == 0 {
+		return false
+	}
+	unit.Path = path
+	unit.PathIndex = 0
+	unit.MoveProgress = 0.0
+	unit.TargetTileX = path[0].X
+	unit.TargetTileY = path[0].Y
+	return true
+}
+
+// closeIn keeps unit heading for a tile within reach of target, stopping it once it gets
+// there. It repaths only when the current path no longer ends within reach (the target
+// moved, or the path was cut short). Returns whether the unit is within reach, and
+// whether it still can be. Must be called with s.mu held.
+func (s *GameServer) closeIn(unit, target *Entity, reach int) (arrived, reachable bool) {
+	if tileDistance(unit.TileX, unit.TileY, target) <= reach {
+		if len(unit.Path) > 0 {
+			stopUnit(unit)
+		}
+		return true, true
+	}
+	if len(unit.Path) > 0 {
+		end := unit.Path[len(unit.Path)-1]
+		if tileDistance(end.X, end.Y, target) <= reach {
+			return false, true
+		}
+	}
+	return false, s.approachWithin(unit, target, reach)
+}
+
+// nearestFreeTile returns the tile within distance of entity that unitId could stand on
+// and that is closest to (fromX, fromY). Must be called with s.mu held.
+func (s *GameServer) nearestFreeTile(entity *Entity, distance, fromX, fromY int, unitId uint32) (TilePosition, bool) {
+	best, bestDistance := TilePosition{}, -1
+	right := entity.TileX + max(entity.FootprintWidth, 1) - 1 + distance
+	bottom := entity.TileY + max(entity.FootprintHeight, 1) - 1 + distance
+	for y := entity.TileY - distance; y <= bottom; y++ {
+		for x := entity.TileX - distance; x <= right; x++ {
+			if !s.isTileAvailableForUnit(x, y, unitId) {
+				continue
+			}
+			if distance := abs(x-fromX) + abs(y-fromY); bestDistance < 0 || distance < bestDistance {
+				best, bestDistance = TilePosition{X: x, Y: y}, distance
+			}
+		}
+	}
+	return best, bestDistance >= 0
+}
+
+// stopUnit halts a unit on the tile it is standing on
+func stopUnit(unit *Entity) {
+	unit.Path = nil
+	unit.PathIndex = 0
+	unit.MoveProgress = 0.0
+	unit.TargetTileX = unit.TileX
+	unit.TargetTileY = unit.TileY
+}
+
+// updateCombat chases each attacking unit's target and lands a hit whenever the unit is in
+// range and its cooldown has passed. Must be called with s.mu held.
+func (s *GameServer) updateCombat() {
+	// Units strike in id order so simultaneous kills resolve the same way every time
+	attackers := make([]uint32, 0)
+	for id, entity := range s.entities {
+		if entity.AttackTargetId != 0 {
+			attackers = append(attackers, id)
+		}
+	}
+	sort.Slice(attackers, func(i, j int) bool { return attackers[i] < attackers[j] })
+
+	for _, id := range attackers {
+		unit, exists := s.entities[id]
+		if !exists || s.isOwnerDisconnected(unit.OwnerId) {
+			continue // Killed earlier this tick, or frozen
+		}
+		target, exists := s.entities[unit.AttackTargetId]
+		if !exists {
+			// Target destroyed: stand down where the unit is
+			unit.AttackTargetId = 0
+			stopUnit(unit)
+			continue
+		}
+
+		def := definitionOf(unit)
+		if def == nil || def.Attack == nil {
+			unit.AttackTargetId = 0 // Its type no longer fights
+			continue
+		}
+		stats := def.Attack
+		arrived, reachable := s.closeIn(unit, target, stats.Range)
+		if !reachable {
+			log.Printf("Unit %d can't reach entity %d, giving up the attack", unit.Id, target.Id)
+			unit.AttackTargetId = 0
+		}
+		if !arrived {
+			continue
+		}
+		if s.tick < unit.NextAttackTick {
+			continue
+		}
+		unit.NextAttackTick = s.tick + durationTicks(time.Duration(stats.Cooldown))
+		s.dealDamage(unit, target, stats.Damage)
+	}
+}
+
+// dealDamage applies one hit from attacker, destroying the target once its health runs
+// out. Must be called with s.mu held.
+func (s *GameServer) dealDamage(attacker, target *Entity, damage int32) {
+	target.Health -= damage
+	hit := entityEvent(EventDamageDealt, target, attacker.OwnerId)
+	hit.Amount = float32(damage)
+	s.emitEvent(hit)
+
+	// The event lets clients tell this apart from leaving view
+	if target.Health <= 0 {
+		s.destroyEntity(target, attacker.OwnerId)
+	}
+}
+
+// destroyEntity removes a killed entity and tells players who killed it. Must be called
+// with s.mu held.
+func (s *GameServer) destroyEntity(entity *Entity, playerId uint32) {
+	s.removeEntity(entity)
+	s.emitEvent(entityEvent(EventEntityDestroyed, entity, playerId))
+	log.Printf("Entity %d (%s) destroyed by client %d", entity.Id, entity.Type, playerId)
+}
+
+// removeEntity takes an entity out of the world, its owner's units and any formation.
+// Must be called with s.mu held.
+func (s *GameServer) removeEntity(entity *Entity) {
+	delete(s.entities, entity.Id)
+	s.leaveFormation(entity.Id)
+	if owner, exists := s.clients[entity.OwnerId]; exists {
+		for i, unitId := range owner.OwnedUnits {
+			if unitId == entity.Id {
+				owner.OwnedUnits = append(owner.OwnedUnits[:i], owner.OwnedUnits[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// leaveFormation takes a unit out of the formation it is moving with. A formation that
+// loses its leader is disbanded; the other members keep their paths.
+// Must be called with s.mu held.
+func (s *GameServer) leaveFormation(unitId uint32) {
+	for id, formation := range s.formations {
+		if formation.LeaderID == unitId {
+			delete(s.formations, id)
+			continue
+		}
+		for i, memberId := range formation.MemberIDs {
+			if memberId == unitId {
+				formation.MemberIDs = append(formation.MemberIDs[:i], formation.MemberIDs[i+1:]...)
+				delete(formation.Offsets, unitId)
+				break
+			}
+		}
+	}
+}
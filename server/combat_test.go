@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func attackCommand(targetId uint32, unitIds ...uint32) Command {
+	ids := make([]interface{}, len(unitIds))
+	for i, id := range unitIds {
+		ids[i] = float64(id)
+	}
+	return Command{Type: "attack", Data: map[string]interface{}{"unitIds": ids, "targetId": float64(targetId)}}
+}
+
+// TestAttackersChaseIntoRangeAndHitOnCooldown verifies an attacking unit walks up to its
+// target, hits once per cooldown and stands down once the target is dead and gone from
+// its owner's units
+func TestAttackersChaseIntoRangeAndHitOnCooldown(t *testing.T) {
+	server, alice, bob, _ := newEventsTestServer()
+	server.entities[11] = &Entity{Id: 11, OwnerId: 1, Type: "worker", TileX: 30, TileY: 35, TargetTileX: 30, TargetTileY: 35, Health: 100, MaxHealth: 100}
+	bob.OwnedUnits = []uint32{20}
+
+	if err := server.processCommand(attackCommand(20, 11), alice); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(server.entities[11].Path) == 0 {
+		t.Fatal("Expected the attacker to path towards its target")
+	}
+
+	var hits []uint64
+	for i := 0; i < 20*TickRate && server.entities[20] != nil; i++ {
+		server.gameTick()
+		for _, event := range bob.Events.events {
+			if event.Type == EventDamageDealt && event.EntityId == 20 && (len(hits) == 0 || event.Tick > hits[len(hits)-1]) {
+				hits = append(hits, event.Tick)
+			}
+		}
+	}
+
+	stats := EntityDefinitions["worker"].Attack
+	if server.entities[20] != nil {
+		t.Fatalf("Expected Bob's worker killed, has %d HP after %d hits", server.entities[20].Health, len(hits))
+	}
+	if len(hits) != int(100/stats.Damage) {
+		t.Errorf("Expected %d hits, got %d", 100/stats.Damage, len(hits))
+	}
+	for i := 1; i < len(hits); i++ {
+		if hits[i]-hits[i-1] != uint64(TickRate) {
+			t.Errorf("Expected a hit every %d ticks, got ticks %v", TickRate, hits)
+			break
+		}
+	}
+	if len(bob.OwnedUnits) != 0 {
+		t.Errorf("Expected the dead worker removed from Bob's units, got %v", bob.OwnedUnits)
+	}
+	server.gameTick()
+	attacker := server.entities[11]
+	if attacker.AttackTargetId != 0 || len(attacker.Path) != 0 || tileDistance(attacker.TileX, attacker.TileY, &Entity{TileX: 35, TileY: 35}) > stats.Range {
+		t.Errorf("Expected the attacker standing down within range, got %+v", attacker)
+	}
+}
+
+// TestAttackCommandValidation verifies attack orders need armed units of the player's own
+// and a visible enemy target, and that moving cancels them
+func TestAttackCommandValidation(t *testing.T) {
+	server, alice, _, _ := newEventsTestServer()
+	server.entities[12] = &Entity{Id: 12, OwnerId: 3, Type: "worker", TileX: 3, TileY: 2, TargetTileX: 3, TargetTileY: 2, Health: 100, MaxHealth: 100}
+	server.entities[13] = &Entity{Id: 13, OwnerId: 2, Type: "worker", TileX: 4, TileY: 4, TargetTileX: 4, TargetTileY: 4, Health: 100, MaxHealth: 100}
+	server.entities[14] = &Entity{Id: 14, OwnerId: 1, Type: "generator", TileX: 6, TileY: 6, TargetTileX: 6, TargetTileY: 6,
+		Health: 100, MaxHealth: 100, FootprintWidth: 2, FootprintHeight: 2}
+	server.clients[3].Team = alice.Team
+
+	tests := []struct {
+		name   string
+		cmd    Command
+		reason string
+	}{
+		{"own unit", attackCommand(10, 10), ErrInvalidTarget},
+		{"allied unit", attackCommand(12, 10), ErrInvalidTarget},
+		{"out of sight", attackCommand(20, 10), ErrInvalidTarget},
+		{"no attackers", attackCommand(13), ErrInvalidData},
+		{"enemy's unit", attackCommand(13, 20), ErrNotOwner},
+		{"unarmed building", attackCommand(13, 14), ErrNotOwner},
+	}
+	for _, tc := range tests {
+		err := server.processCommand(tc.cmd, alice)
+		var cmdErr *CommandError
+		if !errors.As(err, &cmdErr) || cmdErr.Reason != tc.reason {
+			t.Errorf("%s: expected %q, got %v", tc.name, tc.reason, err)
+		}
+	}
+
+	if err := server.processCommand(attackCommand(13, 10), alice); err != nil || server.entities[10].AttackTargetId != 13 {
+		t.Fatalf("Expected the attack ordered, got %v", err)
+	}
+	move := Command{Type: "move", Data: map[string]interface{}{
+		"unitIds": []interface{}{float64(10)}, "targetTileX": float64(1), "targetTileY": float64(1),
+	}}
+	if err := server.processCommand(move, alice); err != nil || server.entities[10].AttackTargetId != 0 {
+		t.Errorf("Expected moving to cancel the attack, got %v with target %d", err, server.entities[10].AttackTargetId)
+	}
+}
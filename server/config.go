@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ConfigEnvPrefix prefixes the environment variable for every flag: -tick-rate is
+// GAME_TICK_RATE, -config is GAME_CONFIG
+const ConfigEnvPrefix = "GAME_"
+
+// Config holds the server settings that can change without recompiling. Each value is
+// taken from the defaults, then the config file, then the environment, then flags.
+type Config struct {
+	ServerPort      string   `json:"serverPort"`      // UDP listen address
+	WebSocketPort   string   `json:"webSocketPort"`   // WebSocket gateway address ("" disables)
+	TickRate        int      `json:"tickRate"`        // Simulation ticks per second
+	MaxClients      int      `json:"maxClients"`      // Players per room
+	ClientTimeout   duration `json:"clientTimeout"`   // Silence before a client counts as disconnected ("10s")
+	ReconnectGrace  duration `json:"reconnectGrace"`  // How long a disconnected player's units and money are kept ("60s")
+	MaxDatagramSize int      `json:"maxDatagramSize"` // Largest datagram sent; bigger messages go out in fragments
+	StartingMoney   int      `json:"startingMoney"`   // Money each player starts a match with
+	Map             string   `json:"map"`             // Default room's map file; other maps are looked up beside it
+	Entities        string   `json:"entities"`        // Unit and building definitions file
+	AdminToken      string   `json:"adminToken"`      // Secret for admin commands ("" disables them)
+	SaveDir         string   `json:"saveDir"`         // Where match saves are written
+	SaveOnShutdown  bool     `json:"saveOnShutdown"`  // Save rooms with players when shutting down
+	Load            string   `json:"load"`            // Save file to restore at startup
+}
+
+// duration is a time.Duration written like "10s" in config files, flags and the environment
+type duration time.Duration
+
+func (d duration) String() string { return time.Duration(d).String() }
+
+func (d *duration) Set(value string) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) { return json.Marshal(d.String()) }
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\": %w", err)
+	}
+	return d.Set(value)
+}
+
+// DefaultConfig returns the compiled-in settings the server runs with when nothing is configured
+func DefaultConfig() Config {
+	return Config{
+		ServerPort:      ServerPort,
+		WebSocketPort:   WebSocketPort,
+		TickRate:        TickRate,
+		MaxClients:      MaxClients,
+		ClientTimeout:   duration(ClientTimeout),
+		ReconnectGrace:  duration(ReconnectGrace),
+		MaxDatagramSize: MaxDatagramSize,
+		StartingMoney:   StartingMoney,
+		Map:             filepath.Join(MapsDir, DefaultMapName+".json"),
+		Entities:        EntitiesFile,
+		AdminToken:      AdminToken,
+		SaveDir:         SaveDir,
+		SaveOnShutdown:  SaveOnShutdown,
+	}
+}
+
+// configFlags binds a flag for every setting to cfg, plus -config to configPath
+func configFlags(cfg *Config, configPath *string, output io.Writer) *flag.FlagSet {
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(configPath, "config", *configPath, "JSON config file")
+	flags.StringVar(&cfg.ServerPort, "port", cfg.ServerPort, "UDP listen address")
+	flags.StringVar(&cfg.WebSocketPort, "ws-port", cfg.WebSocketPort, "WebSocket gateway address (empty disables)")
+	flags.IntVar(&cfg.TickRate, "tick-rate", cfg.TickRate, "simulation ticks per second")
+	flags.IntVar(&cfg.MaxClients, "max-clients", cfg.MaxClients, "players per room")
+	flags.Var(&cfg.ClientTimeout, "client-timeout", "silence before a client counts as disconnected")
+	flags.Var(&cfg.ReconnectGrace, "reconnect-grace", "how long a disconnected player's units and money are kept for them to resume")
+	flags.IntVar(&cfg.MaxDatagramSize, "max-datagram-size", cfg.MaxDatagramSize, "largest datagram sent in bytes (bigger messages are fragmented)")
+	flags.IntVar(&cfg.StartingMoney, "starting-money", cfg.StartingMoney, "money each player starts with")
+	flags.StringVar(&cfg.Map, "map", cfg.Map, "default room's map file (other maps are looked up in its directory)")
+	flags.StringVar(&cfg.Entities, "entities", cfg.Entities, "unit and building definitions file (health, speed, cost, income, ...)")
+	flags.StringVar(&cfg.AdminToken, "admin-token", cfg.AdminToken, "secret for admin commands such as save_match (empty disables them)")
+	flags.StringVar(&cfg.SaveDir, "save-dir", cfg.SaveDir, "directory match saves are written to")
+	flags.BoolVar(&cfg.SaveOnShutdown, "save-on-shutdown", cfg.SaveOnShutdown, "save every room with players when shutting down")
+	flags.StringVar(&cfg.Load, "load", cfg.Load, "save file to restore at startup (its room replaces a fresh one)")
+	flags.Usage = func() {
+		fmt.Fprintf(output, "Usage of server (every flag can also be set as %s<FLAG_NAME>):\n", ConfigEnvPrefix)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// configEnvName returns the environment variable that overrides a flag
+func configEnvName(flagName string) string {
+	return ConfigEnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// LoadConfig builds the configuration from the config file, environment and command-line
+// arguments (without the program name), and validates it
+func LoadConfig(args []string, getenv func(string) string, output io.Writer) (Config, error) {
+	// Find the config file first so the environment and flags can be layered over it
+	configPath := getenv(configEnvName("config"))
+	scratch := DefaultConfig()
+	if err := configFlags(&scratch, &configPath, output).Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	cfg := DefaultConfig()
+	if configPath != "" {
+		if err := cfg.loadFile(configPath); err != nil {
+			return Config{}, err
+		}
+	}
+
+	flags := configFlags(&cfg, &configPath, output)
+	var envErr error
+	flags.VisitAll(func(f *flag.Flag) {
+		name := configEnvName(f.Name)
+		if value := getenv(name); value != "" && envErr == nil {
+			if err := flags.Set(f.Name, value); err != nil {
+				envErr = fmt.Errorf("invalid %s %q: %w", name, value, err)
+			}
+		}
+	})
+	if envErr != nil {
+		return Config{}, envErr
+	}
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if flags.NArg() > 0 {
+		return Config{}, fmt.Errorf("unexpected arguments %q", flags.Args())
+	}
+
+	return cfg, cfg.validate()
+}
+
+// loadFile overlays the settings present in a JSON config file. Unknown keys are errors
+// so typos don't silently fall back to defaults.
+func (c *Config) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// validate checks every setting is usable, including that the map and entity definitions load
+func (c *Config) validate() error {
+	switch {
+	case c.ServerPort == "":
+		return fmt.Errorf("server port must be set")
+	case c.WebSocketPort != "" && c.WebSocketPort == c.ServerPort:
+		return fmt.Errorf("WebSocket port %s must differ from the server port", c.WebSocketPort)
+	case c.TickRate < 1 || c.TickRate > 100:
+		return fmt.Errorf("tick rate must be between 1 and 100, got %d", c.TickRate)
+	case c.MaxClients < 1 || c.MaxClients > 32:
+		return fmt.Errorf("max clients must be between 1 and 32, got %d", c.MaxClients)
+	case time.Duration(c.ClientTimeout) < 2*HeartbeatInterval:
+		return fmt.Errorf("client timeout must be at least %v (two heartbeats), got %v", 2*HeartbeatInterval, c.ClientTimeout)
+	case c.ReconnectGrace < 0:
+		return fmt.Errorf("reconnect grace can't be negative, got %v", c.ReconnectGrace)
+	case c.MaxDatagramSize < 2*FragmentOverhead || c.MaxDatagramSize > MaxUDPPayload:
+		// Every fragment needs room for its envelope and a useful share of the message
+		return fmt.Errorf("max datagram size must be between %d and %d bytes, got %d", 2*FragmentOverhead, MaxUDPPayload, c.MaxDatagramSize)
+	case c.StartingMoney < 0:
+		return fmt.Errorf("starting money can't be negative, got %d", c.StartingMoney)
+	case c.SaveDir == "":
+		return fmt.Errorf("save directory must be set")
+	}
+
+	name := strings.TrimSuffix(filepath.Base(c.Map), ".json")
+	if filepath.Ext(c.Map) != ".json" || !validRoomName.MatchString(name) {
+		return fmt.Errorf("map must be a .json file named with letters, digits, '-' and '_', got %q", c.Map)
+	}
+	if _, err := LoadMap(c.Map); err != nil {
+		return fmt.Errorf("invalid map: %w", err)
+	}
+	if _, err := LoadDefinitions(c.Entities); err != nil {
+		return fmt.Errorf("invalid entity definitions: %w", err)
+	}
+	return nil
+}
+
+// apply makes cfg the running configuration. Must be called before the server starts.
+func (c *Config) apply() {
+	ServerPort = c.ServerPort
+	WebSocketPort = c.WebSocketPort
+	TickRate = c.TickRate
+	MaxInputTickSkew = uint64(2 * c.TickRate)
+	MaxClients = c.MaxClients
+	ClientTimeout = time.Duration(c.ClientTimeout)
+	ReconnectGrace = time.Duration(c.ReconnectGrace)
+	MaxDatagramSize = c.MaxDatagramSize
+	StartingMoney = c.StartingMoney
+	MapsDir = filepath.Dir(c.Map)
+	DefaultMapName = strings.TrimSuffix(filepath.Base(c.Map), ".json")
+	EntitiesFile = c.Entities
+	AdminToken = c.AdminToken
+	SaveDir = c.SaveDir
+	SaveOnShutdown = c.SaveOnShutdown
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func envFrom(env map[string]string) func(string) string {
+	return func(name string) string { return env[name] }
+}
+
+// TestConfigLayering verifies the config file overrides defaults, the environment
+// overrides the file and flags override everything
+func TestConfigLayering(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "balance.json")
+	os.WriteFile(path, []byte(`{"tickRate": 30, "startingMoney": 500, "maxClients": 4, "clientTimeout": "15s"}`), 0o644)
+
+	env := map[string]string{"GAME_CONFIG": path, "GAME_MAX_CLIENTS": "8", "GAME_ADMIN_TOKEN": "secret"}
+	cfg, err := LoadConfig([]string{"-max-clients", "10", "-map", "../maps/test_corridor.json"}, envFrom(env), io.Discard)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if cfg.TickRate != 30 || cfg.StartingMoney != 500 || time.Duration(cfg.ClientTimeout) != 15*time.Second {
+		t.Errorf("Expected file settings, got tick rate %d, money %d, timeout %v", cfg.TickRate, cfg.StartingMoney, cfg.ClientTimeout)
+	}
+	if cfg.AdminToken != "secret" {
+		t.Errorf("Expected the admin token from the environment, got %q", cfg.AdminToken)
+	}
+	if cfg.MaxClients != 10 || cfg.Map != "../maps/test_corridor.json" {
+		t.Errorf("Expected flags to win, got %d players and map %q", cfg.MaxClients, cfg.Map)
+	}
+	if cfg.Entities != EntitiesFile || cfg.ServerPort != ServerPort {
+		t.Errorf("Expected unset values to keep their defaults, got entities %q on %q", cfg.Entities, cfg.ServerPort)
+	}
+}
+
+// TestConfigValidation verifies bad settings are refused at startup with a reason
+func TestConfigValidation(t *testing.T) {
+	unknownKey := filepath.Join(t.TempDir(), "typo.json")
+	os.WriteFile(unknownKey, []byte(`{"tickRat": 30}`), 0o644)
+
+	cases := []struct {
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{args: []string{"-tick-rate", "0"}, want: "tick rate"},
+		{args: []string{"-max-clients", "100"}, want: "max clients"},
+		{args: []string{"-client-timeout", "1s"}, want: "client timeout"},
+		{args: []string{"-reconnect-grace", "-1s"}, want: "reconnect grace"},
+		{args: []string{"-max-datagram-size", "100"}, want: "max datagram size"},
+		{args: []string{"-max-datagram-size", "70000"}, want: "max datagram size"},
+		{args: []string{"-starting-money", "-5"}, want: "starting money"},
+		{args: []string{"-entities", "../maps/default.json"}, want: "entity definitions"},
+		{args: []string{"-ws-port", ServerPort}, want: "must differ"},
+		{args: []string{"-map", "../maps/missing.json"}, want: "invalid map"},
+		{args: []string{"-map", "../maps/default.txt"}, want: ".json"},
+		{args: []string{"stray"}, want: "unexpected arguments"},
+		{env: map[string]string{"GAME_TICK_RATE": "fast"}, want: "GAME_TICK_RATE"},
+		{env: map[string]string{"GAME_CONFIG": unknownKey}, want: "unknown field"},
+	}
+	for _, c := range cases {
+		_, err := LoadConfig(c.args, envFrom(c.env), io.Discard)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%v %v: expected error mentioning %q, got %v", c.args, c.env, c.want, err)
+		}
+	}
+
+	if _, err := LoadConfig(nil, envFrom(nil), io.Discard); err != nil {
+		t.Errorf("Expected the defaults to be valid, got %v", err)
+	}
+}
+
+// TestConfigApplied verifies the running settings follow the config and reach the welcome
+func TestConfigApplied(t *testing.T) {
+	defaults := DefaultConfig()
+	t.Cleanup(defaults.apply)
+
+	cfg := defaults
+	cfg.TickRate, cfg.StartingMoney = 10, 300
+	cfg.MaxDatagramSize = 600
+	cfg.ReconnectGrace = duration(5 * time.Minute)
+	cfg.Map = "../maps/test_corridor.json"
+	cfg.apply()
+
+	if MaxInputTickSkew != 20 || MapsDir != "../maps" || DefaultMapName != "test_corridor" {
+		t.Errorf("Expected derived settings updated, got skew %d, map %s/%s", MaxInputTickSkew, MapsDir, DefaultMapName)
+	}
+
+	server := newSessionTestServer()
+	if server.reconnectGrace != 5*time.Minute {
+		t.Errorf("Expected the configured reconnect grace, got %v", server.reconnectGrace)
+	}
+	welcome := server.welcomeMessage(&Client{Id: 1, Capabilities: capabilitySet{}})
+	if welcome.TickRate != 10 || welcome.StartingMoney != 300 || welcome.MaxDatagramSize != 600 ||
+		welcome.EntityTypes["generator"].Cost != EntityDefinitions["generator"].Cost {
+		t.Errorf("Expected configured settings in the welcome, got %+v", welcome)
+	}
+}
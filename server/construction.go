@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// buildsType reports whether a unit's type can construct buildingType
+func buildsType(unit *Entity, buildingType string) bool {
+	def := definitionOf(unit)
+	if def == nil {
+		return false
+	}
+	for _, builds := range def.Builds {
+		if builds == buildingType {
+			return true
+		}
+	}
+	return false
+}
+
+// selectBuilders returns the units listed in a command's unitIds that belong to client
+// and can construct buildingType. Must be called with s.mu held.
+func (s *GameServer) selectBuilders(data map[string]interface{}, client *Client, buildingType string) []*Entity {
+	unitIdsInterface, _ := data["unitIds"].([]interface{})
+	builders := make([]*Entity, 0, len(unitIdsInterface))
+	for _, unitIdInterface := range unitIdsInterface {
+		unitIdFloat, ok := unitIdInterface.(float64)
+		if !ok {
+			continue
+		}
+		unit, exists := s.entities[uint32(unitIdFloat)]
+		if !exists || unit.OwnerId != client.Id || !buildsType(unit, buildingType) {
+			continue
+		}
+		builders = append(builders, unit)
+	}
+	return builders
+}
+
+// assignBuilders sends workers to a site, returning how many could reach it. Workers
+// that can't are left as they were. Must be called with s.mu held.
+func (s *GameServer) assignBuilders(builders []*Entity, site *Entity) int {
+	ordered := 0
+	for _, unit := range builders {
+		if !s.approachWithin(unit, site, BuilderReach) {
+			continue
+		}
+		s.leaveFormation(unit.Id)
+		unit.AttackTargetId = 0
+		unit.GatherNodeId = 0
+		unit.ConstructTargetId = site.Id
+		ordered++
+	}
+	return ordered
+}
+
+func (s *GameServer) handleCancelBuildCommand(cmd Command, client *Client) error {
+	cancelData, ok := cmd.Data.(map[string]interface{})
+	if !ok {
+		return newCommandError(ErrInvalidData, "cancel_build data must be an object")
+	}
+
+	site, err := s.ownedBuilding(cancelData, client)
+	if err != nil {
+		return err
+	}
+	if !site.UnderConstruction {
+		return newCommandError(ErrInvalidTarget, "building %d is already finished", site.Id)
+	}
+
+	if def := definitionOf(site); def != nil {
+		client.Money += float32(def.Cost) * ConstructionRefund
+	}
+	// Its workers notice the site is gone on the next tick and stand down
+	s.removeEntity(site)
+	s.emitEvent(entityEvent(EventConstructionCancelled, site, client.Id))
+	log.Printf("Client %d cancelled %s site %d", client.Id, site.Type, site.Id)
+	return nil
+}
+
+// updateConstruction lets every worker standing next to its site add its share of the
+// build time, finishing sites that are complete. Must be called with s.mu held.
+func (s *GameServer) updateConstruction(deltaTime float32) {
+	// Workers build in id order so sites finish on the same tick every time
+	builders := make([]uint32, 0)
+	for id, entity := range s.entities {
+		if entity.ConstructTargetId != 0 {
+			builders = append(builders, id)
+		}
+	}
+	sort.Slice(builders, func(i, j int) bool { return builders[i] < builders[j] })
+
+	for _, id := range builders {
+		unit, exists := s.entities[id]
+		if !exists || s.isOwnerDisconnected(unit.OwnerId) {
+			continue // Killed earlier this tick, or frozen
+		}
+		site, exists := s.entities[unit.ConstructTargetId]
+		if !exists || !site.UnderConstruction {
+			unit.ConstructTargetId = 0 // Finished, cancelled or destroyed
+			continue
+		}
+
+		arrived, reachable := s.closeIn(unit, site, BuilderReach)
+		if !reachable {
+			log.Printf("Unit %d can't reach site %d, giving up construction", unit.Id, site.Id)
+			unit.ConstructTargetId = 0
+		}
+		if !arrived {
+			continue
+		}
+
+		// Each worker adds its own share, so more workers finish sooner
+		def := definitionOf(site)
+		if def == nil || def.BuildTime <= 0 {
+			site.BuildProgress = 1
+		} else {
+			buildTime := float32(time.Duration(def.BuildTime).Seconds())
+			site.BuildProgress = min(site.BuildProgress+deltaTime/buildTime, 1)
+		}
+		if site.BuildProgress >= 1 {
+			s.completeBuilding(site)
+		}
+	}
+}
+
+// completeBuilding turns a site into a working building. Must be called with s.mu held.
+func (s *GameServer) completeBuilding(site *Entity) {
+	site.UnderConstruction = false
+	site.BuildProgress = 0
+	s.emitEvent(entityEvent(EventBuildingCompleted, site, site.OwnerId))
+	log.Printf("Client %d finished %s %d", site.OwnerId, site.Type, site.Id)
+}
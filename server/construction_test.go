@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func buildCommand(buildingType string, tileX, tileY int, unitIds ...uint32) Command {
+	ids := make([]interface{}, len(unitIds))
+	for i, id := range unitIds {
+		ids[i] = float64(id)
+	}
+	return Command{Type: "build", Data: map[string]interface{}{
+		"unitIds": ids, "buildingType": buildingType, "tileX": float64(tileX), "tileY": float64(tileY),
+	}}
+}
+
+// siteAt returns the building whose footprint starts at (x, y)
+func siteAt(server *GameServer, x, y int) *Entity {
+	for _, entity := range server.entities {
+		if isBuilding(entity) && entity.TileX == x && entity.TileY == y {
+			return entity
+		}
+	}
+	return nil
+}
+
+// TestWorkersWalkToSiteAndBuild verifies a build order puts down a site, sends the worker
+// over to build it and only starts paying income once the building is finished
+func TestWorkersWalkToSiteAndBuild(t *testing.T) {
+	server, alice, _, _ := newEventsTestServer()
+
+	if err := server.processCommand(buildCommand("generator", 8, 2, 10), alice); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	site := siteAt(server, 8, 2)
+	if site == nil || !site.UnderConstruction || alice.Money != 50 {
+		t.Fatalf("Expected a generator site for 50 money, got %+v with %.0f left", site, alice.Money)
+	}
+	worker := server.entities[10]
+	if worker.ConstructTargetId != site.Id || len(worker.Path) == 0 {
+		t.Fatalf("Expected the worker on its way to the site, got %+v", worker)
+	}
+
+	buildTicks := int(durationTicks(time.Duration(EntityDefinitions["generator"].BuildTime)))
+	for i := 0; i < 2*buildTicks && site.UnderConstruction; i++ {
+		server.gameTick()
+		if site.UnderConstruction && alice.Money != 50 {
+			t.Fatalf("Expected no income from a site, got %.2f money at %.0f%%", alice.Money, site.BuildProgress*100)
+		}
+	}
+	if site.UnderConstruction {
+		t.Fatalf("Expected the generator finished, at %.0f%%", site.BuildProgress*100)
+	}
+	if tileDistance(worker.TileX, worker.TileY, site) != BuilderReach {
+		t.Errorf("Expected the worker to build from next to the site, got (%d,%d)", worker.TileX, worker.TileY)
+	}
+	completed := false
+	for _, event := range alice.Events.events {
+		completed = completed || (event.Type == EventBuildingCompleted && event.EntityId == site.Id)
+	}
+	if !completed {
+		t.Errorf("Expected a %s event, got %v", EventBuildingCompleted, eventTypes(alice.Events.events))
+	}
+
+	// Income starts on the tick the building is finished
+	for i := 1; i < TickRate; i++ {
+		server.gameTick()
+	}
+	if alice.Money < 59.9 || alice.Money > 60.1 {
+		t.Errorf("Expected a second of income since completion, got %.2f money", alice.Money)
+	}
+	if worker.ConstructTargetId != 0 {
+		t.Errorf("Expected the worker released from the finished site, got %d", worker.ConstructTargetId)
+	}
+}
+
+// TestMoreWorkersBuildFaster verifies each worker at a site adds its own share of the work
+func TestMoreWorkersBuildFaster(t *testing.T) {
+	buildTicks := func(workers int) int {
+		server, alice, _, _ := newEventsTestServer()
+		ids := make([]uint32, workers)
+		for i := range ids {
+			ids[i] = uint32(11 + i)
+			server.entities[ids[i]] = &Entity{Id: ids[i], OwnerId: 1, Type: "worker", TileX: 4, TileY: 5 + i, TargetTileX: 4, TargetTileY: 5 + i, Health: 100, MaxHealth: 100}
+		}
+		if err := server.processCommand(buildCommand("generator", 5, 5, ids...), alice); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		site := siteAt(server, 5, 5)
+		ticks := 0
+		for ; ticks < 1000 && site.UnderConstruction; ticks++ {
+			server.gameTick()
+		}
+		return ticks
+	}
+
+	alone, pair := buildTicks(1), buildTicks(2)
+	if pair > alone/2+1 {
+		t.Errorf("Expected two workers to build twice as fast, took %d ticks vs %d alone", pair, alone)
+	}
+}
+
+// TestBuildCommandValidation verifies who can build where, and that cancelling a site
+// refunds part of its cost
+func TestBuildCommandValidation(t *testing.T) {
+	server, alice, bob, _ := newEventsTestServer()
+	alice.Money = 1000
+
+	cases := []struct {
+		cmd    Command
+		reason string
+	}{
+		{buildCommand("generator", 8, 2), ErrNotOwner},     // No workers
+		{buildCommand("generator", 8, 2, 20), ErrNotOwner}, // Bob's worker
+		{buildCommand("generator", 1, 1, 10), ErrBlocked},  // On top of the worker
+		{buildCommand("generator", 39, 2, 10), ErrOutOfBounds},
+	}
+	for i, c := range cases {
+		var cmdErr *CommandError
+		if err := server.processCommand(c.cmd, alice); !errors.As(err, &cmdErr) || cmdErr.Reason != c.reason {
+			t.Errorf("Case %d: expected %s, got %v", i, c.reason, err)
+		}
+	}
+	if alice.Money != 1000 {
+		t.Errorf("Expected rejected builds to cost nothing, got %.0f money", alice.Money)
+	}
+
+	if err := server.processCommand(buildCommand("office", 8, 2, 10), alice); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	site := siteAt(server, 8, 2)
+	var cmdErr *CommandError
+	if err := server.processCommand(trainCommand(site.Id, "worker"), alice); !errors.As(err, &cmdErr) || cmdErr.Reason != ErrInvalidTarget {
+		t.Errorf("Expected training at a site to fail with %s, got %v", ErrInvalidTarget, err)
+	}
+
+	cancel := Command{Type: "cancel_build", Data: map[string]interface{}{"buildingId": float64(site.Id)}}
+	if err := server.processCommand(cancel, bob); !errors.As(err, &cmdErr) || cmdErr.Reason != ErrNotOwner {
+		t.Errorf("Expected %s cancelling another player's site, got %v", ErrNotOwner, err)
+	}
+	if err := server.processCommand(cancel, alice); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	office := EntityDefinitions["office"]
+	if want := 1000 - float32(office.Cost)*(1-ConstructionRefund); alice.Money != want {
+		t.Errorf("Expected %.0f money after the refund, got %.0f", want, alice.Money)
+	}
+	if _, exists := server.entities[site.Id]; exists {
+		t.Error("Expected the cancelled site removed")
+	}
+	server.distributeEvents()
+	cancelled, destroyed := false, false
+	for _, event := range alice.Events.events {
+		cancelled = cancelled || (event.Type == EventConstructionCancelled && event.EntityId == site.Id)
+		destroyed = destroyed || (event.Type == EventEntityDestroyed && event.EntityId == site.Id)
+	}
+	if !cancelled || destroyed {
+		t.Errorf("Expected a %s event and no %s, got %v", EventConstructionCancelled, EventEntityDestroyed, eventTypes(alice.Events.events))
+	}
+	server.gameTick()
+	if server.entities[10].ConstructTargetId != 0 {
+		t.Error("Expected the worker to stand down once its site was cancelled")
+	}
+
+	if err := server.processCommand(Command{Type: "cancel_build", Data: map[string]interface{}{"buildingId": float64(40)}}, bob); !errors.As(err, &cmdErr) || cmdErr.Reason != ErrInvalidTarget {
+		t.Errorf("Expected %s cancelling a finished building, got %v", ErrInvalidTarget, err)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Entity kinds
+const (
+	KindUnit     = "unit"     // Moves around, occupying one tile
+	KindBuilding = "building" // Stays put, occupying its footprint
+)
+
+// StartingUnitType is what every player's starting units are
+const StartingUnitType = "worker"
+
+// EntityDefinition holds the stats every entity of one type shares
+type EntityDefinition struct {
+	Kind            string       `json:"kind"`                      // KindUnit or KindBuilding
+	Health          int32        `json:"health"`                    // Health it is created with (and its maximum)
+	Speed           float32      `json:"speed,omitempty"`           // Tiles per second (units)
+	FootprintWidth  int          `json:"footprintWidth,omitempty"`  // In tiles (buildings)
+	FootprintHeight int          `json:"footprintHeight,omitempty"` // In tiles (buildings)
+	Cost            int          `json:"cost"`                      // Price to build or train
+	Income          float32      `json:"income,omitempty"`          // Money per second it earns its owner
+	Vision          int          `json:"vision"`                    // How far (in tiles) it can see
+	Attack          *AttackStats `json:"attack,omitempty"`          // How it fights (nil = it can't)
+	BuildTime       duration     `json:"buildTime"`                 // Time to build or train
+	Trains          []string     `json:"trains,omitempty"`          // Unit types it can train (buildings)
+	Builds          []string     `json:"builds,omitempty"`          // Building types it can construct (units)
+	Gather          *GatherStats `json:"gather,omitempty"`          // How it harvests resources (nil = it can't)
+	DropOff         bool         `json:"dropOff,omitempty"`         // Workers deliver harvested resources here (buildings)
+}
+
+// GatherStats describes how a unit type harvests resource nodes
+type GatherStats struct {
+	Capacity int32   `json:"capacity"` // Resources carried back per trip
+	Rate     float32 `json:"rate"`     // Resources harvested per second
+}
+
+// DefinitionsFileFormat is the JSON layout of an entity definitions file
+type DefinitionsFileFormat struct {
+	Version  string                       `json:"version"`
+	Entities map[string]*EntityDefinition `json:"entities"` // By entity type
+}
+
+// EntityDefinitions holds the stats of every entity type, keyed by type. These are the
+// compiled-in defaults; main replaces them with the definitions file (EntitiesFile).
+var EntityDefinitions = map[string]*EntityDefinition{
+	"worker": {
+		Kind:      KindUnit,
+		Health:    100,
+		Speed:     4.0,
+		Cost:      50,
+		Vision:    5,
+		Attack:    &AttackStats{Damage: 10, Range: 1, Cooldown: duration(time.Second)},
+		BuildTime: duration(5 * time.Second),
+		Builds:    []string{"generator", "office"},
+		Gather:    &GatherStats{Capacity: 10, Rate: 2},
+	},
+	"generator": {
+		Kind:            KindBuilding,
+		Health:          100,
+		FootprintWidth:  2,
+		FootprintHeight: 2,
+		Cost:            50,
+		Income:          10.0,
+		Vision:          3,
+		BuildTime:       duration(10 * time.Second),
+	},
+	"office": {
+		Kind:            KindBuilding,
+		Health:          200,
+		FootprintWidth:  3,
+		FootprintHeight: 2,
+		Cost:            100,
+		Vision:          4,
+		BuildTime:       duration(20 * time.Second),
+		Trains:          []string{"worker"},
+		DropOff:         true,
+	},
+}
+
+// definitionOf returns the definition of an entity's type, or nil for unknown types
+func definitionOf(entity *Entity) *EntityDefinition {
+	return EntityDefinitions[entity.Type]
+}
+
+// isUnit reports whether an entity is a unit that moves around
+func isUnit(entity *Entity) bool {
+	def := definitionOf(entity)
+	return def != nil && def.Kind == KindUnit
+}
+
+// LoadDefinitions loads and validates an entity definitions file
+func LoadDefinitions(path string) (map[string]*EntityDefinition, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open entity definitions: %w", err)
+	}
+	defer file.Close()
+
+	// Unknown keys are errors so a misspelled stat doesn't silently become zero
+	var definitions DefinitionsFileFormat
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&definitions); err != nil {
+		return nil, fmt.Errorf("failed to parse entity definitions %s: %w", path, err)
+	}
+
+	for entityType, def := range definitions.Entities {
+		if def == nil {
+			return nil, fmt.Errorf("entity type %q has no definition", entityType)
+		}
+		if err := def.validate(); err != nil {
+			return nil, fmt.Errorf("entity type %q: %w", entityType, err)
+		}
+		for _, unitType := range def.Trains {
+			if trained := definitions.Entities[unitType]; trained == nil || trained.Kind != KindUnit {
+				return nil, fmt.Errorf("entity type %q trains %q, which is not a defined unit", entityType, unitType)
+			}
+		}
+		for _, buildingType := range def.Builds {
+			if built := definitions.Entities[buildingType]; built == nil || built.Kind != KindBuilding {
+				return nil, fmt.Errorf("entity type %q builds %q, which is not a defined building", entityType, buildingType)
+			}
+		}
+	}
+	if def := definitions.Entities[StartingUnitType]; def == nil || def.Kind != KindUnit {
+		return nil, fmt.Errorf("starting unit type %q must be defined as a unit", StartingUnitType)
+	}
+	return definitions.Entities, nil
+}
+
+// validate checks a definition's stats make sense for its kind
+func (d *EntityDefinition) validate() error {
+	switch d.Kind {
+	case KindUnit:
+		if d.Speed <= 0 {
+			return fmt.Errorf("units need a positive speed, got %v", d.Speed)
+		}
+		if d.FootprintWidth != 0 || d.FootprintHeight != 0 {
+			return fmt.Errorf("units occupy one tile and can't have a footprint")
+		}
+		if len(d.Trains) > 0 {
+			return fmt.Errorf("only buildings can train units")
+		}
+		if d.DropOff {
+			return fmt.Errorf("only buildings can be drop-offs")
+		}
+	case KindBuilding:
+		if d.Speed != 0 {
+			return fmt.Errorf("buildings can't move")
+		}
+		if d.FootprintWidth < 1 || d.FootprintHeight < 1 {
+			return fmt.Errorf("buildings need a footprint of at least 1x1, got %dx%d", d.FootprintWidth, d.FootprintHeight)
+		}
+		if len(d.Builds) > 0 {
+			return fmt.Errorf("only units can construct buildings")
+		}
+		if d.Gather != nil {
+			return fmt.Errorf("only units can gather resources")
+		}
+	default:
+		return fmt.Errorf("kind must be %q or %q, got %q", KindUnit, KindBuilding, d.Kind)
+	}
+
+	switch {
+	case d.Health <= 0:
+		return fmt.Errorf("health must be positive, got %d", d.Health)
+	case d.Cost < 0:
+		return fmt.Errorf("cost can't be negative, got %d", d.Cost)
+	case d.Income < 0:
+		return fmt.Errorf("income can't be negative, got %v", d.Income)
+	case d.Vision < 0:
+		return fmt.Errorf("vision can't be negative, got %d", d.Vision)
+	case d.BuildTime < 0:
+		return fmt.Errorf("build time can't be negative, got %v", d.BuildTime)
+	}
+
+	if attack := d.Attack; attack != nil {
+		switch {
+		case attack.Damage <= 0:
+			return fmt.Errorf("attack damage must be positive, got %d", attack.Damage)
+		case attack.Range < 1:
+			return fmt.Errorf("attack range must be at least 1, got %d", attack.Range)
+		case attack.Cooldown <= 0:
+			return fmt.Errorf("attack cooldown must be positive, got %v", attack.Cooldown)
+		}
+	}
+	if gather := d.Gather; gather != nil {
+		switch {
+		case gather.Capacity <= 0:
+			return fmt.Errorf("gather capacity must be positive, got %d", gather.Capacity)
+		case gather.Rate <= 0:
+			return fmt.Errorf("gather rate must be positive, got %v", gather.Rate)
+		}
+	}
+	return nil
+}
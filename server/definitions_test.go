@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestShippedDefinitionsMatchDefaults verifies the definitions file the server ships with
+// loads and agrees with the compiled-in defaults tests and tools rely on
+func TestShippedDefinitionsMatchDefaults(t *testing.T) {
+	definitions, err := LoadDefinitions(EntitiesFile)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if !reflect.DeepEqual(definitions, EntityDefinitions) {
+		t.Errorf("Expected %s to match the defaults", EntitiesFile)
+		for entityType, def := range definitions {
+			t.Logf("%s: file %+v, default %+v", entityType, def, EntityDefinitions[entityType])
+		}
+	}
+}
+
+// TestLoadDefinitionsRejectsBadStats verifies definitions that can't work are refused with a reason
+func TestLoadDefinitionsRejectsBadStats(t *testing.T) {
+	dir := t.TempDir()
+	worker := `"worker": {"kind": "unit", "health": 100, "speed": 4, "vision": 5}`
+
+	cases := []struct {
+		entities string
+		want     string
+	}{
+		{worker + `, "tower": {"kind": "turret", "health": 100}`, "kind"},
+		{worker + `, "hut": {"kind": "building", "health": 100}`, "footprint"},
+		{worker + `, "hut": {"kind": "building", "health": 0, "footprintWidth": 1, "footprintHeight": 1}`, "health"},
+		{worker + `, "hut": {"kind": "building", "health": 50, "footprintWidth": 1, "footprintHeight": 1, "speed": 1}`, "move"},
+		{worker + `, "scout": {"kind": "unit", "health": 50}`, "speed"},
+		{worker + `, "scout": {"kind": "unit", "health": 50, "speed": 6, "attack": {"damage": 5, "range": 0, "cooldown": "1s"}}`, "range"},
+		{worker + `, "scout": {"kind": "unit", "health": 50, "speed": 6, "hp": 3}`, "unknown field"},
+		{`"scout": {"kind": "unit", "health": 50, "speed": 6}`, "starting unit"},
+		{worker + `, "hut": {"kind": "building", "health": 50, "footprintWidth": 1, "footprintHeight": 1, "trains": ["scout"]}`, "trains"},
+		{worker + `, "scout": {"kind": "unit", "health": 50, "speed": 6, "trains": ["worker"]}`, "only buildings"},
+		{worker + `, "scout": {"kind": "unit", "health": 50, "speed": 6, "builds": ["worker"]}`, "builds"},
+		{worker + `, "hut": {"kind": "building", "health": 50, "footprintWidth": 1, "footprintHeight": 1, "builds": ["hut"]}`, "only units"},
+		{worker + `, "scout": {"kind": "unit", "health": 50, "speed": 6, "gather": {"capacity": 0, "rate": 1}}`, "capacity"},
+		{worker + `, "scout": {"kind": "unit", "health": 50, "speed": 6, "gather": {"capacity": 5, "rate": 0}}`, "rate"},
+		{worker + `, "scout": {"kind": "unit", "health": 50, "speed": 6, "dropOff": true}`, "drop-offs"},
+		{worker + `, "hut": {"kind": "building", "health": 50, "footprintWidth": 1, "footprintHeight": 1, "gather": {"capacity": 5, "rate": 1}}`, "only units can gather"},
+	}
+	for i, c := range cases {
+		path := filepath.Join(dir, "entities.json")
+		os.WriteFile(path, []byte(`{"version": "1.0", "entities": {`+c.entities+`}}`), 0o644)
+		if _, err := LoadDefinitions(path); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("Case %d: expected error mentioning %q, got %v", i, c.want, err)
+		}
+	}
+}
+
+// TestNewBuildingTypeFromDefinitions verifies a building type that only exists in the
+// definitions can be built, costs what it says and earns its income (with no build time
+// it goes up on the spot)
+func TestNewBuildingTypeFromDefinitions(t *testing.T) {
+	defaults := EntityDefinitions
+	t.Cleanup(func() { EntityDefinitions = defaults })
+	worker := *defaults[StartingUnitType]
+	worker.Builds = []string{"mine"}
+	EntityDefinitions = map[string]*EntityDefinition{
+		StartingUnitType: &worker,
+		"mine":           {Kind: KindBuilding, Health: 300, FootprintWidth: 3, FootprintHeight: 1, Cost: 80, Income: 20, Vision: 2},
+	}
+
+	server, alice, _, _ := newEventsTestServer()
+	alice.Money = 100
+	build := Command{Type: "build", Data: map[string]interface{}{
+		"unitIds": []interface{}{float64(10)}, "buildingType": "mine", "tileX": float64(5), "tileY": float64(5),
+	}}
+	if err := server.processCommand(build, alice); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var mine *Entity
+	for _, entity := range server.entities {
+		if entity.Type == "mine" {
+			mine = entity
+		}
+	}
+	if mine == nil || mine.MaxHealth != 300 || mine.FootprintWidth != 3 || mine.FootprintHeight != 1 || alice.Money != 20 {
+		t.Fatalf("Expected a 3x1 mine with 300 HP for 80 money, got %+v with %.0f left", mine, alice.Money)
+	}
+	if !server.isTileOccupiedByBuilding(7, 5) || server.isTileOccupiedByBuilding(5, 6) {
+		t.Error("Expected the mine to block exactly its footprint")
+	}
+
+	for i := 0; i < TickRate; i++ {
+		server.gameTick()
+	}
+	if alice.Money < 39.9 || alice.Money > 40.1 {
+		t.Errorf("Expected a second of mine income, got %.2f money", alice.Money)
+	}
+}
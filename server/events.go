@@ -0,0 +1,135 @@
+package main
+
+// Reliable event types
+const (
+	EventEntityDestroyed       = "entity_destroyed"       // Entity killed (as opposed to leaving view)
+	EventBuildingCompleted     = "building_completed"     // Building finished and working
+	EventConstructionCancelled = "construction_cancelled" // Site removed by its owner before it was finished
+	EventDamageDealt           = "damage_dealt"           // Entity took damage
+	EventPlayerJoined          = "player_joined"          // New player in the room
+	EventIncomeReceived        = "income_received"        // Money earned over the last second (own only)
+	EventUnitTrained           = "unit_trained"           // Building finished training a unit
+	EventResourceDepleted      = "resource_depleted"      // Resource node ran out for good and was removed
+)
+
+// GameEvent is a one-off happening delivered reliably and in order, alongside the
+// unreliable snapshot stream. Clients acknowledge events by sequence in their ack.
+type GameEvent struct {
+	Seq        uint32  `json:"seq"`  // Per-client event sequence
+	Tick       uint64  `json:"tick"` // Tick it happened on
+	Type       string  `json:"type"`
+	EntityId   uint32  `json:"entityId,omitempty"`   // Entity it happened to
+	EntityType string  `json:"entityType,omitempty"` // That entity's type
+	PlayerId   uint32  `json:"playerId,omitempty"`   // Player responsible (attacker, builder, joiner, earner)
+	Amount     float32 `json:"amount,omitempty"`     // Damage dealt or money received
+	X          int     `json:"x"`                    // Tile it happened on
+	Y          int     `json:"y"`
+	Name       string  `json:"name,omitempty"` // Joining player's name
+
+	audience eventAudience
+	ownerId  uint32 // Owner of EntityId, who always hears about it
+	width    int    // Footprint of the entity, for visibility checks
+	height   int
+}
+
+// eventAudience decides which clients an event is delivered to
+type eventAudience int
+
+const (
+	audienceAll     eventAudience = iota // Everyone in the room
+	audienceNearby                       // Teams involved or able to see the spot
+	audiencePrivate                      // PlayerId only
+)
+
+// eventOutbox holds events waiting for one client's acknowledgement
+type eventOutbox struct {
+	events  []GameEvent
+	nextSeq uint32
+}
+
+// add numbers event and queues it. A client that falls MaxPendingEvents behind loses
+// the oldest ones; snapshots still carry the resulting state.
+func (o *eventOutbox) add(event GameEvent) {
+	o.nextSeq++
+	event.Seq = o.nextSeq
+	o.events = append(o.events, event)
+	if len(o.events) > MaxPendingEvents {
+		o.events = o.events[len(o.events)-MaxPendingEvents:]
+	}
+}
+
+// ack forgets every event up to and including seq
+func (o *eventOutbox) ack(seq uint32) {
+	kept := 0
+	for kept < len(o.events) && o.events[kept].Seq <= seq {
+		kept++
+	}
+	o.events = o.events[kept:]
+}
+
+// pending returns the oldest unacknowledged events that happened by tick (delayed
+// spectators only hear about what their snapshot already shows), at most MaxEventsPerSnapshot
+func (o *eventOutbox) pending(tick uint64) []GameEvent {
+	n := 0
+	for n < len(o.events) && n < MaxEventsPerSnapshot && o.events[n].Tick <= tick {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	return append([]GameEvent(nil), o.events[:n]...)
+}
+
+// emitEvent records an event for delivery with the next snapshots. Must be called with s.mu held.
+func (s *GameServer) emitEvent(event GameEvent) {
+	event.Tick = s.tick
+	s.tickEvents = append(s.tickEvents, event)
+}
+
+// entityEvent returns an event about entity, heard by its owner, playerId's team and
+// anyone who can see where it is
+func entityEvent(eventType string, entity *Entity, playerId uint32) GameEvent {
+	return GameEvent{
+		Type:       eventType,
+		EntityId:   entity.Id,
+		EntityType: entity.Type,
+		PlayerId:   playerId,
+		X:          entity.TileX,
+		Y:          entity.TileY,
+		audience:   audienceNearby,
+		ownerId:    entity.OwnerId,
+		width:      entity.FootprintWidth,
+		height:     entity.FootprintHeight,
+	}
+}
+
+// distributeEvents queues this tick's events for every client that negotiated them and
+// may know about them, judged with the same vision as this tick's snapshots.
+// Must be called with s.mu held.
+func (s *GameServer) distributeEvents() {
+	for _, event := range s.tickEvents {
+		for _, client := range s.clients {
+			if client.Capabilities[CapReliableEvents] && s.eventVisibleTo(client, &event) {
+				client.Events.add(event)
+			}
+		}
+	}
+	s.tickEvents = s.tickEvents[:0]
+}
+
+// eventVisibleTo reports whether client may hear about event. Must be called with s.mu held.
+func (s *GameServer) eventVisibleTo(client *Client, event *GameEvent) bool {
+	if client.Spectator {
+		return true
+	}
+	switch event.audience {
+	case audiencePrivate:
+		return client.Id == event.PlayerId
+	case audienceNearby:
+		if s.ownerTeam(event.ownerId) == client.Team || s.ownerTeam(event.PlayerId) == client.Team {
+			return true
+		}
+		return s.teamVision(client.Team).seesArea(event.X, event.Y, event.width, event.height)
+	}
+	return true
+}
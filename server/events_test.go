@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// newEventsTestServer returns the visibility test match with both players taking reliable
+// events, a generator of Bob's in his corner and Carol (team 2) watching it from nearby
+func newEventsTestServer() (*GameServer, *Client, *Client, *Client) {
+	server, alice, bob := newVisibilityTestServer()
+	server.phase = PhaseRunning
+	carol := &Client{Id: 3, Name: "Carol", Team: 2, SessionToken: "c"}
+	server.clients[3] = carol
+	server.entities[30] = &Entity{Id: 30, OwnerId: 3, Type: "worker", TileX: 32, TileY: 30, TargetTileX: 32, TargetTileY: 30, Health: 100, MaxHealth: 100}
+	server.entities[40] = &Entity{Id: 40, OwnerId: 2, Type: "generator", TileX: 33, TileY: 32, TargetTileX: 33, TargetTileY: 32,
+		Health: 10, MaxHealth: 100, FootprintWidth: 2, FootprintHeight: 2}
+
+	for _, client := range []*Client{alice, bob, carol} {
+		client.Capabilities = capabilitySet{CapReliableEvents: true}
+		client.Addr = &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(client.Id)), Port: 1000}
+	}
+	return server, alice, bob, carol
+}
+
+func eventTypes(events []GameEvent) []string {
+	types := make([]string, 0, len(events))
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+// TestAttackEventsReachInvolvedAndNearbyTeams verifies damage and destruction events go to
+// attacker, owner and anyone who can see the spot, but not to teams out of sight
+func TestAttackEventsReachInvolvedAndNearbyTeams(t *testing.T) {
+	server, alice, bob, carol := newEventsTestServer()
+	server.tick = 1
+	server.entities[11] = &Entity{Id: 11, OwnerId: 1, Type: "worker", TileX: 35, TileY: 33, TargetTileX: 35, TargetTileY: 33, Health: 100, MaxHealth: 100}
+
+	attack := Command{Type: "attack", Data: map[string]interface{}{"unitIds": []interface{}{float64(11)}, "targetId": float64(40)}}
+	if err := server.handleAttackCommand(attack, alice); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	server.updateCombat()
+	server.distributeEvents()
+
+	for _, client := range []*Client{alice, bob, carol} {
+		types := eventTypes(client.Events.events)
+		if len(types) != 2 || types[0] != EventDamageDealt || types[1] != EventEntityDestroyed {
+			t.Errorf("%s: expected damage then destruction, got %v", client.Name, types)
+		}
+	}
+	if destroyed := bob.Events.events[1]; destroyed.EntityId != 40 || destroyed.PlayerId != alice.Id || destroyed.X != 33 {
+		t.Errorf("Expected destruction of 40 by Alice at x=33, got %+v", destroyed)
+	}
+
+	// A fourth team far away hears nothing, and clients that didn't negotiate events get none
+	dave := &Client{Id: 4, Name: "Dave", Team: 3, Capabilities: capabilitySet{CapReliableEvents: true}}
+	eve := &Client{Id: 5, Name: "Eve", Team: 1}
+	server.clients[4], server.clients[5] = dave, eve
+	server.tick = 2
+	server.emitEvent(entityEvent(EventBuildingCompleted, server.entities[20], bob.Id))
+	server.distributeEvents()
+	if len(dave.Events.events) != 0 || len(eve.Events.events) != 0 {
+		t.Errorf("Expected no events for Dave (out of sight) or Eve (not negotiated), got %d and %d",
+			len(dave.Events.events), len(eve.Events.events))
+	}
+}
+
+// TestEventsResentUntilAcknowledged verifies events ride on every snapshot until the
+// client's ack covers them
+func TestEventsResentUntilAcknowledged(t *testing.T) {
+	server, alice, _, _ := newEventsTestServer()
+	server.tick = 1
+	server.emitEvent(GameEvent{Type: EventPlayerJoined, PlayerId: 9, Name: "Zed"})
+	server.emitEvent(GameEvent{Type: EventIncomeReceived, PlayerId: alice.Id, Amount: 10, audience: audiencePrivate})
+	server.distributeEvents()
+
+	for tick := uint64(1); tick <= 2; tick++ {
+		server.tick = tick
+		if snapshot := server.buildSnapshot(alice, server.captureWorldState()); len(snapshot.Events) != 2 {
+			t.Fatalf("Tick %d: expected both events in the snapshot, got %v", tick, eventTypes(snapshot.Events))
+		}
+	}
+
+	server.handleAck(AckMessage{ClientId: alice.Id, SessionToken: alice.SessionToken, Tick: 2, EventSeq: 1}, alice.Addr)
+	server.tick = 3
+	snapshot := server.buildSnapshot(alice, server.captureWorldState())
+	if len(snapshot.Events) != 1 || snapshot.Events[0].Seq != 2 || snapshot.Events[0].Type != EventIncomeReceived {
+		t.Errorf("Expected only the unacknowledged income event, got %+v", snapshot.Events)
+	}
+}
+
+// TestEventOutboxLimits verifies per-snapshot and backlog caps and that delayed snapshots
+// only carry events that had happened by their tick
+func TestEventOutboxLimits(t *testing.T) {
+	var outbox eventOutbox
+	for tick := uint64(1); tick <= MaxPendingEvents+10; tick++ {
+		outbox.add(GameEvent{Tick: tick})
+	}
+	if len(outbox.events) != MaxPendingEvents || outbox.events[0].Seq != 11 {
+		t.Errorf("Expected backlog capped at %d starting at seq 11, got %d from %d", MaxPendingEvents, len(outbox.events), outbox.events[0].Seq)
+	}
+	if pending := outbox.pending(MaxPendingEvents + 10); len(pending) != MaxEventsPerSnapshot {
+		t.Errorf("Expected %d events per snapshot, got %d", MaxEventsPerSnapshot, len(pending))
+	}
+	if pending := outbox.pending(13); len(pending) != 3 {
+		t.Errorf("Expected events up to tick 13 only, got %d", len(pending))
+	}
+}
+
+// TestIncomeReportedOncePerSecond verifies generator income becomes one private event a second
+func TestIncomeReportedOncePerSecond(t *testing.T) {
+	server, alice, bob, _ := newEventsTestServer()
+	server.entities[40].Health = 100
+
+	for i := 0; i < TickRate; i++ {
+		server.gameTick()
+	}
+
+	types := eventTypes(bob.Events.events)
+	if len(types) != 1 || types[0] != EventIncomeReceived {
+		t.Fatalf("Expected one income event for Bob, got %v", types)
+	}
+	income := EntityDefinitions["generator"].Income
+	if amount := bob.Events.events[0].Amount; amount < income-0.01 || amount > income+0.01 {
+		t.Errorf("Expected %v income, got %v", income, amount)
+	}
+	if len(alice.Events.events) != 0 {
+		t.Errorf("Expected Alice not to hear about Bob's income, got %v", eventTypes(alice.Events.events))
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FragmentOverhead is the space reserved in each datagram for the fragment envelope
+// ({"type":"fragment","data":{"id":...,"index":...,"count":...,"payload":"..."}} in JSON)
+const FragmentOverhead = 128
+
+// MaxUDPPayload is the most a single UDP datagram can carry over IPv4
+const MaxUDPPayload = 65507
+
+// FragmentMessage carries one piece of an encoded Message that didn't fit in a datagram.
+// Reassembling all pieces in index order yields the original encoded Message.
+type FragmentMessage struct {
+	Id      uint32 `json:"id"`      // Shared by all fragments of one message
+	Index   int    `json:"index"`   // 0-based position of this fragment
+	Count   int    `json:"count"`   // Total fragments in the message
+	Payload []byte `json:"payload"` // Slice of the encoded message (base64 in JSON)
+}
+
+// writeDatagrams sends an encoded message to addr, fragmenting it (in the same codec) if
+// it exceeds the maximum datagram size
+func (s *GameServer) writeDatagrams(codec Codec, data []byte, addr net.Addr) {
+	writeMessage(s.conn, codec, data, s.maxDatagramSize, s.nextFragmentId, addr)
+}
+
+// writeMessage delivers an encoded message to addr: as a single frame to WebSocket peers,
+// otherwise as UDP datagrams of at most limit bytes on conn
+func writeMessage(conn *net.UDPConn, codec Codec, data []byte, limit int, nextId *uint32, addr net.Addr) {
+	if peer, ok := addr.(*wsPeer); ok {
+		peer.send(data)
+		return
+	}
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if conn == nil || !ok {
+		return // Not listening (simulation-only server, e.g. in tests)
+	}
+
+	datagrams, err := fragmentDatagrams(codec, data, limit, nextId)
+	if err != nil {
+		log.Printf("Error fragmenting message for %s: %v", addr, err)
+		return
+	}
+
+	for _, datagram := range datagrams {
+		conn.WriteToUDP(datagram, udpAddr)
+	}
+}
+
+// fragmentMessage splits an encoded message into datagrams no larger than the maximum
+// datagram size. Messages that already fit are returned unchanged.
+func (s *GameServer) fragmentMessage(codec Codec, data []byte) ([][]byte, error) {
+	return fragmentDatagrams(codec, data, s.maxDatagramSize, s.nextFragmentId)
+}
+
+// fragmentDatagrams splits data into datagrams of at most limit bytes, numbering
+// fragmented messages from nextId (accessed atomically)
+func fragmentDatagrams(codec Codec, data []byte, limit int, nextId *uint32) ([][]byte, error) {
+	if limit <= 0 {
+		limit = MaxDatagramSize
+	}
+	if len(data) <= limit {
+		return [][]byte{data}, nil
+	}
+
+	// Payload is base64 encoded in JSON (4 bytes per 3), raw in binary
+	chunkSize := limit - FragmentOverhead
+	if _, isJSON := codec.(jsonCodec); isJSON {
+		chunkSize = chunkSize * 3 / 4
+	}
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("max datagram size %d too small for fragmentation", limit)
+	}
+
+	count := (len(data) + chunkSize - 1) / chunkSize
+	if count > MaxFragmentCount {
+		return nil, fmt.Errorf("message of %d bytes needs %d fragments (max %d)", len(data), count, MaxFragmentCount)
+	}
+
+	id := atomic.AddUint32(nextId, 1)
+	datagrams := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		fragment := FragmentMessage{
+			Id:      id,
+			Index:   i,
+			Count:   count,
+			Payload: data[i*chunkSize : end],
+		}
+		datagram, err := codec.Encode(MsgFragment, fragment)
+		if err != nil {
+			return nil, err
+		}
+		datagrams = append(datagrams, datagram)
+	}
+
+	return datagrams, nil
+}
+
+// reassemble buffers an incoming fragment and returns the original message once all of
+// its fragments have arrived
+func (a *fragmentAssembler) reassemble(msg Message, addr net.Addr) (Message, bool) {
+	var fragment FragmentMessage
+	if err := json.Unmarshal(msg.Data, &fragment); err != nil {
+		log.Printf("Error unmarshaling fragment: %v", err)
+		return Message{}, false
+	}
+
+	sender := "<nil>"
+	if addr != nil {
+		sender = addr.String()
+	}
+	data, complete := a.add(sender, fragment, time.Now())
+	if !complete {
+		return Message{}, false
+	}
+
+	original, err := decodeDatagram(data)
+	if err != nil {
+		log.Printf("Error unmarshaling reassembled message from %s: %v", addr, err)
+		return Message{}, false
+	}
+	if original.Type == MsgFragment {
+		return Message{}, false // Nested fragments are never valid
+	}
+
+	return original, true
+}
+
+// fragmentKey identifies one fragmented message from one sender
+type fragmentKey struct {
+	sender string
+	id     uint32
+}
+
+// partialMessage collects the fragments of one message as they arrive
+type partialMessage struct {
+	parts     [][]byte
+	received  int
+	firstSeen time.Time
+}
+
+// fragmentAssembler reassembles fragmented messages, dropping any that don't complete
+// within FragmentTimeout
+type fragmentAssembler struct {
+	mu      sync.Mutex
+	pending map[fragmentKey]*partialMessage
+}
+
+func newFragmentAssembler() *fragmentAssembler {
+	return &fragmentAssembler{
+		pending: make(map[fragmentKey]*partialMessage),
+	}
+}
+
+// add stores a fragment and returns the reassembled message once it is complete
+func (a *fragmentAssembler) add(sender string, fragment FragmentMessage, now time.Time) ([]byte, bool) {
+	if fragment.Count <= 0 || fragment.Count > MaxFragmentCount ||
+		fragment.Index < 0 || fragment.Index >= fragment.Count {
+		return nil, false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.expire(now)
+
+	key := fragmentKey{sender: sender, id: fragment.Id}
+	partial, exists := a.pending[key]
+	if !exists {
+		partial = &partialMessage{
+			parts:     make([][]byte, fragment.Count),
+			firstSeen: now,
+		}
+		a.pending[key] = partial
+	}
+
+	// Count must agree across fragments; duplicates are ignored
+	if len(partial.parts) != fragment.Count || partial.parts[fragment.Index] != nil {
+		return nil, false
+	}
+
+	partial.parts[fragment.Index] = fragment.Payload
+	partial.received++
+	if partial.received < fragment.Count {
+		return nil, false
+	}
+
+	delete(a.pending, key)
+
+	size := 0
+	for _, part := range partial.parts {
+		size += len(part)
+	}
+	data := make([]byte, 0, size)
+	for _, part := range partial.parts {
+		data = append(data, part...)
+	}
+	return data, true
+}
+
+// expire drops partial messages older than FragmentTimeout. Must be called with a.mu held.
+func (a *fragmentAssembler) expire(now time.Time) {
+	for key, partial := range a.pending {
+		if now.Sub(partial.firstSeen) > FragmentTimeout {
+			delete(a.pending, key)
+		}
+	}
+}
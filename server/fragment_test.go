@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// decodeFragments parses datagrams produced by fragmentMessage back into fragments
+func decodeFragments(t *testing.T, datagrams [][]byte) []FragmentMessage {
+	t.Helper()
+
+	fragments := make([]FragmentMessage, 0, len(datagrams))
+	for i, datagram := range datagrams {
+		var msg Message
+		if err := json.Unmarshal(datagram, &msg); err != nil {
+			t.Fatalf("Datagram %d is not a valid message: %v", i, err)
+		}
+		if msg.Type != MsgFragment {
+			t.Fatalf("Datagram %d has type %q, expected fragment", i, msg.Type)
+		}
+		var fragment FragmentMessage
+		if err := json.Unmarshal(msg.Data, &fragment); err != nil {
+			t.Fatalf("Datagram %d has invalid fragment body: %v", i, err)
+		}
+		fragments = append(fragments, fragment)
+	}
+	return fragments
+}
+
+// TestSmallMessageNotFragmented verifies messages under the limit are sent as-is
+func TestSmallMessageNotFragmented(t *testing.T) {
+	server := NewGameServer()
+	data := []byte(`{"type":"pong","data":{}}`)
+
+	datagrams, err := server.fragmentMessage(jsonCodec{}, data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(datagrams) != 1 || !bytes.Equal(datagrams[0], data) {
+		t.Errorf("Expected message to be sent unchanged, got %d datagrams", len(datagrams))
+	}
+}
+
+// TestFragmentRoundTrip verifies a large message is split under the limit and reassembled
+func TestFragmentRoundTrip(t *testing.T) {
+	server := NewGameServer()
+	server.maxDatagramSize = 512
+
+	// Snapshot with enough entities to exceed several datagrams
+	snapshot := SnapshotMessage{Tick: 42, Players: map[string]Player{}}
+	for i := uint32(1); i <= 50; i++ {
+		snapshot.Entities = append(snapshot.Entities, Entity{Id: i, Type: "worker", Health: 100, MaxHealth: 100})
+	}
+	data, _ := json.Marshal(Message{Type: MsgSnapshot, Data: server.marshalData(snapshot)})
+
+	datagrams, err := server.fragmentMessage(jsonCodec{}, data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(datagrams) < 2 {
+		t.Fatalf("Expected message of %d bytes to be fragmented, got %d datagram(s)", len(data), len(datagrams))
+	}
+	for i, datagram := range datagrams {
+		if len(datagram) > server.maxDatagramSize {
+			t.Errorf("Datagram %d is %d bytes, exceeds limit %d", i, len(datagram), server.maxDatagramSize)
+		}
+	}
+
+	// Deliver in reverse order
+	fragments := decodeFragments(t, datagrams)
+	assembler := newFragmentAssembler()
+	now := time.Now()
+	var result []byte
+	for i := len(fragments) - 1; i >= 0; i-- {
+		out, complete := assembler.add("client", fragments[i], now)
+		if complete != (i == 0) {
+			t.Fatalf("Fragment %d: complete=%v", i, complete)
+		}
+		result = out
+	}
+
+	if !bytes.Equal(result, data) {
+		t.Error("Reassembled message does not match original")
+	}
+}
+
+// TestFragmentTimeout verifies incomplete messages are discarded after FragmentTimeout
+func TestFragmentTimeout(t *testing.T) {
+	server := NewGameServer()
+	server.maxDatagramSize = 256
+
+	data := []byte(`{"type":"snapshot","data":{"padding":"` + strings.Repeat("x", 1000) + `"}}`)
+	datagrams, err := server.fragmentMessage(jsonCodec{}, data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fragments := decodeFragments(t, datagrams)
+
+	assembler := newFragmentAssembler()
+	start := time.Now()
+	for _, fragment := range fragments[:len(fragments)-1] {
+		assembler.add("client", fragment, start)
+	}
+
+	// Last fragment arrives too late: the partial message is gone, so it starts a new one
+	_, complete := assembler.add("client", fragments[len(fragments)-1], start.Add(FragmentTimeout+time.Second))
+	if complete {
+		t.Error("Expected late fragment not to complete an expired message")
+	}
+	if len(assembler.pending) != 1 {
+		t.Errorf("Expected only the late fragment to be pending, got %d partial messages", len(assembler.pending))
+	}
+}
+
+// TestReassembleFragmentDispatchesOriginal verifies the server unwraps a completed message
+func TestReassembleFragmentDispatchesOriginal(t *testing.T) {
+	server := NewGameServer()
+	server.maxDatagramSize = 256
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+
+	hello := HelloMessage{ClientVersion: "1.0", PlayerName: strings.Repeat("n", 600)}
+	data, _ := json.Marshal(Message{Type: MsgHello, Data: server.marshalData(hello)})
+	datagrams, err := server.fragmentMessage(jsonCodec{}, data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	assembler := newFragmentAssembler()
+	var result Message
+	var complete bool
+	for _, datagram := range datagrams {
+		var msg Message
+		json.Unmarshal(datagram, &msg)
+		result, complete = assembler.reassemble(msg, addr)
+	}
+
+	if !complete {
+		t.Fatal("Expected message to be complete after all fragments")
+	}
+	if result.Type != MsgHello {
+		t.Errorf("Expected reassembled hello, got %q", result.Type)
+	}
+}
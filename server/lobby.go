@@ -0,0 +1,360 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"time"
+)
+
+// MatchPhase is where a room is in its match lifecycle
+type MatchPhase string
+
+const (
+	PhaseLobby     MatchPhase = "lobby"     // Players pick teams and ready up; nothing spawned yet
+	PhaseCountdown MatchPhase = "countdown" // Host started; units spawn at StartTick
+	PhaseRunning   MatchPhase = "running"   // Match in progress
+)
+
+// Late join policies (what happens to a hello once the match has started)
+const (
+	LateJoinSpectate = "spectate" // Join as a spectator without units
+	LateJoinRefuse   = "refuse"   // Reject with match_in_progress
+)
+
+// SetTeamMessage picks a team and, optionally, one of that team's spawn points
+type SetTeamMessage struct {
+	ClientId     uint32 `json:"clientId"`
+	SessionToken string `json:"sessionToken"`
+	Team         int    `json:"team"`
+	SpawnSlot    int    `json:"spawnSlot"` // 1-based index into the lobby's spawnSlots (0 = any of the team's)
+}
+
+type SetReadyMessage struct {
+	ClientId     uint32 `json:"clientId"`
+	SessionToken string `json:"sessionToken"`
+	Ready        bool   `json:"ready"`
+}
+
+// StartMatchMessage asks to start the countdown (host only, everyone ready)
+type StartMatchMessage struct {
+	ClientId     uint32 `json:"clientId"`
+	SessionToken string `json:"sessionToken"`
+}
+
+// LobbyStateMessage lists everyone in the room and the match phase. Sent whenever it
+// changes and periodically until the match is running.
+type LobbyStateMessage struct {
+	Phase      MatchPhase    `json:"phase"`
+	HostId     uint32        `json:"hostId"`
+	StartTick  uint64        `json:"startTick,omitempty"` // Tick units spawn on (countdown and running)
+	LateJoin   string        `json:"lateJoin"`
+	SpawnSlots []LobbySlot   `json:"spawnSlots"`
+	Players    []LobbyPlayer `json:"players"`
+}
+
+// LobbySlot is a spawn point players can claim
+type LobbySlot struct {
+	Slot int `json:"slot"` // 1-based
+	Team int `json:"team"`
+	X    int `json:"x"`
+	Y    int `json:"y"`
+}
+
+type LobbyPlayer struct {
+	Id           uint32 `json:"id"`
+	Name         string `json:"name"`
+	Team         int    `json:"team"`
+	SpawnSlot    int    `json:"spawnSlot,omitempty"`
+	Ready        bool   `json:"ready"`
+	Spectator    bool   `json:"spectator,omitempty"`
+	Disconnected bool   `json:"disconnected,omitempty"`
+}
+
+// lobbyState describes the room for lobby_state. Must be called with s.mu held.
+func (s *GameServer) lobbyState() LobbyStateMessage {
+	state := LobbyStateMessage{
+		Phase:      s.phase,
+		HostId:     s.hostId,
+		StartTick:  s.startTick,
+		LateJoin:   s.lateJoin,
+		SpawnSlots: make([]LobbySlot, 0, len(s.mapData.SpawnPoints)),
+		Players:    make([]LobbyPlayer, 0, len(s.clients)),
+	}
+
+	for i, spawn := range s.mapData.SpawnPoints {
+		state.SpawnSlots = append(state.SpawnSlots, LobbySlot{Slot: i + 1, Team: spawn.Team, X: spawn.X, Y: spawn.Y})
+	}
+
+	for _, client := range s.clients {
+		state.Players = append(state.Players, LobbyPlayer{
+			Id:           client.Id,
+			Name:         client.Name,
+			Team:         client.Team,
+			SpawnSlot:    client.SpawnSlot,
+			Ready:        client.Ready,
+			Spectator:    client.Spectator,
+			Disconnected: client.Disconnected,
+		})
+	}
+	sort.Slice(state.Players, func(i, j int) bool {
+		return state.Players[i].Id < state.Players[j].Id
+	})
+
+	return state
+}
+
+// setTeam moves client to team and claims spawnSlot (0 = any). Must be called with s.mu held.
+func (s *GameServer) setTeam(client *Client, team, spawnSlot int) error {
+	if err := s.checkLobbyAction(client); err != nil {
+		return err
+	}
+	if team < 0 || team >= MaxClients {
+		return newCommandError(ErrInvalidTeam, "team must be between 0 and %d", MaxClients-1)
+	}
+
+	if spawnSlot != 0 {
+		if spawnSlot < 1 || spawnSlot > len(s.mapData.SpawnPoints) {
+			return newCommandError(ErrInvalidSlot, "spawn slot %d does not exist (map has %d)", spawnSlot, len(s.mapData.SpawnPoints))
+		}
+		if s.mapData.SpawnPoints[spawnSlot-1].Team != team {
+			return newCommandError(ErrInvalidSlot, "spawn slot %d belongs to team %d", spawnSlot, s.mapData.SpawnPoints[spawnSlot-1].Team)
+		}
+		for _, other := range s.clients {
+			if other.Id != client.Id && other.SpawnSlot == spawnSlot {
+				return newCommandError(ErrInvalidSlot, "spawn slot %d is taken by %s", spawnSlot, other.Name)
+			}
+		}
+	}
+
+	client.Team = team
+	client.SpawnSlot = spawnSlot
+	client.Ready = false // Changing sides needs a fresh ready
+	s.lobbyDirty = true
+	return nil
+}
+
+// setReady sets client's ready flag. Un-readying during the countdown cancels it.
+// Must be called with s.mu held.
+func (s *GameServer) setReady(client *Client, ready bool) error {
+	if client.Spectator {
+		return newCommandError(ErrSpectating, "spectators don't ready up")
+	}
+	if s.phase == PhaseCountdown && !ready {
+		log.Printf("Client %d (%s) is no longer ready, countdown cancelled", client.Id, client.Name)
+		s.phase = PhaseLobby
+		s.startTick = 0
+	} else if s.phase != PhaseLobby {
+		return newCommandError(ErrMatchInProgress, "match has already started")
+	}
+
+	client.Ready = ready
+	s.lobbyDirty = true
+	return nil
+}
+
+// startCountdown starts the match countdown if the host asks and every connected player
+// is ready. Must be called with s.mu held.
+func (s *GameServer) startCountdown(client *Client) error {
+	if s.phase != PhaseLobby {
+		return newCommandError(ErrMatchInProgress, "match has already started")
+	}
+	if client.Id != s.hostId {
+		return newCommandError(ErrNotHost, "only the host can start the match")
+	}
+	for _, other := range s.clients {
+		if !other.Spectator && !other.Disconnected && !other.Ready {
+			return newCommandError(ErrNotReady, "%s is not ready", other.Name)
+		}
+	}
+
+	s.phase = PhaseCountdown
+	s.startTick = s.tick + uint64(MatchCountdown.Seconds()*float64(TickRate))
+	s.lobbyDirty = true
+	log.Printf("Match starting on tick %d (in %v)", s.startTick, MatchCountdown)
+	return nil
+}
+
+// checkLobbyAction returns an error unless client may change its lobby choices.
+// Must be called with s.mu held.
+func (s *GameServer) checkLobbyAction(client *Client) error {
+	if client.Spectator {
+		return newCommandError(ErrSpectating, "spectators can't pick a team")
+	}
+	if s.phase != PhaseLobby {
+		return newCommandError(ErrMatchInProgress, "match has already started")
+	}
+	return nil
+}
+
+// checkCommandAllowed returns an error unless client may issue game commands right now.
+// Must be called with s.mu held.
+func (s *GameServer) checkCommandAllowed(client *Client) error {
+	if client.Spectator {
+		return newCommandError(ErrSpectating, "spectators can't issue commands")
+	}
+	if s.phase != PhaseRunning {
+		return newCommandError(ErrMatchNotStarted, "match has not started")
+	}
+	return nil
+}
+
+// beginMatch spawns every player's starting units at their spawn points and starts the
+// match. Must be called with s.mu held.
+func (s *GameServer) beginMatch() {
+	ids := make([]uint32, 0, len(s.clients))
+	for id := range s.clients {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	claimed := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		if slot := s.clients[id].SpawnSlot; slot != 0 {
+			claimed[slot] = true
+		}
+	}
+
+	// Players who didn't pick a slot take the first free one of their team
+	for _, id := range ids {
+		client := s.clients[id]
+		if client.Spectator {
+			continue
+		}
+		client.Eliminated = false
+		if client.SpawnSlot == 0 {
+			for i, spawn := range s.mapData.SpawnPoints {
+				if spawn.Team == client.Team && !claimed[i+1] {
+					client.SpawnSlot = i + 1
+					claimed[i+1] = true
+					break
+				}
+			}
+		}
+		s.spawnStartingUnits(client)
+	}
+	s.spawnResourceNodes()
+
+	s.phase = PhaseRunning
+	s.startTick = s.tick
+	s.lobbyDirty = true
+	log.Printf("Match started with %d players", len(ids))
+}
+
+// spawnStartingUnits gives client its starting workers at its spawn slot (or its team's
+// default position). Must be called with s.mu held.
+func (s *GameServer) spawnStartingUnits(client *Client) {
+	var spawnBaseTileX, spawnBaseTileY int
+	if client.SpawnSlot > 0 && client.SpawnSlot <= len(s.mapData.SpawnPoints) {
+		spawnBaseTileX, spawnBaseTileY = s.spawnPointPosition(s.mapData.SpawnPoints[client.SpawnSlot-1])
+	} else {
+		spawnBaseTileX, spawnBaseTileY = s.getSpawnPosition(client.Team)
+	}
+
+	def := EntityDefinitions[StartingUnitType]
+	ownedUnits := make([]uint32, 0, 5)
+	for i := 0; i < 5; i++ {
+		entityId := s.nextId
+		s.nextId++
+
+		// Spawn workers in horizontal line
+		workerX := spawnBaseTileX + i
+		workerY := spawnBaseTileY
+
+		// Ensure spawn position is passable (fallback to base position if not)
+		if !s.isTilePassable(workerX, workerY) {
+			workerX = spawnBaseTileX
+			workerY = spawnBaseTileY
+		}
+
+		worker := &Entity{
+			Id:           entityId,
+			OwnerId:      client.Id,
+			Type:         StartingUnitType,
+			TileX:        workerX,
+			TileY:        workerY,
+			TargetTileX:  workerX,
+			TargetTileY:  workerY,
+			MoveProgress: 0.0,
+			Health:       def.Health,
+			MaxHealth:    def.Health,
+		}
+
+		s.entities[entityId] = worker
+		ownedUnits = append(ownedUnits, entityId)
+	}
+	client.OwnedUnits = ownedUnits
+}
+
+// electHost hands host to the earliest-joined connected player if the current host left
+// or timed out. Must be called with s.mu held.
+func (s *GameServer) electHost() {
+	if host, exists := s.clients[s.hostId]; exists && !host.Spectator && !host.Disconnected {
+		return
+	}
+
+	hostId := uint32(0)
+	for id, client := range s.clients {
+		if !client.Spectator && !client.Disconnected && (hostId == 0 || id < hostId) {
+			hostId = id
+		}
+	}
+	if hostId != 0 || s.clients[s.hostId] == nil {
+		s.hostId = hostId
+	}
+	s.lobbyDirty = true
+}
+
+// playerCount returns how many clients (connected or not) are players rather than
+// spectators. Must be called with s.mu held.
+func (s *GameServer) playerCount() int {
+	count := 0
+	for _, client := range s.clients {
+		if !client.Spectator {
+			count++
+		}
+	}
+	return count
+}
+
+// lobbyMessages queues lobby_state for every connected client when it changed, and once a
+// second until the match is running. Must be called with s.mu held.
+func (s *GameServer) lobbyMessages(outgoing []outgoingMessage) []outgoingMessage {
+	if !s.lobbyDirty && (s.phase == PhaseRunning || s.tick%uint64(TickRate) != 0) {
+		return outgoing
+	}
+	s.lobbyDirty = false
+
+	state := s.lobbyState()
+	for _, client := range s.clients {
+		if client.Disconnected {
+			continue
+		}
+		outgoing = append(outgoing, outgoingMessage{
+			addr:    client.Addr,
+			codec:   codecFor(client),
+			msgType: MsgLobbyState,
+			payload: state,
+		})
+	}
+	return outgoing
+}
+
+// handleLobbyAction authenticates a lobby message, applies it and reports a rejection back
+// as a command_error
+func (s *GameServer) handleLobbyAction(msgType MessageType, clientId uint32, token string, clientAddr net.Addr, apply func(*Client) error) {
+	s.mu.Lock()
+	client := s.authenticate(clientId, token, clientAddr)
+	var err error
+	var codec Codec
+	if client != nil {
+		client.LastSeen = time.Now()
+		codec = codecFor(client)
+		err = apply(client)
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		s.sendPayload(codec, MsgCommandError, newCommandErrorMessage(0, string(msgType), err), clientAddr)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// newLobbyTestServer creates a lobby with two players on a map with one spawn point per
+// team plus a second one for team 0
+func newLobbyTestServer() (*GameServer, *Client, *Client) {
+	server := newSessionTestServer()
+	server.mapData.SpawnPoints = []SpawnPoint{
+		{Team: 0, X: 2, Y: 2},
+		{Team: 1, X: 12, Y: 12},
+		{Team: 0, X: 2, Y: 12},
+	}
+
+	server.handleHello(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "Host"}, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000})
+	server.handleHello(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "Guest"}, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000})
+
+	var host, guest *Client
+	for _, client := range server.clients {
+		if client.Name == "Host" {
+			host = client
+		} else {
+			guest = client
+		}
+	}
+	return server, host, guest
+}
+
+func expectCommandError(t *testing.T, err error, reason string) {
+	t.Helper()
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.Reason != reason {
+		t.Errorf("Expected %s, got %v", reason, err)
+	}
+}
+
+// TestHelloJoinsLobbyWithoutUnits verifies nothing spawns before the match starts
+func TestHelloJoinsLobbyWithoutUnits(t *testing.T) {
+	server, host, guest := newLobbyTestServer()
+
+	if len(server.entities) != 0 {
+		t.Errorf("Expected no units in the lobby, got %d entities", len(server.entities))
+	}
+	if server.phase != PhaseLobby || server.hostId != host.Id {
+		t.Errorf("Expected lobby hosted by %d, got phase %s host %d", host.Id, server.phase, server.hostId)
+	}
+	if host.Team != 0 || guest.Team != 1 {
+		t.Errorf("Expected default teams 0 and 1, got %d and %d", host.Team, guest.Team)
+	}
+
+	state := server.lobbyState()
+	if len(state.Players) != 2 || len(state.SpawnSlots) != 3 {
+		t.Errorf("Expected 2 players and 3 spawn slots, got %+v", state)
+	}
+}
+
+// TestSetTeamValidatesSpawnSlot verifies slots must exist, belong to the team and be free
+func TestSetTeamValidatesSpawnSlot(t *testing.T) {
+	server, host, guest := newLobbyTestServer()
+	guest.Ready = true
+
+	expectCommandError(t, server.setTeam(guest, 0, 2), ErrInvalidSlot)
+	expectCommandError(t, server.setTeam(guest, 0, 9), ErrInvalidSlot)
+	expectCommandError(t, server.setTeam(guest, MaxClients, 0), ErrInvalidTeam)
+
+	if err := server.setTeam(host, 0, 3); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectCommandError(t, server.setTeam(guest, 0, 3), ErrInvalidSlot)
+
+	if err := server.setTeam(guest, 0, 1); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if guest.Team != 0 || guest.SpawnSlot != 1 || guest.Ready {
+		t.Errorf("Expected guest on team 0 slot 1 and no longer ready, got team %d slot %d ready %v",
+			guest.Team, guest.SpawnSlot, guest.Ready)
+	}
+}
+
+// TestStartMatchSpawnsAtChosenSlots verifies the host starts a countdown once everyone is
+// ready and units appear at each player's spawn point when it ends
+func TestStartMatchSpawnsAtChosenSlots(t *testing.T) {
+	server, host, guest := newLobbyTestServer()
+	server.setTeam(host, 0, 3)
+
+	expectCommandError(t, server.startCountdown(host), ErrNotReady)
+	server.setReady(host, true)
+	server.setReady(guest, true)
+	expectCommandError(t, server.startCountdown(guest), ErrNotHost)
+
+	if err := server.startCountdown(host); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectCommandError(t, server.setTeam(guest, 0, 0), ErrMatchInProgress)
+
+	for server.phase == PhaseCountdown {
+		if len(server.entities) != 0 {
+			t.Fatal("Expected no units before the countdown ends")
+		}
+		server.gameTick()
+	}
+
+	if server.phase != PhaseRunning || server.tick != uint64(MatchCountdown.Seconds()*float64(TickRate)) {
+		t.Fatalf("Expected match running after the countdown, got %s on tick %d", server.phase, server.tick)
+	}
+	if len(host.OwnedUnits) != 5 || len(guest.OwnedUnits) != 5 {
+		t.Fatalf("Expected 5 workers each, got %d and %d", len(host.OwnedUnits), len(guest.OwnedUnits))
+	}
+	if worker := server.entities[host.OwnedUnits[0]]; worker.TileX != 2 || worker.TileY != 12 {
+		t.Errorf("Expected host's units at slot 3 (2,12), got (%d,%d)", worker.TileX, worker.TileY)
+	}
+	if worker := server.entities[guest.OwnedUnits[0]]; worker.TileX != 12 || worker.TileY != 12 {
+		t.Errorf("Expected guest's units at team 1's slot (12,12), got (%d,%d)", worker.TileX, worker.TileY)
+	}
+}
+
+// TestUnreadyCancelsCountdown verifies a player backing out stops the countdown
+func TestUnreadyCancelsCountdown(t *testing.T) {
+	server, host, guest := newLobbyTestServer()
+	server.setReady(host, true)
+	server.setReady(guest, true)
+	server.startCountdown(host)
+
+	if err := server.setReady(guest, false); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if server.phase != PhaseLobby {
+		t.Errorf("Expected countdown cancelled, got phase %s", server.phase)
+	}
+}
+
+// TestLateJoinFollowsRoomSetting verifies late joiners spectate or are refused
+func TestLateJoinFollowsRoomSetting(t *testing.T) {
+	server, _, _ := newLobbyTestServer()
+	server.beginMatch()
+	entities := len(server.entities)
+
+	server.handleHello(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "Late"}, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 1000})
+	var late *Client
+	for _, client := range server.clients {
+		if client.Name == "Late" {
+			late = client
+		}
+	}
+	if late == nil || !late.Spectator || len(server.entities) != entities {
+		t.Fatalf("Expected late joiner to spectate without units, got %+v", late)
+	}
+	expectCommandError(t, server.checkCommandAllowed(late), ErrSpectating)
+
+	server.lateJoin = LateJoinRefuse
+	server.handleHello(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "Later"}, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 4), Port: 1000})
+	if len(server.clients) != 3 {
+		t.Errorf("Expected late joiner refused, got %d clients", len(server.clients))
+	}
+}
+
+// TestHostHandoffAndLobbyReset verifies the host role passes on and an empty match
+// returns to the lobby
+func TestHostHandoffAndLobbyReset(t *testing.T) {
+	server, host, guest := newLobbyTestServer()
+
+	server.removeClient(host.Id)
+	if server.hostId != guest.Id {
+		t.Errorf("Expected guest to become host, got %d", server.hostId)
+	}
+
+	server.beginMatch()
+	server.clients[99] = &Client{Id: 99, Name: "Watcher", Spectator: true, Team: -1}
+	server.removeClient(guest.Id)
+
+	if server.phase != PhaseLobby || len(server.entities) != 0 {
+		t.Errorf("Expected empty match to return to lobby, got phase %s with %d entities", server.phase, len(server.entities))
+	}
+	if watcher := server.clients[99]; watcher.Spectator || server.hostId != 99 {
+		t.Errorf("Expected remaining spectator to become a player and host, got spectator=%v host %d", watcher.Spectator, server.hostId)
+	}
+}
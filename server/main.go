@@ -2,36 +2,119 @@ package main
 
 import (
 	"container/heap"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"math"
 	"net"
 	"os"
+	"os/signal"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const (
-	ServerPort        = ":8080"
-	TickRate          = 20 // 20 Hz
-	MaxClients        = 6
+	MaxSpectators     = 16                          // Spectators per room
 	TileSize          = 32                          // World units per tile
 	ArenaTilesWidth   = 25                          // 800 / 32
 	ArenaTilesHeight  = 18                          // 576 / 32 (adjusted for clean division)
 	ArenaWidth        = ArenaTilesWidth * TileSize  // 800
 	ArenaHeight       = ArenaTilesHeight * TileSize // 576
-	MovementSpeed     = 4.0                         // tiles per second
-	ClientTimeout     = 10 * time.Second            // Timeout if no ping/input
+	MaxSpectatorDelay = 2 * time.Minute             // Longest delay a room can put on spectator snapshots
 	HeartbeatInterval = 2 * time.Second             // How often clients should ping
+	MatchCountdown    = 3 * time.Second             // Between the host starting the match and units spawning
+
+	// Delta compression
+	SnapshotHistorySize = 32 // Snapshots kept per client as delta baselines (1.6s at 20 Hz)
+
+	// Datagram fragmentation
+	MaxFragmentCount = 64              // Largest message we'll reassemble (in fragments)
+	FragmentTimeout  = 2 * time.Second // Discard partially received messages after this long
+
+	// Flood protection
+	DatagramRate        = 200              // Datagrams per second per address
+	DatagramBurst       = 400              // Datagrams accepted in a burst before the rate applies
+	HelloRate           = 1                // Hellos per second per address
+	HelloBurst          = 3                // Hellos accepted in a burst (e.g. quick reconnects)
+	InputRate           = 60               // Input messages per second per client
+	InputBurst          = 120              // Input messages accepted in a burst
+	MaxFramesPerInput   = 8                // Command frames read from one input message (newest kept)
+	MaxCommandsPerFrame = 16               // Commands read from one frame
+	MaxCommandsPerTick  = 32               // Commands applied per client per tick
+	MaxQueuedFrames     = 64               // Frames queued per client between ticks
+	MaxQueuedInputs     = 1024             // Frames queued across all clients between ticks
+	BanStrikes          = 100              // Rate limit violations within StrikeWindow that trigger a ban
+	StrikeWindow        = 10 * time.Second // Window strikes are counted over
+	BanDuration         = 60 * time.Second // How long a banned address is ignored
+	StatsLogInterval    = time.Minute      // How often changed flood counters are logged
+
+	// Chat
+	MaxChatLength      = 200                    // Characters per chat message
+	ChatRate           = 1                      // Chat messages per second per client
+	ChatBurst          = 5                      // Chat messages accepted in a burst
+	ChatResendInterval = 500 * time.Millisecond // Unacknowledged chat is resent this often
+	MaxChatBacklog     = 64                     // Unacknowledged chat kept per client (oldest dropped)
+
+	// Reliable events
+	MaxPendingEvents     = 256 // Unacknowledged events kept per client (oldest dropped)
+	MaxEventsPerSnapshot = 32  // Events piggybacked on one snapshot; the rest follow in later ones
+
+	// WebSocket gateway (browser clients)
+	WebSocketPath         = "/ws"           // Upgrade endpoint
+	WebSocketMaxMessage   = 64 * 1024       // Largest message accepted from a browser
+	WebSocketSendQueue    = 256             // Frames buffered per browser; more are dropped like lost datagrams
+	WebSocketWriteTimeout = 5 * time.Second // A browser that takes longer to accept a frame is disconnected
+
+	// Rooms
+	DefaultRoomId    = "default"       // Room hellos without a room id join (never closed)
+	MaxRooms         = 32              // Rooms hosted at once, including the default room
+	RoomIdleTimeout  = 2 * time.Minute // Rooms other than the default close after being empty this long
+	RoomReapInterval = 10 * time.Second
+
+	// Construction
+	ConstructionRefund = 0.75 // Share of a building's cost returned when its site is cancelled
+	BuilderReach       = 1    // Tiles from a site a worker builds from (1 = adjacent, diagonals included)
+
+	// Resources
+	ResourceNodeType   = "resource_node" // Entity type of the map's resource nodes (owned by no one)
+	GatherSearchRadius = 10              // How far workers look for another node once theirs runs out
+	GatherReach        = 1               // Tiles from a node or drop-off a worker works from (1 = adjacent)
+
+	// Production
+	MaxTrainingQueue  = 5 // Units queued per building, including the one in training
+	RallySearchRadius = 5 // How far from a blocked rally point trained units look for a tile
+
+	// Shutdown
+	ShutdownTimeout = 5 * time.Second // Deadline for stopping rooms, notifying clients and closing sockets
+	ShutdownNotices = 3               // Copies of the shutdown message sent to each client (UDP may drop some)
+)
 
-	// Game economy
-	StartingMoney = 100
-	BuildingCost  = 50
-
-	// Resource generation (money per second per building)
-	GeneratorIncome = 10.0
+// Settings chosen at startup by flags, environment or config file (see config.go); these
+// are the compiled-in defaults
+var (
+	ServerPort      = ":8080"
+	WebSocketPort   = ":8081"          // HTTP port accepting WebSocket upgrades ("" disables the gateway)
+	TickRate        = 20               // 20 Hz
+	MaxClients      = 6                // Players per room (spectators don't count)
+	ClientTimeout   = 10 * time.Second // Timeout if no ping/input
+	ReconnectGrace  = 60 * time.Second // How long a timed-out player's units/money are kept
+	MaxDatagramSize = 1200             // Max bytes per UDP datagram before fragmenting (safe below typical MTU)
+	StartingMoney   = 100
+	MapsDir         = "../maps"               // Where map files are looked up by name (relative to server directory)
+	DefaultMapName  = "default"               // Map loaded for the default room and for rooms created without one
+	EntitiesFile    = "../data/entities.json" // Unit and building definitions (see definitions.go)
+	AdminToken      = ""                      // Required by admin commands such as save_match ("" disables them)
+	SaveDir         = "saves"                 // Where match saves are written
+	SaveOnShutdown  = false                   // Save every room with players when shutting down
 )
 
 type MessageType string
@@ -43,6 +126,70 @@ const (
 	MsgSnapshot MessageType = "snapshot"
 	MsgPing     MessageType = "ping"
 	MsgPong     MessageType = "pong"
+	MsgAck      MessageType = "ack"
+	MsgFragment MessageType = "fragment"
+
+	MsgGoodbye      MessageType = "goodbye"       // Client is leaving
+	MsgShutdown     MessageType = "shutdown"      // Server is going away
+	MsgReject       MessageType = "reject"        // Hello refused
+	MsgCommandError MessageType = "command_error" // Command in an input frame was rejected
+
+	MsgListRooms   MessageType = "list_rooms"   // Ask which rooms are open
+	MsgRoomList    MessageType = "room_list"    // Answer to list_rooms
+	MsgCreateRoom  MessageType = "create_room"  // Open a new room with its own map and simulation
+	MsgRoomCreated MessageType = "room_created" // Answer to create_room; join with a hello carrying its id
+	MsgStats       MessageType = "stats"        // Monitoring: ask for server-wide counters
+	MsgServerStats MessageType = "server_stats" // Answer to stats
+
+	MsgSaveMatch  MessageType = "save_match"  // Admin: write a room's match state to disk
+	MsgMatchSaved MessageType = "match_saved" // Answer to save_match
+
+	MsgSetTeam    MessageType = "set_team"    // Lobby: pick team and spawn slot
+	MsgSetReady   MessageType = "set_ready"   // Lobby: toggle ready
+	MsgStartMatch MessageType = "start_match" // Lobby: host starts the countdown
+	MsgLobbyState MessageType = "lobby_state" // Players, teams and match phase
+	MsgFollow     MessageType = "follow"      // Spectator: watch one player's view (or everything)
+
+	MsgChat         MessageType = "chat"          // Client says something (resent until chat_ack)
+	MsgChatMessages MessageType = "chat_messages" // Chat and system messages for a client (resent until chat_ack)
+	MsgChatAck      MessageType = "chat_ack"      // Acknowledges chat by sequence, in either direction
+)
+
+// Reject reason codes
+const (
+	RejectServerFull      = "server_full"
+	RejectVersionMismatch = "version_mismatch"
+	RejectMatchInProgress = "match_in_progress"
+	RejectInvalidSession  = "invalid_session"
+	RejectInternalError   = "internal_error"
+	RejectRoomNotFound    = "room_not_found"
+	RejectRoomLimit       = "room_limit"
+	RejectInvalidRoom     = "invalid_room"
+	RejectNotAuthorized   = "not_authorized"
+)
+
+// Command error reason codes
+const (
+	ErrUnknownCommand    = "unknown_command"
+	ErrInvalidData       = "invalid_data"
+	ErrUnknownType       = "unknown_type"
+	ErrNotOwner          = "not_owner"
+	ErrInvalidTarget     = "invalid_target"
+	ErrInsufficientFunds = "insufficient_funds"
+	ErrOutOfBounds       = "out_of_bounds"
+	ErrBlocked           = "blocked"
+	ErrNoPath            = "no_path"
+	ErrRateLimited       = "rate_limited"
+	ErrMatchNotStarted   = "match_not_started"
+	ErrMatchInProgress   = "match_in_progress"
+	ErrSpectating        = "spectating"
+	ErrNotHost           = "not_host"
+	ErrNotReady          = "not_ready"
+	ErrInvalidTeam       = "invalid_team"
+	ErrInvalidSlot       = "invalid_slot"
+	ErrNotSpectator      = "not_spectator"
+	ErrMessageTooLong    = "message_too_long"
+	ErrQueueFull         = "queue_full"
 )
 
 type Message struct {
@@ -51,19 +198,35 @@ type Message struct {
 }
 
 type HelloMessage struct {
-	ClientVersion string `json:"clientVersion"`
-	PlayerName    string `json:"playerName"`
+	ClientVersion string   `json:"clientVersion"` // Protocol version the client speaks ("major.minor")
+	PlayerName    string   `json:"playerName"`
+	RoomId        string   `json:"roomId,omitempty"`       // Room to join (empty = the session's room, or the default room)
+	Role          string   `json:"role,omitempty"`         // "player" (default) or "spectator"
+	Follow        uint32   `json:"follow,omitempty"`       // Spectators: player whose view to watch (0 = everything)
+	SessionToken  string   `json:"sessionToken,omitempty"` // Previous session to resume after a disconnect
+	Capabilities  []string `json:"capabilities,omitempty"` // Optional features the client supports
 }
 
 type WelcomeMessage struct {
-	ClientId          uint32      `json:"clientId"`
-	TickRate          int         `json:"tickRate"`
-	HeartbeatInterval int         `json:"heartbeatInterval"` // milliseconds
-	InputRedundancy   int         `json:"inputRedundancy"`   // How many commands to send per input
-	TileSize          int         `json:"tileSize"`          // World units per tile
-	ArenaTilesWidth   int         `json:"arenaTilesWidth"`
-	ArenaTilesHeight  int         `json:"arenaTilesHeight"`
-	TerrainData       TerrainData `json:"terrainData"` // Terrain information for rendering
+	ClientId          uint32                       `json:"clientId"`
+	RoomId            string                       `json:"roomId"`          // Room the client joined
+	Role              string                       `json:"role"`            // "player" or "spectator"
+	SpectatorDelay    int                          `json:"spectatorDelay"`  // ms spectator snapshots lag behind the match
+	SessionToken      string                       `json:"sessionToken"`    // Must accompany every input/ping/ack
+	ProtocolVersion   string                       `json:"protocolVersion"` // Server's protocol version
+	Capabilities      []string                     `json:"capabilities"`    // Optional features enabled for this client
+	TickRate          int                          `json:"tickRate"`
+	MaxPlayers        int                          `json:"maxPlayers"`        // Players per room
+	ClientTimeout     int                          `json:"clientTimeout"`     // milliseconds of silence before the server drops the client
+	StartingMoney     int                          `json:"startingMoney"`     // Money each player starts a match with
+	EntityTypes       map[string]*EntityDefinition `json:"entityTypes"`       // Stats of every unit and building type
+	HeartbeatInterval int                          `json:"heartbeatInterval"` // milliseconds
+	InputRedundancy   int                          `json:"inputRedundancy"`   // How many commands to send per input
+	MaxDatagramSize   int                          `json:"maxDatagramSize"`   // Larger messages arrive as fragments
+	TileSize          int                          `json:"tileSize"`          // World units per tile
+	ArenaTilesWidth   int                          `json:"arenaTilesWidth"`
+	ArenaTilesHeight  int                          `json:"arenaTilesHeight"`
+	TerrainData       TerrainData                  `json:"terrainData"` // Terrain information for rendering
 }
 
 type TerrainData struct {
@@ -79,8 +242,73 @@ type TerrainTile struct {
 }
 
 type InputMessage struct {
-	ClientId uint32         `json:"clientId"`
-	Commands []CommandFrame `json:"commands"`
+	ClientId     uint32         `json:"clientId"`
+	SessionToken string         `json:"sessionToken"`
+	Commands     []CommandFrame `json:"commands"`
+}
+
+type GoodbyeMessage struct {
+	ClientId     uint32 `json:"clientId"`
+	SessionToken string `json:"sessionToken"`
+}
+
+type RejectMessage struct {
+	Reason  string `json:"reason"`  // One of the Reject* codes
+	Message string `json:"message"` // Human-readable detail
+}
+
+// CreateRoomMessage asks for a new room. All fields are optional.
+type CreateRoomMessage struct {
+	RoomId         string `json:"roomId,omitempty"`         // Requested id (generated if empty)
+	MapName        string `json:"mapName,omitempty"`        // Map file name without extension (e.g. "test_corridor")
+	LateJoin       string `json:"lateJoin,omitempty"`       // "spectate" (default) or "refuse" once the match has started
+	SpectatorDelay int    `json:"spectatorDelay,omitempty"` // Seconds spectator snapshots lag behind the match
+}
+
+// RoomInfo describes one open room
+type RoomInfo struct {
+	RoomId     string     `json:"roomId"`
+	MapName    string     `json:"mapName"`
+	Players    int        `json:"players"`
+	MaxPlayers int        `json:"maxPlayers"`
+	Spectators int        `json:"spectators"`
+	Phase      MatchPhase `json:"phase"`
+	Tick       uint64     `json:"tick"`
+}
+
+type RoomListMessage struct {
+	Rooms []RoomInfo `json:"rooms"`
+}
+
+// ServerStatsMessage reports server-wide counters for monitoring
+type ServerStatsMessage struct {
+	Rooms int           `json:"rooms"` // Rooms open
+	Flood floodCounters `json:"flood"` // Traffic dropped by flood protection since startup
+}
+
+type CommandErrorMessage struct {
+	Sequence    uint32 `json:"sequence"`    // Input frame the command came in
+	CommandType string `json:"commandType"` // e.g. "move", "build"
+	Reason      string `json:"reason"`      // One of the Err* codes
+	Message     string `json:"message"`     // Human-readable detail
+}
+
+type PingMessage struct {
+	ClientId       uint32 `json:"clientId"`
+	SessionToken   string `json:"sessionToken"`
+	ClientTime     int64  `json:"clientTime"`               // Client clock (ms) when sent, echoed in pong
+	EchoServerTime int64  `json:"echoServerTime,omitempty"` // ServerTime from the last pong received
+	EchoDelay      int64  `json:"echoDelay,omitempty"`      // ms between receiving that pong and sending this ping
+}
+
+// PongMessage answers a ping with what clients need to measure RTT and schedule inputs
+type PongMessage struct {
+	ClientTime   int64  `json:"clientTime"`   // Echo of the ping's ClientTime
+	ServerTime   int64  `json:"serverTime"`   // Server clock (ms) when the ping was handled
+	ServerTick   uint64 `json:"serverTick"`   // Last simulated tick when the ping was handled
+	TickInterval int64  `json:"tickInterval"` // ms per tick
+	Rtt          uint32 `json:"rtt"`          // Server's smoothed RTT estimate for this client (ms)
+	Jitter       uint32 `json:"jitter"`       // Server's smoothed RTT deviation for this client (ms)
 }
 
 type CommandFrame struct {
@@ -102,26 +330,74 @@ type MoveCommand struct {
 }
 
 type BuildCommand struct {
-	BuildingType string `json:"buildingType"`
-	TileX        int    `json:"tileX"`
-	TileY        int    `json:"tileY"`
+	UnitIds      []uint32 `json:"unitIds"` // Workers that construct it
+	BuildingType string   `json:"buildingType"`
+	TileX        int      `json:"tileX"`
+	TileY        int      `json:"tileY"`
+}
+
+type CancelBuildCommand struct {
+	BuildingId uint32 `json:"buildingId"` // Site under construction
+}
+
+type GatherCommand struct {
+	UnitIds []uint32 `json:"unitIds"` // Workers to harvest with
+	NodeId  uint32   `json:"nodeId"`  // Resource node to harvest
 }
 
 type AttackCommand struct {
-	TargetId uint32 `json:"targetId"`
+	UnitIds  []uint32 `json:"unitIds"` // Which units attack
+	TargetId uint32   `json:"targetId"`
+}
+
+type TrainCommand struct {
+	BuildingId uint32 `json:"buildingId"`
+	UnitType   string `json:"unitType"` // One of the building's definition's trains
+}
+
+type CancelTrainCommand struct {
+	BuildingId uint32 `json:"buildingId"`
+	Index      *int   `json:"index,omitempty"` // Queue position to cancel (default: the last)
+}
+
+type RallyCommand struct {
+	BuildingId uint32 `json:"buildingId"`
+	TileX      int    `json:"tileX"` // Where units trained by the building walk to
+	TileY      int    `json:"tileY"`
 }
 
 type SnapshotMessage struct {
-	Tick         uint64            `json:"tick"`
-	BaselineTick uint64            `json:"baselineTick"` // For delta compression (0 = full snapshot)
-	Entities     []Entity          `json:"entities"`
-	Players      map[string]Player `json:"players"`
+	Tick            uint64            `json:"tick"`
+	BaselineTick    uint64            `json:"baselineTick"`              // Tick this delta applies to (0 = full snapshot)
+	Entities        []Entity          `json:"entities"`                  // Delta: only added/changed entities
+	RemovedEntities []uint32          `json:"removedEntities,omitempty"` // Delta: entities gone since baseline
+	Players         map[string]Player `json:"players"`                   // Delta: only added/changed players
+	RemovedPlayers  []string          `json:"removedPlayers,omitempty"`  // Delta: players gone since baseline
+
+	// Input acknowledgement for the receiving client (lets it trim resends and reconcile predictions)
+	LastProcessedSeq  uint32 `json:"lastProcessedSeq"`  // Highest input sequence applied
+	LastProcessedTick uint64 `json:"lastProcessedTick"` // Server tick that sequence was applied on
+
+	// Reliable events not yet acknowledged, oldest first (resent in every snapshot until acked)
+	Events []GameEvent `json:"events,omitempty"`
+}
+
+// AckMessage tells the server the latest snapshot tick a client has received
+type AckMessage struct {
+	ClientId     uint32 `json:"clientId"`
+	SessionToken string `json:"sessionToken"`
+	Tick         uint64 `json:"tick"`
+	EventSeq     uint32 `json:"eventSeq,omitempty"` // Highest reliable event received
 }
 
 type Player struct {
-	Id    uint32  `json:"id"`
-	Name  string  `json:"name"`
-	Money float32 `json:"money"`
+	Id           uint32  `json:"id"`
+	Name         string  `json:"name"`
+	Money        float32 `json:"money"`
+	MoneyHidden  bool    `json:"moneyHidden,omitempty"`  // Opponent's balance, not revealed
+	Disconnected bool    `json:"disconnected,omitempty"` // Timed out, units frozen until reconnect
+	Rtt          uint32  `json:"rtt,omitempty"`          // Smoothed round-trip time (ms)
+	Jitter       uint32  `json:"jitter,omitempty"`       // Smoothed RTT deviation (ms)
 }
 
 type Entity struct {
@@ -137,22 +413,75 @@ type Entity struct {
 	MaxHealth       int32   `json:"maxHealth"`
 	FootprintWidth  int     `json:"footprintWidth,omitempty"`  // In tiles (0 for units)
 	FootprintHeight int     `json:"footprintHeight,omitempty"` // In tiles (0 for units)
+	Remembered      bool    `json:"remembered,omitempty"`      // Last-known state of an enemy building out of sight
+
+	// Construction
+	UnderConstruction bool    `json:"underConstruction,omitempty"` // Site still being built: no income or training yet
+	BuildProgress     float32 `json:"buildProgress,omitempty"`     // 0.0 to 1.0 while under construction
+
+	// Resources: what a node has left, or what a worker is carrying
+	ResourceType string `json:"resourceType,omitempty"` // e.g. "gold"
+	Resources    int32  `json:"resources,omitempty"`
+
+	// Production (buildings; hidden from other teams)
+	TrainingQueue []string `json:"trainingQueue,omitempty"` // Unit types waiting to be trained, first one in training
+	TrainProgress float32  `json:"trainProgress,omitempty"` // 0.0 to 1.0 through the first in the queue
+	HasRally      bool     `json:"hasRally,omitempty"`      // Trained units walk to the rally tile
+	RallyTileX    int      `json:"rallyTileX,omitempty"`
+	RallyTileY    int      `json:"rallyTileY,omitempty"`
 
 	// Pathfinding
 	Path        []TilePosition `json:"-"` // Full path to goal (not sent to client)
 	PathIndex   int            `json:"-"` // Current waypoint index
 	BlockedTime float32        `json:"-"` // Time spent blocked (for rerouting)
+
+	// Combat
+	AttackTargetId uint32 `json:"-"` // Entity this unit was ordered to attack (0 = none)
+	NextAttackTick uint64 `json:"-"` // First tick the unit may hit again
+
+	// Construction
+	ConstructTargetId uint32 `json:"-"` // Site this worker was ordered to build (0 = none)
+
+	// Harvesting (workers) and regrowth (resource nodes)
+	GatherNodeId   uint32  `json:"-"` // Node this worker harvests (0 = none)
+	NextGatherTick uint64  `json:"-"` // First tick the worker may take another unit of resources
+	MaxResources   int32   `json:"-"` // Amount a node started with and regrows up to
+	Regeneration   float32 `json:"-"` // Resources a node regains per second
+	Regrowth       float32 `json:"-"` // Regeneration not yet added to Resources
 }
 
 type Client struct {
-	Id               uint32
-	Name             string
-	Addr             *net.UDPAddr
-	LastSeen         time.Time
-	OwnedUnits       []uint32 // Entity IDs of units owned by this player
-	Money            float32
-	LastProcessedSeq uint32
-	LastAckTick      uint64 // For delta compression (not implemented)
+	Id                uint32
+	Name              string
+	Team              int           // Shares vision with clients on the same team
+	SpawnSlot         int           // Chosen spawn point (1-based, 0 = any of the team's)
+	Ready             bool          // Ready for the host to start the match
+	Role              string        // Role asked for in hello (RolePlayer or RoleSpectator)
+	Spectator         bool          // Watching: has no units, can't command (asked to, or joined late)
+	Following         uint32        // Spectators: player whose view is watched (0 = everything)
+	SessionToken      string        // Secret issued in welcome; proves packets come from this client
+	ClientVersion     string        // Protocol version from hello
+	Capabilities      capabilitySet // Optional features negotiated in hello
+	Codec             Codec         // Wire encoding for messages after welcome (nil = JSON)
+	Addr              net.Addr      // Last address a valid packet came from
+	LastSeen          time.Time
+	Rtt               time.Duration // Smoothed round-trip time measured from ping echoes
+	RttJitter         time.Duration // Smoothed deviation of RTT samples
+	InputBucket       tokenBucket   // Limits input messages per second
+	ChatBucket        tokenBucket   // Limits chat messages per second
+	LastChatSeq       uint32        // Highest chat sequence accepted from the client
+	Chat              chatOutbox    // Chat waiting for the client's acknowledgement
+	Eliminated        bool          // Lost every unit and building this match
+	Events            eventOutbox   // Reliable events waiting for the client's acknowledgement
+	IncomeEarned      float32       // Generator income since the last income_received event
+	Disconnected      bool          // Timed out; entities frozen until reconnect or grace expiry
+	DisconnectedAt    time.Time     // When the client timed out
+	OwnedUnits        []uint32      // Entity IDs of units owned by this player
+	Money             float32
+	LastProcessedSeq  uint32
+	LastProcessedTick uint64          // Tick LastProcessedSeq was applied on
+	LastAckTick       uint64          // Latest snapshot tick acknowledged by the client (delta baseline)
+	History           snapshotHistory // Snapshots recently sent to this client
 }
 
 // FormationGroup tracks units moving together in formation
@@ -190,6 +519,18 @@ type Feature struct {
 	VisualHeight float32 `json:"visualHeight"`
 }
 
+// ResourceNode is a harvestable deposit placed on the map. Each becomes a neutral entity
+// when a match starts.
+type ResourceNode struct {
+	Type         string  `json:"type"` // Resource it yields, e.g. "gold"
+	X            int     `json:"x"`
+	Y            int     `json:"y"`
+	Width        int     `json:"width,omitempty"`  // In tiles (default 1)
+	Height       int     `json:"height,omitempty"` // In tiles (default 1)
+	Quantity     int32   `json:"quantity"`         // Amount it starts with and regrows up to
+	Regeneration float32 `json:"regeneration"`     // Amount regained per second (0 = runs out for good)
+}
+
 type SpawnPoint struct {
 	Team   int `json:"team"`
 	X      int `json:"x"`
@@ -204,6 +545,7 @@ type MapData struct {
 	DefaultTerrain TerrainType
 	Tiles          map[TileCoord]TerrainType // Sparse map for non-default tiles
 	Features       []Feature
+	ResourceNodes  []ResourceNode
 	SpawnPoints    []SpawnPoint
 }
 
@@ -224,9 +566,10 @@ type MapFileFormat struct {
 			Height   float32 `json:"height"`
 		} `json:"tiles"`
 	} `json:"terrain"`
-	Features    []Feature    `json:"features"`
-	SpawnPoints []SpawnPoint `json:"spawnPoints"`
-	Metadata    struct {
+	Features      []Feature      `json:"features"`
+	ResourceNodes []ResourceNode `json:"resourceNodes"`
+	SpawnPoints   []SpawnPoint   `json:"spawnPoints"`
+	Metadata      struct {
 		Author      string `json:"author"`
 		Created     string `json:"created"`
 		Description string `json:"description"`
@@ -240,8 +583,11 @@ type QueuedInput struct {
 	Commands []Command
 }
 
+// GameServer runs one room's simulation. Rooms share the listening socket, flood
+// protection and fragment ids of the RoomManager that hosts them.
 type GameServer struct {
 	conn            *net.UDPConn
+	roomId          string
 	clients         map[uint32]*Client
 	entities        map[uint32]*Entity
 	formations      map[uint32]*FormationGroup // Active formation groups
@@ -250,12 +596,29 @@ type GameServer struct {
 	nextFormationID uint32
 	mu              sync.RWMutex
 	inputQueue      []QueuedInput
+	queuedFrames    map[uint32]int // Frames each client has in inputQueue (guarded by queueMu)
 	queueMu         sync.Mutex
-	mapData         *MapData // Map configuration
+	mapData         *MapData      // Map configuration
+	maxDatagramSize int           // Messages larger than this are fragmented
+	reconnectGrace  time.Duration // How long disconnected players keep their entities
+	phase           MatchPhase
+	hostId          uint32                    // Player allowed to start the match
+	startTick       uint64                    // Tick the match starts (or started) on
+	lateJoin        string                    // What a hello gets once the match has started
+	lobbyDirty      bool                      // lobby_state changed since last sent
+	spectatorDelay  uint64                    // Ticks spectator snapshots lag behind the match (0 = live)
+	worldHistory    []snapshotRecord          // Recent world states for delayed spectator snapshots, indexed by tick
+	tickEvents      []GameEvent               // Events since the last snapshots, delivered with the next ones
+	vision          map[int]*visionGrid       // Per-team visibility, computed lazily each tick
+	visionTick      uint64                    // Tick vision was computed for
+	lastKnown       map[int]map[uint32]Entity // Per-team memory of enemy buildings
+	nextFragmentId  *uint32                   // Accessed atomically (sends happen from several goroutines)
+	limiter         *rateLimiter
+	flood           *floodCounters // Traffic dropped by flood protection (updated atomically)
 }
 
 func NewGameServer() *GameServer {
-	return &GameServer{
+	s := &GameServer{
 		clients:         make(map[uint32]*Client),
 		entities:        make(map[uint32]*Entity),
 		formations:      make(map[uint32]*FormationGroup),
@@ -263,7 +626,15 @@ func NewGameServer() *GameServer {
 		nextId:          1,
 		nextFormationID: 1,
 		inputQueue:      make([]QueuedInput, 0),
+		maxDatagramSize: MaxDatagramSize,
+		reconnectGrace:  ReconnectGrace,
+		phase:           PhaseLobby,
+		lateJoin:        LateJoinSpectate,
+		nextFragmentId:  new(uint32),
+		flood:           &floodCounters{},
 	}
+	s.limiter = newRateLimiter(s.flood)
+	return s
 }
 
 // LoadMap loads a map from a JSON file and returns MapData
@@ -285,6 +656,12 @@ func LoadMap(filepath string) (*MapData, error) {
 		return nil, fmt.Errorf("invalid map dimensions: %dx%d", mapFile.Width, mapFile.Height)
 	}
 
+	for i, node := range mapFile.ResourceNodes {
+		if err := node.validate(mapFile.Width, mapFile.Height); err != nil {
+			return nil, fmt.Errorf("invalid resource node %d: %w", i, err)
+		}
+	}
+
 	// Build MapData
 	mapData := &MapData{
 		Width:          mapFile.Width,
@@ -293,6 +670,7 @@ func LoadMap(filepath string) (*MapData, error) {
 		DefaultTerrain: mapFile.Terrain.Default,
 		Tiles:          make(map[TileCoord]TerrainType),
 		Features:       mapFile.Features,
+		ResourceNodes:  mapFile.ResourceNodes,
 		SpawnPoints:    mapFile.SpawnPoints,
 	}
 
@@ -307,38 +685,24 @@ func LoadMap(filepath string) (*MapData, error) {
 		}
 	}
 
-	log.Printf("Loaded map '%s': %dx%d tiles, %d terrain tiles, %d features, %d spawn points",
-		mapFile.Name, mapData.Width, mapData.Height, len(mapData.Tiles), len(mapData.Features), len(mapData.SpawnPoints))
+	log.Printf("Loaded map '%s': %dx%d tiles, %d terrain tiles, %d features, %d resource nodes, %d spawn points",
+		mapFile.Name, mapData.Width, mapData.Height, len(mapData.Tiles), len(mapData.Features), len(mapData.ResourceNodes), len(mapData.SpawnPoints))
 
 	return mapData, nil
 }
 
-func (s *GameServer) Start() error {
-	addr, err := net.ResolveUDPAddr("udp", ServerPort)
-	if err != nil {
-		return err
-	}
-
-	s.conn, err = net.ListenUDP("udp", addr)
-	if err != nil {
-		return err
-	}
-
-	log.Printf("Game server listening on %s", ServerPort)
-
-	// Start the game tick loop
-	go s.tickLoop()
-
-	// Handle incoming messages
-	return s.handleMessages()
-}
-
-func (s *GameServer) tickLoop() {
+// tickLoop runs the simulation until stop is closed
+func (s *GameServer) tickLoop(stop <-chan struct{}) {
 	ticker := time.NewTicker(time.Duration(1000/TickRate) * time.Millisecond)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		s.gameTick()
+	for {
+		select {
+		case <-ticker.C:
+			s.gameTick()
+		case <-stop:
+			return
+		}
 	}
 }
 
@@ -347,6 +711,7 @@ func (s *GameServer) gameTick() {
 	s.queueMu.Lock()
 	inputs := s.inputQueue
 	s.inputQueue = make([]QueuedInput, 0) // Clear queue
+	s.queuedFrames = nil
 	s.queueMu.Unlock()
 
 	// Sort by tick (earliest first) for fair processing
@@ -358,23 +723,23 @@ func (s *GameServer) gameTick() {
 	s.mu.Lock()
 	s.tick++
 
-	// Clean up disconnected clients (heartbeat timeout)
+	// Disconnect timed-out clients and remove those whose grace period expired
 	now := time.Now()
-	for id, client := range s.clients {
-		if now.Sub(client.LastSeen) > ClientTimeout {
-			log.Printf("Client %d (%s) timed out (no heartbeat/input for %v)", id, client.Name, ClientTimeout)
-			// Delete all owned units
-			for _, unitId := range client.OwnedUnits {
-				delete(s.entities, unitId)
-			}
-			delete(s.clients, id)
-		}
+	s.updateConnections(now)
+
+	if s.phase == PhaseCountdown && s.tick >= s.startTick {
+		s.beginMatch()
 	}
 
+	// Messages to send once the lock is released
+	outgoing := make([]outgoingMessage, 0, len(s.clients))
+	outgoing = s.lobbyMessages(outgoing)
+
 	// Process all queued inputs in tick order
+	commandsThisTick := make(map[uint32]int, len(s.clients))
 	for _, input := range inputs {
 		client, exists := s.clients[input.ClientId]
-		if !exists {
+		if !exists || client.Disconnected {
 			continue
 		}
 
@@ -385,18 +750,52 @@ func (s *GameServer) gameTick() {
 
 		// Mark as processed
 		client.LastProcessedSeq = input.Sequence
+		client.LastProcessedTick = s.tick
 
-		// Process commands
+		// Process commands, reporting rejected ones back to the client
 		for _, cmd := range input.Commands {
-			s.processCommand(cmd, client)
+			var err error
+			if commandsThisTick[client.Id] >= MaxCommandsPerTick {
+				atomic.AddUint64(&s.flood.DroppedCommands, 1)
+				err = newCommandError(ErrRateLimited, "more than %d commands this tick", MaxCommandsPerTick)
+			} else {
+				commandsThisTick[client.Id]++
+				err = s.checkCommandAllowed(client)
+				if err == nil {
+					err = s.processCommand(cmd, client)
+				}
+			}
+			if err != nil {
+				outgoing = append(outgoing, outgoingMessage{
+					addr:    client.Addr,
+					codec:   codecFor(client),
+					msgType: MsgCommandError,
+					payload: newCommandErrorMessage(input.Sequence, cmd.Type, err),
+				})
+			}
 		}
 	}
 
-	// Update entity movement
+	// Chase targets and land hits before moving, so units stopping in range stay put
+	s.updateCombat()
+
+	// Workers next to their sites build, then training counts down and sends out finished units
 	deltaTime := 1.0 / float32(TickRate)
+	s.updateConstruction(deltaTime)
+	s.updateProduction(deltaTime)
+
+	// Harvest, deliver loads and regrow resource nodes
+	s.updateGathering()
+	s.regrowResources(deltaTime)
+
+	// Update entity movement
 	for _, entity := range s.entities {
+		// Disconnected players' units stay frozen in place
+		if s.isOwnerDisconnected(entity.OwnerId) {
+			continue
+		}
 		// Update movement for all unit types
-		if entity.Type == "worker" {
+		if isUnit(entity) {
 			s.updateEntityMovement(entity, deltaTime)
 		}
 	}
@@ -404,67 +803,61 @@ func (s *GameServer) gameTick() {
 	// Update formations (followers maintain offset from leader)
 	s.tickFormations()
 
-	// Generate resources from buildings
+	// Generate resources from finished buildings
 	for _, entity := range s.entities {
-		if entity.Type == "generator" {
-			if client, ok := s.clients[entity.OwnerId]; ok {
-				client.Money += GeneratorIncome * deltaTime
+		if def := definitionOf(entity); def != nil && def.Income > 0 && !entity.UnderConstruction {
+			if client, ok := s.clients[entity.OwnerId]; ok && !client.Disconnected {
+				client.Money += def.Income * deltaTime
+				client.IncomeEarned += def.Income * deltaTime
 			}
 		}
 	}
 
-	// Create snapshot
-	entities := make([]Entity, 0, len(s.entities))
-	for _, entity := range s.entities {
-		entities = append(entities, *entity)
-	}
-
-	// Create player data
-	players := make(map[string]Player)
-	for id, client := range s.clients {
-		players[fmt.Sprintf("%d", id)] = Player{
-			Id:    id,
-			Name:  client.Name,
-			Money: client.Money,
+	// Report income once a second rather than every tick
+	if s.tick%uint64(TickRate) == 0 {
+		for _, client := range s.clients {
+			if client.IncomeEarned > 0 {
+				s.emitEvent(GameEvent{Type: EventIncomeReceived, PlayerId: client.Id, Amount: client.IncomeEarned, audience: audiencePrivate})
+				client.IncomeEarned = 0
+			}
 		}
 	}
 
-	snapshot := SnapshotMessage{
-		Tick:         s.tick,
-		BaselineTick: 0, // TODO: Delta compression - always full snapshot for now
-		Entities:     entities,
-		Players:      players,
-	}
-	s.mu.Unlock()
-
-	// Send snapshot to all clients (without holding lock)
-	s.broadcastMessage(Message{
-		Type: MsgSnapshot,
-		Data: s.marshalData(snapshot),
-	})
-}
-
-func (s *GameServer) handleMessages() error {
-	buffer := make([]byte, 1024)
+	// Announce eliminations and (re)send chat awaiting acknowledgement
+	s.checkEliminations()
+	outgoing = s.chatMessages(outgoing, now)
 
-	for {
-		n, clientAddr, err := s.conn.ReadFromUDP(buffer)
-		if err != nil {
-			log.Printf("Error reading UDP message: %v", err)
+	// Build per-client snapshots, delta-compressed against each client's acknowledged baseline
+	current := s.captureWorldState()
+	delayed, haveDelayed := s.recordSpectatorWorld(current)
+	s.distributeEvents()
+	for _, client := range s.clients {
+		if client.Disconnected {
 			continue
 		}
-
-		var msg Message
-		if err := json.Unmarshal(buffer[:n], &msg); err != nil {
-			log.Printf("Error unmarshaling message: %v", err)
-			continue
+		world := current
+		if client.Spectator && s.spectatorDelay > 0 {
+			if !haveDelayed {
+				continue // Match hasn't been going long enough to show anything yet
+			}
+			world = delayed
 		}
+		outgoing = append(outgoing, outgoingMessage{
+			addr:    client.Addr,
+			codec:   codecFor(client),
+			msgType: MsgSnapshot,
+			payload: s.buildSnapshot(client, world),
+		})
+	}
+	s.mu.Unlock()
 
-		s.handleMessage(msg, clientAddr)
+	// Send command errors, chat and snapshots (without holding lock)
+	for _, out := range outgoing {
+		s.sendPayload(out.codec, out.msgType, out.payload, out.addr)
 	}
 }
 
-func (s *GameServer) handleMessage(msg Message, clientAddr *net.UDPAddr) {
+func (s *GameServer) handleMessage(msg Message, clientAddr net.Addr) {
 	switch msg.Type {
 	case MsgHello:
 		var hello HelloMessage
@@ -483,72 +876,198 @@ func (s *GameServer) handleMessage(msg Message, clientAddr *net.UDPAddr) {
 		s.handleInput(input, clientAddr)
 
 	case MsgPing:
-		s.handlePing(clientAddr)
+		var ping PingMessage
+		if err := json.Unmarshal(msg.Data, &ping); err != nil {
+			log.Printf("Error unmarshaling ping message: %v", err)
+			return
+		}
+		s.handlePing(ping, clientAddr)
+
+	case MsgAck:
+		var ack AckMessage
+		if err := json.Unmarshal(msg.Data, &ack); err != nil {
+			log.Printf("Error unmarshaling ack message: %v", err)
+			return
+		}
+		s.handleAck(ack, clientAddr)
+
+	case MsgChat:
+		var chat ChatMessage
+		if err := json.Unmarshal(msg.Data, &chat); err != nil {
+			log.Printf("Error unmarshaling chat message: %v", err)
+			return
+		}
+		s.handleChat(chat, clientAddr)
+
+	case MsgChatAck:
+		var ack ChatAckMessage
+		if err := json.Unmarshal(msg.Data, &ack); err != nil {
+			log.Printf("Error unmarshaling chat_ack message: %v", err)
+			return
+		}
+		s.handleChatAck(ack, clientAddr)
+
+	case MsgGoodbye:
+		var goodbye GoodbyeMessage
+		if err := json.Unmarshal(msg.Data, &goodbye); err != nil {
+			log.Printf("Error unmarshaling goodbye message: %v", err)
+			return
+		}
+		s.handleGoodbye(goodbye, clientAddr)
+
+	case MsgSetTeam:
+		var setTeam SetTeamMessage
+		if err := json.Unmarshal(msg.Data, &setTeam); err != nil {
+			log.Printf("Error unmarshaling set_team message: %v", err)
+			return
+		}
+		s.handleLobbyAction(msg.Type, setTeam.ClientId, setTeam.SessionToken, clientAddr, func(client *Client) error {
+			return s.setTeam(client, setTeam.Team, setTeam.SpawnSlot)
+		})
+
+	case MsgSetReady:
+		var setReady SetReadyMessage
+		if err := json.Unmarshal(msg.Data, &setReady); err != nil {
+			log.Printf("Error unmarshaling set_ready message: %v", err)
+			return
+		}
+		s.handleLobbyAction(msg.Type, setReady.ClientId, setReady.SessionToken, clientAddr, func(client *Client) error {
+			return s.setReady(client, setReady.Ready)
+		})
+
+	case MsgStartMatch:
+		var start StartMatchMessage
+		if err := json.Unmarshal(msg.Data, &start); err != nil {
+			log.Printf("Error unmarshaling start_match message: %v", err)
+			return
+		}
+		s.handleLobbyAction(msg.Type, start.ClientId, start.SessionToken, clientAddr, s.startCountdown)
+
+	case MsgFollow:
+		var follow FollowMessage
+		if err := json.Unmarshal(msg.Data, &follow); err != nil {
+			log.Printf("Error unmarshaling follow message: %v", err)
+			return
+		}
+		s.handleLobbyAction(msg.Type, follow.ClientId, follow.SessionToken, clientAddr, func(client *Client) error {
+			return s.setFollowing(client, follow.PlayerId)
+		})
 	}
 }
 
-func (s *GameServer) handleHello(hello HelloMessage, clientAddr *net.UDPAddr) {
+func (s *GameServer) handleHello(hello HelloMessage, clientAddr net.Addr) {
+	// Each hello can allocate a client and units, so they're limited separately (and not answered)
+	if !s.limiter.allowHello(clientAddr, time.Now()) {
+		return
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if len(s.clients) >= MaxClients {
-		log.Printf("Server full, rejecting client from %s", clientAddr.String())
+	if err := checkClientVersion(hello.ClientVersion); err != nil {
+		log.Printf("Rejecting client from %s: %v", clientAddr.String(), err)
+		s.sendReject(clientAddr, RejectVersionMismatch, fmt.Sprintf("%v (server %s, minimum %s)", err, ProtocolVersion, MinClientVersion))
 		return
 	}
+	capabilities := negotiateCapabilities(hello.Capabilities)
 
-	clientId := s.nextId
-	s.nextId++
-
-	// Spawn starting units for this player (5 workers)
-	// Assign team based on client number (team 0 for first client, team 1 for second, etc.)
-	teamId := len(s.clients)
-	spawnBaseTileX, spawnBaseTileY := s.getSpawnPosition(teamId)
+	// A hello carrying a previous session token resumes that session
+	if hello.SessionToken != "" {
+		if client := s.findClientBySessionToken(hello.SessionToken); client != nil {
+			// The client may have been updated in between, renegotiate
+			client.ClientVersion = hello.ClientVersion
+			client.Capabilities = capabilities
+			client.Codec = negotiatedCodec(capabilities)
+			s.resumeClient(client, clientAddr)
+			return
+		}
+		log.Printf("Unknown or expired session from %s, joining as new player", clientAddr.String())
+	}
 
-	ownedUnits := make([]uint32, 0, 5)
-	for i := 0; i < 5; i++ {
-		entityId := s.nextId
-		s.nextId++
+	// Once the match has started, would-be players watch or are turned away
+	role := RolePlayer
+	if hello.Role == RoleSpectator {
+		role = RoleSpectator
+	}
+	spectator := role == RoleSpectator || s.phase != PhaseLobby
+	if role == RolePlayer && spectator && s.lateJoin == LateJoinRefuse {
+		log.Printf("Match in progress, rejecting client from %s", clientAddr.String())
+		s.sendReject(clientAddr, RejectMatchInProgress, "match has already started")
+		return
+	}
 
-		// Spawn workers in horizontal line
-		workerX := spawnBaseTileX + i
-		workerY := spawnBaseTileY
+	if spectator && s.spectatorCount() >= MaxSpectators {
+		log.Printf("No spectator slots, rejecting client from %s", clientAddr.String())
+		s.sendReject(clientAddr, RejectServerFull, fmt.Sprintf("server is full (%d spectators)", MaxSpectators))
+		return
+	}
+	if !spectator && s.playerCount() >= MaxClients {
+		log.Printf("Server full, rejecting client from %s", clientAddr.String())
+		s.sendReject(clientAddr, RejectServerFull, fmt.Sprintf("server is full (%d players)", MaxClients))
+		return
+	}
 
-		// Ensure spawn position is passable (fallback to base position if not)
-		if !s.isTilePassable(workerX, workerY) {
-			workerX = spawnBaseTileX
-			workerY = spawnBaseTileY
-		}
+	sessionToken, err := newSessionToken()
+	if err != nil {
+		log.Printf("Failed to generate session token for %s: %v", clientAddr.String(), err)
+		s.sendReject(clientAddr, RejectInternalError, "could not create session")
+		return
+	}
 
-		worker := &Entity{
-			Id:           entityId,
-			OwnerId:      clientId,
-			Type:         "worker",
-			TileX:        workerX,
-			TileY:        workerY,
-			TargetTileX:  workerX,
-			TargetTileY:  workerY,
-			MoveProgress: 0.0,
-			Health:       100,
-			MaxHealth:    100,
-		}
+	clientId := s.nextId
+	s.nextId++
 
-		s.entities[entityId] = worker
-		ownedUnits = append(ownedUnits, entityId)
+	// Assign the lowest team not already taken (team 0 for first client, team 1 for second, etc.)
+	// Players can change it in the lobby; units spawn when the match starts.
+	teamId := s.nextFreeTeam()
+	if spectator {
+		teamId = -1
 	}
 
 	client := &Client{
-		Id:         clientId,
-		Name:       hello.PlayerName,
-		Addr:       clientAddr,
-		LastSeen:   time.Now(),
-		OwnedUnits: ownedUnits,
-		Money:      StartingMoney,
+		Id:            clientId,
+		Name:          hello.PlayerName,
+		Team:          teamId,
+		Role:          role,
+		Spectator:     spectator,
+		Following:     s.followTarget(hello.Follow),
+		SessionToken:  sessionToken,
+		ClientVersion: hello.ClientVersion,
+		Capabilities:  capabilities,
+		Codec:         negotiatedCodec(capabilities),
+		Addr:          clientAddr,
+		LastSeen:      time.Now(),
+		Money:         float32(StartingMoney),
 	}
 
 	s.clients[clientId] = client
+	s.electHost()
+	s.lobbyDirty = true
+
+	log.Printf("Client %d (%s) connected from %s in %s phase (spectator %v, protocol %s, capabilities %v)",
+		clientId, hello.PlayerName, clientAddr.String(), s.phase, spectator, hello.ClientVersion, capabilities.list())
+	if spectator {
+		s.systemMessage("%s is spectating", client.Name)
+	} else {
+		s.systemMessage("%s joined", client.Name)
+		s.emitEvent(GameEvent{Type: EventPlayerJoined, PlayerId: client.Id, Name: client.Name})
+	}
 
-	log.Printf("Client %d (%s) connected from %s with %d workers", clientId, hello.PlayerName, clientAddr.String(), len(ownedUnits))
+	s.sendWelcome(client)
+}
 
+// sendWelcome sends the session and map details a client needs to start playing.
+// Must be called with s.mu held.
+func (s *GameServer) sendWelcome(client *Client) {
+	s.sendMessage(Message{
+		Type: MsgWelcome,
+		Data: s.marshalData(s.welcomeMessage(client)),
+	}, client.Addr)
+}
+
+// welcomeMessage describes the session, the room's settings and its map to client.
+// Must be called with s.mu held.
+func (s *GameServer) welcomeMessage(client *Client) WelcomeMessage {
 	// Build terrain data for client
 	terrainTiles := make([]TerrainTile, 0, len(s.mapData.Tiles))
 	for coord, terrain := range s.mapData.Tiles {
@@ -560,12 +1079,22 @@ func (s *GameServer) handleHello(hello HelloMessage, clientAddr *net.UDPAddr) {
 		})
 	}
 
-	// Send welcome message
 	welcome := WelcomeMessage{
-		ClientId:          clientId,
+		ClientId:          client.Id,
+		RoomId:            s.roomId,
+		Role:              RolePlayer,
+		SpectatorDelay:    int(s.spectatorDelay * 1000 / uint64(TickRate)),
+		SessionToken:      client.SessionToken,
+		ProtocolVersion:   ProtocolVersion,
+		Capabilities:      client.Capabilities.list(),
 		TickRate:          TickRate,
+		MaxPlayers:        MaxClients,
+		ClientTimeout:     int(ClientTimeout.Milliseconds()),
+		StartingMoney:     StartingMoney,
+		EntityTypes:       EntityDefinitions,
 		HeartbeatInterval: int(HeartbeatInterval.Milliseconds()),
 		InputRedundancy:   3, // Client should send last 3 commands
+		MaxDatagramSize:   s.maxDatagramSize,
 		TileSize:          TileSize,
 		ArenaTilesWidth:   s.mapData.Width,
 		ArenaTilesHeight:  s.mapData.Height,
@@ -575,81 +1104,336 @@ func (s *GameServer) handleHello(hello HelloMessage, clientAddr *net.UDPAddr) {
 		},
 	}
 
-	s.sendMessage(Message{
-		Type: MsgWelcome,
-		Data: s.marshalData(welcome),
-	}, clientAddr)
+	if client.Spectator {
+		welcome.Role = RoleSpectator
+	}
+	return welcome
 }
 
-func (s *GameServer) handlePing(clientAddr *net.UDPAddr) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	// Find client by address
-	var foundClient *Client
+// findClientBySessionToken returns the client holding token, or nil.
+// Must be called with s.mu held.
+func (s *GameServer) findClientBySessionToken(token string) *Client {
 	for _, client := range s.clients {
-		if client.Addr.String() == clientAddr.String() {
-			foundClient = client
-			break
+		if subtle.ConstantTimeCompare([]byte(client.SessionToken), []byte(token)) == 1 {
+			return client
+		}
+	}
+	return nil
+}
+
+// resumeClient reattaches a returning player to their existing client, units and money.
+// Must be called with s.mu held.
+func (s *GameServer) resumeClient(client *Client, clientAddr net.Addr) {
+	client.Addr = clientAddr
+	client.LastSeen = time.Now()
+	client.Disconnected = false
+	client.DisconnectedAt = time.Time{}
+
+	// The client starts over: fresh sequence numbers and a full snapshot
+	client.LastProcessedSeq = 0
+	client.LastProcessedTick = 0
+	client.LastAckTick = 0
+	client.History = snapshotHistory{}
+	client.LastChatSeq = 0
+	s.electHost()
+	s.lobbyDirty = true
+	s.systemMessage("%s reconnected", client.Name)
+
+	log.Printf("Client %d (%s) reconnected from %s", client.Id, client.Name, clientAddr.String())
+
+	s.sendWelcome(client)
+}
+
+// updateConnections marks clients that stopped sending as disconnected, freezing their
+// entities, and removes them for good once the reconnect grace period has passed.
+// Must be called with s.mu held.
+func (s *GameServer) updateConnections(now time.Time) {
+	for id, client := range s.clients {
+		if !client.Disconnected && now.Sub(client.LastSeen) > ClientTimeout {
+			log.Printf("Client %d (%s) timed out (no heartbeat/input for %v), holding for %v",
+				id, client.Name, ClientTimeout, s.reconnectGrace)
+			client.Disconnected = true
+			client.DisconnectedAt = now
+			s.electHost()
+			s.lobbyDirty = true
+			s.systemMessage("%s lost connection", client.Name)
+
+			// Freeze units where they stand
+			for _, entity := range s.entities {
+				if entity.OwnerId == id {
+					entity.Path = nil
+					entity.PathIndex = 0
+					entity.MoveProgress = 0.0
+					entity.TargetTileX = entity.TileX
+					entity.TargetTileY = entity.TileY
+				}
+			}
+		}
+
+		if client.Disconnected && now.Sub(client.DisconnectedAt) > s.reconnectGrace {
+			log.Printf("Client %d (%s) did not reconnect within %v, removing", id, client.Name, s.reconnectGrace)
+			s.removeClient(id)
+			s.systemMessage("%s did not reconnect and left the game", client.Name)
 		}
 	}
+}
 
-	if foundClient != nil {
-		// Update last seen time
-		foundClient.LastSeen = time.Now()
+// removeClient deletes a client and every entity it owns (units and buildings).
+// Must be called with s.mu held.
+func (s *GameServer) removeClient(id uint32) {
+	for entityId, entity := range s.entities {
+		if entity.OwnerId == id {
+			delete(s.entities, entityId)
+		}
+	}
+	delete(s.clients, id)
+	s.electHost()
+	s.lobbyDirty = true
 
-		// Send pong response
-		s.mu.Unlock() // Unlock before sending
-		s.sendMessage(Message{
-			Type: MsgPong,
-			Data: json.RawMessage("{}"),
-		}, clientAddr)
-		s.mu.Lock() // Re-lock for defer
+	// Once every player has gone the room starts over with a fresh lobby
+	if s.phase != PhaseLobby && s.playerCount() == 0 {
+		log.Printf("All players left, returning to lobby")
+		s.phase = PhaseLobby
+		s.startTick = 0
+		s.lastKnown = nil
+		s.clearResourceNodes()
+		for _, client := range s.clients {
+			if client.Role != RoleSpectator {
+				client.Spectator = false
+				client.Team = s.nextFreeTeam()
+			}
+		}
+		s.electHost()
 	}
 }
 
-func (s *GameServer) handleInput(input InputMessage, clientAddr *net.UDPAddr) {
-	s.mu.RLock()
-	client, exists := s.clients[input.ClientId]
-	s.mu.RUnlock()
+// isOwnerDisconnected reports whether an entity's owner is currently disconnected.
+// Must be called with s.mu held.
+func (s *GameServer) isOwnerDisconnected(ownerId uint32) bool {
+	client, exists := s.clients[ownerId]
+	return exists && client.Disconnected
+}
+
+func (s *GameServer) handlePing(ping PingMessage, clientAddr net.Addr) {
+	now := time.Now()
+
+	s.mu.Lock()
+	client := s.authenticate(ping.ClientId, ping.SessionToken, clientAddr)
+	var codec Codec
+	var pong PongMessage
+	if client != nil {
+		client.LastSeen = now
+		codec = codecFor(client)
+		if sample, ok := rttSample(ping, now); ok {
+			client.updateRtt(sample)
+		}
+		pong = s.newPongMessage(ping, client, now)
+	}
+	s.mu.Unlock()
+
+	// Heartbeats from a dead session tell the client to stop waiting
+	if client == nil {
+		s.sendReject(clientAddr, RejectInvalidSession, "session expired or unknown, send hello to rejoin")
+		return
+	}
+
+	// Send pong response (without holding lock)
+	s.sendPayload(codec, MsgPong, pong, clientAddr)
+}
 
-	if !exists {
+func (s *GameServer) handleGoodbye(goodbye GoodbyeMessage, clientAddr net.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	client := s.authenticate(goodbye.ClientId, goodbye.SessionToken, clientAddr)
+	if client == nil {
 		return
 	}
 
-	// Update last seen (quick lock)
+	// Leaving on purpose skips the reconnect grace period
+	log.Printf("Client %d (%s) left", client.Id, client.Name)
+	s.removeClient(client.Id)
+	s.systemMessage("%s left", client.Name)
+}
+
+// sendReject tells addr why its hello (or session) was refused
+func (s *GameServer) sendReject(addr net.Addr, reason, message string) {
+	s.sendMessage(Message{
+		Type: MsgReject,
+		Data: s.marshalData(RejectMessage{
+			Reason:  reason,
+			Message: message,
+		}),
+	}, addr)
+}
+
+func (s *GameServer) handleAck(ack AckMessage, clientAddr net.Addr) {
 	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	client := s.authenticate(ack.ClientId, ack.SessionToken, clientAddr)
+	if client == nil {
+		return
+	}
+
 	client.LastSeen = time.Now()
+
+	// Acks can arrive out of order; only move the baseline forward, never past the present
+	if ack.Tick > client.LastAckTick && ack.Tick <= s.tick {
+		client.LastAckTick = ack.Tick
+	}
+	client.Events.ack(ack.EventSeq)
+}
+
+func (s *GameServer) handleInput(input InputMessage, clientAddr net.Addr) {
+	now := time.Now()
+
+	// Validate session and update last seen (quick lock)
+	s.mu.Lock()
+	client := s.authenticate(input.ClientId, input.SessionToken, clientAddr)
+	var lastProcessedSeq uint32
+	allowed := false
+	if client != nil {
+		client.LastSeen = now
+		lastProcessedSeq = client.LastProcessedSeq
+		allowed = client.InputBucket.allow(now, InputRate, InputBurst)
+		// Frames can't claim a tick far from ours to jump the processing order
+		for i := range input.Commands {
+			input.Commands[i].Tick = s.clampInputTick(input.Commands[i].Tick)
+		}
+	}
 	s.mu.Unlock()
 
+	if client == nil {
+		return
+	}
+	if !allowed {
+		atomic.AddUint64(&s.flood.DroppedInputs, 1)
+		s.limiter.penalize(clientAddr, now)
+		return
+	}
+
+	// Only the newest frames matter; older ones are redundant copies
+	frames := input.Commands
+	if len(frames) > MaxFramesPerInput {
+		atomic.AddUint64(&s.flood.DroppedFrames, uint64(len(frames)-MaxFramesPerInput))
+		frames = frames[len(frames)-MaxFramesPerInput:]
+	}
+
 	// Enqueue all command frames (with redundancy)
 	s.queueMu.Lock()
 	defer s.queueMu.Unlock()
 
-	for _, cmdFrame := range input.Commands {
+	for _, cmdFrame := range frames {
 		// Skip already-processed commands (deduplication)
-		if cmdFrame.Sequence <= client.LastProcessedSeq {
+		if cmdFrame.Sequence <= lastProcessedSeq {
 			continue
 		}
 
+		// Bound the queue so one client can't balloon it and stall the tick
+		if s.queuedFrames[input.ClientId] >= MaxQueuedFrames || len(s.inputQueue) >= MaxQueuedInputs {
+			atomic.AddUint64(&s.flood.DroppedFrames, 1)
+			continue
+		}
+
+		commands := cmdFrame.Commands
+		if len(commands) > MaxCommandsPerFrame {
+			atomic.AddUint64(&s.flood.DroppedCommands, uint64(len(commands)-MaxCommandsPerFrame))
+			commands = commands[:MaxCommandsPerFrame]
+		}
+
 		// Add to input queue
 		s.inputQueue = append(s.inputQueue, QueuedInput{
 			ClientId: input.ClientId,
 			Sequence: cmdFrame.Sequence,
 			Tick:     cmdFrame.Tick,
-			Commands: cmdFrame.Commands,
+			Commands: commands,
 		})
+		if s.queuedFrames == nil {
+			s.queuedFrames = make(map[uint32]int)
+		}
+		s.queuedFrames[input.ClientId]++
+	}
+}
+
+// newSessionToken returns a random 128-bit hex token
+func newSessionToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// authenticate returns the client if token matches its session, or nil otherwise.
+// Disconnected clients must send a new hello to resume. A valid token from a new address
+// (e.g. after a NAT rebind) moves the session there. Must be called with s.mu held.
+func (s *GameServer) authenticate(clientId uint32, token string, clientAddr net.Addr) *Client {
+	client, exists := s.clients[clientId]
+	if !exists || client.Disconnected || token == "" ||
+		subtle.ConstantTimeCompare([]byte(client.SessionToken), []byte(token)) != 1 {
+		return nil
+	}
+
+	if clientAddr != nil && (client.Addr == nil || client.Addr.String() != clientAddr.String()) {
+		log.Printf("Client %d (%s) moved from %s to %s", client.Id, client.Name, client.Addr.String(), clientAddr.String())
+		client.Addr = clientAddr
+	}
+
+	return client
+}
+
+// CommandError explains why a command was rejected
+type CommandError struct {
+	Reason  string // One of the Err* codes
+	Message string
+}
+
+func (e *CommandError) Error() string {
+	return e.Reason + ": " + e.Message
+}
+
+func newCommandError(reason, format string, args ...interface{}) error {
+	return &CommandError{Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// newCommandErrorMessage describes a rejected command for sending to its client
+func newCommandErrorMessage(sequence uint32, commandType string, err error) CommandErrorMessage {
+	body := CommandErrorMessage{
+		Sequence:    sequence,
+		CommandType: commandType,
+		Reason:      ErrInvalidData,
+		Message:     err.Error(),
 	}
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) {
+		body.Reason = cmdErr.Reason
+		body.Message = cmdErr.Message
+	}
+	return body
 }
 
-func (s *GameServer) processCommand(cmd Command, client *Client) {
+// processCommand applies one command for client, returning a *CommandError if it was rejected
+func (s *GameServer) processCommand(cmd Command, client *Client) error {
 	switch cmd.Type {
 	case "move":
-		s.handleMoveCommand(cmd, client)
+		return s.handleMoveCommand(cmd, client)
 	case "build":
-		s.handleBuildCommand(cmd, client)
+		return s.handleBuildCommand(cmd, client)
+	case "cancel_build":
+		return s.handleCancelBuildCommand(cmd, client)
 	case "attack":
-		s.handleAttackCommand(cmd, client)
+		return s.handleAttackCommand(cmd, client)
+	case "gather":
+		return s.handleGatherCommand(cmd, client)
+	case "train":
+		return s.handleTrainCommand(cmd, client)
+	case "cancel_train":
+		return s.handleCancelTrainCommand(cmd, client)
+	case "rally":
+		return s.handleRallyCommand(cmd, client)
+	default:
+		return newCommandError(ErrUnknownCommand, "unknown command type %q", cmd.Type)
 	}
 }
 
@@ -684,7 +1468,7 @@ func (s *GameServer) updateEntityMovement(entity *Entity, deltaTime float32) {
 			if other.Id == entity.Id {
 				continue
 			}
-			if other.Type != "worker" && other.Type != "player" {
+			if !isUnit(other) {
 				continue
 			}
 			// Skip friendly units - allow passing through teammates
@@ -732,8 +1516,8 @@ func (s *GameServer) updateEntityMovement(entity *Entity, deltaTime float32) {
 	}
 
 	// Calculate movement progress increment
-	// MovementSpeed is tiles/second, so progress per tick = (tiles/sec) * deltaTime / 1 tile
-	progressIncrement := MovementSpeed * deltaTime
+	// Speed is tiles/second, so progress per tick = (tiles/sec) * deltaTime / 1 tile
+	progressIncrement := definitionOf(entity).Speed * deltaTime
 	entity.MoveProgress += progressIncrement
 
 	// Check if reached waypoint
@@ -1428,22 +2212,22 @@ func getPrimaryDirection(dx, dy float64) string {
 	}
 }
 
-func (s *GameServer) handleMoveCommand(cmd Command, client *Client) {
+func (s *GameServer) handleMoveCommand(cmd Command, client *Client) error {
 	moveData, ok := cmd.Data.(map[string]interface{})
 	if !ok {
-		return
+		return newCommandError(ErrInvalidData, "move data must be an object")
 	}
 
 	// Get unit IDs to move
 	unitIdsInterface, ok := moveData["unitIds"].([]interface{})
 	if !ok || len(unitIdsInterface) == 0 {
-		return
+		return newCommandError(ErrInvalidData, "move requires unitIds")
 	}
 
 	targetTileX, okX := moveData["targetTileX"].(float64) // JSON numbers are float64
 	targetTileY, okY := moveData["targetTileY"].(float64)
 	if !okX || !okY {
-		return
+		return newCommandError(ErrInvalidData, "move requires targetTileX and targetTileY")
 	}
 
 	tileX := int(targetTileX)
@@ -1451,7 +2235,7 @@ func (s *GameServer) handleMoveCommand(cmd Command, client *Client) {
 
 	// Validate bounds
 	if tileX < 0 || tileX >= s.mapData.Width || tileY < 0 || tileY >= s.mapData.Height {
-		return
+		return newCommandError(ErrOutOfBounds, "target (%d,%d) is outside the map", tileX, tileY)
 	}
 
 	// Get formation type (default to "box")
@@ -1476,13 +2260,20 @@ func (s *GameServer) handleMoveCommand(cmd Command, client *Client) {
 		}
 
 		// Only move units, not buildings
-		if entity.Type == "worker" {
+		if isUnit(entity) {
 			validUnitIds = append(validUnitIds, unitId)
 		}
 	}
 
 	if len(validUnitIds) == 0 {
-		return
+		return newCommandError(ErrNotOwner, "none of the selected units can be moved by this player")
+	}
+
+	// Moving cancels any attack, construction or harvesting order
+	for _, unitId := range validUnitIds {
+		s.entities[unitId].AttackTargetId = 0
+		s.entities[unitId].ConstructTargetId = 0
+		s.entities[unitId].GatherNodeId = 0
 	}
 
 	// If only one unit, use simple pathfinding without formations
@@ -1492,16 +2283,15 @@ func (s *GameServer) handleMoveCommand(cmd Command, client *Client) {
 
 		// Single unit pathfinding - no formation needed
 		path := s.findPath(entity.TileX, entity.TileY, tileX, tileY, entity.Id)
-		if len(path) > 0 {
-			entity.Path = path
-			entity.PathIndex = 0
-			entity.MoveProgress = 0.0
-			if len(path) > 0 {
-				entity.TargetTileX = path[0].X
-				entity.TargetTileY = path[0].Y
-			}
+		if len(path) == 0 {
+			return newCommandError(ErrNoPath, "no path to target (%d,%d)", tileX, tileY)
 		}
-		return
+		entity.Path = path
+		entity.PathIndex = 0
+		entity.MoveProgress = 0.0
+		entity.TargetTileX = path[0].X
+		entity.TargetTileY = path[0].Y
+		return nil
 	}
 
 	// Sort units by distance to target (closest first becomes tip)
@@ -1540,7 +2330,7 @@ func (s *GameServer) handleMoveCommand(cmd Command, client *Client) {
 		}
 		if !found {
 			log.Printf("No passable tile found near target (%d,%d)", tileX, tileY)
-			return
+			return newCommandError(ErrNoPath, "no passable tile near target (%d,%d)", tileX, tileY)
 		}
 	}
 
@@ -1629,7 +2419,7 @@ func (s *GameServer) handleMoveCommand(cmd Command, client *Client) {
 		log.Printf("No path found for leader unit %d", leader.Id)
 		// Formation can't move, disband it
 		delete(s.formations, formationGroup.ID)
-		return
+		return newCommandError(ErrNoPath, "no path to target (%d,%d)", tileX, tileY)
 	}
 
 	// Initialize follower paths to their final formation positions
@@ -1659,11 +2449,12 @@ func (s *GameServer) handleMoveCommand(cmd Command, client *Client) {
 				unitId, entity.TileX, entity.TileY, followerTargetX, followerTargetY)
 		}
 	}
+	return nil
 }
 
 func (s *GameServer) isTileOccupiedByBuilding(tileX, tileY int) bool {
 	for _, entity := range s.entities {
-		if entity.Type == "generator" {
+		if isBuilding(entity) {
 			// Check if (tileX, tileY) is within building's footprint
 			if tileX >= entity.TileX && tileX < entity.TileX+entity.FootprintWidth &&
 				tileY >= entity.TileY && tileY < entity.TileY+entity.FootprintHeight {
@@ -1674,28 +2465,27 @@ func (s *GameServer) isTileOccupiedByBuilding(tileX, tileY int) bool {
 	return false
 }
 
+// nextFreeTeam returns the lowest team id no current client is on
+func (s *GameServer) nextFreeTeam() int {
+	taken := make(map[int]bool, len(s.clients))
+	for _, client := range s.clients {
+		taken[client.Team] = true
+	}
+	team := 0
+	for taken[team] {
+		team++
+	}
+	return team
+}
+
 // getSpawnPosition returns a spawn position for a given team
 // It attempts to find a passable tile near the team's spawn point
 func (s *GameServer) getSpawnPosition(teamId int) (int, int) {
 	// Find spawn point for this team
 	for _, spawn := range s.mapData.SpawnPoints {
 		if spawn.Team == teamId {
-			// Try to find a passable tile near the spawn point
-			for attempt := 0; attempt < 100; attempt++ {
-				offsetX := 0
-				offsetY := 0
-				if spawn.Radius > 0 {
-					// Random offset within radius (simplified - not true circle)
-					offsetX = (attempt % (spawn.Radius*2 + 1)) - spawn.Radius
-					offsetY = (attempt / (spawn.Radius*2 + 1)) - spawn.Radius
-				}
-
-				x := spawn.X + offsetX
-				y := spawn.Y + offsetY
-
-				if s.isTilePassable(x, y) {
-					return x, y
-				}
+			if x, y, ok := s.passableNearSpawn(spawn); ok {
+				return x, y
 			}
 		}
 	}
@@ -1708,6 +2498,35 @@ func (s *GameServer) getSpawnPosition(teamId int) (int, int) {
 	}
 }
 
+// spawnPointPosition returns a passable tile near spawn, falling back to its team's default
+func (s *GameServer) spawnPointPosition(spawn SpawnPoint) (int, int) {
+	if x, y, ok := s.passableNearSpawn(spawn); ok {
+		return x, y
+	}
+	return s.getSpawnPosition(spawn.Team)
+}
+
+// passableNearSpawn looks for a passable tile within spawn's radius
+func (s *GameServer) passableNearSpawn(spawn SpawnPoint) (int, int, bool) {
+	for attempt := 0; attempt < 100; attempt++ {
+		offsetX := 0
+		offsetY := 0
+		if spawn.Radius > 0 {
+			// Random offset within radius (simplified - not true circle)
+			offsetX = (attempt % (spawn.Radius*2 + 1)) - spawn.Radius
+			offsetY = (attempt / (spawn.Radius*2 + 1)) - spawn.Radius
+		}
+
+		x := spawn.X + offsetX
+		y := spawn.Y + offsetY
+
+		if s.isTilePassable(x, y) {
+			return x, y, true
+		}
+	}
+	return 0, 0, false
+}
+
 // isTilePassable checks if a tile can be moved through or built on
 func (s *GameServer) isTilePassable(tileX, tileY int) bool {
 	// 1. Check bounds
@@ -1749,7 +2568,7 @@ func (s *GameServer) isTilePassable(tileX, tileY int) bool {
 func (s *GameServer) isTileOccupiedByUnit(tileX, tileY int, excludeId uint32) bool {
 	for _, entity := range s.entities {
 		// Skip non-units (buildings)
-		if entity.Type != "worker" && entity.Type != "player" {
+		if !isUnit(entity) {
 			continue
 		}
 
@@ -1790,10 +2609,10 @@ func (s *GameServer) isTileAvailableForUnit(tileX, tileY int, unitId uint32) boo
 	return true
 }
 
-func (s *GameServer) handleBuildCommand(cmd Command, client *Client) {
+func (s *GameServer) handleBuildCommand(cmd Command, client *Client) error {
 	buildData, ok := cmd.Data.(map[string]interface{})
 	if !ok {
-		return
+		return newCommandError(ErrInvalidData, "build data must be an object")
 	}
 
 	buildingType, _ := buildData["buildingType"].(string)
@@ -1803,41 +2622,45 @@ func (s *GameServer) handleBuildCommand(cmd Command, client *Client) {
 	tileY := int(tileYFloat)
 
 	// Validate building type and get footprint
-	var footprintWidth, footprintHeight int
-	switch buildingType {
-	case "generator":
-		footprintWidth = 2
-		footprintHeight = 2
-	default:
-		return // Unknown building type
+	def, exists := EntityDefinitions[buildingType]
+	if !exists || def.Kind != KindBuilding {
+		return newCommandError(ErrUnknownType, "unknown building type %q", buildingType)
 	}
+	footprintWidth := def.FootprintWidth
+	footprintHeight := def.FootprintHeight
 
 	// Check if player has enough money
-	if client.Money < BuildingCost {
-		return
+	if client.Money < float32(def.Cost) {
+		return newCommandError(ErrInsufficientFunds, "%s costs %d, have %.0f", buildingType, def.Cost, client.Money)
 	}
 
 	// Check bounds
 	if tileX < 0 || tileX+footprintWidth > s.mapData.Width ||
 		tileY < 0 || tileY+footprintHeight > s.mapData.Height {
-		return
+		return newCommandError(ErrOutOfBounds, "%s at (%d,%d) does not fit on the map", buildingType, tileX, tileY)
 	}
 
-	// Check for collisions with existing buildings (all tiles in footprint must be free)
+	// Check for collisions with existing buildings and units (all tiles in footprint must
+	// be free, or units would be walled in by the site)
 	for dx := 0; dx < footprintWidth; dx++ {
 		for dy := 0; dy < footprintHeight; dy++ {
 			if s.isTileOccupiedByBuilding(tileX+dx, tileY+dy) {
-				return
+				return newCommandError(ErrBlocked, "tile (%d,%d) is occupied by a building", tileX+dx, tileY+dy)
+			}
+			if s.isTileOccupiedByUnit(tileX+dx, tileY+dy, 0) {
+				return newCommandError(ErrBlocked, "tile (%d,%d) is occupied by a unit", tileX+dx, tileY+dy)
 			}
 		}
 	}
 
-	// Deduct money and create building
-	client.Money -= BuildingCost
+	// Only the player's own workers that know how to put this building up can build it
+	builders := s.selectBuilders(buildData, client, buildingType)
+	if len(builders) == 0 {
+		return newCommandError(ErrNotOwner, "none of the selected units can build %s for this player", buildingType)
+	}
 
+	// The id is only used up once the site is known to be reachable
 	entityId := s.nextId
-	s.nextId++
-
 	building := &Entity{
 		Id:              entityId,
 		OwnerId:         client.Id,
@@ -1847,81 +2670,76 @@ func (s *GameServer) handleBuildCommand(cmd Command, client *Client) {
 		TargetTileX:     tileX,
 		TargetTileY:     tileY,
 		MoveProgress:    0.0,
-		Health:          100,
-		MaxHealth:       100,
+		Health:          def.Health,
+		MaxHealth:       def.Health,
 		FootprintWidth:  footprintWidth,
 		FootprintHeight: footprintHeight,
 	}
-
 	s.entities[entityId] = building
 
-	log.Printf("Client %d built %s at tile (%d, %d)", client.Id, buildingType, tileX, tileY)
-}
-
-func (s *GameServer) handleAttackCommand(cmd Command, client *Client) {
-	attackData, ok := cmd.Data.(map[string]interface{})
-	if !ok {
-		return
-	}
-
-	targetIdFloat, ok := attackData["targetId"].(float64)
-	if !ok {
-		return
+	// Buildings without a build time go up on the spot; the rest are sites the workers
+	// walk to and build
+	if def.BuildTime == 0 {
+		s.nextId++
+		client.Money -= float32(def.Cost)
+		s.emitEvent(entityEvent(EventBuildingCompleted, building, client.Id))
+		log.Printf("Client %d built %s at tile (%d, %d)", client.Id, buildingType, tileX, tileY)
+		return nil
 	}
-	targetId := uint32(targetIdFloat)
 
-	// Find target entity
-	target, exists := s.entities[targetId]
-	if !exists {
-		return
+	building.UnderConstruction = true
+	ordered := s.assignBuilders(builders, building)
+	if ordered == 0 {
+		delete(s.entities, entityId)
+		return newCommandError(ErrNoPath, "no path to the %s site at (%d,%d)", buildingType, tileX, tileY)
 	}
+	s.nextId++
+	client.Money -= float32(def.Cost)
 
-	// Can't attack own entities
-	if target.OwnerId == client.Id {
-		return
-	}
+	log.Printf("Client %d started %s at tile (%d, %d) with %d workers", client.Id, buildingType, tileX, tileY, ordered)
+	return nil
+}
 
-	// Only allow attacking buildings for now
-	if target.Type != "generator" {
-		return
+// broadcastMessage sends a message to every connected client in its own encoding
+func (s *GameServer) broadcastMessage(msgType MessageType, payload interface{}) {
+	s.mu.RLock()
+	outgoing := make([]outgoingMessage, 0, len(s.clients))
+	for _, client := range s.clients {
+		if client.Disconnected {
+			continue
+		}
+		outgoing = append(outgoing, outgoingMessage{
+			addr:    client.Addr,
+			codec:   codecFor(client),
+			msgType: msgType,
+			payload: payload,
+		})
 	}
+	s.mu.RUnlock()
 
-	// Apply damage
-	damage := int32(25)
-	target.Health -= damage
-
-	log.Printf("Client %d attacked entity %d for %d damage (HP: %d)", client.Id, targetId, damage, target.Health)
-
-	// Check if destroyed
-	if target.Health <= 0 {
-		delete(s.entities, targetId)
-		log.Printf("Entity %d destroyed", targetId)
+	for _, out := range outgoing {
+		s.sendPayload(out.codec, out.msgType, out.payload, out.addr)
 	}
-	// No events needed - client will see health change / entity removal in snapshot
 }
 
-func (s *GameServer) broadcastMessage(msg Message) {
-	data, err := json.Marshal(msg)
-	if err != nil {
-		log.Printf("Error marshaling broadcast message: %v", err)
-		return
-	}
+// sendMessage sends a JSON message, used before a client's codec is negotiated
+func (s *GameServer) sendMessage(msg Message, addr net.Addr) {
+	s.sendPayload(jsonCodec{}, msg.Type, msg.Data, addr)
+}
 
-	s.mu.RLock()
-	for _, client := range s.clients {
-		s.conn.WriteToUDP(data, client.Addr)
+// sendPayload encodes payload with codec (JSON if nil) and sends it to addr
+func (s *GameServer) sendPayload(codec Codec, msgType MessageType, payload interface{}, addr net.Addr) {
+	if codec == nil {
+		codec = jsonCodec{}
 	}
-	s.mu.RUnlock()
-}
 
-func (s *GameServer) sendMessage(msg Message, addr *net.UDPAddr) {
-	data, err := json.Marshal(msg)
+	data, err := codec.Encode(msgType, payload)
 	if err != nil {
-		log.Printf("Error marshaling message: %v", err)
+		log.Printf("Error encoding %s message (%s): %v", msgType, codec.Name(), err)
 		return
 	}
 
-	s.conn.WriteToUDP(data, addr)
+	s.writeDatagrams(codec, data, addr)
 }
 
 func (s *GameServer) marshalData(data interface{}) json.RawMessage {
@@ -1934,18 +2752,46 @@ func (s *GameServer) marshalData(data interface{}) json.RawMessage {
 }
 
 func main() {
-	// Load map (relative to server directory)
-	mapData, err := LoadMap("../maps/default.json")
+	cfg, err := LoadConfig(os.Args[1:], os.Getenv, os.Stderr)
+	if err == flag.ErrHelp {
+		return
+	}
 	if err != nil {
-		log.Fatalf("Failed to load map: %v", err)
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	cfg.apply()
+	log.Printf("Config: tick rate %d, %d players per room, client timeout %v, money %d, entities %s, map %s",
+		cfg.TickRate, cfg.MaxClients, cfg.ClientTimeout, cfg.StartingMoney, cfg.Entities, cfg.Map)
+
+	// Unit and building stats come from the definitions file (checked by validate)
+	if EntityDefinitions, err = LoadDefinitions(EntitiesFile); err != nil {
+		log.Fatalf("Invalid entity definitions: %v", err)
+	}
+	log.Printf("Loaded %d entity types from %s", len(EntityDefinitions), EntitiesFile)
+
+	// Start the room manager (opens the default room with the default map, unless a
+	// saved match replaces it)
+	manager := NewRoomManager(MapsDir)
+	if cfg.Load != "" {
+		if manager.restore, err = ReadMatchSave(cfg.Load); err != nil {
+			log.Fatalf("Invalid save: %v", err)
+		}
 	}
 
-	// Create server and assign map
-	server := NewGameServer()
-	server.mapData = mapData
+	// SIGINT/SIGTERM shut down cleanly; a second signal kills the process as usual
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		log.Printf("Received %v, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		manager.Shutdown(ctx, "Server is shutting down")
+	}()
 
-	// Start server
-	if err := server.Start(); err != nil {
+	if err := manager.Start(); err != nil {
 		log.Fatal(err)
 	}
+	log.Printf("Server stopped")
 }
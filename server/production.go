@@ -0,0 +1,269 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// trainsUnit reports whether a building's type can train unitType
+func trainsUnit(building *Entity, unitType string) bool {
+	def := definitionOf(building)
+	if def == nil {
+		return false
+	}
+	for _, trains := range def.Trains {
+		if trains == unitType {
+			return true
+		}
+	}
+	return false
+}
+
+// hideProduction strips what a building is training and where its units gather, which
+// only its owner's team may know
+func hideProduction(entity *Entity) {
+	entity.TrainingQueue = nil
+	entity.TrainProgress = 0
+	entity.HasRally = false
+	entity.RallyTileX = 0
+	entity.RallyTileY = 0
+}
+
+// ownedBuilding looks up the building a production command refers to. Must be called
+// with s.mu held.
+func (s *GameServer) ownedBuilding(data map[string]interface{}, client *Client) (*Entity, error) {
+	buildingIdFloat, ok := data["buildingId"].(float64)
+	if !ok {
+		return nil, newCommandError(ErrInvalidData, "buildingId is required")
+	}
+	buildingId := uint32(buildingIdFloat)
+
+	building, exists := s.entities[buildingId]
+	if !exists || building.OwnerId != client.Id {
+		return nil, newCommandError(ErrNotOwner, "building %d does not belong to this player", buildingId)
+	}
+	if !isBuilding(building) {
+		return nil, newCommandError(ErrInvalidTarget, "entity %d (%s) is not a building", buildingId, building.Type)
+	}
+	return building, nil
+}
+
+func (s *GameServer) handleTrainCommand(cmd Command, client *Client) error {
+	trainData, ok := cmd.Data.(map[string]interface{})
+	if !ok {
+		return newCommandError(ErrInvalidData, "train data must be an object")
+	}
+
+	building, err := s.ownedBuilding(trainData, client)
+	if err != nil {
+		return err
+	}
+	if building.UnderConstruction {
+		return newCommandError(ErrInvalidTarget, "building %d is still under construction", building.Id)
+	}
+
+	unitType, _ := trainData["unitType"].(string)
+	def, exists := EntityDefinitions[unitType]
+	if !exists || def.Kind != KindUnit || !trainsUnit(building, unitType) {
+		return newCommandError(ErrUnknownType, "%s can't train %q", building.Type, unitType)
+	}
+	if len(building.TrainingQueue) >= MaxTrainingQueue {
+		return newCommandError(ErrQueueFull, "building %d already has %d units queued", building.Id, MaxTrainingQueue)
+	}
+	if client.Money < float32(def.Cost) {
+		return newCommandError(ErrInsufficientFunds, "%s costs %d, have %.0f", unitType, def.Cost, client.Money)
+	}
+
+	// Paid up front and refunded if cancelled. The queue is copied rather than appended in
+	// place because recorded snapshots share it.
+	client.Money -= float32(def.Cost)
+	queue := make([]string, len(building.TrainingQueue), len(building.TrainingQueue)+1)
+	copy(queue, building.TrainingQueue)
+	building.TrainingQueue = append(queue, unitType)
+
+	log.Printf("Client %d queued %s at building %d", client.Id, unitType, building.Id)
+	return nil
+}
+
+func (s *GameServer) handleCancelTrainCommand(cmd Command, client *Client) error {
+	cancelData, ok := cmd.Data.(map[string]interface{})
+	if !ok {
+		return newCommandError(ErrInvalidData, "cancel_train data must be an object")
+	}
+
+	building, err := s.ownedBuilding(cancelData, client)
+	if err != nil {
+		return err
+	}
+
+	queue := building.TrainingQueue
+	if len(queue) == 0 {
+		return newCommandError(ErrInvalidTarget, "building %d is not training anything", building.Id)
+	}
+
+	// Cancel the most recently queued unit unless told otherwise
+	index := len(queue) - 1
+	if indexFloat, ok := cancelData["index"].(float64); ok {
+		index = int(indexFloat)
+	}
+	if index < 0 || index >= len(queue) {
+		return newCommandError(ErrInvalidData, "building %d has no queue position %d", building.Id, index)
+	}
+
+	unitType := queue[index]
+	if def := EntityDefinitions[unitType]; def != nil {
+		client.Money += float32(def.Cost)
+	}
+
+	remaining := append(queue[:index:index], queue[index+1:]...)
+	if len(remaining) == 0 {
+		remaining = nil
+	}
+	building.TrainingQueue = remaining
+	if index == 0 {
+		building.TrainProgress = 0 // The next unit starts from scratch
+	}
+
+	log.Printf("Client %d cancelled %s at building %d", client.Id, unitType, building.Id)
+	return nil
+}
+
+func (s *GameServer) handleRallyCommand(cmd Command, client *Client) error {
+	rallyData, ok := cmd.Data.(map[string]interface{})
+	if !ok {
+		return newCommandError(ErrInvalidData, "rally data must be an object")
+	}
+
+	building, err := s.ownedBuilding(rallyData, client)
+	if err != nil {
+		return err
+	}
+
+	tileXFloat, okX := rallyData["tileX"].(float64)
+	tileYFloat, okY := rallyData["tileY"].(float64)
+	if !okX || !okY {
+		return newCommandError(ErrInvalidData, "rally requires tileX and tileY")
+	}
+	tileX := int(tileXFloat)
+	tileY := int(tileYFloat)
+	if tileX < 0 || tileX >= s.mapData.Width || tileY < 0 || tileY >= s.mapData.Height {
+		return newCommandError(ErrOutOfBounds, "rally point (%d,%d) is outside the map", tileX, tileY)
+	}
+
+	building.HasRally = true
+	building.RallyTileX = tileX
+	building.RallyTileY = tileY
+	return nil
+}
+
+// updateProduction advances the unit at the front of every training queue and spawns it
+// once its build time has passed. Must be called with s.mu held.
+func (s *GameServer) updateProduction(deltaTime float32) {
+	// Buildings train in id order so units spawning at once claim tiles the same way every time
+	producers := make([]uint32, 0)
+	for id, entity := range s.entities {
+		if len(entity.TrainingQueue) > 0 {
+			producers = append(producers, id)
+		}
+	}
+	sort.Slice(producers, func(i, j int) bool { return producers[i] < producers[j] })
+
+	for _, id := range producers {
+		building := s.entities[id]
+		owner, exists := s.clients[building.OwnerId]
+		if !exists || owner.Disconnected {
+			continue // Frozen like the rest of the player's entities
+		}
+
+		unitType := building.TrainingQueue[0]
+		def := EntityDefinitions[unitType]
+		if def == nil || def.Kind != KindUnit {
+			// Not a unit type. Orders and restored saves are checked, so this is only a safeguard.
+			building.TrainingQueue = popQueue(building.TrainingQueue)
+			building.TrainProgress = 0
+			continue
+		}
+
+		if buildTime := time.Duration(def.BuildTime).Seconds(); buildTime > 0 {
+			building.TrainProgress = min(building.TrainProgress+deltaTime/float32(buildTime), 1)
+		} else {
+			building.TrainProgress = 1
+		}
+		if building.TrainProgress < 1 {
+			continue
+		}
+
+		// A finished unit waits inside until a tile next to the building frees up
+		if s.spawnTrainedUnit(building, owner, unitType, def) {
+			building.TrainingQueue = popQueue(building.TrainingQueue)
+			building.TrainProgress = 0
+		}
+	}
+}
+
+// popQueue removes the front of a training queue (nil once it is empty)
+func popQueue(queue []string) []string {
+	if len(queue) <= 1 {
+		return nil
+	}
+	return queue[1:]
+}
+
+// spawnTrainedUnit places a newly trained unit on the free tile next to building closest
+// to its rally point (or in front of it) and sends it to the rally point. Returns false
+// if every adjacent tile is taken. Must be called with s.mu held.
+func (s *GameServer) spawnTrainedUnit(building *Entity, owner *Client, unitType string, def *EntityDefinition) bool {
+	towardX, towardY := building.TileX, building.TileY+max(building.FootprintHeight, 1)
+	if building.HasRally {
+		towardX, towardY = building.RallyTileX, building.RallyTileY
+	}
+	tile, found := s.nearestFreeTile(building, 1, towardX, towardY, 0)
+	if !found {
+		return false
+	}
+
+	entityId := s.nextId
+	s.nextId++
+
+	unit := &Entity{
+		Id:           entityId,
+		OwnerId:      owner.Id,
+		Type:         unitType,
+		TileX:        tile.X,
+		TileY:        tile.Y,
+		TargetTileX:  tile.X,
+		TargetTileY:  tile.Y,
+		MoveProgress: 0.0,
+		Health:       def.Health,
+		MaxHealth:    def.Health,
+	}
+	s.entities[entityId] = unit
+	owner.OwnedUnits = append(owner.OwnedUnits, entityId)
+	s.emitEvent(entityEvent(EventUnitTrained, unit, owner.Id))
+
+	if building.HasRally {
+		s.sendToRally(unit, building)
+	}
+
+	log.Printf("Building %d trained %s %d for client %d", building.Id, unitType, entityId, owner.Id)
+	return true
+}
+
+// sendToRally paths a freshly trained unit to building's rally point, or to the nearest
+// free tile if something stands on it. Must be called with s.mu held.
+func (s *GameServer) sendToRally(unit, building *Entity) {
+	rally := &Entity{TileX: building.RallyTileX, TileY: building.RallyTileY}
+	goal, found := s.nearestFreeTile(rally, RallySearchRadius, rally.TileX, rally.TileY, unit.Id)
+	if !found || (goal.X == unit.TileX && goal.Y == unit.TileY) {
+		return
+	}
+	path := s.findPath(unit.TileX, unit.TileY, goal.X, goal.Y, unit.Id)
+	if len(path) == 0 {
+		return
+	}
+	unit.Path = path
+	unit.PathIndex = 0
+	unit.TargetTileX = path[0].X
+	unit.TargetTileY = path[0].Y
+}
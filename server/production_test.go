@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func trainCommand(buildingId uint32, unitType string) Command {
+	return Command{Type: "train", Data: map[string]interface{}{"buildingId": float64(buildingId), "unitType": unitType}}
+}
+
+// addOffice gives a client an office at (x, y)
+func addOffice(server *GameServer, id uint32, owner *Client, x, y int) *Entity {
+	def := EntityDefinitions["office"]
+	office := &Entity{Id: id, OwnerId: owner.Id, Type: "office", TileX: x, TileY: y, TargetTileX: x, TargetTileY: y,
+		Health: def.Health, MaxHealth: def.Health, FootprintWidth: def.FootprintWidth, FootprintHeight: def.FootprintHeight}
+	server.entities[id] = office
+	return office
+}
+
+// TestTrainedUnitsSpawnNextToTheBuilding verifies a queued unit is paid for up front, takes
+// its build time and appears beside the building as one of its owner's units
+func TestTrainedUnitsSpawnNextToTheBuilding(t *testing.T) {
+	server, alice, _, _ := newEventsTestServer()
+	office := addOffice(server, 50, alice, 5, 5)
+	alice.OwnedUnits = []uint32{10}
+
+	if err := server.processCommand(trainCommand(50, "worker"), alice); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if alice.Money != 50 || len(office.TrainingQueue) != 1 {
+		t.Fatalf("Expected a worker queued for 50, got queue %v and %.0f money", office.TrainingQueue, alice.Money)
+	}
+
+	buildTicks := int(durationTicks(time.Duration(EntityDefinitions["worker"].BuildTime)))
+	ticks := 0
+	for ; ticks < 2*buildTicks && len(alice.OwnedUnits) == 1; ticks++ {
+		server.gameTick()
+	}
+	if ticks < buildTicks-1 || ticks > buildTicks+1 {
+		t.Errorf("Expected training to take about %d ticks, took %d", buildTicks, ticks)
+	}
+	if len(alice.OwnedUnits) != 2 {
+		t.Fatalf("Expected a second unit for Alice, got %v", alice.OwnedUnits)
+	}
+
+	unit := server.entities[alice.OwnedUnits[1]]
+	if unit == nil || unit.Type != "worker" || unit.Health != 100 || tileDistance(unit.TileX, unit.TileY, office) != 1 {
+		t.Errorf("Expected a full-health worker next to the office, got %+v", unit)
+	}
+	if office.TrainingQueue != nil || office.TrainProgress != 0 {
+		t.Errorf("Expected the queue emptied, got %v at %.2f", office.TrainingQueue, office.TrainProgress)
+	}
+	trained := false
+	for _, event := range alice.Events.events {
+		trained = trained || (event.Type == EventUnitTrained && event.EntityId == unit.Id)
+	}
+	if !trained {
+		t.Errorf("Expected a %s event, got %v", EventUnitTrained, eventTypes(alice.Events.events))
+	}
+}
+
+// TestTrainCommandValidation verifies what buildings train, queue limits, funds and
+// cancellation refunds
+func TestTrainCommandValidation(t *testing.T) {
+	server, alice, bob, _ := newEventsTestServer()
+	office := addOffice(server, 50, alice, 5, 5)
+	alice.Money = 1000
+
+	cases := []struct {
+		cmd    Command
+		client *Client
+		code   string
+	}{
+		{trainCommand(40, "worker"), bob, ErrUnknownType},     // Generators don't train
+		{trainCommand(50, "worker"), bob, ErrNotOwner},        // Alice's office
+		{trainCommand(10, "worker"), alice, ErrInvalidTarget}, // A worker isn't a building
+		{trainCommand(50, "office"), alice, ErrUnknownType},
+		{Command{Type: "train", Data: map[string]interface{}{"unitType": "worker"}}, alice, ErrInvalidData},
+	}
+	for i, c := range cases {
+		var cmdErr *CommandError
+		if err := server.processCommand(c.cmd, c.client); !errors.As(err, &cmdErr) || cmdErr.Reason != c.code {
+			t.Errorf("Case %d: expected %s, got %v", i, c.code, err)
+		}
+	}
+
+	for i := 0; i < MaxTrainingQueue; i++ {
+		if err := server.processCommand(trainCommand(50, "worker"), alice); err != nil {
+			t.Fatalf("Unexpected error queueing unit %d: %v", i, err)
+		}
+	}
+	var cmdErr *CommandError
+	if err := server.processCommand(trainCommand(50, "worker"), alice); !errors.As(err, &cmdErr) || cmdErr.Reason != ErrQueueFull {
+		t.Errorf("Expected %s, got %v", ErrQueueFull, err)
+	}
+
+	bob.Money = 10
+	addOffice(server, 60, bob, 30, 20)
+	if err := server.processCommand(trainCommand(60, "worker"), bob); !errors.As(err, &cmdErr) || cmdErr.Reason != ErrInsufficientFunds {
+		t.Errorf("Expected %s, got %v", ErrInsufficientFunds, err)
+	}
+
+	// Cancelling the unit in training refunds it and restarts the next one
+	queued := office.TrainingQueue
+	office.TrainProgress = 0.5
+	cancel := Command{Type: "cancel_train", Data: map[string]interface{}{"buildingId": float64(50), "index": float64(0)}}
+	if err := server.processCommand(cancel, alice); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if alice.Money != 1000-float32(MaxTrainingQueue-1)*50 || len(office.TrainingQueue) != MaxTrainingQueue-1 || office.TrainProgress != 0 {
+		t.Errorf("Expected a refund and a restarted queue, got %v at %.2f with %.0f money", office.TrainingQueue, office.TrainProgress, alice.Money)
+	}
+	if len(queued) != MaxTrainingQueue {
+		t.Errorf("Expected the previous queue left intact for recorded snapshots, got %v", queued)
+	}
+
+	// Without an index the last queued unit is cancelled
+	for len(office.TrainingQueue) > 0 {
+		if err := server.processCommand(Command{Type: "cancel_train", Data: map[string]interface{}{"buildingId": float64(50)}}, alice); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if alice.Money != 1000 || office.TrainingQueue != nil {
+		t.Errorf("Expected every unit refunded, got %v with %.0f money", office.TrainingQueue, alice.Money)
+	}
+	if err := server.processCommand(cancel, alice); !errors.As(err, &cmdErr) || cmdErr.Reason != ErrInvalidTarget {
+		t.Errorf("Expected %s cancelling an empty queue, got %v", ErrInvalidTarget, err)
+	}
+}
+
+// TestTrainedUnitsWalkToRallyPoint verifies units leave their building towards its rally
+// point and that rally points outside the map are refused
+func TestTrainedUnitsWalkToRallyPoint(t *testing.T) {
+	server, alice, _, _ := newEventsTestServer()
+	office := addOffice(server, 50, alice, 5, 5)
+
+	rally := func(x, y int) Command {
+		return Command{Type: "rally", Data: map[string]interface{}{"buildingId": float64(50), "tileX": float64(x), "tileY": float64(y)}}
+	}
+	var cmdErr *CommandError
+	if err := server.processCommand(rally(-1, 3), alice); !errors.As(err, &cmdErr) || cmdErr.Reason != ErrOutOfBounds {
+		t.Errorf("Expected %s, got %v", ErrOutOfBounds, err)
+	}
+	if err := server.processCommand(rally(15, 6), alice); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := server.processCommand(trainCommand(50, "worker"), alice); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for i := 0; i < 10*TickRate && len(alice.OwnedUnits) == 0; i++ {
+		server.gameTick()
+	}
+	if len(alice.OwnedUnits) != 1 {
+		t.Fatalf("Expected a trained unit, got %v", alice.OwnedUnits)
+	}
+	unit := server.entities[alice.OwnedUnits[0]]
+	if unit.TileX != office.TileX+office.FootprintWidth {
+		t.Errorf("Expected the unit to appear on the side facing the rally point, got (%d,%d)", unit.TileX, unit.TileY)
+	}
+
+	for i := 0; i < 5*TickRate; i++ {
+		server.gameTick()
+	}
+	if unit.TileX != 15 || unit.TileY != 6 {
+		t.Errorf("Expected the unit at the rally point, got (%d,%d)", unit.TileX, unit.TileY)
+	}
+}
+
+// TestProductionHiddenFromEnemies verifies other teams see a building but not what it is
+// training or where its units rally
+func TestProductionHiddenFromEnemies(t *testing.T) {
+	server, alice, bob := newVisibilityTestServer()
+	office := addOffice(server, 50, alice, 30, 34)
+	office.TrainingQueue = []string{"worker"}
+	office.HasRally = true
+	office.RallyTileX, office.RallyTileY = 28, 30
+
+	world := server.captureWorldState()
+	if seen, ok := server.clientView(bob, world).entities[50]; !ok || seen.TrainingQueue != nil || seen.HasRally {
+		t.Errorf("Expected Bob to see the office without its production, got %+v (visible %v)", seen, ok)
+	}
+	if own := server.clientView(alice, world).entities[50]; len(own.TrainingQueue) != 1 || !own.HasRally {
+		t.Errorf("Expected Alice to see her office's production, got %+v", own)
+	}
+}
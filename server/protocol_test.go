@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+)
+
+// TestProcessCommandReportsReasons verifies rejected commands carry a reason code
+func TestProcessCommandReportsReasons(t *testing.T) {
+	server := newSessionTestServer()
+	client := &Client{Id: 1, Name: "Tester", Money: 10}
+	server.clients[1] = client
+	server.entities[2] = &Entity{Id: 2, OwnerId: 1, Type: "worker", TileX: 1, TileY: 1}
+	server.entities[3] = &Entity{Id: 3, OwnerId: 9, Type: "worker", TileX: 5, TileY: 5}
+
+	tests := []struct {
+		name   string
+		cmd    Command
+		reason string
+	}{
+		{"unknown command", Command{Type: "dance"}, ErrUnknownCommand},
+		{"malformed move", Command{Type: "move", Data: "north"}, ErrInvalidData},
+		{"move out of bounds", Command{Type: "move", Data: map[string]interface{}{
+			"unitIds": []interface{}{float64(2)}, "targetTileX": float64(-1), "targetTileY": float64(0),
+		}}, ErrOutOfBounds},
+		{"move enemy unit", Command{Type: "move", Data: map[string]interface{}{
+			"unitIds": []interface{}{float64(3)}, "targetTileX": float64(2), "targetTileY": float64(2),
+		}}, ErrNotOwner},
+		{"unknown building", Command{Type: "build", Data: map[string]interface{}{
+			"buildingType": "castle", "tileX": float64(3), "tileY": float64(3),
+		}}, ErrUnknownType},
+		{"cannot afford", Command{Type: "build", Data: map[string]interface{}{
+			"buildingType": "generator", "tileX": float64(3), "tileY": float64(3),
+		}}, ErrInsufficientFunds},
+		{"attack missing target", Command{Type: "attack", Data: map[string]interface{}{
+			"targetId": float64(99),
+		}}, ErrInvalidTarget},
+	}
+
+	for _, tc := range tests {
+		err := server.processCommand(tc.cmd, client)
+		var cmdErr *CommandError
+		if !errors.As(err, &cmdErr) {
+			t.Errorf("%s: expected CommandError, got %v", tc.name, err)
+			continue
+		}
+		if cmdErr.Reason != tc.reason {
+			t.Errorf("%s: expected reason %q, got %q (%s)", tc.name, tc.reason, cmdErr.Reason, cmdErr.Message)
+		}
+	}
+
+	// A valid command reports no error
+	valid := Command{Type: "move", Data: map[string]interface{}{
+		"unitIds": []interface{}{float64(2)}, "targetTileX": float64(4), "targetTileY": float64(1),
+	}}
+	if err := server.processCommand(valid, client); err != nil {
+		t.Errorf("Expected valid move to succeed, got %v", err)
+	}
+}
+
+// TestCommandErrorMessageEncoding verifies the wire format of command errors
+func TestCommandErrorMessageEncoding(t *testing.T) {
+	body := newCommandErrorMessage(7, "build", newCommandError(ErrBlocked, "tile (1,1) is occupied"))
+
+	data, err := jsonCodec{}.Encode(MsgCommandError, body)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	msg, err := decodeDatagram(data)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if msg.Type != MsgCommandError {
+		t.Fatalf("Expected command_error message, got %q", msg.Type)
+	}
+
+	var decoded CommandErrorMessage
+	if err := json.Unmarshal(msg.Data, &decoded); err != nil {
+		t.Fatalf("Invalid body: %v", err)
+	}
+	if decoded != body || body.Sequence != 7 || body.Reason != ErrBlocked || body.Message != "tile (1,1) is occupied" {
+		t.Errorf("Unexpected command error body: %+v", decoded)
+	}
+}
+
+// TestGoodbyeRemovesClientImmediately verifies leaving skips the reconnect grace period
+func TestGoodbyeRemovesClientImmediately(t *testing.T) {
+	server := newSessionTestServer()
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	server.clients[1] = &Client{Id: 1, Name: "Leaver", SessionToken: "secret", Addr: addr}
+	server.entities[2] = &Entity{Id: 2, OwnerId: 1, Type: "worker"}
+
+	// Forged goodbye is ignored
+	server.handleGoodbye(GoodbyeMessage{ClientId: 1, SessionToken: "guess"}, addr)
+	if _, exists := server.clients[1]; !exists {
+		t.Fatal("Goodbye with wrong token removed the client")
+	}
+
+	server.handleGoodbye(GoodbyeMessage{ClientId: 1, SessionToken: "secret"}, addr)
+	if _, exists := server.clients[1]; exists {
+		t.Error("Expected client removed after goodbye")
+	}
+	if _, exists := server.entities[2]; exists {
+		t.Error("Expected leaver's units removed after goodbye")
+	}
+}
+
+// TestHelloRejectedWhenFull verifies a full server tells the late client why with a
+// server_full reject and does not create a client
+func TestHelloRejectedWhenFull(t *testing.T) {
+	server := newSessionTestServer()
+	server.conn = listenTestUDP(t)
+	for i := uint32(1); i <= uint32(MaxClients); i++ {
+		server.clients[i] = &Client{Id: i}
+	}
+	server.nextId = uint32(MaxClients) + 1
+
+	late := listenTestUDP(t)
+	server.handleHello(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "Late"}, late.LocalAddr())
+	if len(server.clients) != MaxClients {
+		t.Errorf("Expected %d clients, got %d", MaxClients, len(server.clients))
+	}
+
+	msg := receiveMessage(t, late)
+	var reject RejectMessage
+	if err := json.Unmarshal(msg.Data, &reject); msg.Type != MsgReject || err != nil {
+		t.Fatalf("Expected %s, got %s (%v)", MsgReject, msg.Type, err)
+	}
+	if reject.Reason != RejectServerFull {
+		t.Errorf("Expected reason %s, got %+v", RejectServerFull, reject)
+	}
+}
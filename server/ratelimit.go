@@ -0,0 +1,216 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket allows bursts up to a capacity, refilling at a steady rate
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token if one is available. A zero bucket starts full.
+func (b *tokenBucket) allow(now time.Time, rate, burst float64) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// floodCounters counts traffic dropped by flood protection. Fields are updated atomically.
+type floodCounters struct {
+	DroppedDatagrams uint64 `json:"droppedDatagrams"` // From banned or over-rate addresses
+	DroppedHellos    uint64 `json:"droppedHellos"`    // Over the per-address hello rate
+	DroppedInputs    uint64 `json:"droppedInputs"`    // Input messages over the per-client rate
+	DroppedFrames    uint64 `json:"droppedFrames"`    // Command frames over the per-message or queue caps
+	DroppedCommands  uint64 `json:"droppedCommands"`  // Commands over the per-frame or per-tick caps
+	DroppedChats     uint64 `json:"droppedChats"`     // Chat messages over the per-client rate
+	Bans             uint64 `json:"bans"`             // Addresses temporarily banned
+}
+
+// snapshot returns a consistent-enough copy for reporting
+func (c *floodCounters) snapshot() floodCounters {
+	return floodCounters{
+		DroppedDatagrams: atomic.LoadUint64(&c.DroppedDatagrams),
+		DroppedHellos:    atomic.LoadUint64(&c.DroppedHellos),
+		DroppedInputs:    atomic.LoadUint64(&c.DroppedInputs),
+		DroppedFrames:    atomic.LoadUint64(&c.DroppedFrames),
+		DroppedCommands:  atomic.LoadUint64(&c.DroppedCommands),
+		DroppedChats:     atomic.LoadUint64(&c.DroppedChats),
+		Bans:             atomic.LoadUint64(&c.Bans),
+	}
+}
+
+// endpointLimit tracks one remote address's rates and misbehaviour
+type endpointLimit struct {
+	datagrams   tokenBucket
+	hellos      tokenBucket
+	strikes     int       // Rate limit violations in the current window
+	windowStart time.Time // When strikes started counting
+	bannedUntil time.Time
+	lastSeen    time.Time
+}
+
+// rateLimiter applies per-address limits and bans addresses that keep exceeding them.
+// A nil rateLimiter allows everything.
+type rateLimiter struct {
+	mu        sync.Mutex
+	endpoints map[string]*endpointLimit // Keyed by IP so port hopping doesn't reset limits
+	lastSweep time.Time
+	counters  *floodCounters
+}
+
+func newRateLimiter(counters *floodCounters) *rateLimiter {
+	return &rateLimiter{
+		endpoints: make(map[string]*endpointLimit),
+		counters:  counters,
+	}
+}
+
+// endpointKey identifies the remote host an address belongs to
+func endpointKey(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		if a == nil {
+			return ""
+		}
+		return a.IP.String()
+	case *wsPeer:
+		return a.host
+	case nil:
+		return ""
+	}
+	return addr.String()
+}
+
+// endpoint returns the limits for key, creating them if needed. Must be called with l.mu held.
+func (l *rateLimiter) endpoint(key string, now time.Time) *endpointLimit {
+	l.sweep(now)
+
+	e, exists := l.endpoints[key]
+	if !exists {
+		e = &endpointLimit{windowStart: now}
+		l.endpoints[key] = e
+	}
+	e.lastSeen = now
+	return e
+}
+
+// sweep forgets idle, unbanned endpoints at most once per StrikeWindow. Must be called with l.mu held.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < StrikeWindow {
+		return
+	}
+	l.lastSweep = now
+
+	for key, e := range l.endpoints {
+		if now.Sub(e.lastSeen) > StrikeWindow && now.After(e.bannedUntil) {
+			delete(l.endpoints, key)
+		}
+	}
+}
+
+// allowDatagram reports whether a datagram from addr should be processed at all
+func (l *rateLimiter) allowDatagram(addr net.Addr, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e := l.endpoint(endpointKey(addr), now)
+	if now.Before(e.bannedUntil) {
+		atomic.AddUint64(&l.counters.DroppedDatagrams, 1)
+		return false
+	}
+	if !e.datagrams.allow(now, DatagramRate, DatagramBurst) {
+		atomic.AddUint64(&l.counters.DroppedDatagrams, 1)
+		l.strike(addr, e, now)
+		return false
+	}
+	return true
+}
+
+// allowHello reports whether addr may open (or resume) a session now
+func (l *rateLimiter) allowHello(addr net.Addr, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e := l.endpoint(endpointKey(addr), now)
+	if !e.hellos.allow(now, HelloRate, HelloBurst) {
+		atomic.AddUint64(&l.counters.DroppedHellos, 1)
+		l.strike(addr, e, now)
+		return false
+	}
+	return true
+}
+
+// penalize records a violation detected elsewhere (e.g. a client exceeding its input rate)
+func (l *rateLimiter) penalize(addr net.Addr, now time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.strike(addr, l.endpoint(endpointKey(addr), now), now)
+}
+
+// strike counts a violation and bans the endpoint once it reaches BanStrikes within
+// StrikeWindow. Must be called with l.mu held.
+func (l *rateLimiter) strike(addr net.Addr, e *endpointLimit, now time.Time) {
+	if now.Sub(e.windowStart) > StrikeWindow {
+		e.strikes = 0
+		e.windowStart = now
+	}
+
+	e.strikes++
+	if e.strikes < BanStrikes {
+		return
+	}
+
+	e.strikes = 0
+	e.bannedUntil = now.Add(BanDuration)
+	atomic.AddUint64(&l.counters.Bans, 1)
+	log.Printf("Banned %s for %v after repeated rate limit violations", endpointKey(addr), BanDuration)
+}
+
+// statsLoop logs flood protection counters (shared by all rooms) whenever they change.
+// Monitoring can also query them at any time with a stats message.
+func (m *RoomManager) statsLoop() {
+	ticker := time.NewTicker(StatsLogInterval)
+	defer ticker.Stop()
+
+	var last floodCounters
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.done:
+			return
+		}
+		current := m.flood.snapshot()
+		if current != last {
+			log.Printf("Flood protection: %+v", current)
+			last = current
+		}
+	}
+}
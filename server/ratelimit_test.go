@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestTokenBucketRefills verifies buckets start full, drain, and refill at the given rate
+func TestTokenBucketRefills(t *testing.T) {
+	var bucket tokenBucket
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !bucket.allow(now, 1, 3) {
+			t.Fatalf("Expected burst token %d to be allowed", i)
+		}
+	}
+	if bucket.allow(now, 1, 3) {
+		t.Fatal("Expected empty bucket to refuse")
+	}
+
+	if !bucket.allow(now.Add(time.Second), 1, 3) {
+		t.Error("Expected a token after one second at 1/s")
+	}
+	if bucket.allow(now.Add(time.Second), 1, 3) {
+		t.Error("Expected only one token to have refilled")
+	}
+}
+
+// TestHelloFloodIsLimited verifies an address can't create clients faster than the hello rate
+func TestHelloFloodIsLimited(t *testing.T) {
+	server := newSessionTestServer()
+
+	for i := 0; i < 20; i++ {
+		addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000 + i}
+		server.handleHello(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "Spam"}, addr)
+	}
+
+	if len(server.clients) != HelloBurst {
+		t.Errorf("Expected %d clients from one address, got %d", HelloBurst, len(server.clients))
+	}
+	if counters := server.flood.snapshot(); counters.DroppedHellos != uint64(20-HelloBurst) {
+		t.Errorf("Expected %d dropped hellos, got %d", 20-HelloBurst, counters.DroppedHellos)
+	}
+}
+
+// TestRepeatedViolationsBanAddress verifies addresses that keep flooding are banned for a while
+func TestRepeatedViolationsBanAddress(t *testing.T) {
+	var counters floodCounters
+	limiter := newRateLimiter(&counters)
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	other := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+	now := time.Now()
+
+	for i := 0; i < DatagramBurst+BanStrikes; i++ {
+		limiter.allowDatagram(addr, now)
+	}
+	if counters.snapshot().Bans != 1 {
+		t.Fatalf("Expected one ban, got %d", counters.Bans)
+	}
+
+	// Even once the bucket refills, the ban holds
+	if limiter.allowDatagram(addr, now.Add(BanDuration/2)) {
+		t.Error("Expected banned address to be dropped")
+	}
+	if !limiter.allowDatagram(other, now.Add(BanDuration/2)) {
+		t.Error("Expected other addresses to be unaffected")
+	}
+	if !limiter.allowDatagram(addr, now.Add(BanDuration+time.Second)) {
+		t.Error("Expected ban to expire")
+	}
+}
+
+// TestNilRateLimiterAllowsEverything verifies servers built without a limiter still work
+func TestNilRateLimiterAllowsEverything(t *testing.T) {
+	var limiter *rateLimiter
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+
+	if !limiter.allowDatagram(addr, time.Now()) || !limiter.allowHello(addr, time.Now()) {
+		t.Error("Expected nil limiter to allow traffic")
+	}
+	limiter.penalize(addr, time.Now())
+}
+
+// TestInputFloodIsBounded verifies one client can't grow the input queue without limit
+func TestInputFloodIsBounded(t *testing.T) {
+	server := newSessionTestServer()
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	server.clients[1] = &Client{Id: 1, Name: "Flooder", SessionToken: "secret", Addr: addr}
+
+	sequence := uint32(0)
+	for i := 0; i < 2*InputBurst; i++ {
+		frames := make([]CommandFrame, 0, 20)
+		for j := 0; j < 20; j++ {
+			sequence++
+			commands := make([]Command, 40)
+			for k := range commands {
+				commands[k] = Command{Type: "move"}
+			}
+			frames = append(frames, CommandFrame{Sequence: sequence, Commands: commands})
+		}
+		server.handleInput(InputMessage{ClientId: 1, SessionToken: "secret", Commands: frames}, addr)
+	}
+
+	if len(server.inputQueue) != MaxQueuedFrames {
+		t.Errorf("Expected queue capped at %d frames, got %d", MaxQueuedFrames, len(server.inputQueue))
+	}
+	for _, input := range server.inputQueue {
+		if len(input.Commands) > MaxCommandsPerFrame {
+			t.Fatalf("Expected at most %d commands per frame, got %d", MaxCommandsPerFrame, len(input.Commands))
+		}
+	}
+
+	counters := server.flood.snapshot()
+	if counters.DroppedInputs == 0 || counters.DroppedFrames == 0 || counters.DroppedCommands == 0 {
+		t.Errorf("Expected drops to be counted, got %+v", counters)
+	}
+
+	// The next tick starts with an empty per-client allowance
+	server.gameTick()
+	server.clients[1].InputBucket = tokenBucket{}
+	sequence++
+	server.handleInput(InputMessage{ClientId: 1, SessionToken: "secret", Commands: []CommandFrame{{Sequence: sequence}}}, addr)
+	if len(server.inputQueue) != 1 {
+		t.Errorf("Expected queue to accept frames after the tick, got %d", len(server.inputQueue))
+	}
+}
+
+// TestCommandsPerTickAreCapped verifies excess commands are rejected with rate_limited
+func TestCommandsPerTickAreCapped(t *testing.T) {
+	server := newSessionTestServer()
+	client := &Client{Id: 1, Name: "Busy", SessionToken: "secret", LastSeen: time.Now()}
+	server.clients[1] = client
+
+	for seq := uint32(1); seq <= 4; seq++ {
+		commands := make([]Command, MaxCommandsPerFrame)
+		for i := range commands {
+			commands[i] = Command{Type: "noop"}
+		}
+		server.inputQueue = append(server.inputQueue, QueuedInput{ClientId: 1, Sequence: seq, Commands: commands})
+	}
+
+	server.gameTick()
+
+	excess := uint64(4*MaxCommandsPerFrame - MaxCommandsPerTick)
+	if counters := server.flood.snapshot(); counters.DroppedCommands != excess {
+		t.Errorf("Expected %d commands dropped, got %d", excess, counters.DroppedCommands)
+	}
+	if client.LastProcessedSeq != 4 {
+		t.Errorf("Expected all frames marked processed, got seq %d", client.LastProcessedSeq)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// isResourceNode reports whether an entity is one of the map's resource nodes
+func isResourceNode(entity *Entity) bool {
+	return entity.Type == ResourceNodeType
+}
+
+// validate checks a resource node fits on a width x height map and can be harvested
+func (n *ResourceNode) validate(width, height int) error {
+	nodeWidth, nodeHeight := max(n.Width, 1), max(n.Height, 1)
+	switch {
+	case n.Type == "":
+		return fmt.Errorf("type must be set")
+	case n.Quantity <= 0:
+		return fmt.Errorf("quantity must be positive, got %d", n.Quantity)
+	case n.Regeneration < 0:
+		return fmt.Errorf("regeneration can't be negative, got %v", n.Regeneration)
+	case n.Width < 0 || n.Height < 0:
+		return fmt.Errorf("size can't be negative, got %dx%d", n.Width, n.Height)
+	case n.X < 0 || n.Y < 0 || n.X+nodeWidth > width || n.Y+nodeHeight > height:
+		return fmt.Errorf("%s at (%d,%d) does not fit on the %dx%d map", n.Type, n.X, n.Y, width, height)
+	}
+	return nil
+}
+
+// spawnResourceNodes puts the map's resource nodes in the world, full, as entities owned
+// by no one. Must be called with s.mu held.
+func (s *GameServer) spawnResourceNodes() {
+	for _, spec := range s.mapData.ResourceNodes {
+		entityId := s.nextId
+		s.nextId++
+
+		s.entities[entityId] = &Entity{
+			Id:              entityId,
+			Type:            ResourceNodeType,
+			TileX:           spec.X,
+			TileY:           spec.Y,
+			TargetTileX:     spec.X,
+			TargetTileY:     spec.Y,
+			FootprintWidth:  max(spec.Width, 1),
+			FootprintHeight: max(spec.Height, 1),
+			ResourceType:    spec.Type,
+			Resources:       spec.Quantity,
+			MaxResources:    spec.Quantity,
+			Regeneration:    spec.Regeneration,
+		}
+	}
+}
+
+// clearResourceNodes removes every resource node so the next match starts with full ones.
+// Must be called with s.mu held.
+func (s *GameServer) clearResourceNodes() {
+	for id, entity := range s.entities {
+		if isResourceNode(entity) {
+			delete(s.entities, id)
+		}
+	}
+}
+
+func (s *GameServer) handleGatherCommand(cmd Command, client *Client) error {
+	gatherData, ok := cmd.Data.(map[string]interface{})
+	if !ok {
+		return newCommandError(ErrInvalidData, "gather data must be an object")
+	}
+
+	nodeIdFloat, ok := gatherData["nodeId"].(float64)
+	if !ok {
+		return newCommandError(ErrInvalidData, "gather requires nodeId")
+	}
+	nodeId := uint32(nodeIdFloat)
+
+	node, exists := s.entities[nodeId]
+	if !exists || !isResourceNode(node) {
+		return newCommandError(ErrInvalidTarget, "entity %d is not a resource node", nodeId)
+	}
+	// Like attack targets, nodes must have been seen to be known
+	_, remembered := s.lastKnown[client.Team][nodeId]
+	if !remembered && !s.teamVision(client.Team).seesEntity(node) {
+		return newCommandError(ErrInvalidTarget, "resource node %d is not in sight", nodeId)
+	}
+
+	unitIdsInterface, ok := gatherData["unitIds"].([]interface{})
+	if !ok || len(unitIdsInterface) == 0 {
+		return newCommandError(ErrInvalidData, "gather requires unitIds")
+	}
+
+	// Send every selected unit that can harvest to the node
+	gatherers, ordered := 0, 0
+	for _, unitIdInterface := range unitIdsInterface {
+		unitIdFloat, ok := unitIdInterface.(float64)
+		if !ok {
+			continue
+		}
+		unit, exists := s.entities[uint32(unitIdFloat)]
+		if !exists || unit.OwnerId != client.Id {
+			continue
+		}
+		if def := definitionOf(unit); def == nil || def.Gather == nil {
+			continue
+		}
+		gatherers++
+		if s.approachWithin(unit, node, GatherReach) {
+			s.leaveFormation(unit.Id)
+			unit.AttackTargetId = 0
+			unit.ConstructTargetId = 0
+			unit.GatherNodeId = node.Id
+			ordered++
+		}
+	}
+
+	if gatherers == 0 {
+		return newCommandError(ErrNotOwner, "none of the selected units can gather for this player")
+	}
+	if ordered == 0 {
+		return newCommandError(ErrNoPath, "no path to resource node %d", nodeId)
+	}
+	log.Printf("Client %d sent %d units to gather %s from node %d", client.Id, ordered, node.ResourceType, nodeId)
+	return nil
+}
+
+// updateGathering runs every harvesting worker's loop: walk to its node, harvest until
+// full, carry the load to the nearest drop-off and credit its owner, then go back.
+// Must be called with s.mu held.
+func (s *GameServer) updateGathering() {
+	// Workers harvest in id order so the last units of a node go to the same worker every time
+	gatherers := make([]uint32, 0)
+	for id, entity := range s.entities {
+		if entity.GatherNodeId != 0 {
+			gatherers = append(gatherers, id)
+		}
+	}
+	sort.Slice(gatherers, func(i, j int) bool { return gatherers[i] < gatherers[j] })
+
+	for _, id := range gatherers {
+		unit, exists := s.entities[id]
+		if !exists || unit.GatherNodeId == 0 {
+			continue // Killed, or its node ran out, earlier this tick
+		}
+		owner, exists := s.clients[unit.OwnerId]
+		if !exists || owner.Disconnected {
+			continue // Frozen like the rest of the player's entities
+		}
+		def := definitionOf(unit)
+		if def == nil || def.Gather == nil {
+			unit.GatherNodeId = 0 // Its type no longer gathers
+			continue
+		}
+		node, exists := s.entities[unit.GatherNodeId]
+		if !exists {
+			// Its node ran out with nothing else nearby: bring the last load home, then stop
+			if unit.Resources > 0 {
+				s.deliverLoad(unit, owner)
+			}
+			if unit.Resources == 0 {
+				unit.GatherNodeId = 0
+			}
+			continue
+		}
+
+		// Full, or the node is empty for now: take what's carried home
+		if unit.Resources >= def.Gather.Capacity || (node.Resources == 0 && unit.Resources > 0) {
+			s.deliverLoad(unit, owner)
+			continue
+		}
+		if node.Resources == 0 {
+			// Regrowing: move on to another node of the same kind if there is one close by
+			if next := s.nearestNode(node.ResourceType, unit, node.Id); next != nil {
+				unit.GatherNodeId = next.Id
+			}
+			continue
+		}
+
+		arrived, reachable := s.closeIn(unit, node, GatherReach)
+		if !reachable {
+			log.Printf("Unit %d can't reach resource node %d, giving up gathering", unit.Id, node.Id)
+			unit.GatherNodeId = 0
+		}
+		if !arrived || s.tick < unit.NextGatherTick {
+			continue
+		}
+
+		unit.NextGatherTick = s.tick + durationTicks(time.Duration(float32(time.Second)/def.Gather.Rate))
+		node.Resources--
+		unit.Resources++
+		unit.ResourceType = node.ResourceType
+		if node.Resources == 0 && node.Regeneration == 0 {
+			s.depleteNode(node)
+		}
+	}
+}
+
+// deliverLoad takes a worker's load to its owner's nearest drop-off and credits it as
+// money once there. Workers without a drop-off wait with their load. Must be called with
+// s.mu held.
+func (s *GameServer) deliverLoad(unit *Entity, owner *Client) {
+	dropOff := s.nearestDropOff(unit)
+	if dropOff == nil {
+		return
+	}
+	arrived, reachable := s.closeIn(unit, dropOff, GatherReach)
+	if !reachable {
+		log.Printf("Unit %d can't reach drop-off %d, giving up gathering", unit.Id, dropOff.Id)
+		unit.GatherNodeId = 0
+	}
+	if !arrived {
+		return
+	}
+
+	owner.Money += float32(unit.Resources)
+	owner.IncomeEarned += float32(unit.Resources)
+	unit.Resources = 0
+	unit.ResourceType = ""
+}
+
+// nearestDropOff returns the finished drop-off building of unit's owner closest to it, or
+// nil if there is none. Must be called with s.mu held.
+func (s *GameServer) nearestDropOff(unit *Entity) *Entity {
+	var best *Entity
+	bestDistance := 0
+	for _, entity := range s.entities {
+		if entity.OwnerId != unit.OwnerId || entity.UnderConstruction {
+			continue
+		}
+		if def := definitionOf(entity); def == nil || !def.DropOff {
+			continue
+		}
+		distance := tileDistance(unit.TileX, unit.TileY, entity)
+		if best == nil || distance < bestDistance || (distance == bestDistance && entity.Id < best.Id) {
+			best, bestDistance = entity, distance
+		}
+	}
+	return best
+}
+
+// nearestNode returns the node of resourceType with resources left that is closest to
+// unit within GatherSearchRadius, other than excludeId, or nil. Must be called with s.mu
+// held.
+func (s *GameServer) nearestNode(resourceType string, unit *Entity, excludeId uint32) *Entity {
+	var best *Entity
+	bestDistance := 0
+	for _, entity := range s.entities {
+		if !isResourceNode(entity) || entity.Id == excludeId || entity.ResourceType != resourceType || entity.Resources == 0 {
+			continue
+		}
+		distance := tileDistance(unit.TileX, unit.TileY, entity)
+		if distance > GatherSearchRadius {
+			continue
+		}
+		if best == nil || distance < bestDistance || (distance == bestDistance && entity.Id < best.Id) {
+			best, bestDistance = entity, distance
+		}
+	}
+	return best
+}
+
+// depleteNode removes a node that has run out for good, moving the workers harvesting it
+// on to the nearest node of the same kind. Workers with no node to move on to keep their
+// order until they have delivered what they carry. Must be called with s.mu held.
+func (s *GameServer) depleteNode(node *Entity) {
+	delete(s.entities, node.Id)
+	s.emitEvent(entityEvent(EventResourceDepleted, node, 0))
+	log.Printf("Resource node %d (%s) depleted", node.Id, node.ResourceType)
+
+	for _, entity := range s.entities {
+		if entity.GatherNodeId != node.Id {
+			continue
+		}
+		if next := s.nearestNode(node.ResourceType, entity, node.Id); next != nil {
+			entity.GatherNodeId = next.Id
+		} else if entity.Resources == 0 {
+			entity.GatherNodeId = 0
+		}
+	}
+}
+
+// regrowResources refills regenerating nodes towards the quantity they started with.
+// Must be called with s.mu held.
+func (s *GameServer) regrowResources(deltaTime float32) {
+	for _, entity := range s.entities {
+		if !isResourceNode(entity) || entity.Regeneration <= 0 {
+			continue
+		}
+		if entity.Resources >= entity.MaxResources {
+			entity.Regrowth = 0
+			continue
+		}
+		entity.Regrowth += entity.Regeneration * deltaTime
+		if whole := int32(entity.Regrowth); whole > 0 {
+			entity.Resources = min(entity.Resources+whole, entity.MaxResources)
+			entity.Regrowth -= float32(whole)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func gatherCommand(nodeId uint32, unitIds ...uint32) Command {
+	ids := make([]interface{}, len(unitIds))
+	for i, id := range unitIds {
+		ids[i] = float64(id)
+	}
+	return Command{Type: "gather", Data: map[string]interface{}{"unitIds": ids, "nodeId": float64(nodeId)}}
+}
+
+func addNode(server *GameServer, id uint32, x, y int, quantity int32, regeneration float32) *Entity {
+	node := &Entity{Id: id, Type: ResourceNodeType, TileX: x, TileY: y, TargetTileX: x, TargetTileY: y,
+		FootprintWidth: 1, FootprintHeight: 1, ResourceType: "gold", Resources: quantity, MaxResources: quantity, Regeneration: regeneration}
+	server.entities[id] = node
+	return node
+}
+
+// TestWorkersGatherAndDeliver verifies a gathering worker harvests a full load, carries it
+// to the nearest drop-off for its owner's money and heads back, with the node's remaining
+// amount in snapshots
+func TestWorkersGatherAndDeliver(t *testing.T) {
+	server, alice, _, _ := newEventsTestServer()
+	addOffice(server, 50, alice, 6, 2)
+	node := addNode(server, 60, 2, 6, 100, 0)
+
+	if err := server.processCommand(gatherCommand(60, 10), alice); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	worker := server.entities[10]
+	if worker.GatherNodeId != 60 || len(worker.Path) == 0 {
+		t.Fatalf("Expected the worker on its way to the node, got %+v", worker)
+	}
+
+	capacity := EntityDefinitions["worker"].Gather.Capacity
+	for i := 0; i < 30*TickRate && alice.Money == 100; i++ {
+		server.gameTick()
+		if worker.Resources > capacity {
+			t.Fatalf("Expected at most %d carried, got %d", capacity, worker.Resources)
+		}
+	}
+	if alice.Money != 100+float32(capacity) {
+		t.Fatalf("Expected a load of %d delivered, got %.0f money", capacity, alice.Money)
+	}
+	if node.Resources != 100-capacity || worker.Resources != 0 || worker.ResourceType != "" {
+		t.Errorf("Expected %d left and an empty worker, got %d left and %d %q carried",
+			100-capacity, node.Resources, worker.Resources, worker.ResourceType)
+	}
+	if worker.GatherNodeId != 60 {
+		t.Errorf("Expected the worker to keep gathering, got node %d", worker.GatherNodeId)
+	}
+
+	snapshot := server.buildSnapshot(alice, server.captureWorldState())
+	if seen, ok := snapshotEntity(snapshot, 60); !ok || seen.Resources != node.Resources || seen.ResourceType != "gold" {
+		t.Errorf("Expected the node with %d gold in the snapshot, got %+v", node.Resources, seen)
+	}
+
+	// Moving the worker elsewhere ends the loop
+	move := Command{Type: "move", Data: map[string]interface{}{"unitIds": []interface{}{float64(10)}, "targetTileX": float64(2), "targetTileY": float64(2)}}
+	if err := server.processCommand(move, alice); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if worker.GatherNodeId != 0 {
+		t.Errorf("Expected a move to stop gathering, got node %d", worker.GatherNodeId)
+	}
+}
+
+// TestDepletedNodeIsRemoved verifies a node without regeneration disappears once empty,
+// telling players and moving its workers on to another node of the same kind
+func TestDepletedNodeIsRemoved(t *testing.T) {
+	server, alice, _, _ := newEventsTestServer()
+	addNode(server, 60, 2, 3, 3, 0)
+	next := addNode(server, 61, 4, 3, 50, 0)
+
+	if err := server.processCommand(gatherCommand(60, 10), alice); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 10*TickRate; i++ {
+		server.gameTick()
+		if _, exists := server.entities[60]; !exists {
+			break
+		}
+	}
+	if _, exists := server.entities[60]; exists {
+		t.Fatal("Expected the empty node removed")
+	}
+
+	depleted := false
+	for _, event := range alice.Events.events {
+		depleted = depleted || (event.Type == EventResourceDepleted && event.EntityId == 60)
+	}
+	if !depleted {
+		t.Errorf("Expected a %s event, got %v", EventResourceDepleted, eventTypes(alice.Events.events))
+	}
+	worker := server.entities[10]
+	if worker.GatherNodeId != next.Id || worker.Resources != 3 {
+		t.Errorf("Expected the worker moved on to node %d carrying 3, got node %d carrying %d", next.Id, worker.GatherNodeId, worker.Resources)
+	}
+}
+
+// TestLastLoadDeliveredWhenNodesRunOut verifies a worker whose node runs out with no other
+// node nearby still brings what it carries to a drop-off before going idle
+func TestLastLoadDeliveredWhenNodesRunOut(t *testing.T) {
+	server, alice, _, _ := newEventsTestServer()
+	addOffice(server, 50, alice, 6, 2)
+	addNode(server, 60, 2, 6, 3, 0)
+
+	if err := server.processCommand(gatherCommand(60, 10), alice); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	worker := server.entities[10]
+	for i := 0; i < 30*TickRate && alice.Money == 100; i++ {
+		server.gameTick()
+	}
+	if _, exists := server.entities[60]; exists {
+		t.Fatal("Expected the empty node removed")
+	}
+	if alice.Money != 103 {
+		t.Errorf("Expected the last 3 gold delivered, got %.0f money", alice.Money)
+	}
+	if worker.Resources != 0 || worker.GatherNodeId != 0 {
+		t.Errorf("Expected an idle empty worker, got node %d carrying %d", worker.GatherNodeId, worker.Resources)
+	}
+}
+
+// TestRegeneratingNodeRefills verifies a node with regeneration stays on the map when
+// empty and regrows up to the quantity it started with
+func TestRegeneratingNodeRefills(t *testing.T) {
+	server, _, _, _ := newEventsTestServer()
+	node := addNode(server, 60, 2, 3, 5, 2)
+	node.Resources = 0
+
+	for i := 0; i < TickRate; i++ {
+		server.gameTick()
+	}
+	if node.Resources != 2 {
+		t.Errorf("Expected 2 regrown after a second, got %d", node.Resources)
+	}
+	for i := 0; i < 5*TickRate; i++ {
+		server.gameTick()
+	}
+	if node.Resources != 5 {
+		t.Errorf("Expected the node refilled to 5, got %d", node.Resources)
+	}
+}
+
+// TestGatherCommandValidation verifies who can gather from what
+func TestGatherCommandValidation(t *testing.T) {
+	server, alice, _, _ := newEventsTestServer()
+	addNode(server, 60, 2, 4, 100, 0)
+	addNode(server, 61, 20, 20, 100, 0) // Out of Alice's sight
+	server.entities[12] = &Entity{Id: 12, OwnerId: 1, Type: "generator", TileX: 5, TileY: 5, TargetTileX: 5, TargetTileY: 5,
+		Health: 100, MaxHealth: 100, FootprintWidth: 2, FootprintHeight: 2}
+
+	cases := []struct {
+		cmd    Command
+		reason string
+	}{
+		{gatherCommand(60), ErrInvalidData},
+		{gatherCommand(60, 20), ErrNotOwner}, // Bob's worker
+		{gatherCommand(60, 12), ErrNotOwner}, // Buildings can't gather
+		{gatherCommand(40, 10), ErrInvalidTarget},
+		{gatherCommand(61, 10), ErrInvalidTarget},
+		{gatherCommand(99, 10), ErrInvalidTarget},
+	}
+	for i, c := range cases {
+		var cmdErr *CommandError
+		if err := server.processCommand(c.cmd, alice); !errors.As(err, &cmdErr) || cmdErr.Reason != c.reason {
+			t.Errorf("Case %d: expected %s, got %v", i, c.reason, err)
+		}
+	}
+	if server.entities[10].GatherNodeId != 0 {
+		t.Error("Expected rejected orders to leave the worker idle")
+	}
+
+	attack := Command{Type: "attack", Data: map[string]interface{}{"unitIds": []interface{}{float64(10)}, "targetId": float64(60)}}
+	var cmdErr *CommandError
+	if err := server.processCommand(attack, alice); !errors.As(err, &cmdErr) || cmdErr.Reason != ErrInvalidTarget {
+		t.Errorf("Expected attacking a resource node to fail with %s, got %v", ErrInvalidTarget, err)
+	}
+}
+
+// TestLoadMapResourceNodes verifies resource nodes load from map files and bad ones are
+// rejected
+func TestLoadMapResourceNodes(t *testing.T) {
+	dir := t.TempDir()
+	load := func(nodes string) (*MapData, error) {
+		path := filepath.Join(dir, "map.json")
+		os.WriteFile(path, []byte(`{"name": "Nodes", "width": 20, "height": 20, "tileSize": 32,
+			"terrain": {"default": {"type": "grass", "passable": true}, "tiles": []},
+			"resourceNodes": [`+nodes+`], "spawnPoints": []}`), 0o644)
+		return LoadMap(path)
+	}
+
+	mapData, err := load(`{"type": "gold", "x": 3, "y": 4, "width": 2, "height": 2, "quantity": 500, "regeneration": 0.5}`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(mapData.ResourceNodes) != 1 || mapData.ResourceNodes[0].Quantity != 500 || mapData.ResourceNodes[0].Regeneration != 0.5 {
+		t.Errorf("Expected one node of 500 regrowing 0.5/s, got %+v", mapData.ResourceNodes)
+	}
+
+	bad := map[string]string{
+		"type":         `{"x": 1, "y": 1, "quantity": 10}`,
+		"quantity":     `{"type": "gold", "x": 1, "y": 1, "quantity": 0}`,
+		"regeneration": `{"type": "gold", "x": 1, "y": 1, "quantity": 10, "regeneration": -1}`,
+		"fit":          `{"type": "gold", "x": 19, "y": 1, "width": 2, "quantity": 10}`,
+	}
+	for want, node := range bad {
+		if _, err := load(node); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected an error about %s for %s, got %v", want, node, err)
+		}
+	}
+}
+
+// TestResourceNodesSpawnWithMatch verifies starting a match puts the map's nodes down
+// full and returning to the lobby clears them
+func TestResourceNodesSpawnWithMatch(t *testing.T) {
+	server, alice, bob := newVisibilityTestServer()
+	server.mapData.ResourceNodes = []ResourceNode{{Type: "gold", X: 10, Y: 10, Width: 2, Quantity: 300}}
+
+	server.beginMatch()
+	var node *Entity
+	for _, entity := range server.entities {
+		if isResourceNode(entity) {
+			node = entity
+		}
+	}
+	if node == nil || node.OwnerId != 0 || node.Resources != 300 || node.FootprintWidth != 2 || node.FootprintHeight != 1 {
+		t.Fatalf("Expected a neutral 2x1 node with 300 gold, got %+v", node)
+	}
+
+	server.removeClient(alice.Id)
+	server.removeClient(bob.Id)
+	if _, exists := server.entities[node.Id]; exists {
+		t.Error("Expected the node cleared on returning to the lobby")
+	}
+}
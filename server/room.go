@@ -0,0 +1,504 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// validRoomName limits room ids and map names to something safe to log and to use as a
+// file name
+var validRoomName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// RoomError explains why a room couldn't be created or joined
+type RoomError struct {
+	Reason  string // One of the Reject* codes
+	Message string
+}
+
+func (e *RoomError) Error() string {
+	return e.Reason + ": " + e.Message
+}
+
+func newRoomError(reason, format string, args ...interface{}) error {
+	return &RoomError{Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// Room is one match: a GameServer with its own map, clients and tick loop
+type Room struct {
+	Id         string
+	MapName    string
+	server     *GameServer
+	stop       chan struct{} // Closed to stop the tick loop
+	stopped    chan struct{} // Closed once the tick loop has returned (nil if it never ran)
+	emptySince time.Time     // When the room last had no players (zero while occupied)
+}
+
+// info describes the room for room lists
+func (r *Room) info() RoomInfo {
+	players, spectators, phase, tick := r.server.occupancy()
+	return RoomInfo{
+		RoomId:     r.Id,
+		MapName:    r.MapName,
+		Players:    players,
+		MaxPlayers: MaxClients,
+		Spectators: spectators,
+		Phase:      phase,
+		Tick:       tick,
+	}
+}
+
+// sessionEnvelope picks the session token out of any message sent after welcome
+type sessionEnvelope struct {
+	SessionToken string `json:"sessionToken"`
+}
+
+// RoomManager hosts many rooms behind one UDP socket (plus the WebSocket gateway). Hellos
+// are routed by room id; everything after is routed by the session token the room issued.
+type RoomManager struct {
+	conn           *net.UDPConn
+	mapsDir        string
+	mu             sync.Mutex
+	rooms          map[string]*Room
+	sessions       map[string]*Room // Session token -> room, filled as sessions are first seen
+	nextRoomId     uint32
+	nextFragmentId uint32 // Shared by all rooms so fragment ids never collide per client (accessed atomically)
+	fragments      *fragmentAssembler
+	limiter        *rateLimiter
+	flood          floodCounters // Traffic dropped by flood protection (updated atomically)
+	webSocket      *http.Server  // WebSocket gateway (nil if disabled)
+	peersMu        sync.Mutex
+	peers          map[*wsPeer]struct{} // Open WebSocket connections
+	closing        atomic.Bool          // Set once Shutdown begins
+	done           chan struct{}        // Closed by Shutdown to stop background loops
+	restore        *MatchSave           // Match to restore when listening (see -load)
+}
+
+func NewRoomManager(mapsDir string) *RoomManager {
+	m := &RoomManager{
+		mapsDir:   mapsDir,
+		rooms:     make(map[string]*Room),
+		sessions:  make(map[string]*Room),
+		fragments: newFragmentAssembler(),
+		peers:     make(map[*wsPeer]struct{}),
+		done:      make(chan struct{}),
+	}
+	m.limiter = newRateLimiter(&m.flood)
+	return m
+}
+
+// Start listens on ServerPort (and WebSocketPort if set), opens the default room and
+// handles messages until Shutdown
+func (m *RoomManager) Start() error {
+	if err := m.listen(); err != nil {
+		return err
+	}
+	return m.serve()
+}
+
+// listen opens the sockets and the default room
+func (m *RoomManager) listen() error {
+	addr, err := net.ResolveUDPAddr("udp", ServerPort)
+	if err != nil {
+		return err
+	}
+
+	m.conn, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	if m.restore != nil {
+		if _, err := m.restoreRoom(m.restore); err != nil {
+			return fmt.Errorf("failed to restore saved match: %w", err)
+		}
+	}
+	if m.rooms[DefaultRoomId] == nil {
+		if _, err := m.createRoom(CreateRoomMessage{RoomId: DefaultRoomId, MapName: DefaultMapName}); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Game server listening on %s", m.conn.LocalAddr())
+
+	if WebSocketPort != "" {
+		m.webSocket = m.newWebSocketServer()
+	}
+	return nil
+}
+
+// serve runs the background loops and handles messages until Shutdown closes the socket
+func (m *RoomManager) serve() error {
+	if m.webSocket != nil {
+		go m.listenWebSocket()
+	}
+	go m.reapLoop()
+	go m.statsLoop()
+
+	return m.handleMessages()
+}
+
+// createRoom loads the requested map and starts a room simulating it. An empty id is
+// generated; an empty late join policy means spectate.
+func (m *RoomManager) createRoom(req CreateRoomMessage) (*Room, error) {
+	id, mapName, lateJoin := req.RoomId, req.MapName, req.LateJoin
+	if mapName == "" {
+		mapName = DefaultMapName
+	}
+	if lateJoin == "" {
+		lateJoin = LateJoinSpectate
+	}
+	if lateJoin != LateJoinSpectate && lateJoin != LateJoinRefuse {
+		return nil, newRoomError(RejectInvalidRoom, "late join must be %q or %q", LateJoinSpectate, LateJoinRefuse)
+	}
+	if req.SpectatorDelay < 0 || time.Duration(req.SpectatorDelay)*time.Second > MaxSpectatorDelay {
+		return nil, newRoomError(RejectInvalidRoom, "spectator delay must be between 0 and %d seconds", int(MaxSpectatorDelay.Seconds()))
+	}
+	if !validRoomName.MatchString(mapName) {
+		return nil, newRoomError(RejectInvalidRoom, "invalid map name %q", mapName)
+	}
+	if id != "" && !validRoomName.MatchString(id) {
+		return nil, newRoomError(RejectInvalidRoom, "invalid room id %q (letters, digits, '-' and '_', at most 32)", id)
+	}
+
+	mapData, err := LoadMap(filepath.Join(m.mapsDir, mapName+".json"))
+	if err != nil {
+		log.Printf("Failed to load map %q for new room: %v", mapName, err)
+		return nil, newRoomError(RejectInvalidRoom, "unknown map %q", mapName)
+	}
+
+	server := NewGameServer()
+	server.mapData = mapData
+	server.lateJoin = lateJoin
+	server.spectatorDelay = uint64(req.SpectatorDelay * TickRate)
+	return m.addRoom(id, mapName, server)
+}
+
+// addRoom hosts server as room id (generated if empty) and starts its simulation
+func (m *RoomManager) addRoom(id, mapName string, server *GameServer) (*Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.rooms) >= MaxRooms {
+		return nil, newRoomError(RejectRoomLimit, "server is hosting the maximum of %d rooms", MaxRooms)
+	}
+	if id == "" {
+		for id == "" || m.rooms[id] != nil {
+			m.nextRoomId++
+			id = fmt.Sprintf("room-%d", m.nextRoomId)
+		}
+	} else if m.rooms[id] != nil {
+		return nil, newRoomError(RejectInvalidRoom, "room %q already exists", id)
+	}
+
+	server.conn = m.conn
+	server.roomId = id
+	server.nextFragmentId = &m.nextFragmentId
+	server.limiter = m.limiter
+	server.flood = &m.flood
+
+	room := &Room{
+		Id:         id,
+		MapName:    mapName,
+		server:     server,
+		stop:       make(chan struct{}),
+		emptySince: time.Now(),
+	}
+	m.rooms[id] = room
+	if m.conn != nil {
+		// Not listening means tests drive ticks themselves
+		room.stopped = make(chan struct{})
+		go func() {
+			server.tickLoop(room.stop)
+			close(room.stopped)
+		}()
+	}
+
+	log.Printf("Room %q opened on map %q (%d rooms)", id, mapName, len(m.rooms))
+	return room, nil
+}
+
+// closeRoom stops a room's simulation and forgets its sessions. Must be called with m.mu held.
+func (m *RoomManager) closeRoom(room *Room) {
+	close(room.stop)
+	delete(m.rooms, room.Id)
+	for token, r := range m.sessions {
+		if r == room {
+			delete(m.sessions, token)
+		}
+	}
+	log.Printf("Room %q closed (%d rooms)", room.Id, len(m.rooms))
+}
+
+// listRooms returns every open room, ordered by id
+func (m *RoomManager) listRooms() []RoomInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rooms := make([]RoomInfo, 0, len(m.rooms))
+	for _, room := range m.rooms {
+		rooms = append(rooms, room.info())
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].RoomId < rooms[j].RoomId
+	})
+	return rooms
+}
+
+// serverStats returns the counters answered to stats requests
+func (m *RoomManager) serverStats() ServerStatsMessage {
+	m.mu.Lock()
+	rooms := len(m.rooms)
+	m.mu.Unlock()
+	return ServerStatsMessage{Rooms: rooms, Flood: m.flood.snapshot()}
+}
+
+// roomForSession returns the room that issued token, or nil
+func (m *RoomManager) roomForSession(token string) *Room {
+	if token == "" {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if room, exists := m.sessions[token]; exists {
+		return room
+	}
+	for _, room := range m.rooms {
+		if room.server.hasSession(token) {
+			m.sessions[token] = room
+			return room
+		}
+	}
+	return nil
+}
+
+// roomForHello picks the room a hello joins: the one it names, else the one that issued
+// its session token, else the default room
+func (m *RoomManager) roomForHello(hello HelloMessage) *Room {
+	if hello.RoomId != "" {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.rooms[hello.RoomId]
+	}
+	if room := m.roomForSession(hello.SessionToken); room != nil {
+		return room
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rooms[DefaultRoomId]
+}
+
+// reapLoop closes rooms that have been empty too long
+func (m *RoomManager) reapLoop() {
+	ticker := time.NewTicker(RoomReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			m.reap(now)
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// reap closes rooms (other than the default) empty for longer than RoomIdleTimeout and
+// forgets sessions that no longer exist
+func (m *RoomManager) reap(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for token, room := range m.sessions {
+		if !room.server.hasSession(token) {
+			delete(m.sessions, token)
+		}
+	}
+
+	for _, room := range m.rooms {
+		if players, spectators, _, _ := room.server.occupancy(); players+spectators > 0 {
+			room.emptySince = time.Time{}
+			continue
+		}
+		if room.emptySince.IsZero() {
+			room.emptySince = now
+		}
+		if room.Id != DefaultRoomId && now.Sub(room.emptySince) > RoomIdleTimeout {
+			m.closeRoom(room)
+		}
+	}
+}
+
+func (m *RoomManager) handleMessages() error {
+	buffer := make([]byte, 65535) // Max UDP payload
+
+	for {
+		n, clientAddr, err := m.conn.ReadFromUDP(buffer)
+		if err != nil {
+			if m.closing.Load() {
+				return nil
+			}
+			log.Printf("Error reading UDP message: %v", err)
+			continue
+		}
+
+		m.handleDatagram(buffer[:n], clientAddr)
+	}
+}
+
+// handleDatagram decodes one UDP datagram or WebSocket message and dispatches it
+func (m *RoomManager) handleDatagram(data []byte, clientAddr net.Addr) {
+	if m.closing.Load() {
+		return // Shutting down: clients have been told
+	}
+
+	// Drop floods and banned addresses before doing any work
+	if !m.limiter.allowDatagram(clientAddr, time.Now()) {
+		return
+	}
+
+	msg, err := decodeDatagram(data)
+	if err != nil {
+		log.Printf("Error decoding message from %s: %v", clientAddr.String(), err)
+		return
+	}
+
+	// Fragments are buffered until the whole message has arrived
+	if msg.Type == MsgFragment {
+		var ok bool
+		if msg, ok = m.fragments.reassemble(msg, clientAddr); !ok {
+			return
+		}
+	}
+
+	m.handleMessage(msg, clientAddr)
+}
+
+// handleMessage answers room operations itself and hands everything else to the right room
+func (m *RoomManager) handleMessage(msg Message, clientAddr net.Addr) {
+	switch msg.Type {
+	case MsgHello:
+		var hello HelloMessage
+		if err := json.Unmarshal(msg.Data, &hello); err != nil {
+			log.Printf("Error unmarshaling hello message: %v", err)
+			return
+		}
+		room := m.roomForHello(hello)
+		if room == nil {
+			if m.limiter.allowHello(clientAddr, time.Now()) {
+				m.sendReject(clientAddr, RejectRoomNotFound, fmt.Sprintf("no room %q", hello.RoomId))
+			}
+			return
+		}
+		room.server.handleHello(hello, clientAddr)
+
+	case MsgListRooms:
+		// The list is far larger than the request, so a spoofed address could use it to
+		// amplify floods; it counts against the hello rate
+		if !m.limiter.allowHello(clientAddr, time.Now()) {
+			return
+		}
+		m.sendMessage(MsgRoomList, RoomListMessage{Rooms: m.listRooms()}, clientAddr)
+
+	case MsgStats:
+		// Answers are larger than requests, so they count against the hello rate
+		if !m.limiter.allowHello(clientAddr, time.Now()) {
+			return
+		}
+		m.sendMessage(MsgServerStats, m.serverStats(), clientAddr)
+
+	case MsgCreateRoom:
+		var create CreateRoomMessage
+		if err := json.Unmarshal(msg.Data, &create); err != nil {
+			log.Printf("Error unmarshaling create_room message: %v", err)
+			return
+		}
+		// Rooms cost a map and a tick loop, so creating one counts against the hello rate
+		if !m.limiter.allowHello(clientAddr, time.Now()) {
+			return
+		}
+		room, err := m.createRoom(create)
+		if err != nil {
+			reason, message := RejectInternalError, err.Error()
+			var roomErr *RoomError
+			if errors.As(err, &roomErr) {
+				reason, message = roomErr.Reason, roomErr.Message
+			}
+			m.sendReject(clientAddr, reason, message)
+			return
+		}
+		m.sendMessage(MsgRoomCreated, room.info(), clientAddr)
+
+	case MsgSaveMatch:
+		var req SaveMatchMessage
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			log.Printf("Error unmarshaling save_match message: %v", err)
+			return
+		}
+		// Token guesses count against the hello rate like any other sessionless request
+		if !m.limiter.allowHello(clientAddr, time.Now()) {
+			return
+		}
+		m.handleSaveMatch(req, clientAddr)
+
+	default:
+		var envelope sessionEnvelope
+		if err := json.Unmarshal(msg.Data, &envelope); err != nil {
+			log.Printf("Error unmarshaling %s message: %v", msg.Type, err)
+			return
+		}
+		room := m.roomForSession(envelope.SessionToken)
+		if room == nil {
+			// Heartbeats from a dead session tell the client to stop waiting
+			if msg.Type == MsgPing {
+				m.sendReject(clientAddr, RejectInvalidSession, "session expired or unknown, send hello to rejoin")
+			}
+			return
+		}
+		room.server.handleMessage(msg, clientAddr)
+	}
+}
+
+// sendReject tells addr why its request was refused
+func (m *RoomManager) sendReject(addr net.Addr, reason, message string) {
+	m.sendMessage(MsgReject, RejectMessage{Reason: reason, Message: message}, addr)
+}
+
+// sendMessage sends a JSON message that doesn't belong to any room
+func (m *RoomManager) sendMessage(msgType MessageType, payload interface{}, addr net.Addr) {
+	codec := jsonCodec{}
+	data, err := codec.Encode(msgType, payload)
+	if err != nil {
+		log.Printf("Error encoding %s message: %v", msgType, err)
+		return
+	}
+	writeMessage(m.conn, codec, data, MaxDatagramSize, &m.nextFragmentId, addr)
+}
+
+// hasSession reports whether token belongs to one of this room's clients (connected or not)
+func (s *GameServer) hasSession(token string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.findClientBySessionToken(token) != nil
+}
+
+// occupancy returns the number of players and spectators in the room, its match phase
+// and current tick
+func (s *GameServer) occupancy() (int, int, MatchPhase, uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	players := s.playerCount()
+	return players, len(s.clients) - players, s.phase, s.tick
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestRoomManager returns a manager (not listening, so rooms don't tick on their own)
+// hosting the default room
+func newTestRoomManager(t *testing.T) *RoomManager {
+	manager := NewRoomManager(MapsDir)
+	if _, err := manager.createRoom(CreateRoomMessage{RoomId: DefaultRoomId}); err != nil {
+		t.Fatalf("Failed to create default room: %v", err)
+	}
+	t.Cleanup(func() {
+		manager.mu.Lock()
+		defer manager.mu.Unlock()
+		for _, room := range manager.rooms {
+			manager.closeRoom(room)
+		}
+	})
+	return manager
+}
+
+func helloData(hello HelloMessage) Message {
+	return Message{Type: MsgHello, Data: NewGameServer().marshalData(hello)}
+}
+
+// listenTestUDP opens a loopback UDP socket that is closed when the test ends
+func listenTestUDP(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// receiveMessage reads the next message sent to conn, failing after a second of silence
+func receiveMessage(t *testing.T, conn *net.UDPConn) Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buffer := make([]byte, 65535)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatalf("Expected a message: %v", err)
+	}
+	msg, err := decodeDatagram(buffer[:n])
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	return msg
+}
+
+// TestCreateRoomLoadsMapAndGeneratesId verifies rooms get their own map and a fresh id
+func TestCreateRoomLoadsMapAndGeneratesId(t *testing.T) {
+	manager := newTestRoomManager(t)
+
+	room, err := manager.createRoom(CreateRoomMessage{MapName: "test_corridor"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if room.Id == "" || room.Id == DefaultRoomId {
+		t.Errorf("Expected a generated room id, got %q", room.Id)
+	}
+	if room.server.mapData == manager.rooms[DefaultRoomId].server.mapData {
+		t.Error("Expected each room to load its own map")
+	}
+	if room.server.flood != &manager.flood || room.server.limiter != manager.limiter {
+		t.Error("Expected rooms to share the manager's flood protection")
+	}
+
+	if rooms := manager.listRooms(); len(rooms) != 2 || rooms[0].RoomId != DefaultRoomId {
+		t.Errorf("Expected default room and new room listed, got %+v", rooms)
+	}
+}
+
+// TestStatsReportFloodCounters verifies monitoring can query the flood protection counters
+func TestStatsReportFloodCounters(t *testing.T) {
+	manager := newTestRoomManager(t)
+	manager.conn = listenTestUDP(t)
+	atomic.AddUint64(&manager.flood.DroppedHellos, 3)
+	atomic.AddUint64(&manager.flood.Bans, 1)
+
+	monitor := listenTestUDP(t)
+	manager.handleMessage(Message{Type: MsgStats}, monitor.LocalAddr())
+
+	msg := receiveMessage(t, monitor)
+	var stats ServerStatsMessage
+	if err := json.Unmarshal(msg.Data, &stats); msg.Type != MsgServerStats || err != nil {
+		t.Fatalf("Expected %s, got %s (%v)", MsgServerStats, msg.Type, err)
+	}
+	if stats.Rooms != 1 || stats.Flood.DroppedHellos != 3 || stats.Flood.Bans != 1 {
+		t.Errorf("Expected 1 room, 3 dropped hellos and 1 ban, got %+v", stats)
+	}
+}
+
+// TestListRoomsRateLimited verifies room lists are only sent at the hello rate, so the
+// server can't be used to amplify floods at a spoofed address
+func TestListRoomsRateLimited(t *testing.T) {
+	manager := newTestRoomManager(t)
+	manager.conn = listenTestUDP(t)
+	target := listenTestUDP(t)
+
+	for i := 0; i < HelloBurst; i++ {
+		manager.handleMessage(Message{Type: MsgListRooms}, target.LocalAddr())
+		if msg := receiveMessage(t, target); msg.Type != MsgRoomList {
+			t.Fatalf("Request %d: expected %s, got %s", i, MsgRoomList, msg.Type)
+		}
+	}
+
+	manager.handleMessage(Message{Type: MsgListRooms}, target.LocalAddr())
+	target.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := target.Read(make([]byte, 65535)); err == nil {
+		t.Errorf("Expected requests over the hello burst to go unanswered, got %d bytes", n)
+	}
+}
+
+// TestCreateRoomRejectsBadRequests verifies unknown maps, unsafe names and duplicate ids are refused
+func TestCreateRoomRejectsBadRequests(t *testing.T) {
+	manager := newTestRoomManager(t)
+
+	tests := []struct {
+		id, mapName string
+	}{
+		{"", "no_such_map"},
+		{"", "../maps/default"},
+		{"bad id", "default"},
+		{DefaultRoomId, "default"},
+	}
+	for _, tt := range tests {
+		_, err := manager.createRoom(CreateRoomMessage{RoomId: tt.id, MapName: tt.mapName})
+		var roomErr *RoomError
+		if !errors.As(err, &roomErr) || roomErr.Reason != RejectInvalidRoom {
+			t.Errorf("createRoom(%q, %q): expected %s, got %v", tt.id, tt.mapName, RejectInvalidRoom, err)
+		}
+	}
+}
+
+// TestCreateRoomLimit verifies the server stops opening rooms at MaxRooms
+func TestCreateRoomLimit(t *testing.T) {
+	manager := newTestRoomManager(t)
+
+	for i := 1; i < MaxRooms; i++ {
+		if _, err := manager.createRoom(CreateRoomMessage{RoomId: fmt.Sprintf("r%d", i), MapName: "test_single_rock"}); err != nil {
+			t.Fatalf("Room %d: unexpected error: %v", i, err)
+		}
+	}
+
+	_, err := manager.createRoom(CreateRoomMessage{MapName: "test_single_rock"})
+	var roomErr *RoomError
+	if !errors.As(err, &roomErr) || roomErr.Reason != RejectRoomLimit {
+		t.Errorf("Expected %s, got %v", RejectRoomLimit, err)
+	}
+}
+
+// TestMessagesRoutedToTheirRoom verifies hellos join the named room and later messages
+// follow the session token there
+func TestMessagesRoutedToTheirRoom(t *testing.T) {
+	manager := newTestRoomManager(t)
+	other, err := manager.createRoom(CreateRoomMessage{RoomId: "other", MapName: "default"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defaultRoom := manager.rooms[DefaultRoomId]
+
+	manager.handleMessage(helloData(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "A"}),
+		&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000})
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+	manager.handleMessage(helloData(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "B", RoomId: "other"}), addr)
+
+	if len(defaultRoom.server.clients) != 1 || len(other.server.clients) != 1 {
+		t.Fatalf("Expected one client per room, got default=%d other=%d", len(defaultRoom.server.clients), len(other.server.clients))
+	}
+
+	var client *Client
+	for _, c := range other.server.clients {
+		client = c
+	}
+	input := InputMessage{
+		ClientId:     client.Id,
+		SessionToken: client.SessionToken,
+		Commands:     []CommandFrame{{Sequence: 1, Commands: []Command{{Type: "move"}}}},
+	}
+	manager.handleMessage(Message{Type: MsgInput, Data: other.server.marshalData(input)}, addr)
+
+	if len(other.server.inputQueue) != 1 || len(defaultRoom.server.inputQueue) != 0 {
+		t.Errorf("Expected input queued in its own room only, got default=%d other=%d",
+			len(defaultRoom.server.inputQueue), len(other.server.inputQueue))
+	}
+	if manager.roomForHello(HelloMessage{SessionToken: client.SessionToken}) != other {
+		t.Error("Expected a resuming hello without a room id to return to the session's room")
+	}
+}
+
+// TestHelloForUnknownRoomCreatesNoClient verifies a missing room isn't silently replaced
+func TestHelloForUnknownRoomCreatesNoClient(t *testing.T) {
+	manager := newTestRoomManager(t)
+
+	manager.handleMessage(helloData(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "A", RoomId: "nowhere"}),
+		&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000})
+
+	if clients := len(manager.rooms[DefaultRoomId].server.clients); clients != 0 {
+		t.Errorf("Expected no client to join, default room has %d", clients)
+	}
+}
+
+// TestReapClosesIdleRooms verifies empty rooms close after RoomIdleTimeout but the default room stays
+func TestReapClosesIdleRooms(t *testing.T) {
+	manager := newTestRoomManager(t)
+	idle, _ := manager.createRoom(CreateRoomMessage{RoomId: "idle", MapName: "default"})
+	busy, _ := manager.createRoom(CreateRoomMessage{RoomId: "busy", MapName: "default"})
+	busy.server.clients[1] = &Client{Id: 1, SessionToken: "secret"}
+
+	now := time.Now()
+	manager.reap(now.Add(RoomIdleTimeout / 2))
+	if len(manager.rooms) != 3 {
+		t.Fatalf("Expected no room closed before the idle timeout, have %d", len(manager.rooms))
+	}
+
+	manager.reap(now.Add(RoomIdleTimeout + time.Second))
+	if manager.rooms["idle"] != nil {
+		t.Error("Expected idle room to close")
+	}
+	if manager.rooms["busy"] == nil || manager.rooms[DefaultRoomId] == nil {
+		t.Error("Expected occupied and default rooms to stay open")
+	}
+	select {
+	case <-idle.stop:
+	default:
+		t.Error("Expected idle room's stop channel to be closed")
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SaveFormatVersion is written into every save; loading refuses other versions
+const SaveFormatVersion = 1
+
+// MatchSave is a room's complete simulation state. It includes session tokens, so save
+// files are as sensitive as the sessions themselves.
+type MatchSave struct {
+	Version         int                       `json:"version"`
+	SavedAt         time.Time                 `json:"savedAt"`
+	TickRate        int                       `json:"tickRate"` // Rate the ticks below were counted at
+	RoomId          string                    `json:"roomId"`
+	MapName         string                    `json:"mapName"`
+	Map             savedMap                  `json:"map"` // Whole map, so the save loads even if the file changed
+	LateJoin        string                    `json:"lateJoin"`
+	SpectatorDelay  uint64                    `json:"spectatorDelay"` // Ticks
+	Phase           MatchPhase                `json:"phase"`
+	HostId          uint32                    `json:"hostId"`
+	StartTick       uint64                    `json:"startTick"`
+	Tick            uint64                    `json:"tick"`
+	NextId          uint32                    `json:"nextId"`
+	NextFormationId uint32                    `json:"nextFormationId"`
+	Clients         []savedClient             `json:"clients"`
+	Entities        []savedEntity             `json:"entities"`
+	Formations      []*FormationGroup         `json:"formations"`
+	LastKnown       map[int]map[uint32]Entity `json:"lastKnown,omitempty"` // Per-team memory of enemy buildings
+}
+
+// SaveMatchMessage asks for a room's match to be saved. It needs the server's admin
+// token; a server without one refuses every admin command.
+type SaveMatchMessage struct {
+	AdminToken string `json:"adminToken"`
+	RoomId     string `json:"roomId,omitempty"` // Empty means the default room
+}
+
+// MatchSavedMessage answers save_match
+type MatchSavedMessage struct {
+	RoomId string `json:"roomId"`
+	Path   string `json:"path"` // Save file on the server, for -load
+	Tick   uint64 `json:"tick"`
+}
+
+// savedMap is MapData with its sparse tiles as a list (JSON keys can't be structs)
+type savedMap struct {
+	Width          int            `json:"width"`
+	Height         int            `json:"height"`
+	TileSize       int            `json:"tileSize"`
+	DefaultTerrain TerrainType    `json:"defaultTerrain"`
+	Tiles          []savedTile    `json:"tiles"`
+	Features       []Feature      `json:"features"`
+	ResourceNodes  []ResourceNode `json:"resourceNodes,omitempty"`
+	SpawnPoints    []SpawnPoint   `json:"spawnPoints"`
+}
+
+type savedTile struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	TerrainType
+}
+
+// savedEntity adds the pathfinding and combat state snapshots leave out
+type savedEntity struct {
+	Entity
+	Path        []TilePosition `json:"path,omitempty"`
+	PathIndex   int            `json:"pathIndex,omitempty"`
+	BlockedTime float32        `json:"blockedTime,omitempty"`
+
+	AttackTargetId uint32 `json:"attackTargetId,omitempty"`
+	NextAttackTick uint64 `json:"nextAttackTick,omitempty"`
+
+	ConstructTargetId uint32 `json:"constructTargetId,omitempty"`
+
+	GatherNodeId   uint32  `json:"gatherNodeId,omitempty"`
+	NextGatherTick uint64  `json:"nextGatherTick,omitempty"`
+	MaxResources   int32   `json:"maxResources,omitempty"`
+	Regeneration   float32 `json:"regeneration,omitempty"`
+	Regrowth       float32 `json:"regrowth,omitempty"`
+}
+
+// savedClient is the part of a client that outlives its connection. Everything else
+// (address, sequences, outboxes, codec) is renegotiated when the client resumes.
+type savedClient struct {
+	Id           uint32   `json:"id"`
+	Name         string   `json:"name"`
+	Team         int      `json:"team"`
+	SpawnSlot    int      `json:"spawnSlot"`
+	Ready        bool     `json:"ready"`
+	Role         string   `json:"role"`
+	Spectator    bool     `json:"spectator"`
+	Following    uint32   `json:"following,omitempty"`
+	SessionToken string   `json:"sessionToken"`
+	Eliminated   bool     `json:"eliminated,omitempty"`
+	OwnedUnits   []uint32 `json:"ownedUnits"`
+	Money        float32  `json:"money"`
+	IncomeEarned float32  `json:"incomeEarned,omitempty"`
+}
+
+// matchSave captures the room's state. Must be called with s.mu held.
+func (s *GameServer) matchSave(mapName string) *MatchSave {
+	save := &MatchSave{
+		Version:         SaveFormatVersion,
+		SavedAt:         time.Now().UTC(),
+		TickRate:        TickRate,
+		RoomId:          s.roomId,
+		MapName:         mapName,
+		Map:             saveMap(s.mapData),
+		LateJoin:        s.lateJoin,
+		SpectatorDelay:  s.spectatorDelay,
+		Phase:           s.phase,
+		HostId:          s.hostId,
+		StartTick:       s.startTick,
+		Tick:            s.tick,
+		NextId:          s.nextId,
+		NextFormationId: s.nextFormationID,
+		Clients:         make([]savedClient, 0, len(s.clients)),
+		Entities:        make([]savedEntity, 0, len(s.entities)),
+		Formations:      make([]*FormationGroup, 0, len(s.formations)),
+		LastKnown:       s.lastKnown,
+	}
+
+	for _, client := range s.clients {
+		save.Clients = append(save.Clients, savedClient{
+			Id:           client.Id,
+			Name:         client.Name,
+			Team:         client.Team,
+			SpawnSlot:    client.SpawnSlot,
+			Ready:        client.Ready,
+			Role:         client.Role,
+			Spectator:    client.Spectator,
+			Following:    client.Following,
+			SessionToken: client.SessionToken,
+			Eliminated:   client.Eliminated,
+			OwnedUnits:   client.OwnedUnits,
+			Money:        client.Money,
+			IncomeEarned: client.IncomeEarned,
+		})
+	}
+	for _, entity := range s.entities {
+		save.Entities = append(save.Entities, savedEntity{
+			Entity:      *entity,
+			Path:        entity.Path,
+			PathIndex:   entity.PathIndex,
+			BlockedTime: entity.BlockedTime,
+
+			AttackTargetId: entity.AttackTargetId,
+			NextAttackTick: entity.NextAttackTick,
+
+			ConstructTargetId: entity.ConstructTargetId,
+
+			GatherNodeId:   entity.GatherNodeId,
+			NextGatherTick: entity.NextGatherTick,
+			MaxResources:   entity.MaxResources,
+			Regeneration:   entity.Regeneration,
+			Regrowth:       entity.Regrowth,
+		})
+	}
+	for _, formation := range s.formations {
+		save.Formations = append(save.Formations, formation)
+	}
+	return save
+}
+
+func saveMap(mapData *MapData) savedMap {
+	saved := savedMap{
+		Width:          mapData.Width,
+		Height:         mapData.Height,
+		TileSize:       mapData.TileSize,
+		DefaultTerrain: mapData.DefaultTerrain,
+		Tiles:          make([]savedTile, 0, len(mapData.Tiles)),
+		Features:       mapData.Features,
+		ResourceNodes:  mapData.ResourceNodes,
+		SpawnPoints:    mapData.SpawnPoints,
+	}
+	for coord, terrain := range mapData.Tiles {
+		saved.Tiles = append(saved.Tiles, savedTile{X: coord.X, Y: coord.Y, TerrainType: terrain})
+	}
+	return saved
+}
+
+func (m savedMap) mapData() *MapData {
+	mapData := &MapData{
+		Width:          m.Width,
+		Height:         m.Height,
+		TileSize:       m.TileSize,
+		DefaultTerrain: m.DefaultTerrain,
+		Tiles:          make(map[TileCoord]TerrainType, len(m.Tiles)),
+		Features:       m.Features,
+		ResourceNodes:  m.ResourceNodes,
+		SpawnPoints:    m.SpawnPoints,
+	}
+	for _, tile := range m.Tiles {
+		mapData.Tiles[TileCoord{X: tile.X, Y: tile.Y}] = tile.TerrainType
+	}
+	return mapData
+}
+
+// restoreGameServer rebuilds a room's simulation from a save. Every client comes back
+// disconnected and has the reconnect grace period to resume with its session token.
+func restoreGameServer(save *MatchSave) (*GameServer, error) {
+	if save.Version != SaveFormatVersion {
+		return nil, fmt.Errorf("save format version %d is not supported (expected %d)", save.Version, SaveFormatVersion)
+	}
+	if save.Map.Width <= 0 || save.Map.Height <= 0 {
+		return nil, fmt.Errorf("save has an invalid %dx%d map", save.Map.Width, save.Map.Height)
+	}
+	if save.TickRate != TickRate {
+		log.Printf("Save was made at %d ticks per second, running at %d: timings will scale", save.TickRate, TickRate)
+	}
+
+	s := NewGameServer()
+	s.roomId = save.RoomId
+	s.mapData = save.Map.mapData()
+	s.lateJoin = save.LateJoin
+	s.spectatorDelay = save.SpectatorDelay
+	s.phase = save.Phase
+	s.hostId = save.HostId
+	s.startTick = save.StartTick
+	s.tick = save.Tick
+	s.nextId = save.NextId
+	s.nextFormationID = save.NextFormationId
+	s.lastKnown = save.LastKnown
+	s.lobbyDirty = true
+
+	now := time.Now()
+	for _, saved := range save.Clients {
+		s.clients[saved.Id] = &Client{
+			Id:             saved.Id,
+			Name:           saved.Name,
+			Team:           saved.Team,
+			SpawnSlot:      saved.SpawnSlot,
+			Ready:          saved.Ready,
+			Role:           saved.Role,
+			Spectator:      saved.Spectator,
+			Following:      saved.Following,
+			SessionToken:   saved.SessionToken,
+			Capabilities:   capabilitySet{},
+			Eliminated:     saved.Eliminated,
+			OwnedUnits:     saved.OwnedUnits,
+			Money:          saved.Money,
+			IncomeEarned:   saved.IncomeEarned,
+			LastSeen:       now,
+			Disconnected:   true,
+			DisconnectedAt: now,
+		}
+	}
+	for _, saved := range save.Entities {
+		entity := saved.Entity
+		entity.Path = saved.Path
+		entity.PathIndex = saved.PathIndex
+		entity.BlockedTime = saved.BlockedTime
+		entity.AttackTargetId = saved.AttackTargetId
+		entity.NextAttackTick = saved.NextAttackTick
+		entity.ConstructTargetId = saved.ConstructTargetId
+		entity.GatherNodeId = saved.GatherNodeId
+		entity.NextGatherTick = saved.NextGatherTick
+		entity.MaxResources = saved.MaxResources
+		entity.Regeneration = saved.Regeneration
+		entity.Regrowth = saved.Regrowth
+		if entity.Id >= s.nextId {
+			return nil, fmt.Errorf("entity %d is not below the saved next id %d", entity.Id, s.nextId)
+		}
+		// Types missing from the loaded definitions couldn't move, fight, earn or train
+		if definitionOf(&entity) == nil && !isResourceNode(&entity) {
+			return nil, fmt.Errorf("entity %d has type %q, which is not in the entity definitions", entity.Id, entity.Type)
+		}
+		for _, unitType := range entity.TrainingQueue {
+			if def := EntityDefinitions[unitType]; def == nil || def.Kind != KindUnit {
+				return nil, fmt.Errorf("entity %d is training %q, which is not a unit type in the entity definitions", entity.Id, unitType)
+			}
+		}
+		s.entities[entity.Id] = &entity
+	}
+	for _, formation := range save.Formations {
+		s.formations[formation.ID] = formation
+	}
+	return s, nil
+}
+
+// encodeMatchSave turns save into the JSON written to disk. A save taken from a running
+// room shares its live state, so this must run under the same lock as matchSave.
+func encodeMatchSave(save *MatchSave) ([]byte, error) {
+	data, err := json.MarshalIndent(save, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode save: %w", err)
+	}
+	return data, nil
+}
+
+// writeMatchSave writes an encoded save to dir as <room>-<tick>.json, replacing the file
+// atomically so a crash mid-write never leaves a truncated save. Returns the file's path.
+func writeMatchSave(dir, roomId string, tick uint64, data []byte) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create save directory: %w", err)
+	}
+
+	temp, err := os.CreateTemp(dir, ".save-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create save file: %w", err)
+	}
+	defer os.Remove(temp.Name()) // No-op once renamed
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return "", fmt.Errorf("failed to write save file: %w", err)
+	}
+	// Flushed to disk before the rename, or a crash could leave the new name on an empty file
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return "", fmt.Errorf("failed to write save file: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		return "", fmt.Errorf("failed to write save file: %w", err)
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%s-%d.json", roomId, tick))
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return "", fmt.Errorf("failed to write save file: %w", err)
+	}
+	return path, nil
+}
+
+// ReadMatchSave loads a save file written by writeMatchSave
+func ReadMatchSave(path string) (*MatchSave, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read save file: %w", err)
+	}
+	var save MatchSave
+	if err := json.Unmarshal(data, &save); err != nil {
+		return nil, fmt.Errorf("failed to parse save file %s: %w", path, err)
+	}
+	if save.Version != SaveFormatVersion {
+		return nil, fmt.Errorf("save format version %d is not supported (expected %d)", save.Version, SaveFormatVersion)
+	}
+	if !validRoomName.MatchString(save.RoomId) {
+		return nil, fmt.Errorf("save has an invalid room id %q", save.RoomId)
+	}
+	return &save, nil
+}
+
+// saveRoom writes a room's current state to SaveDir and returns the file and tick saved
+func (m *RoomManager) saveRoom(room *Room) (string, uint64, error) {
+	// Only encoding needs the lock (the save shares the live state); the disk can take
+	// as long as it likes without holding up the game loop
+	room.server.mu.RLock()
+	save := room.server.matchSave(room.MapName)
+	data, err := encodeMatchSave(save)
+	room.server.mu.RUnlock()
+	if err != nil {
+		return "", 0, err
+	}
+
+	path, err := writeMatchSave(SaveDir, save.RoomId, save.Tick, data)
+	if err != nil {
+		return "", 0, err
+	}
+	log.Printf("Room %q saved at tick %d to %s", room.Id, save.Tick, path)
+	return path, save.Tick, nil
+}
+
+// restoreRoom hosts the match in save under its original room id
+func (m *RoomManager) restoreRoom(save *MatchSave) (*Room, error) {
+	server, err := restoreGameServer(save)
+	if err != nil {
+		return nil, err
+	}
+	room, err := m.addRoom(save.RoomId, save.MapName, server)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Room %q restored at tick %d with %d clients and %d entities (saved %s)",
+		room.Id, save.Tick, len(save.Clients), len(save.Entities), save.SavedAt.Format(time.RFC3339))
+	return room, nil
+}
+
+// handleSaveMatch saves the requested room for an admin
+func (m *RoomManager) handleSaveMatch(req SaveMatchMessage, addr net.Addr) {
+	if AdminToken == "" || subtle.ConstantTimeCompare([]byte(req.AdminToken), []byte(AdminToken)) != 1 {
+		log.Printf("Refused save_match from %s: bad admin token", addr)
+		m.sendReject(addr, RejectNotAuthorized, "admin token required")
+		return
+	}
+
+	roomId := req.RoomId
+	if roomId == "" {
+		roomId = DefaultRoomId
+	}
+	m.mu.Lock()
+	room := m.rooms[roomId]
+	m.mu.Unlock()
+	if room == nil {
+		m.sendReject(addr, RejectRoomNotFound, fmt.Sprintf("no room %q", roomId))
+		return
+	}
+
+	path, tick, err := m.saveRoom(room)
+	if err != nil {
+		log.Printf("Failed to save room %q: %v", room.Id, err)
+		m.sendReject(addr, RejectInternalError, "failed to save match")
+		return
+	}
+	m.sendMessage(MsgMatchSaved, MatchSavedMessage{RoomId: room.Id, Path: path, Tick: tick}, addr)
+}
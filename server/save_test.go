@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestMatchSaveRoundTrip verifies a running match, including paths and formations,
+// survives a save and load, and that players can resume their sessions afterwards
+func TestMatchSaveRoundTrip(t *testing.T) {
+	server, host, guest := newLobbyTestServer()
+	server.mapData.Tiles[TileCoord{X: 5, Y: 5}] = TerrainType{Type: "rock", Passable: false}
+	server.roomId = "tycoon"
+	server.mapData.ResourceNodes = []ResourceNode{{Type: "gold", X: 8, Y: 8, Quantity: 200, Regeneration: 0.5}}
+	server.beginMatch()
+	server.tick = 123
+	host.Money = 42.5
+
+	unit := server.entities[host.OwnedUnits[0]]
+	unit.Path = []TilePosition{{X: 3, Y: 2}, {X: 4, Y: 2}, {X: 5, Y: 3}}
+	unit.PathIndex = 1
+	server.formations[7] = &FormationGroup{ID: 7, Type: "line", LeaderID: unit.Id, MemberIDs: []uint32{unit.Id},
+		Offsets: map[uint32]TilePosition{unit.Id: {X: 0, Y: 0}}, TargetX: 5, TargetY: 3, IsMoving: true}
+	server.nextFormationID = 8
+
+	for _, entity := range server.entities {
+		if isResourceNode(entity) {
+			entity.Resources = 150
+			entity.Regrowth = 0.25
+			unit.GatherNodeId = entity.Id
+		}
+	}
+	unit.Resources = 4
+	unit.ResourceType = "gold"
+	unit.NextGatherTick = 130
+
+	data, err := encodeMatchSave(server.matchSave("default"))
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	path, err := writeMatchSave(t.TempDir(), server.roomId, server.tick, data)
+	if err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if filepath.Base(path) != server.roomId+"-123.json" {
+		t.Errorf("Expected the save named after room and tick, got %s", path)
+	}
+	save, err := ReadMatchSave(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	restored, err := restoreGameServer(save)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	if restored.tick != 123 || restored.nextId != server.nextId || restored.nextFormationID != 8 || restored.phase != PhaseRunning {
+		t.Errorf("Expected counters and phase restored, got tick %d, next id %d, formation %d, phase %s",
+			restored.tick, restored.nextId, restored.nextFormationID, restored.phase)
+	}
+	if !reflect.DeepEqual(restored.mapData, server.mapData) {
+		t.Error("Expected the map restored exactly")
+	}
+	if len(restored.entities) != len(server.entities) {
+		t.Fatalf("Expected %d entities, got %d", len(server.entities), len(restored.entities))
+	}
+	for id, entity := range server.entities {
+		if !reflect.DeepEqual(restored.entities[id], entity) {
+			t.Errorf("Entity %d: expected %+v, got %+v", id, entity, restored.entities[id])
+		}
+	}
+	if !reflect.DeepEqual(restored.formations[7], server.formations[7]) {
+		t.Errorf("Expected formation restored, got %+v", restored.formations[7])
+	}
+
+	restoredHost := restored.clients[host.Id]
+	if restoredHost.Money != 42.5 || restoredHost.Team != host.Team || !reflect.DeepEqual(restoredHost.OwnedUnits, host.OwnedUnits) {
+		t.Errorf("Expected host's money, team and units restored, got %+v", restoredHost)
+	}
+	if !restoredHost.Disconnected || !restored.clients[guest.Id].Disconnected {
+		t.Error("Expected restored clients to wait for reconnection")
+	}
+
+	restored.handleHello(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "Host", SessionToken: host.SessionToken},
+		&net.UDPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 2000})
+	if restoredHost.Disconnected || len(restored.clients) != 2 {
+		t.Errorf("Expected the host to resume its session, got disconnected=%v with %d clients", restoredHost.Disconnected, len(restored.clients))
+	}
+}
+
+// TestReadMatchSaveRejectsBadSaves verifies unknown versions, broken files and entity types
+// missing from the definitions are refused
+func TestReadMatchSaveRejectsBadSaves(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, save interface{}) string {
+		data, _ := json.Marshal(save)
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, data, 0o644)
+		return path
+	}
+
+	if _, err := ReadMatchSave(write("future.json", MatchSave{Version: SaveFormatVersion + 1, RoomId: "a"})); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Errorf("Expected a version error, got %v", err)
+	}
+	if _, err := ReadMatchSave(write("room.json", MatchSave{Version: SaveFormatVersion, RoomId: "../etc"})); err == nil {
+		t.Error("Expected an invalid room id to be refused")
+	}
+	if _, err := ReadMatchSave(write("garbage.json", "not a save")); err == nil {
+		t.Error("Expected a malformed save to be refused")
+	}
+	if _, err := restoreGameServer(&MatchSave{Version: SaveFormatVersion, RoomId: "a", Map: savedMap{Width: 10, Height: 10},
+		NextId: 2, Entities: []savedEntity{{Entity: Entity{Id: 5}}}}); err == nil {
+		t.Error("Expected entity ids at or past the next id to be refused")
+	}
+	unknown := []savedEntity{
+		{Entity: Entity{Id: 1, Type: "catapult"}},
+		{Entity: Entity{Id: 1, Type: "office", TrainingQueue: []string{"catapult"}}},
+	}
+	for _, entity := range unknown {
+		save := &MatchSave{Version: SaveFormatVersion, RoomId: "a", Map: savedMap{Width: 10, Height: 10}, NextId: 2, Entities: []savedEntity{entity}}
+		if _, err := restoreGameServer(save); err == nil || !strings.Contains(err.Error(), "catapult") {
+			t.Errorf("Expected a save with an unknown type to be refused, got %v", err)
+		}
+	}
+}
+
+// TestSaveMatchNeedsAdminToken verifies save_match only works with the configured token
+// and that a restored room replaces the fresh one
+func TestSaveMatchNeedsAdminToken(t *testing.T) {
+	token, dir := AdminToken, SaveDir
+	t.Cleanup(func() { AdminToken, SaveDir = token, dir })
+	SaveDir = t.TempDir()
+
+	manager := newTestRoomManager(t)
+	manager.rooms[DefaultRoomId].server.tick = 50
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	request := func(adminToken string) {
+		manager.handleMessage(Message{Type: MsgSaveMatch, Data: NewGameServer().marshalData(SaveMatchMessage{AdminToken: adminToken})}, addr)
+	}
+	saves := func() []string {
+		files, _ := filepath.Glob(filepath.Join(SaveDir, "*.json"))
+		return files
+	}
+
+	AdminToken = ""
+	request("")
+	AdminToken = "secret"
+	request("guess")
+	if files := saves(); len(files) != 0 {
+		t.Fatalf("Expected refused requests to save nothing, got %v", files)
+	}
+
+	request("secret")
+	files := saves()
+	if len(files) != 1 || filepath.Base(files[0]) != DefaultRoomId+"-50.json" {
+		t.Fatalf("Expected one save of the default room, got %v", files)
+	}
+
+	save, err := ReadMatchSave(files[0])
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	restoredManager := NewRoomManager(MapsDir)
+	room, err := restoredManager.restoreRoom(save)
+	if err != nil || room.Id != DefaultRoomId || room.server.tick != 50 {
+		t.Errorf("Expected the default room restored at tick 50, got %v (%v)", room, err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"path/filepath"
 	"realtime-game-server/testutil"
 	"strings"
@@ -97,6 +98,11 @@ func (a *TestGameServerAdapter) LoadMap(path string) error {
 
 // SpawnUnit creates a unit at the specified position
 func (a *TestGameServerAdapter) SpawnUnit(unitType string, team int, x, y int) uint32 {
+	health := EntityDefinitions[StartingUnitType].Health
+	if def, exists := EntityDefinitions[unitType]; exists {
+		health = def.Health
+	}
+
 	entityID := a.server.nextId
 	a.server.nextId++
 
@@ -109,8 +115,8 @@ func (a *TestGameServerAdapter) SpawnUnit(unitType string, team int, x, y int) u
 		TargetTileX:  x,
 		TargetTileY:  y,
 		MoveProgress: 0.0,
-		Health:       100,
-		MaxHealth:    100,
+		Health:       health,
+		MaxHealth:    health,
 	}
 
 	a.server.entities[entityID] = entity
@@ -124,8 +130,10 @@ func (a *TestGameServerAdapter) SpawnBuilding(buildingType string, team int, x,
 	entityID := a.server.nextId
 	a.server.nextId++
 
-	footprintWidth := 2
-	footprintHeight := 2
+	health, footprintWidth, footprintHeight := int32(100), 2, 2
+	if def, exists := EntityDefinitions[buildingType]; exists {
+		health, footprintWidth, footprintHeight = def.Health, def.FootprintWidth, def.FootprintHeight
+	}
 
 	entity := &Entity{
 		Id:              entityID,
@@ -136,8 +144,8 @@ func (a *TestGameServerAdapter) SpawnBuilding(buildingType string, team int, x,
 		TargetTileX:     x,
 		TargetTileY:     y,
 		MoveProgress:    0.0,
-		Health:          100,
-		MaxHealth:       100,
+		Health:          health,
+		MaxHealth:       health,
 		FootprintWidth:  footprintWidth,
 		FootprintHeight: footprintHeight,
 	}
@@ -150,12 +158,15 @@ func (a *TestGameServerAdapter) SpawnBuilding(buildingType string, team int, x,
 
 // Tick advances the game simulation by one tick
 func (a *TestGameServerAdapter) Tick() {
+	// Chase targets and land hits
+	a.server.updateCombat()
+
 	// Update formation followers to maintain formation shape
 	a.server.tickFormations()
 
 	// Process movement for all entities
 	for _, entity := range a.server.entities {
-		if entity.Type == "worker" || entity.Type == "unit" {
+		if isUnit(entity) {
 			a.server.updateEntityMovement(entity, a.deltaTime)
 		}
 	}
@@ -237,15 +248,36 @@ func (a *TestGameServerAdapter) MoveUnits(entityIDs []uint32, targetX, targetY i
 
 // AttackTarget commands units to attack a target
 func (a *TestGameServerAdapter) AttackTarget(entityIDs []uint32, targetID uint32) error {
-	// Create mock client
-	mockClient := &Client{
-		Id:    0,
-		Name:  "TestClient",
-		Money: 1000,
+	if len(entityIDs) == 0 {
+		return fmt.Errorf("attack requires at least one unit")
+	}
+
+	// Attack as the units' owner, on its own team so the target counts as an enemy
+	attacker, exists := a.server.entities[entityIDs[0]]
+	if !exists {
+		return fmt.Errorf("unknown attacker %d", entityIDs[0])
+	}
+	ownerID := attacker.OwnerId
+	mockClient, exists := a.server.clients[ownerID]
+	if !exists {
+		mockClient = &Client{
+			Id:    ownerID,
+			Name:  "TestClient",
+			Team:  int(ownerID),
+			Money: 1000,
+		}
+		a.server.clients[ownerID] = mockClient
+	}
+
+	// Convert unit IDs to interface{} array (as JSON parsing would do)
+	unitIdsInterface := make([]interface{}, len(entityIDs))
+	for i, id := range entityIDs {
+		unitIdsInterface[i] = float64(id)
 	}
 
 	// Create attack command data as map (simulating JSON parsing)
 	attackData := map[string]interface{}{
+		"unitIds":  unitIdsInterface,
 		"targetId": float64(targetID),
 	}
 
@@ -255,7 +287,5 @@ func (a *TestGameServerAdapter) AttackTarget(entityIDs []uint32, targetID uint32
 	}
 
 	// Process the command (once for all units)
-	a.server.handleAttackCommand(cmd, mockClient)
-
-	return nil
+	return a.server.handleAttackCommand(cmd, mockClient)
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// newGrassMap returns a width x height map of open grass with 32 pixel tiles
+func newGrassMap(width, height int) *MapData {
+	return &MapData{
+		Width:          width,
+		Height:         height,
+		TileSize:       32,
+		DefaultTerrain: TerrainType{Type: "grass", Passable: true},
+		Tiles:          map[TileCoord]TerrainType{},
+	}
+}
+
+func newSessionTestServer() *GameServer {
+	server := NewGameServer()
+	server.mapData = newGrassMap(20, 20)
+	return server
+}
+
+// TestHelloIssuesUniqueSessionTokens verifies every client gets its own token
+func TestHelloIssuesUniqueSessionTokens(t *testing.T) {
+	server := newSessionTestServer()
+
+	server.handleHello(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "A"}, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000})
+	server.handleHello(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "B"}, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000})
+
+	if len(server.clients) != 2 {
+		t.Fatalf("Expected 2 clients, got %d", len(server.clients))
+	}
+
+	tokens := make(map[string]bool)
+	for _, client := range server.clients {
+		if len(client.SessionToken) != 32 {
+			t.Errorf("Client %d has token %q, expected 32 hex characters", client.Id, client.SessionToken)
+		}
+		tokens[client.SessionToken] = true
+	}
+	if len(tokens) != 2 {
+		t.Error("Expected distinct session tokens per client")
+	}
+}
+
+// TestInputRequiresValidToken verifies inputs with a missing or wrong token are dropped
+func TestInputRequiresValidToken(t *testing.T) {
+	server := newSessionTestServer()
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	server.clients[1] = &Client{Id: 1, Name: "Victim", SessionToken: "secret", Addr: addr}
+
+	frame := []CommandFrame{{Sequence: 1, Commands: []Command{{Type: "move"}}}}
+
+	server.handleInput(InputMessage{ClientId: 1, Commands: frame}, addr)
+	server.handleInput(InputMessage{ClientId: 1, SessionToken: "guess", Commands: frame}, addr)
+	if len(server.inputQueue) != 0 {
+		t.Fatalf("Expected inputs without a valid token to be dropped, queue has %d", len(server.inputQueue))
+	}
+
+	server.handleInput(InputMessage{ClientId: 1, SessionToken: "secret", Commands: frame}, addr)
+	if len(server.inputQueue) != 1 {
+		t.Errorf("Expected input with valid token to be queued, queue has %d", len(server.inputQueue))
+	}
+}
+
+// TestValidTokenFromNewAddressMovesSession verifies NAT rebinds keep the session
+func TestValidTokenFromNewAddressMovesSession(t *testing.T) {
+	server := newSessionTestServer()
+	oldAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	newAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2000}
+	client := &Client{Id: 1, Name: "Roamer", SessionToken: "secret", Addr: oldAddr}
+	server.clients[1] = client
+
+	// Wrong token from a new address must not hijack the session
+	server.handlePing(PingMessage{ClientId: 1, SessionToken: "guess"}, newAddr)
+	if client.Addr.String() != oldAddr.String() {
+		t.Fatalf("Invalid token moved session to %s", client.Addr)
+	}
+
+	server.handlePing(PingMessage{ClientId: 1, SessionToken: "secret"}, newAddr)
+	if client.Addr.String() != newAddr.String() {
+		t.Errorf("Expected session to move to %s, still at %s", newAddr, client.Addr)
+	}
+}
+
+// TestTimeoutFreezesEntitiesDuringGrace verifies timed-out players keep their state
+func TestTimeoutFreezesEntitiesDuringGrace(t *testing.T) {
+	server := newSessionTestServer()
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	server.handleHello(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "Flaky"}, addr)
+	server.beginMatch()
+
+	var client *Client
+	for _, c := range server.clients {
+		client = c
+	}
+	worker := server.entities[client.OwnedUnits[0]]
+	worker.Path = []TilePosition{{X: worker.TileX + 1, Y: worker.TileY}}
+	client.Money = 75
+
+	now := time.Now()
+	client.LastSeen = now.Add(-ClientTimeout - time.Second)
+	server.updateConnections(now)
+
+	if !client.Disconnected {
+		t.Fatal("Expected client to be marked disconnected after timeout")
+	}
+	if len(server.entities) != 5 || len(server.clients) != 1 {
+		t.Errorf("Expected units and client kept during grace, got %d entities, %d clients", len(server.entities), len(server.clients))
+	}
+	if len(worker.Path) != 0 {
+		t.Error("Expected disconnected player's units to stop moving")
+	}
+
+	// Packets with the old token are refused until the client says hello again
+	if server.authenticate(client.Id, client.SessionToken, addr) != nil {
+		t.Error("Expected disconnected session to require a new hello")
+	}
+
+	// Reconnect from a new address with the previous token
+	newAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2000}
+	server.handleHello(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "Flaky", SessionToken: client.SessionToken}, newAddr)
+
+	if len(server.clients) != 1 {
+		t.Fatalf("Expected reconnect to reuse the client, got %d clients", len(server.clients))
+	}
+	if client.Disconnected || client.Money != 75 || client.Addr.String() != newAddr.String() {
+		t.Errorf("Expected restored session at %s with money 75, got disconnected=%v money=%v addr=%s",
+			newAddr, client.Disconnected, client.Money, client.Addr)
+	}
+	if len(server.entities) != 5 {
+		t.Errorf("Expected reconnect not to spawn new units, got %d entities", len(server.entities))
+	}
+}
+
+// TestGraceExpiryRemovesAllOwnedEntities verifies units and buildings go once grace runs out
+func TestGraceExpiryRemovesAllOwnedEntities(t *testing.T) {
+	server := newSessionTestServer()
+	server.clients[1] = &Client{Id: 1, Name: "Gone", SessionToken: "a", OwnedUnits: []uint32{10}}
+	server.clients[2] = &Client{Id: 2, Name: "Stays", SessionToken: "b", LastSeen: time.Now()}
+	server.entities[10] = &Entity{Id: 10, OwnerId: 1, Type: "worker"}
+	server.entities[11] = &Entity{Id: 11, OwnerId: 1, Type: "generator", FootprintWidth: 2, FootprintHeight: 2}
+	server.entities[12] = &Entity{Id: 12, OwnerId: 2, Type: "worker"}
+
+	now := time.Now()
+	server.clients[1].Disconnected = true
+	server.clients[1].DisconnectedAt = now.Add(-server.reconnectGrace - time.Second)
+	server.updateConnections(now)
+
+	if _, exists := server.clients[1]; exists {
+		t.Error("Expected client removed after grace period")
+	}
+	if _, exists := server.entities[10]; exists {
+		t.Error("Expected worker removed with its owner")
+	}
+	if _, exists := server.entities[11]; exists {
+		t.Error("Expected generator removed with its owner")
+	}
+	if _, exists := server.entities[12]; !exists {
+		t.Error("Expected other player's entities to remain")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// ShutdownMessage tells clients the server is going away. Their sessions end with it
+// unless the server comes back from a saved match.
+type ShutdownMessage struct {
+	Message string `json:"message"` // Human-readable reason
+}
+
+// shutdownNotices returns a shutdown message for every connected client.
+// Must be called with s.mu held.
+func (s *GameServer) shutdownNotices(message string) []outgoingMessage {
+	outgoing := make([]outgoingMessage, 0, len(s.clients))
+	for _, client := range s.clients {
+		if client.Disconnected {
+			continue
+		}
+		outgoing = append(outgoing, outgoingMessage{
+			addr:    client.Addr,
+			codec:   codecFor(client),
+			msgType: MsgShutdown,
+			payload: ShutdownMessage{Message: message},
+		})
+	}
+	return outgoing
+}
+
+// Shutdown stops every room's simulation, tells clients the server is going away and
+// closes the sockets, abandoning whatever hasn't finished when ctx expires. Start returns
+// once the UDP socket is closed. Only the first call does anything.
+func (m *RoomManager) Shutdown(ctx context.Context, message string) {
+	if !m.closing.CompareAndSwap(false, true) {
+		return
+	}
+	close(m.done)
+
+	// Stop the simulations first so no snapshots follow the notice
+	m.mu.Lock()
+	rooms := make([]*Room, 0, len(m.rooms))
+	for _, room := range m.rooms {
+		close(room.stop)
+		rooms = append(rooms, room)
+	}
+	m.rooms = make(map[string]*Room)
+	m.sessions = make(map[string]*Room)
+	m.mu.Unlock()
+
+	for _, room := range rooms {
+		if room.stopped == nil {
+			continue
+		}
+		select {
+		case <-room.stopped:
+		case <-ctx.Done():
+			log.Printf("Room %q didn't stop its tick before the shutdown deadline", room.Id)
+		}
+	}
+
+	if SaveOnShutdown {
+		for _, room := range rooms {
+			if players, _, _, _ := room.server.occupancy(); players == 0 {
+				continue // Nothing worth resuming
+			}
+			if _, _, err := m.saveRoom(room); err != nil {
+				log.Printf("Failed to save room %q: %v", room.Id, err)
+			}
+		}
+	}
+
+	// Notices are repeated since any single datagram may be lost
+	notified := 0
+	for i := 0; i < ShutdownNotices; i++ {
+		for _, room := range rooms {
+			room.server.mu.Lock()
+			outgoing := room.server.shutdownNotices(message)
+			room.server.mu.Unlock()
+
+			for _, out := range outgoing {
+				room.server.sendPayload(out.codec, out.msgType, out.payload, out.addr)
+			}
+			if i == 0 {
+				notified += len(outgoing)
+			}
+		}
+	}
+	log.Printf("Shutdown: stopped %d rooms and notified %d clients", len(rooms), notified)
+
+	m.closeWebSockets(ctx)
+	if flood := m.flood.snapshot(); flood != (floodCounters{}) {
+		log.Printf("Flood protection at shutdown: %+v", flood)
+	}
+
+	if m.conn != nil {
+		m.conn.Close()
+	}
+}
+
+// closeWebSockets stops the gateway accepting connections and closes every browser
+// connection once the frames queued for it (including the shutdown notice) are written
+func (m *RoomManager) closeWebSockets(ctx context.Context) {
+	if m.webSocket != nil {
+		m.webSocket.Shutdown(ctx)
+	}
+
+	m.peersMu.Lock()
+	peers := make([]*wsPeer, 0, len(m.peers))
+	for peer := range m.peers {
+		peers = append(peers, peer)
+	}
+	m.peersMu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer *wsPeer) {
+			defer wg.Done()
+			peer.closeGracefully(ctx, wsCloseGoingAway)
+		}(peer)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestShutdownNotifiesClientsAndStops verifies a running server stops its rooms, tells
+// connected clients it is going away and returns from serving
+func TestShutdownNotifiesClientsAndStops(t *testing.T) {
+	port, wsPort := ServerPort, WebSocketPort
+	ServerPort, WebSocketPort = "127.0.0.1:0", ""
+	t.Cleanup(func() { ServerPort, WebSocketPort = port, wsPort })
+
+	manager := NewRoomManager(MapsDir)
+	if err := manager.listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- manager.serve() }()
+
+	conn, err := net.DialUDP("udp", nil, manager.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The welcome carries every entity definition and may arrive in fragments
+	assembler := newFragmentAssembler()
+	readUntil := func(msgType MessageType) bool {
+		buffer := make([]byte, 65535)
+		for {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				return false
+			}
+			msg, err := decodeDatagram(buffer[:n])
+			if err == nil && msg.Type == MsgFragment {
+				msg, _ = assembler.reassemble(msg, nil)
+			}
+			if err == nil && msg.Type == msgType {
+				return true
+			}
+		}
+	}
+
+	hello, _ := json.Marshal(helloData(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "A"}))
+	conn.Write(hello)
+	if !readUntil(MsgWelcome) {
+		t.Fatal("Expected a welcome")
+	}
+	room := manager.rooms[DefaultRoomId]
+
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	manager.Shutdown(ctx, "maintenance")
+
+	if !readUntil(MsgShutdown) {
+		t.Error("Expected a shutdown message")
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Expected serve to return cleanly, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected serve to return after shutdown")
+	}
+	select {
+	case <-room.stopped:
+	default:
+		t.Error("Expected the room's tick loop to have stopped")
+	}
+	manager.Shutdown(ctx, "again") // Repeated shutdowns are harmless
+}
+
+// TestShutdownClosesWebSockets verifies browsers get the shutdown notice followed by a
+// going-away close frame
+func TestShutdownClosesWebSockets(t *testing.T) {
+	manager := newTestRoomManager(t)
+	server, browser := net.Pipe()
+	defer browser.Close()
+	peer := newWSPeer(server)
+	manager.peers[peer] = struct{}{}
+	manager.handleMessage(helloData(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "Browser"}), peer)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		manager.Shutdown(ctx, "maintenance")
+	}()
+
+	browser.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(browser)
+	notices := 0
+	for {
+		opcode, payload, err := readServerFrame(r)
+		if err != nil {
+			t.Fatalf("Connection ended without a close frame: %v", err)
+		}
+		if opcode == wsOpClose {
+			if len(payload) != 2 || binary.BigEndian.Uint16(payload) != wsCloseGoingAway {
+				t.Errorf("Expected going-away close status, got %v", payload)
+			}
+			break
+		}
+		var msg Message
+		if json.Unmarshal(payload, &msg) == nil && msg.Type == MsgShutdown {
+			var shutdown ShutdownMessage
+			json.Unmarshal(msg.Data, &shutdown)
+			if shutdown.Message != "maintenance" {
+				t.Errorf("Expected the shutdown reason, got %q", shutdown.Message)
+			}
+			notices++
+		}
+	}
+	if notices != ShutdownNotices {
+		t.Errorf("Expected %d shutdown notices before the close frame, got %d", ShutdownNotices, notices)
+	}
+}
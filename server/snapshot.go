@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// snapshotRecord is the world state as sent to a client on a given tick
+type snapshotRecord struct {
+	tick     uint64
+	entities map[uint32]Entity
+	players  map[string]Player
+}
+
+// snapshotHistory is a ring of the snapshots recently sent to one client,
+// indexed by tick so an acknowledged tick can be looked up as a delta baseline
+type snapshotHistory struct {
+	records [SnapshotHistorySize]snapshotRecord
+}
+
+func (h *snapshotHistory) store(record snapshotRecord) {
+	h.records[record.tick%SnapshotHistorySize] = record
+}
+
+// get returns the record for tick, or false if it was never stored or has been overwritten
+func (h *snapshotHistory) get(tick uint64) (*snapshotRecord, bool) {
+	if tick == 0 {
+		return nil, false
+	}
+	record := &h.records[tick%SnapshotHistorySize]
+	if record.tick != tick {
+		return nil, false
+	}
+	return record, true
+}
+
+// outgoingMessage is a message queued for sending once the state lock is released
+type outgoingMessage struct {
+	addr    net.Addr
+	codec   Codec
+	msgType MessageType
+	payload interface{}
+}
+
+// captureWorldState copies the current entities and players into a snapshot record.
+// Must be called with s.mu held.
+func (s *GameServer) captureWorldState() snapshotRecord {
+	record := snapshotRecord{
+		tick:     s.tick,
+		entities: make(map[uint32]Entity, len(s.entities)),
+		players:  make(map[string]Player, len(s.clients)),
+	}
+
+	for id, entity := range s.entities {
+		record.entities[id] = *entity
+	}
+
+	for id, client := range s.clients {
+		record.players[fmt.Sprintf("%d", id)] = Player{
+			Id:           id,
+			Name:         client.Name,
+			Money:        client.Money,
+			Disconnected: client.Disconnected,
+			Rtt:          durationMillis(client.Rtt),
+			Jitter:       durationMillis(client.RttJitter),
+		}
+	}
+
+	return record
+}
+
+// buildSnapshot returns the snapshot to send to client for the current world state,
+// limited to what the client's team can see. It is a delta against the client's last
+// acknowledged tick when the client negotiated delta snapshots and that baseline is
+// still in its history, and a full snapshot otherwise. Must be called with s.mu held.
+func (s *GameServer) buildSnapshot(client *Client, world snapshotRecord) SnapshotMessage {
+	current := s.clientView(client, world)
+
+	baseline, ok := client.History.get(client.LastAckTick)
+	if !client.Capabilities[CapDeltaSnapshots] {
+		ok = false
+	}
+	if ok && current.tick-baseline.tick >= SnapshotHistorySize {
+		ok = false // Baseline too old, client must resync
+	}
+
+	var snapshot SnapshotMessage
+	if ok {
+		snapshot = diffSnapshot(baseline, &current)
+	} else {
+		snapshot = fullSnapshot(&current)
+	}
+
+	snapshot.LastProcessedSeq = client.LastProcessedSeq
+	snapshot.LastProcessedTick = client.LastProcessedTick
+	snapshot.Events = client.Events.pending(world.tick)
+
+	client.History.store(current)
+	return snapshot
+}
+
+// fullSnapshot returns a snapshot containing every entity and player in record
+func fullSnapshot(record *snapshotRecord) SnapshotMessage {
+	entities := make([]Entity, 0, len(record.entities))
+	for _, entity := range record.entities {
+		entities = append(entities, entity)
+	}
+
+	players := make(map[string]Player, len(record.players))
+	for id, player := range record.players {
+		players[id] = player
+	}
+
+	return SnapshotMessage{
+		Tick:         record.tick,
+		BaselineTick: 0,
+		Entities:     entities,
+		Players:      players,
+	}
+}
+
+// diffSnapshot returns a delta snapshot that turns baseline into current
+func diffSnapshot(baseline, current *snapshotRecord) SnapshotMessage {
+	snapshot := SnapshotMessage{
+		Tick:         current.tick,
+		BaselineTick: baseline.tick,
+		Entities:     make([]Entity, 0),
+		Players:      make(map[string]Player),
+	}
+
+	// Added or changed entities
+	for id, entity := range current.entities {
+		if old, exists := baseline.entities[id]; !exists || !sameEntityState(old, entity) {
+			snapshot.Entities = append(snapshot.Entities, entity)
+		}
+	}
+
+	// Removed entities
+	for id := range baseline.entities {
+		if _, exists := current.entities[id]; !exists {
+			snapshot.RemovedEntities = append(snapshot.RemovedEntities, id)
+		}
+	}
+
+	// Added or changed players
+	for id, player := range current.players {
+		if old, exists := baseline.players[id]; !exists || old != player {
+			snapshot.Players[id] = player
+		}
+	}
+
+	// Removed players
+	for id := range baseline.players {
+		if _, exists := current.players[id]; !exists {
+			snapshot.RemovedPlayers = append(snapshot.RemovedPlayers, id)
+		}
+	}
+
+	// Stable ordering keeps deltas deterministic (helps debugging and tests)
+	sort.Slice(snapshot.Entities, func(i, j int) bool {
+		return snapshot.Entities[i].Id < snapshot.Entities[j].Id
+	})
+	sort.Slice(snapshot.RemovedEntities, func(i, j int) bool {
+		return snapshot.RemovedEntities[i] < snapshot.RemovedEntities[j]
+	})
+	sort.Strings(snapshot.RemovedPlayers)
+
+	return snapshot
+}
+
+// sameEntityState reports whether two entity states look identical on the wire
+// (server-only fields such as Path are ignored)
+func sameEntityState(a, b Entity) bool {
+	return a.Id == b.Id &&
+		a.OwnerId == b.OwnerId &&
+		a.Type == b.Type &&
+		a.TileX == b.TileX &&
+		a.TileY == b.TileY &&
+		a.TargetTileX == b.TargetTileX &&
+		a.TargetTileY == b.TargetTileY &&
+		a.MoveProgress == b.MoveProgress &&
+		a.Health == b.Health &&
+		a.MaxHealth == b.MaxHealth &&
+		a.FootprintWidth == b.FootprintWidth &&
+		a.FootprintHeight == b.FootprintHeight &&
+		a.Remembered == b.Remembered &&
+		a.UnderConstruction == b.UnderConstruction &&
+		a.BuildProgress == b.BuildProgress &&
+		a.ResourceType == b.ResourceType &&
+		a.Resources == b.Resources &&
+		sameQueue(a.TrainingQueue, b.TrainingQueue) &&
+		a.TrainProgress == b.TrainProgress &&
+		a.HasRally == b.HasRally &&
+		a.RallyTileX == b.RallyTileX &&
+		a.RallyTileY == b.RallyTileY
+}
+
+// sameQueue reports whether two training queues hold the same unit types in order
+func sameQueue(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newSnapshotTestServer creates a server with one client and two workers
+func newSnapshotTestServer() (*GameServer, *Client) {
+	server := NewGameServer()
+	server.mapData = newGrassMap(20, 20)
+
+	client := &Client{Id: 1, Name: "TestPlayer", SessionToken: "secret", Money: 100, LastSeen: time.Now()}
+	client.Capabilities = capabilitySet{CapDeltaSnapshots: true}
+	server.clients[1] = client
+	server.entities[2] = &Entity{Id: 2, OwnerId: 1, Type: "worker", TileX: 1, TileY: 1, Health: 100, MaxHealth: 100}
+	server.entities[3] = &Entity{Id: 3, OwnerId: 1, Type: "worker", TileX: 2, TileY: 1, Health: 100, MaxHealth: 100}
+
+	return server, client
+}
+
+// TestSnapshotFullWithoutAck verifies clients that never ack always get full snapshots
+func TestSnapshotFullWithoutAck(t *testing.T) {
+	server, client := newSnapshotTestServer()
+
+	for i := 0; i < 3; i++ {
+		server.tick++
+		snapshot := server.buildSnapshot(client, server.captureWorldState())
+
+		if snapshot.BaselineTick != 0 {
+			t.Errorf("Tick %d: expected full snapshot, got delta against %d", server.tick, snapshot.BaselineTick)
+		}
+		if len(snapshot.Entities) != 2 {
+			t.Errorf("Tick %d: expected 2 entities, got %d", server.tick, len(snapshot.Entities))
+		}
+		if len(snapshot.Players) != 1 {
+			t.Errorf("Tick %d: expected 1 player, got %d", server.tick, len(snapshot.Players))
+		}
+	}
+}
+
+// TestSnapshotDeltaAgainstAckedTick verifies deltas only carry changes since the acked tick
+func TestSnapshotDeltaAgainstAckedTick(t *testing.T) {
+	server, client := newSnapshotTestServer()
+
+	server.tick = 1
+	server.buildSnapshot(client, server.captureWorldState())
+	server.handleAck(AckMessage{ClientId: 1, SessionToken: "secret", Tick: 1}, nil)
+
+	if client.LastAckTick != 1 {
+		t.Fatalf("Expected LastAckTick 1, got %d", client.LastAckTick)
+	}
+
+	// Move one worker, remove the other, add a building and change money
+	server.tick = 2
+	server.entities[2].TileX = 5
+	delete(server.entities, 3)
+	server.entities[4] = &Entity{Id: 4, OwnerId: 1, Type: "generator", TileX: 10, TileY: 10, FootprintWidth: 2, FootprintHeight: 2}
+	client.Money = 50
+
+	snapshot := server.buildSnapshot(client, server.captureWorldState())
+
+	if snapshot.BaselineTick != 1 {
+		t.Fatalf("Expected delta against tick 1, got baseline %d", snapshot.BaselineTick)
+	}
+	if len(snapshot.Entities) != 2 || snapshot.Entities[0].Id != 2 || snapshot.Entities[1].Id != 4 {
+		t.Errorf("Expected changed entities [2 4], got %v", snapshot.Entities)
+	}
+	if len(snapshot.RemovedEntities) != 1 || snapshot.RemovedEntities[0] != 3 {
+		t.Errorf("Expected removed entities [3], got %v", snapshot.RemovedEntities)
+	}
+	if player, ok := snapshot.Players["1"]; !ok || player.Money != 50 {
+		t.Errorf("Expected changed player 1 with money 50, got %v", snapshot.Players)
+	}
+
+	// Nothing changes on the next tick: delta (still against tick 1) only repeats the same changes
+	server.tick = 3
+	snapshot = server.buildSnapshot(client, server.captureWorldState())
+	if snapshot.BaselineTick != 1 || len(snapshot.Entities) != 2 {
+		t.Errorf("Expected same delta against tick 1, got baseline %d with %d entities", snapshot.BaselineTick, len(snapshot.Entities))
+	}
+
+	// After acking tick 3 there is nothing left to send
+	server.handleAck(AckMessage{ClientId: 1, SessionToken: "secret", Tick: 3}, nil)
+	server.tick = 4
+	snapshot = server.buildSnapshot(client, server.captureWorldState())
+	if snapshot.BaselineTick != 3 || len(snapshot.Entities) != 0 || len(snapshot.Players) != 0 || len(snapshot.RemovedEntities) != 0 {
+		t.Errorf("Expected empty delta against tick 3, got %+v", snapshot)
+	}
+}
+
+// TestSnapshotFallsBackWhenBaselineTooOld verifies a stale ack produces a full snapshot
+func TestSnapshotFallsBackWhenBaselineTooOld(t *testing.T) {
+	server, client := newSnapshotTestServer()
+
+	server.tick = 1
+	server.buildSnapshot(client, server.captureWorldState())
+	server.handleAck(AckMessage{ClientId: 1, SessionToken: "secret", Tick: 1}, nil)
+
+	// Advance past the history window without further acks
+	for i := 0; i < SnapshotHistorySize; i++ {
+		server.tick++
+		server.buildSnapshot(client, server.captureWorldState())
+	}
+
+	server.tick++
+	snapshot := server.buildSnapshot(client, server.captureWorldState())
+	if snapshot.BaselineTick != 0 {
+		t.Errorf("Expected full snapshot after baseline expired, got delta against %d", snapshot.BaselineTick)
+	}
+	if len(snapshot.Entities) != 2 {
+		t.Errorf("Expected full entity list (2), got %d", len(snapshot.Entities))
+	}
+}
+
+// TestAckIgnoresFutureAndOlderTicks verifies the baseline only moves forward to known ticks
+func TestAckIgnoresFutureAndOlderTicks(t *testing.T) {
+	server, client := newSnapshotTestServer()
+	server.tick = 10
+
+	server.handleAck(AckMessage{ClientId: 1, SessionToken: "secret", Tick: 8}, nil)
+	server.handleAck(AckMessage{ClientId: 1, SessionToken: "secret", Tick: 5}, nil)
+	if client.LastAckTick != 8 {
+		t.Errorf("Expected older ack to be ignored (LastAckTick 8), got %d", client.LastAckTick)
+	}
+
+	server.handleAck(AckMessage{ClientId: 1, SessionToken: "secret", Tick: 50}, nil)
+	if client.LastAckTick != 8 {
+		t.Errorf("Expected future ack to be ignored (LastAckTick 8), got %d", client.LastAckTick)
+	}
+}
+
+// TestSnapshotAcknowledgesProcessedInput verifies each client learns its last applied sequence
+func TestSnapshotAcknowledgesProcessedInput(t *testing.T) {
+	server, client := newSnapshotTestServer()
+	other := &Client{Id: 5, Name: "Other", SessionToken: "other", LastSeen: time.Now()}
+	server.clients[5] = other
+
+	server.inputQueue = append(server.inputQueue,
+		QueuedInput{ClientId: 1, Sequence: 3, Tick: 1, Commands: []Command{{Type: "move", Data: map[string]interface{}{
+			"unitIds": []interface{}{float64(2)}, "targetTileX": float64(6), "targetTileY": float64(1),
+		}}}},
+		QueuedInput{ClientId: 1, Sequence: 4, Tick: 1},
+	)
+	server.gameTick()
+
+	if client.LastProcessedSeq != 4 || client.LastProcessedTick != server.tick {
+		t.Fatalf("Expected seq 4 applied on tick %d, got seq %d on tick %d",
+			server.tick, client.LastProcessedSeq, client.LastProcessedTick)
+	}
+
+	snapshot := server.buildSnapshot(client, server.captureWorldState())
+	if snapshot.LastProcessedSeq != 4 || snapshot.LastProcessedTick != client.LastProcessedTick {
+		t.Errorf("Expected snapshot to ack seq 4 on tick %d, got seq %d on tick %d",
+			client.LastProcessedTick, snapshot.LastProcessedSeq, snapshot.LastProcessedTick)
+	}
+
+	otherSnapshot := server.buildSnapshot(other, server.captureWorldState())
+	if otherSnapshot.LastProcessedSeq != 0 {
+		t.Errorf("Expected other client's snapshot to ack nothing, got seq %d", otherSnapshot.LastProcessedSeq)
+	}
+}
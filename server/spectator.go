@@ -0,0 +1,66 @@
+package main
+
+// Client roles requested in hello
+const (
+	RolePlayer    = "player"    // Takes a player slot and gets units once the match starts
+	RoleSpectator = "spectator" // Watches without units or commands; doesn't use a player slot
+)
+
+// FollowMessage asks to watch the match through one player's fog of war
+type FollowMessage struct {
+	ClientId     uint32 `json:"clientId"`
+	SessionToken string `json:"sessionToken"`
+	PlayerId     uint32 `json:"playerId"` // 0 = watch everything
+}
+
+// spectatorCount returns how many clients are watching rather than playing.
+// Must be called with s.mu held.
+func (s *GameServer) spectatorCount() int {
+	return len(s.clients) - s.playerCount()
+}
+
+// followTarget returns playerId if it names a player in the room, otherwise 0.
+// Must be called with s.mu held.
+func (s *GameServer) followTarget(playerId uint32) uint32 {
+	if target, exists := s.clients[playerId]; exists && !target.Spectator {
+		return playerId
+	}
+	return 0
+}
+
+// setFollowing switches which player's view spectator client watches (0 = everything).
+// Must be called with s.mu held.
+func (s *GameServer) setFollowing(client *Client, playerId uint32) error {
+	if !client.Spectator {
+		return newCommandError(ErrNotSpectator, "only spectators can follow a player")
+	}
+	if playerId != 0 && s.followTarget(playerId) == 0 {
+		return newCommandError(ErrInvalidTarget, "player %d is not in the match", playerId)
+	}
+	client.Following = playerId
+	return nil
+}
+
+// recordSpectatorWorld remembers current for delayed spectators and returns the world
+// spectatorDelay ticks ago, if the room has been running that long. Must be called with
+// s.mu held.
+func (s *GameServer) recordSpectatorWorld(current snapshotRecord) (snapshotRecord, bool) {
+	if s.spectatorDelay == 0 {
+		return current, true
+	}
+
+	size := s.spectatorDelay + 1
+	if uint64(len(s.worldHistory)) != size {
+		s.worldHistory = make([]snapshotRecord, size)
+	}
+	s.worldHistory[current.tick%size] = current
+
+	if current.tick < s.spectatorDelay {
+		return snapshotRecord{}, false
+	}
+	delayed := s.worldHistory[(current.tick-s.spectatorDelay)%size]
+	if delayed.entities == nil || delayed.tick != current.tick-s.spectatorDelay {
+		return snapshotRecord{}, false
+	}
+	return delayed, true
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestSpectatorsDontTakePlayerSlots verifies spectators join a full room without units
+// and can't command
+func TestSpectatorsDontTakePlayerSlots(t *testing.T) {
+	server := newSessionTestServer()
+	for i := 0; i < MaxClients; i++ {
+		server.handleHello(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "Player"}, &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i+1)), Port: 1000})
+	}
+
+	server.handleHello(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "Caster", Role: RoleSpectator}, &net.UDPAddr{IP: net.IPv4(10, 0, 1, 1), Port: 1000})
+	server.handleHello(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "Extra"}, &net.UDPAddr{IP: net.IPv4(10, 0, 1, 2), Port: 1000})
+
+	if server.playerCount() != MaxClients || server.spectatorCount() != 1 {
+		t.Fatalf("Expected %d players and 1 spectator, got %d and %d", MaxClients, server.playerCount(), server.spectatorCount())
+	}
+
+	var caster *Client
+	for _, client := range server.clients {
+		if client.Name == "Caster" {
+			caster = client
+		}
+	}
+	if caster.Role != RoleSpectator || !caster.Spectator {
+		t.Fatalf("Expected caster to be a spectator, got %+v", caster)
+	}
+
+	server.beginMatch()
+	if len(caster.OwnedUnits) != 0 || len(server.entities) != MaxClients*5 {
+		t.Errorf("Expected only players to get units, caster has %d, %d entities", len(caster.OwnedUnits), len(server.entities))
+	}
+	expectCommandError(t, server.checkCommandAllowed(caster), ErrSpectating)
+	expectCommandError(t, server.setReady(caster, true), ErrSpectating)
+}
+
+// TestSpectatorsStayWhenMatchResets verifies an emptied match doesn't turn requested
+// spectators into players
+func TestSpectatorsStayWhenMatchResets(t *testing.T) {
+	server, host, guest := newLobbyTestServer()
+	server.handleHello(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "Caster", Role: RoleSpectator}, &net.UDPAddr{IP: net.IPv4(10, 0, 1, 1), Port: 1000})
+	server.beginMatch()
+
+	server.removeClient(host.Id)
+	server.removeClient(guest.Id)
+
+	if server.phase != PhaseLobby || server.spectatorCount() != 1 || server.hostId != 0 {
+		t.Errorf("Expected lobby with the spectator still watching and no host, got phase %s, %d spectators, host %d",
+			server.phase, server.spectatorCount(), server.hostId)
+	}
+}
+
+// TestSpectatorSeesEverythingOrFollowedView verifies spectators see all teams, or one
+// player's fog of war while following them
+func TestSpectatorSeesEverythingOrFollowedView(t *testing.T) {
+	server, alice, bob := newVisibilityTestServer()
+	server.tick = 1
+	watcher := &Client{Id: 3, Name: "Watcher", Team: -1, Role: RoleSpectator, Spectator: true, SessionToken: "w", LastSeen: time.Now()}
+	server.clients[3] = watcher
+
+	snapshot := server.buildSnapshot(watcher, server.captureWorldState())
+	if len(snapshot.Entities) != 2 || snapshot.Players["2"].MoneyHidden {
+		t.Errorf("Expected spectator to see every entity and balance, got %+v", snapshot)
+	}
+
+	expectCommandError(t, server.setFollowing(alice, bob.Id), ErrNotSpectator)
+	expectCommandError(t, server.setFollowing(watcher, 99), ErrInvalidTarget)
+	expectCommandError(t, server.setFollowing(watcher, watcher.Id), ErrInvalidTarget)
+	if err := server.setFollowing(watcher, alice.Id); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	server.tick = 2
+	view := server.clientView(watcher, server.captureWorldState())
+	if _, ok := view.entities[20]; ok {
+		t.Error("Expected Bob's distant worker hidden while following Alice")
+	}
+	if _, ok := view.entities[10]; !ok {
+		t.Error("Expected Alice's worker visible while following Alice")
+	}
+	if !view.players["2"].MoneyHidden || view.players["1"].MoneyHidden {
+		t.Errorf("Expected only Alice's money visible, got %+v", view.players)
+	}
+}
+
+// TestDelayedSpectatorSnapshots verifies spectators lag spectatorDelay ticks behind
+// players and get nothing until that much of the match has been played
+func TestDelayedSpectatorSnapshots(t *testing.T) {
+	server, alice, _ := newVisibilityTestServer()
+	server.spectatorDelay = 3
+	watcher := &Client{Id: 3, Name: "Watcher", Team: -1, Role: RoleSpectator, Spectator: true, SessionToken: "w", LastSeen: time.Now()}
+	server.clients[3] = watcher
+
+	for tick := uint64(1); tick <= 6; tick++ {
+		server.tick = tick
+		server.entities[10].TileX = int(tick)
+
+		delayed, ok := server.recordSpectatorWorld(server.captureWorldState())
+		if tick <= server.spectatorDelay {
+			if ok {
+				t.Errorf("Tick %d: expected no delayed world yet", tick)
+			}
+			continue
+		}
+		if !ok || delayed.tick != tick-3 || delayed.entities[10].TileX != int(tick-3) {
+			t.Errorf("Tick %d: expected world from tick %d, got tick %d (ok %v)", tick, tick-3, delayed.tick, ok)
+		}
+	}
+
+	// Players keep getting the live world
+	if view := server.clientView(alice, server.captureWorldState()); view.entities[10].TileX != 6 {
+		t.Errorf("Expected players to see the live world, got worker at %d", view.entities[10].TileX)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Protocol versions are "major.minor". Clients must share the server's major version
+// and be at least MinClientVersion; optional features are negotiated as capabilities.
+const (
+	ProtocolVersion  = "1.2"
+	MinClientVersion = "1.1"
+)
+
+// Optional protocol features a client can ask for in its hello
+const (
+	CapDeltaSnapshots = "delta_snapshots" // Snapshots relative to the client's acked tick
+	CapBinaryEncoding = "binary_encoding" // Compact binary codec instead of JSON after welcome
+	CapReliableEvents = "reliable_events" // Acked game events piggybacked on snapshots
+)
+
+// ServerCapabilities lists every optional feature this server can provide
+var ServerCapabilities = []string{
+	CapDeltaSnapshots,
+	CapBinaryEncoding,
+	CapReliableEvents,
+}
+
+// protocolVersion is a parsed "major.minor" version string
+type protocolVersion struct {
+	major, minor int
+}
+
+func parseProtocolVersion(version string) (protocolVersion, error) {
+	majorStr, minorStr, found := strings.Cut(version, ".")
+	if !found {
+		minorStr = "0"
+	}
+
+	major, err := strconv.Atoi(majorStr)
+	if err != nil || major < 0 {
+		return protocolVersion{}, fmt.Errorf("invalid protocol version %q", version)
+	}
+	minor, err := strconv.Atoi(minorStr)
+	if err != nil || minor < 0 {
+		return protocolVersion{}, fmt.Errorf("invalid protocol version %q", version)
+	}
+
+	return protocolVersion{major: major, minor: minor}, nil
+}
+
+func (v protocolVersion) less(other protocolVersion) bool {
+	if v.major != other.major {
+		return v.major < other.major
+	}
+	return v.minor < other.minor
+}
+
+// checkClientVersion returns nil if a client speaking version can join this server
+func checkClientVersion(version string) error {
+	client, err := parseProtocolVersion(version)
+	if err != nil {
+		return err
+	}
+
+	server, _ := parseProtocolVersion(ProtocolVersion)
+	minimum, _ := parseProtocolVersion(MinClientVersion)
+
+	if client.major != server.major {
+		return fmt.Errorf("client protocol %s is incompatible with server protocol %s", version, ProtocolVersion)
+	}
+	if client.less(minimum) {
+		return fmt.Errorf("client protocol %s is older than minimum supported %s", version, MinClientVersion)
+	}
+	return nil
+}
+
+// capabilitySet is the set of optional features enabled for one client
+type capabilitySet map[string]bool
+
+// negotiateCapabilities returns the features both the client asked for and the server supports
+func negotiateCapabilities(requested []string) capabilitySet {
+	supported := make(map[string]bool, len(ServerCapabilities))
+	for _, capability := range ServerCapabilities {
+		supported[capability] = true
+	}
+
+	enabled := make(capabilitySet)
+	for _, capability := range requested {
+		if supported[capability] {
+			enabled[capability] = true
+		}
+	}
+	return enabled
+}
+
+// list returns the enabled capabilities in a stable order for the welcome message
+func (c capabilitySet) list() []string {
+	capabilities := make([]string, 0, len(c))
+	for _, capability := range ServerCapabilities {
+		if c[capability] {
+			capabilities = append(capabilities, capability)
+		}
+	}
+	return capabilities
+}
+
+// negotiatedCodec returns the wire codec for a client's enabled capabilities
+func negotiatedCodec(capabilities capabilitySet) Codec {
+	if capabilities[CapBinaryEncoding] {
+		return binaryCodec{}
+	}
+	return jsonCodec{}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// TestCheckClientVersion verifies which client versions may join
+func TestCheckClientVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		ok      bool
+	}{
+		{ProtocolVersion, true},
+		{MinClientVersion, true},
+		{"1.9", true},  // Newer minor, same major
+		{"1.0", false}, // Older than minimum
+		{"2.0", false}, // Different major
+		{"0.9", false},
+		{"", false},
+		{"banana", false},
+	}
+
+	for _, tc := range tests {
+		err := checkClientVersion(tc.version)
+		if (err == nil) != tc.ok {
+			t.Errorf("checkClientVersion(%q): expected ok=%v, got err=%v", tc.version, tc.ok, err)
+		}
+	}
+}
+
+// TestNegotiateCapabilities verifies only mutually supported features are enabled
+func TestNegotiateCapabilities(t *testing.T) {
+	enabled := negotiateCapabilities([]string{"teleportation", CapDeltaSnapshots})
+
+	if !enabled[CapDeltaSnapshots] {
+		t.Error("Expected delta_snapshots to be enabled")
+	}
+	if enabled["teleportation"] {
+		t.Error("Expected unknown capability to be ignored")
+	}
+	if list := enabled.list(); len(list) != 1 || list[0] != CapDeltaSnapshots {
+		t.Errorf("Expected [delta_snapshots], got %v", list)
+	}
+}
+
+// TestHelloVersionMismatchRejected verifies incompatible clients don't get a slot
+func TestHelloVersionMismatchRejected(t *testing.T) {
+	server := newSessionTestServer()
+
+	server.handleHello(HelloMessage{ClientVersion: "0.1", PlayerName: "Ancient"}, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000})
+	if len(server.clients) != 0 {
+		t.Errorf("Expected incompatible client to be rejected, got %d clients", len(server.clients))
+	}
+
+	server.handleHello(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "Modern", Capabilities: []string{CapDeltaSnapshots}},
+		&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000})
+	if len(server.clients) != 1 {
+		t.Fatalf("Expected compatible client to join, got %d clients", len(server.clients))
+	}
+	for _, client := range server.clients {
+		if !client.Capabilities[CapDeltaSnapshots] {
+			t.Error("Expected negotiated delta_snapshots capability on client")
+		}
+	}
+}
+
+// TestNoDeltaWithoutCapability verifies clients that didn't negotiate deltas get full snapshots
+func TestNoDeltaWithoutCapability(t *testing.T) {
+	server, client := newSnapshotTestServer()
+	client.Capabilities = nil
+
+	server.tick = 1
+	server.buildSnapshot(client, server.captureWorldState())
+	client.LastAckTick = 1
+
+	server.tick = 2
+	snapshot := server.buildSnapshot(client, server.captureWorldState())
+	if snapshot.BaselineTick != 0 || len(snapshot.Entities) != 2 {
+		t.Errorf("Expected full snapshot, got baseline %d with %d entities", snapshot.BaselineTick, len(snapshot.Entities))
+	}
+}
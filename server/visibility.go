@@ -0,0 +1,214 @@
+package main
+
+// DefaultVisionRadius applies to entity types missing from EntityDefinitions
+const DefaultVisionRadius = 4
+
+// visionGrid marks which map tiles a team can currently see
+type visionGrid struct {
+	width, height int
+	visible       []bool
+}
+
+func newVisionGrid(width, height int) *visionGrid {
+	return &visionGrid{
+		width:   width,
+		height:  height,
+		visible: make([]bool, width*height),
+	}
+}
+
+// reveal marks every tile within radius of (centerX, centerY) as visible
+func (g *visionGrid) reveal(centerX, centerY, radius int) {
+	for y := centerY - radius; y <= centerY+radius; y++ {
+		for x := centerX - radius; x <= centerX+radius; x++ {
+			if x < 0 || x >= g.width || y < 0 || y >= g.height {
+				continue
+			}
+			dx, dy := x-centerX, y-centerY
+			if dx*dx+dy*dy <= radius*radius {
+				g.visible[y*g.width+x] = true
+			}
+		}
+	}
+}
+
+// revealEntity marks everything entity can see. Buildings see from every footprint tile.
+func (g *visionGrid) revealEntity(entity *Entity) {
+	radius := DefaultVisionRadius
+	if def := definitionOf(entity); def != nil {
+		radius = def.Vision
+	}
+	width, height := max(entity.FootprintWidth, 1), max(entity.FootprintHeight, 1)
+	for dy := 0; dy < height; dy++ {
+		for dx := 0; dx < width; dx++ {
+			g.reveal(entity.TileX+dx, entity.TileY+dy, radius)
+		}
+	}
+}
+
+func (g *visionGrid) isVisible(x, y int) bool {
+	if x < 0 || x >= g.width || y < 0 || y >= g.height {
+		return false
+	}
+	return g.visible[y*g.width+x]
+}
+
+// seesArea reports whether any tile of the rectangle is visible
+func (g *visionGrid) seesArea(x, y, width, height int) bool {
+	if width <= 0 {
+		width = 1
+	}
+	if height <= 0 {
+		height = 1
+	}
+	for dy := 0; dy < height; dy++ {
+		for dx := 0; dx < width; dx++ {
+			if g.isVisible(x+dx, y+dy) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// seesEntity reports whether any tile the entity occupies (or is moving into) is visible
+func (g *visionGrid) seesEntity(entity *Entity) bool {
+	return g.seesArea(entity.TileX, entity.TileY, entity.FootprintWidth, entity.FootprintHeight) ||
+		g.isVisible(entity.TargetTileX, entity.TargetTileY)
+}
+
+// isBuilding reports whether an entity is a structure (remembered once seen)
+func isBuilding(entity *Entity) bool {
+	return entity.FootprintWidth > 0 || entity.FootprintHeight > 0
+}
+
+// ownerTeam returns the team an entity's owner plays on, or -1 if the owner is gone.
+// Must be called with s.mu held.
+func (s *GameServer) ownerTeam(ownerId uint32) int {
+	if client, exists := s.clients[ownerId]; exists {
+		return client.Team
+	}
+	return -1
+}
+
+// teamVision returns what team can see this tick, computing it (and updating the team's
+// memory of enemy buildings) on first use each tick. Must be called with s.mu held.
+func (s *GameServer) teamVision(team int) *visionGrid {
+	if s.visionTick != s.tick || s.vision == nil {
+		s.vision = make(map[int]*visionGrid)
+		s.visionTick = s.tick
+	}
+	if grid, ok := s.vision[team]; ok {
+		return grid
+	}
+
+	grid := newVisionGrid(s.mapData.Width, s.mapData.Height)
+	for _, entity := range s.entities {
+		if s.ownerTeam(entity.OwnerId) == team {
+			grid.revealEntity(entity)
+		}
+	}
+	s.vision[team] = grid
+
+	s.updateLastKnown(team, grid)
+	return grid
+}
+
+// updateLastKnown records enemy buildings the team can see and forgets remembered ones
+// whose site is visible again without them. Must be called with s.mu held.
+func (s *GameServer) updateLastKnown(team int, grid *visionGrid) {
+	if s.lastKnown == nil {
+		s.lastKnown = make(map[int]map[uint32]Entity)
+	}
+	memory, ok := s.lastKnown[team]
+	if !ok {
+		memory = make(map[uint32]Entity)
+		s.lastKnown[team] = memory
+	}
+
+	for id, entity := range s.entities {
+		if isBuilding(entity) && s.ownerTeam(entity.OwnerId) != team && grid.seesEntity(entity) {
+			memory[id] = *entity
+		}
+	}
+
+	for id, remembered := range memory {
+		if _, exists := s.entities[id]; !exists && grid.seesEntity(&remembered) {
+			delete(memory, id) // Saw the empty site
+		}
+	}
+}
+
+// worldVision computes what team could see in a past world state. Unlike teamVision it
+// neither caches nor updates building memory. Must be called with s.mu held.
+func (s *GameServer) worldVision(team int, world snapshotRecord) *visionGrid {
+	grid := newVisionGrid(s.mapData.Width, s.mapData.Height)
+	for _, entity := range world.entities {
+		if s.ownerTeam(entity.OwnerId) == team {
+			grid.revealEntity(&entity)
+		}
+	}
+	return grid
+}
+
+// clientView filters the world state down to what client may see: its team's entities,
+// enemies inside its team's vision, remembered enemy buildings, and only its own money.
+// Spectators see everything, or exactly what the player they follow sees.
+// Must be called with s.mu held.
+func (s *GameServer) clientView(client *Client, world snapshotRecord) snapshotRecord {
+	if client.Spectator {
+		followed, exists := s.clients[client.Following]
+		if client.Following == 0 || !exists {
+			return world // Watching the whole match
+		}
+		client = followed
+	}
+
+	// Delayed spectator worlds are seen through the vision of their own tick
+	var grid *visionGrid
+	if world.tick == s.tick {
+		grid = s.teamVision(client.Team)
+	} else {
+		grid = s.worldVision(client.Team, world)
+	}
+
+	view := snapshotRecord{
+		tick:     world.tick,
+		entities: make(map[uint32]Entity, len(world.entities)),
+		players:  make(map[string]Player, len(world.players)),
+	}
+
+	for id, entity := range world.entities {
+		if s.ownerTeam(entity.OwnerId) == client.Team {
+			view.entities[id] = entity
+		} else if grid.seesEntity(&entity) {
+			hideProduction(&entity)
+			view.entities[id] = entity
+		}
+	}
+
+	// Enemy buildings out of sight appear where they were last seen (memory reflects the
+	// present, so delayed worlds go without)
+	var remembered map[uint32]Entity
+	if world.tick == s.tick {
+		remembered = s.lastKnown[client.Team]
+	}
+	for id, building := range remembered {
+		if _, visible := view.entities[id]; !visible {
+			building.Path = nil
+			building.Remembered = true
+			hideProduction(&building)
+			view.entities[id] = building
+		}
+	}
+
+	for id, player := range world.players {
+		if player.Id != client.Id && s.ownerTeam(player.Id) != client.Team {
+			player.Money = 0
+			player.MoneyHidden = true
+		}
+		view.players[id] = player
+	}
+
+	return view
+}
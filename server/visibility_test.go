@@ -0,0 +1,154 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newVisibilityTestServer creates a 40x40 map with two clients on opposite corners
+func newVisibilityTestServer() (*GameServer, *Client, *Client) {
+	server := NewGameServer()
+	server.mapData = newGrassMap(40, 40)
+
+	alice := &Client{Id: 1, Name: "Alice", Team: 0, SessionToken: "a", Money: 100, LastSeen: time.Now()}
+	bob := &Client{Id: 2, Name: "Bob", Team: 1, SessionToken: "b", Money: 250, LastSeen: time.Now()}
+	server.clients[1] = alice
+	server.clients[2] = bob
+
+	server.entities[10] = &Entity{Id: 10, OwnerId: 1, Type: "worker", TileX: 2, TileY: 2, TargetTileX: 2, TargetTileY: 2, Health: 100, MaxHealth: 100}
+	server.entities[20] = &Entity{Id: 20, OwnerId: 2, Type: "worker", TileX: 35, TileY: 35, TargetTileX: 35, TargetTileY: 35, Health: 100, MaxHealth: 100}
+
+	return server, alice, bob
+}
+
+// snapshotEntity finds an entity by id in a snapshot
+func snapshotEntity(snapshot SnapshotMessage, id uint32) (Entity, bool) {
+	for _, entity := range snapshot.Entities {
+		if entity.Id == id {
+			return entity, true
+		}
+	}
+	return Entity{}, false
+}
+
+// TestVisibilityHidesDistantEnemies verifies enemies outside vision are not sent
+func TestVisibilityHidesDistantEnemies(t *testing.T) {
+	server, alice, _ := newVisibilityTestServer()
+	server.tick = 1
+
+	snapshot := server.buildSnapshot(alice, server.captureWorldState())
+
+	if _, ok := snapshotEntity(snapshot, 10); !ok {
+		t.Error("Expected own worker in snapshot")
+	}
+	if _, ok := snapshotEntity(snapshot, 20); ok {
+		t.Error("Expected distant enemy worker to be hidden")
+	}
+}
+
+// TestVisibilityRevealsNearbyEnemies verifies enemies within vision radius are sent
+func TestVisibilityRevealsNearbyEnemies(t *testing.T) {
+	server, alice, _ := newVisibilityTestServer()
+	server.tick = 1
+	server.entities[20].TileX, server.entities[20].TileY = 5, 4
+	server.entities[20].TargetTileX, server.entities[20].TargetTileY = 5, 4
+
+	snapshot := server.buildSnapshot(alice, server.captureWorldState())
+
+	if _, ok := snapshotEntity(snapshot, 20); !ok {
+		t.Error("Expected nearby enemy worker in snapshot")
+	}
+}
+
+// TestVisibilitySharedWithTeam verifies allies see each other's units and surroundings
+func TestVisibilitySharedWithTeam(t *testing.T) {
+	server, alice, bob := newVisibilityTestServer()
+	bob.Team = alice.Team
+	server.tick = 1
+
+	snapshot := server.buildSnapshot(alice, server.captureWorldState())
+
+	if _, ok := snapshotEntity(snapshot, 20); !ok {
+		t.Error("Expected ally's distant worker in snapshot")
+	}
+}
+
+// TestVisibilityHidesEnemyMoney verifies opponents' money is withheld
+func TestVisibilityHidesEnemyMoney(t *testing.T) {
+	server, alice, _ := newVisibilityTestServer()
+	server.tick = 1
+
+	snapshot := server.buildSnapshot(alice, server.captureWorldState())
+
+	for _, player := range snapshot.Players {
+		switch player.Id {
+		case alice.Id:
+			if player.MoneyHidden || player.Money != 100 {
+				t.Errorf("Expected own money 100 visible, got %v (hidden %v)", player.Money, player.MoneyHidden)
+			}
+		default:
+			if !player.MoneyHidden || player.Money != 0 {
+				t.Errorf("Expected opponent money hidden, got %v (hidden %v)", player.Money, player.MoneyHidden)
+			}
+		}
+	}
+}
+
+// TestVisibilityRemembersEnemyBuildings verifies buildings stay at their last-known state
+// once out of sight and are forgotten when their site is seen empty
+func TestVisibilityRemembersEnemyBuildings(t *testing.T) {
+	server, alice, _ := newVisibilityTestServer()
+	server.entities[30] = &Entity{Id: 30, OwnerId: 2, Type: "generator", TileX: 6, TileY: 2, TargetTileX: 6, TargetTileY: 2,
+		Health: 200, MaxHealth: 200, FootprintWidth: 2, FootprintHeight: 2}
+
+	server.tick = 1
+	snapshot := server.buildSnapshot(alice, server.captureWorldState())
+	if building, ok := snapshotEntity(snapshot, 30); !ok || building.Remembered {
+		t.Fatalf("Expected visible generator, got %+v (present %v)", building, ok)
+	}
+
+	// Alice's worker walks away; the generator is damaged out of sight
+	server.entities[10].TileX, server.entities[10].TargetTileX = 2, 2
+	server.entities[10].TileY, server.entities[10].TargetTileY = 30, 30
+	server.entities[30].Health = 50
+
+	server.tick = 2
+	snapshot = server.buildSnapshot(alice, server.captureWorldState())
+	building, ok := snapshotEntity(snapshot, 30)
+	if !ok || !building.Remembered {
+		t.Fatalf("Expected remembered generator, got %+v (present %v)", building, ok)
+	}
+	if building.Health != 200 {
+		t.Errorf("Expected last-known health 200, got %d", building.Health)
+	}
+
+	// The generator is destroyed out of sight; it stays remembered
+	delete(server.entities, 30)
+	server.tick = 3
+	snapshot = server.buildSnapshot(alice, server.captureWorldState())
+	if _, ok := snapshotEntity(snapshot, 30); !ok {
+		t.Error("Expected destroyed generator still remembered until its site is seen")
+	}
+
+	// Alice returns and sees the empty site
+	server.entities[10].TileY, server.entities[10].TargetTileY = 2, 2
+	server.tick = 4
+	snapshot = server.buildSnapshot(alice, server.captureWorldState())
+	if _, ok := snapshotEntity(snapshot, 30); ok {
+		t.Error("Expected generator forgotten after seeing its empty site")
+	}
+}
+
+// TestNextFreeTeamReusesGaps verifies teams freed by leaving players are reassigned
+func TestNextFreeTeamReusesGaps(t *testing.T) {
+	server, _, _ := newVisibilityTestServer()
+
+	if team := server.nextFreeTeam(); team != 2 {
+		t.Errorf("Expected team 2, got %d", team)
+	}
+
+	delete(server.clients, 1)
+	if team := server.nextFreeTeam(); team != 0 {
+		t.Errorf("Expected freed team 0, got %d", team)
+	}
+}
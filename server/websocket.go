@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is appended to the client's key when accepting a handshake (RFC 6455 section 4.2.2)
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes
+const (
+	wsOpContinuation byte = 0x0
+	wsOpText         byte = 0x1
+	wsOpBinary       byte = 0x2
+	wsOpClose        byte = 0x8
+	wsOpPing         byte = 0x9
+	wsOpPong         byte = 0xA
+)
+
+// WebSocket close status codes
+const (
+	wsCloseNormal        uint16 = 1000
+	wsCloseGoingAway     uint16 = 1001 // Server shutting down
+	wsCloseProtocolError uint16 = 1002
+)
+
+var errWebSocketProtocol = errors.New("websocket protocol error")
+
+// wsPeer is one browser connection. It stands in for a UDP address, so rooms, sessions
+// and rate limits treat WebSocket clients exactly like UDP ones; each message travels as
+// one frame instead of datagrams.
+type wsPeer struct {
+	conn   net.Conn
+	remote string // Browser's "ip:port"
+	host   string // Browser's IP, for rate limits
+	out    chan []byte
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newWSPeer(conn net.Conn) *wsPeer {
+	remote := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	peer := &wsPeer{
+		conn:   conn,
+		remote: remote,
+		host:   host,
+		out:    make(chan []byte, WebSocketSendQueue),
+		done:   make(chan struct{}),
+	}
+	go peer.writeLoop()
+	return peer
+}
+
+func (p *wsPeer) Network() string { return "ws" }
+func (p *wsPeer) String() string  { return "ws://" + p.remote }
+
+// send queues an encoded message as one frame (binary codec messages as binary frames).
+// Like a UDP datagram it is dropped if the browser can't keep up.
+func (p *wsPeer) send(data []byte) {
+	opcode := wsOpText
+	if len(data) > 0 && data[0] == BinaryCodecVersion {
+		opcode = wsOpBinary
+	}
+
+	p.queue(append(appendFrameHeader(make([]byte, 0, len(data)+10), opcode, len(data)), data...))
+}
+
+// queue hands a whole frame to the writer, dropping it if the queue is full or the
+// connection closed. Frames are queued whole so concurrent senders can't interleave.
+func (p *wsPeer) queue(frame []byte) {
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+	select {
+	case p.out <- frame:
+	default:
+	}
+}
+
+// writeLoop writes queued frames until the connection closes, closing it after a close frame
+func (p *wsPeer) writeLoop() {
+	for {
+		select {
+		case data := <-p.out:
+			p.conn.SetWriteDeadline(time.Now().Add(WebSocketWriteTimeout))
+			if _, err := p.conn.Write(data); err != nil || data[0] == 0x80|wsOpClose {
+				p.close()
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// writeControl queues a control frame (control payloads are at most 125 bytes)
+func (p *wsPeer) writeControl(opcode byte, payload []byte) {
+	p.queue(append(appendFrameHeader(nil, opcode, len(payload)), payload...))
+}
+
+// closeGracefully queues a close frame behind everything already queued and waits for
+// it to be written, closing the connection outright if ctx expires first
+func (p *wsPeer) closeGracefully(ctx context.Context, code uint16) {
+	frame := appendFrameHeader(nil, wsOpClose, 2)
+	frame = binary.BigEndian.AppendUint16(frame, code)
+	select {
+	case p.out <- frame:
+	case <-p.done:
+		return
+	case <-ctx.Done():
+		p.close()
+		return
+	}
+
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		p.close()
+	}
+}
+
+func (p *wsPeer) close() {
+	p.once.Do(func() {
+		close(p.done)
+		p.conn.Close()
+	})
+}
+
+// appendFrameHeader appends an unmasked, final frame header (servers never mask)
+func appendFrameHeader(buf []byte, opcode byte, length int) []byte {
+	buf = append(buf, 0x80|opcode)
+	switch {
+	case length < 126:
+		buf = append(buf, byte(length))
+	case length <= 0xFFFF:
+		buf = append(buf, 126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(length))
+	default:
+		buf = append(buf, 127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(length))
+	}
+	return buf
+}
+
+// readFrame reads one client frame, unmasking its payload
+func readFrame(r *bufio.Reader, limit int) (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	if header[0]&0x70 != 0 || header[1]&0x80 == 0 {
+		return false, 0, nil, fmt.Errorf("%w: reserved bits set or unmasked client frame", errWebSocketProtocol)
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > uint64(limit) {
+		return false, 0, nil, fmt.Errorf("%w: %d byte frame exceeds %d", errWebSocketProtocol, length, limit)
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(r, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// readMessage returns the next complete text or binary message, answering pings and
+// joining continuation frames. Returns io.EOF once the browser closes the connection.
+func (p *wsPeer) readMessage(r *bufio.Reader) ([]byte, error) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := readFrame(r, WebSocketMaxMessage)
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsOpPing:
+			p.writeControl(wsOpPong, payload)
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			return nil, io.EOF // Caller answers with its own close frame
+		case wsOpText, wsOpBinary:
+			if message != nil {
+				return nil, fmt.Errorf("%w: new message before the last one finished", errWebSocketProtocol)
+			}
+			message = append([]byte{}, payload...)
+		case wsOpContinuation:
+			if message == nil {
+				return nil, fmt.Errorf("%w: continuation without a message", errWebSocketProtocol)
+			}
+			if len(message)+len(payload) > WebSocketMaxMessage {
+				return nil, fmt.Errorf("%w: message exceeds %d bytes", errWebSocketProtocol, WebSocketMaxMessage)
+			}
+			message = append(message, payload...)
+		default:
+			return nil, fmt.Errorf("%w: unknown opcode %d", errWebSocketProtocol, opcode)
+		}
+
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// websocketAccept computes Sec-WebSocket-Accept for a client's Sec-WebSocket-Key
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHasToken reports whether a comma-separated header contains token (case-insensitive)
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newWebSocketServer returns the HTTP server for the WebSocket gateway. Any origin may
+// connect: sessions are authenticated by token, not by cookies.
+func (m *RoomManager) newWebSocketServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(WebSocketPath, m.handleWebSocket)
+	return &http.Server{
+		Addr:              WebSocketPort,
+		Handler:           mux,
+		ReadHeaderTimeout: WebSocketWriteTimeout,
+	}
+}
+
+// listenWebSocket serves the WebSocket gateway for browser clients until shutdown
+func (m *RoomManager) listenWebSocket() {
+	log.Printf("WebSocket gateway listening on %s%s", WebSocketPort, WebSocketPath)
+	if err := m.webSocket.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("WebSocket gateway stopped: %v", err)
+	}
+}
+
+// handleWebSocket upgrades a request to a WebSocket and feeds its messages through the
+// same path as UDP datagrams until it closes
+func (m *RoomManager) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || !headerHasToken(r.Header, "Connection", "upgrade") ||
+		!strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("WebSocket hijack failed for %s: %v", r.RemoteAddr, err)
+		return
+	}
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	peer := newWSPeer(conn)
+	m.peersMu.Lock()
+	m.peers[peer] = struct{}{}
+	m.peersMu.Unlock()
+	defer func() {
+		m.peersMu.Lock()
+		delete(m.peers, peer)
+		m.peersMu.Unlock()
+	}()
+	log.Printf("WebSocket client connected from %s", peer.remote)
+
+	for {
+		// Clients ping every HeartbeatInterval, so a silent socket is a dead one
+		conn.SetReadDeadline(time.Now().Add(ClientTimeout))
+		data, err := peer.readMessage(rw.Reader)
+		if err != nil {
+			code := wsCloseNormal
+			switch {
+			case errors.Is(err, io.EOF):
+			case errors.Is(err, errWebSocketProtocol):
+				code = wsCloseProtocolError
+				log.Printf("WebSocket client %s disconnected: %v", peer.remote, err)
+			default:
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("WebSocket client %s disconnected: %v", peer.remote, err)
+				}
+				peer.close()
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), WebSocketWriteTimeout)
+			defer cancel()
+			peer.closeGracefully(ctx, code)
+			return
+		}
+		m.handleDatagram(data, peer)
+	}
+}
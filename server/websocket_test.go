@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientFrame encodes a masked frame as a browser would send it
+func clientFrame(fin bool, opcode byte, payload []byte) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// readServerFrame reads one unmasked server frame
+func readServerFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(r, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, length)
+	_, err := io.ReadFull(r, payload)
+	return header[0] & 0x0F, payload, err
+}
+
+// TestWebSocketAccept verifies the handshake key from RFC 6455's example
+func TestWebSocketAccept(t *testing.T) {
+	if accept := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Expected RFC 6455 example accept key, got %q", accept)
+	}
+}
+
+// TestWebSocketReadMessage verifies fragmented messages are joined around pings, and that
+// unmasked or oversized frames are refused
+func TestWebSocketReadMessage(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	peer := newWSPeer(server)
+	defer peer.close()
+
+	var stream []byte
+	stream = append(stream, clientFrame(false, wsOpText, []byte(`{"type":`))...)
+	stream = append(stream, clientFrame(true, wsOpPing, []byte("hi"))...)
+	stream = append(stream, clientFrame(true, wsOpContinuation, []byte(`"ping"}`))...)
+	stream = append(stream, clientFrame(true, wsOpBinary, bytes.Repeat([]byte{7}, 300))...)
+	stream = append(stream, clientFrame(true, wsOpClose, nil)...)
+	go io.Copy(io.Discard, client) // Pong and close replies
+	r := bufio.NewReader(bytes.NewReader(stream))
+
+	message, err := peer.readMessage(r)
+	if err != nil || string(message) != `{"type":"ping"}` {
+		t.Fatalf("Expected joined text message, got %q (%v)", message, err)
+	}
+	if message, err = peer.readMessage(r); err != nil || len(message) != 300 {
+		t.Fatalf("Expected 300 byte binary message, got %d (%v)", len(message), err)
+	}
+	if _, err = peer.readMessage(r); err != io.EOF {
+		t.Errorf("Expected EOF on close, got %v", err)
+	}
+
+	unmasked := []byte{0x81, 0x02, 'h', 'i'}
+	if _, err := peer.readMessage(bufio.NewReader(bytes.NewReader(unmasked))); !errors.Is(err, errWebSocketProtocol) {
+		t.Errorf("Expected unmasked frame refused, got %v", err)
+	}
+	huge := clientFrame(true, wsOpBinary, make([]byte, WebSocketMaxMessage+1))
+	if _, err := peer.readMessage(bufio.NewReader(bytes.NewReader(huge))); !errors.Is(err, errWebSocketProtocol) {
+		t.Errorf("Expected oversized frame refused, got %v", err)
+	}
+}
+
+// TestWebSocketClientJoinsRoom verifies a browser can upgrade, say hello and be welcomed
+// into the same room as UDP clients
+func TestWebSocketClientJoinsRoom(t *testing.T) {
+	manager := newTestRoomManager(t)
+	manager.handleMessage(helloData(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "UDP"}),
+		&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000})
+
+	httpServer := httptest.NewServer(http.HandlerFunc(manager.handleWebSocket))
+	defer httpServer.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(httpServer.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+	r := bufio.NewReader(conn)
+	response, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("Reading handshake failed: %v", err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols || response.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Expected 101 with accept key, got %d %q", response.StatusCode, response.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	hello := helloData(HelloMessage{ClientVersion: ProtocolVersion, PlayerName: "Browser"})
+	data, _ := json.Marshal(hello)
+	conn.Write(clientFrame(true, wsOpText, data))
+
+	opcode, payload, err := readServerFrame(r)
+	if err != nil {
+		t.Fatalf("Reading welcome failed: %v", err)
+	}
+	var msg Message
+	if opcode != wsOpText || json.Unmarshal(payload, &msg) != nil || msg.Type != MsgWelcome {
+		t.Fatalf("Expected a welcome text frame, got opcode %d: %s", opcode, payload)
+	}
+
+	server := manager.rooms[DefaultRoomId].server
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	if len(server.clients) != 2 {
+		t.Errorf("Expected UDP and WebSocket clients in one room, got %d clients", len(server.clients))
+	}
+}
+
+// TestWebSocketRejectsPlainRequests verifies requests without an upgrade are refused
+func TestWebSocketRejectsPlainRequests(t *testing.T) {
+	manager := newTestRoomManager(t)
+	recorder := httptest.NewRecorder()
+	manager.handleWebSocket(recorder, httptest.NewRequest(http.MethodGet, WebSocketPath, nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a plain request, got %d", recorder.Code)
+	}
+}
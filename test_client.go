@@ -19,6 +19,9 @@ const (
 	MsgSnapshot MessageType = "snapshot"
 	MsgPing     MessageType = "ping"
 	MsgPong     MessageType = "pong"
+
+	MsgSetReady   MessageType = "set_ready"
+	MsgStartMatch MessageType = "start_match"
 )
 
 type Message struct {
@@ -45,6 +48,7 @@ type TerrainData struct {
 
 type WelcomeMessage struct {
 	ClientId          uint32      `json:"clientId"`
+	SessionToken      string      `json:"sessionToken"`
 	TickRate          int         `json:"tickRate"`
 	HeartbeatInterval int         `json:"heartbeatInterval"`
 	InputRedundancy   int         `json:"inputRedundancy"`
@@ -66,8 +70,20 @@ type CommandFrame struct {
 }
 
 type InputPayload struct {
-	ClientId uint32         `json:"clientId"`
-	Commands []CommandFrame `json:"commands"`
+	ClientId     uint32         `json:"clientId"`
+	SessionToken string         `json:"sessionToken"`
+	Commands     []CommandFrame `json:"commands"`
+}
+
+type SetReadyPayload struct {
+	ClientId     uint32 `json:"clientId"`
+	SessionToken string `json:"sessionToken"`
+	Ready        bool   `json:"ready"`
+}
+
+type PingPayload struct {
+	ClientId     uint32 `json:"clientId"`
+	SessionToken string `json:"sessionToken"`
 }
 
 type SnapshotEntity struct {
@@ -86,9 +102,10 @@ type SnapshotEntity struct {
 }
 
 type SnapshotMessage struct {
-	Tick         uint64           `json:"tick"`
-	BaselineTick uint64           `json:"baselineTick"`
-	Entities     []SnapshotEntity `json:"entities"`
+	Tick             uint64           `json:"tick"`
+	BaselineTick     uint64           `json:"baselineTick"`
+	Entities         []SnapshotEntity `json:"entities"`
+	LastProcessedSeq uint32           `json:"lastProcessedSeq"`
 }
 
 type tileTarget struct {
@@ -131,7 +148,7 @@ func main() {
 	defer conn.Close()
 
 	hello := HelloMessage{
-		ClientVersion: "1.0",
+		ClientVersion: "1.1",
 		PlayerName:    "TestClient",
 	}
 	helloBytes, _ := json.Marshal(hello)
@@ -179,6 +196,18 @@ func main() {
 		commandMu      sync.Mutex
 	)
 
+	pingBytes, _ := json.Marshal(PingPayload{ClientId: welcome.ClientId, SessionToken: welcome.SessionToken})
+
+	// Units only spawn once the match starts: ready up and, if we're the host, start it
+	readyBytes, _ := json.Marshal(SetReadyPayload{ClientId: welcome.ClientId, SessionToken: welcome.SessionToken, Ready: true})
+	if err := sendMessage(conn, MsgSetReady, readyBytes); err != nil {
+		log.Printf("failed to send ready: %v", err)
+	}
+	if err := sendMessage(conn, MsgStartMatch, pingBytes); err != nil {
+		log.Printf("failed to send start: %v", err)
+	}
+	fmt.Println("Sent ready and start_match")
+
 	stopHeartbeat := make(chan struct{})
 	go func(interval int) {
 		ticker := time.NewTicker(time.Duration(interval) * time.Millisecond)
@@ -186,7 +215,7 @@ func main() {
 		for {
 			select {
 			case <-ticker.C:
-				if err := sendMessage(conn, MsgPing, []byte(`{}`)); err != nil {
+				if err := sendMessage(conn, MsgPing, pingBytes); err != nil {
 					log.Printf("failed to send ping: %v", err)
 				} else {
 					fmt.Println("Sent ping")
@@ -246,8 +275,9 @@ func main() {
 					commandHistory = commandHistory[len(commandHistory)-inputRedundancy:]
 				}
 				payload := InputPayload{
-					ClientId: welcome.ClientId,
-					Commands: append([]CommandFrame(nil), commandHistory...),
+					ClientId:     welcome.ClientId,
+					SessionToken: welcome.SessionToken,
+					Commands:     append([]CommandFrame(nil), commandHistory...),
 				}
 				commandMu.Unlock()
 
@@ -297,6 +327,13 @@ func main() {
 				currentTick = snapshot.Tick
 				tickMu.Unlock()
 
+				// Drop frames the server has already applied from the resend history
+				commandMu.Lock()
+				for len(commandHistory) > 0 && commandHistory[0].Sequence <= snapshot.LastProcessedSeq {
+					commandHistory = commandHistory[1:]
+				}
+				commandMu.Unlock()
+
 				snapshotCount++
 				fmt.Printf("Snapshot tick %d: %d entities\n", snapshot.Tick, len(snapshot.Entities))
 